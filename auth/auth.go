@@ -0,0 +1,154 @@
+// Package auth implements the OAuth flow of the Smart Device Management API.
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/smartdevicemanagement/v1"
+)
+
+// Client authorized by the OAuth client secret file. The token is cached in tokenPath, and requested from the web
+// when the file doesn't exist.
+func NewClient(credPath string, tokenPath string) (*http.Client, error) {
+	config, err := loadConfig(credPath)
+	if err != nil {
+		return nil, err
+	}
+	return GetClient(config, tokenPath), nil
+}
+
+// Client authorized by the token cached in tokenPath. Unlike NewClient, fails instead of requesting a token from
+// the web when the file doesn't exist.
+func NewCachedClient(credPath string, tokenPath string) (*http.Client, error) {
+	config, err := loadConfig(credPath)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := tokenFromFile(tokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("no token cached in %v: %v", tokenPath, err)
+	}
+	return config.Client(context.Background(), tok), nil
+}
+
+// Run the OAuth flow even if a token is cached, and save the new token in tokenPath
+func Login(credPath string, tokenPath string) error {
+	config, err := loadConfig(credPath)
+	if err != nil {
+		return err
+	}
+	saveToken(tokenPath, getTokenFromWeb(config))
+	return nil
+}
+
+// Refresh the token cached in tokenPath if expired, without falling back to the web flow, and return the scopes
+// granted to it
+func CheckToken(ctx context.Context, credPath string, tokenPath string) ([]string, error) {
+	config, err := loadConfig(credPath)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := tokenFromFile(tokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("no token cached in %v: %v", tokenPath, err)
+	}
+	tok, err = config.TokenSource(ctx, tok).Token()
+	if err != nil {
+		return nil, fmt.Errorf("unable to refresh token: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://oauth2.googleapis.com/tokeninfo?access_token="+url.QueryEscape(tok.AccessToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var info struct {
+		Scope            string `json:"scope"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("unable to decode token info: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token info returned %v: %v", resp.Status, info.ErrorDescription)
+	}
+	return strings.Fields(info.Scope), nil
+}
+
+func loadConfig(credPath string) (*oauth2.Config, error) {
+	b, err := os.ReadFile(credPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client secret file: %v", err)
+	}
+	config, err := google.ConfigFromJSON(b, smartdevicemanagement.SdmServiceScope)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse client secret file to config: %v", err)
+	}
+	return config, nil
+}
+
+// Retrieve a token, saves the token, then returns the generated client.
+func GetClient(config *oauth2.Config, tokFile string) *http.Client {
+	// The file token.json stores the user's access and refresh tokens, and is
+	// created automatically when the authorization flow completes for the first
+	// time.
+	tok, err := tokenFromFile(tokFile)
+	if err != nil {
+		tok = getTokenFromWeb(config)
+		saveToken(tokFile, tok)
+	}
+	return config.Client(context.Background(), tok)
+}
+
+// Request a token from the web, then returns the retrieved token.
+func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "consent"))
+	fmt.Printf("Go to the following link in your browser then type the "+
+		"authorization code: \n%v\n", authURL)
+
+	var authCode string
+	if _, err := fmt.Scan(&authCode); err != nil {
+		log.Fatalf("Unable to read authorization code %v", err)
+	}
+
+	tok, err := config.Exchange(context.TODO(), authCode)
+	if err != nil {
+		log.Fatalf("Unable to retrieve token from web %v", err)
+	}
+	return tok
+}
+
+// Retrieves a token from a local file.
+func tokenFromFile(file string) (*oauth2.Token, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tok := &oauth2.Token{}
+	err = json.NewDecoder(f).Decode(tok)
+	return tok, err
+}
+
+// Saves a token to a file path.
+func saveToken(path string, token *oauth2.Token) {
+	fmt.Printf("Saving credential file to: %s\n", path)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatalf("Unable to cache oauth token: %v", err)
+	}
+	defer f.Close()
+	json.NewEncoder(f).Encode(token)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	nestconsumer "github.com/cormoran/NestDoorbellConsumer"
+	"github.com/cormoran/NestDoorbellConsumer/processor"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"google.golang.org/api/googleapi"
+)
+
+// Runtime control of the consumer. Every request needs "Authorization: Bearer <token>".
+//   - GET /devices: devices of every project
+//   - POST /devices/{id}/commands {command, params}: execute an SDM command of -admin-commands on the device (id, full
+//     name or custom name) and return its {results}, e.g. GenerateRtspStream for scripts without their own OAuth client
+//   - GET /events?limit=N: recently received events, newest first
+//   - GET /status: pause state of projects and the bandwidth limit
+//   - POST /pause, /resume [?project=<name>]: stop or restart processing events. Every project if not given
+//   - POST /snapshot?device=<id or name>[&duration=10s]: record the live stream of the device into the output directory
+//   - POST /reload: reload notifiers, rules and the device filter from -config
+//   - POST /bandwidth?limit=<bytes/sec>: change -bandwidth-limit. 0 removes the limit
+type adminServer struct {
+	token     string
+	projects  []*Project
+	history   *nestconsumer.EventHistory
+	bandwidth *processor.BandwidthLimiter
+	reload    func() error
+	commands  []string // allowed SDM commands. "sdm.devices.commands.CameraLiveStream.*" allows the trait's commands
+}
+
+type adminCommandRequest struct {
+	Command string          `json:"command"` // e.g. sdm.devices.commands.CameraLiveStream.GenerateRtspStream
+	Params  json.RawMessage `json:"params"`
+}
+
+type adminCommandResponse struct {
+	Results json.RawMessage `json:"results"`
+}
+
+type adminDevice struct {
+	Project     string `json:"project"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	DisplayName string `json:"displayName"`
+}
+
+type adminProjectStatus struct {
+	Name   string `json:"name"`
+	Paused bool   `json:"paused"`
+}
+
+type adminStatus struct {
+	Projects       []adminProjectStatus `json:"projects"`
+	BandwidthLimit int64                `json:"bandwidthLimit"` // bytes per second. 0 means no limit
+}
+
+func (s *adminServer) Serve(addr string) {
+	log.Printf("Serving admin API on %v", addr)
+	if err := http.ListenAndServe(addr, s.Handler()); err != nil {
+		log.Printf("Admin server stopped: %v", err)
+	}
+}
+
+// Routes of the API behind the token check
+func (s *adminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /devices", func(w http.ResponseWriter, r *http.Request) {
+		devices := []adminDevice{}
+		for _, project := range s.projects {
+			for _, device := range project.consumer.Devices().Devices() {
+				devices = append(devices, adminDevice{
+					Project:     project.config.Name,
+					Name:        device.Name,
+					Type:        device.Type,
+					DisplayName: sdmevents.DeviceDisplayName(device),
+				})
+			}
+		}
+		writeJson(w, devices)
+	})
+	mux.HandleFunc("POST /devices/{id}/commands", func(w http.ResponseWriter, r *http.Request) {
+		var request adminCommandRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !s.commandAllowed(request.Command) {
+			http.Error(w, "command not allowed by -admin-commands: "+request.Command, http.StatusForbidden)
+			return
+		}
+		if len(request.Params) == 0 {
+			request.Params = json.RawMessage("{}")
+		}
+		for _, project := range s.projects {
+			device, err := sdmevents.FindDevice(project.consumer.Devices().Devices(), r.PathValue("id"))
+			if err != nil {
+				continue
+			}
+			var results json.RawMessage
+			if err := processor.ExecuteDeviceCommand(r.Context(), project.consumer.Service(), device.Name, request.Command, request.Params, &results); err != nil {
+				log.Printf("Admin API failed to execute %v on %v: %v", request.Command, device.Name, err)
+				code := http.StatusBadGateway
+				if e, ok := err.(*googleapi.Error); ok && e.Code >= 400 && e.Code < 500 {
+					code = e.Code
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+			log.Printf("Admin API executed %v on %v", request.Command, device.Name)
+			writeJson(w, adminCommandResponse{Results: results})
+			return
+		}
+		http.Error(w, "device not found in any project: "+r.PathValue("id"), http.StatusNotFound)
+	})
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		writeJson(w, s.history.Recent(limit))
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, s.status())
+	})
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		s.forProjects(w, r, func(project *Project) { project.consumer.Pause() })
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		s.forProjects(w, r, func(project *Project) { project.consumer.Resume() })
+	})
+	mux.HandleFunc("POST /snapshot", func(w http.ResponseWriter, r *http.Request) {
+		duration := defaultSnapshotDuration
+		if v := r.URL.Query().Get("duration"); len(v) > 0 {
+			var err error
+			if duration, err = time.ParseDuration(v); err != nil {
+				http.Error(w, "invalid duration: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		path, err := snapshot(r.Context(), s.projects, r.URL.Query().Get("device"), duration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJson(w, map[string]string{"path": path})
+	})
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Reloaded config")
+		writeJson(w, s.status())
+	})
+	mux.HandleFunc("POST /bandwidth", func(w http.ResponseWriter, r *http.Request) {
+		limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+		if err != nil || limit < 0 {
+			http.Error(w, "limit must be bytes per second", http.StatusBadRequest)
+			return
+		}
+		s.bandwidth.SetRate(limit)
+		log.Printf("Bandwidth limit set to %v bytes/sec", limit)
+		writeJson(w, s.status())
+	})
+	return s.authorize(mux)
+}
+
+func (s *adminServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns true if command is in the allowlist, exactly or by a "trait.*" entry. The wildcard matches a single command
+// name, so "x.Trait.*" allows neither "x.TraitOther.Command" nor "x.Trait.Sub.Command"
+func (s *adminServer) commandAllowed(command string) bool {
+	if len(command) == 0 {
+		return false
+	}
+	for _, allowed := range s.commands {
+		if trait, ok := strings.CutSuffix(allowed, ".*"); ok {
+			if name, ok := strings.CutPrefix(command, trait+"."); ok && len(name) > 0 && !strings.ContainsAny(name, ".*") {
+				return true
+			}
+			continue
+		}
+		if allowed == command {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *adminServer) status() adminStatus {
+	status := adminStatus{Projects: []adminProjectStatus{}, BandwidthLimit: s.bandwidth.Rate()}
+	for _, project := range s.projects {
+		status.Projects = append(status.Projects, adminProjectStatus{Name: project.config.Name, Paused: project.consumer.Paused()})
+	}
+	return status
+}
+
+// Apply f to the project given by ?project=, or every project
+func (s *adminServer) forProjects(w http.ResponseWriter, r *http.Request, f func(project *Project)) {
+	name := r.URL.Query().Get("project")
+	found := false
+	for _, project := range s.projects {
+		if len(name) == 0 || project.config.Name == name {
+			f(project)
+			found = true
+		}
+	}
+	if !found {
+		http.Error(w, "unknown project: "+name, http.StatusNotFound)
+		return
+	}
+	writeJson(w, s.status())
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
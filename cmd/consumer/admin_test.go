@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	nestconsumer "github.com/cormoran/NestDoorbellConsumer"
+	"github.com/cormoran/NestDoorbellConsumer/processor"
+)
+
+func newTestAdminServer(t *testing.T, names ...string) *adminServer {
+	s := &adminServer{
+		token:     "secret",
+		bandwidth: processor.NewBandwidthLimiter(0),
+		reload:    func() error { return nil },
+		commands:  []string{"sdm.devices.commands.CameraEventImage.GenerateImage", "sdm.devices.commands.CameraLiveStream.*"},
+	}
+	for _, name := range names {
+		consumer, err := nestconsumer.New(
+			nestconsumer.WithSmartDeviceManagement("project-"+name, http.DefaultClient),
+			nestconsumer.WithMessageSource(noMessageSource{}),
+			nestconsumer.WithStorage(t.TempDir(), nestconsumer.DefaultOutputFileNameFormat),
+			nestconsumer.WithStateDir(t.TempDir()),
+			nestconsumer.WithName(name),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.projects = append(s.projects, &Project{config: ProjectConfig{Name: name}, consumer: consumer})
+	}
+	return s
+}
+
+func adminRequest(handler http.Handler, method, target, authorization, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if len(authorization) > 0 {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAuthorize(t *testing.T) {
+	handler := newTestAdminServer(t, "home").Handler()
+	for _, authorization := range []string{"", "Bearer", "Bearer ", "Bearer wrong", "Bearer secret2", "bearer secret", "Basic c2VjcmV0", "secret"} {
+		if w := adminRequest(handler, "GET", "/status", authorization, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("GET /status with Authorization %q = %v, want 401", authorization, w.Code)
+		}
+	}
+	// also before reaching a handler changing anything
+	reloaded := false
+	s := newTestAdminServer(t, "home")
+	s.reload = func() error { reloaded = true; return nil }
+	if w := adminRequest(s.Handler(), "POST", "/reload", "Bearer wrong", ""); w.Code != http.StatusUnauthorized || reloaded {
+		t.Errorf("POST /reload with a wrong token = %v, reloaded %v, want 401", w.Code, reloaded)
+	}
+	if w := adminRequest(handler, "GET", "/status", "Bearer secret", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /status with the token = %v %q, want 200", w.Code, w.Body)
+	}
+}
+
+func TestAdminCommandAllowed(t *testing.T) {
+	s := newTestAdminServer(t)
+	s.commands = append(s.commands, "sdm.devices.commands.Camera*", "*")
+	for _, c := range []struct {
+		command string
+		want    bool
+	}{
+		{"sdm.devices.commands.CameraEventImage.GenerateImage", true},
+		{"sdm.devices.commands.CameraLiveStream.GenerateRtspStream", true},
+		{"sdm.devices.commands.CameraLiveStream.StopRtspStream", true},
+		// similarly named traits
+		{"sdm.devices.commands.CameraLiveStreamX.GenerateRtspStream", false},
+		{"sdm.devices.commands.CameraLiveStreams.GenerateRtspStream", false},
+		{"sdm.devices.commands.CameraLiveStream", false},
+		{"sdm.devices.commands.CameraLiveStream.", false},
+		{"sdm.devices.commands.CameraLiveStream.Sub.Command", false},
+		{"sdm.devices.commands.CameraLiveStream.*", false},
+		{"xsdm.devices.commands.CameraLiveStream.GenerateRtspStream", false},
+		// exact entries don't match prefixes, and "*" without a trait isn't a wildcard
+		{"sdm.devices.commands.CameraEventImage.GenerateImageX", false},
+		{"sdm.devices.commands.CameraEventImage", false},
+		{"sdm.devices.commands.CameraPreview.Foo", false},
+		{"sdm.devices.commands.ThermostatMode.SetMode", false},
+		{"", false},
+	} {
+		if got := s.commandAllowed(c.command); got != c.want {
+			t.Errorf("commandAllowed(%q) = %v, want %v", c.command, got, c.want)
+		}
+	}
+	s.commands = nil
+	if s.commandAllowed("sdm.devices.commands.CameraLiveStream.GenerateRtspStream") {
+		t.Error("empty -admin-commands allows a command")
+	}
+}
+
+func TestAdminCommandForbidden(t *testing.T) {
+	handler := newTestAdminServer(t, "home").Handler()
+	w := adminRequest(handler, "POST", "/devices/front/commands", "Bearer secret", `{"command":"sdm.devices.commands.CameraLiveStreamX.GenerateRtspStream"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("POST of a command not allowed = %v %q, want 403", w.Code, w.Body)
+	}
+	w = adminRequest(handler, "POST", "/devices/front/commands", "Bearer secret", `{"command":`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST of invalid JSON = %v %q, want 400", w.Code, w.Body)
+	}
+}
+
+func decodeAdminStatus(t *testing.T, w *httptest.ResponseRecorder) adminStatus {
+	t.Helper()
+	var status adminStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("invalid status %q: %v", w.Body, err)
+	}
+	return status
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	s := newTestAdminServer(t, "home", "office")
+	handler := s.Handler()
+	paused := func() string {
+		status := decodeAdminStatus(t, adminRequest(handler, "GET", "/status", "Bearer secret", ""))
+		names := []string{}
+		for _, project := range status.Projects {
+			if project.Paused {
+				names = append(names, project.Name)
+			}
+		}
+		return strings.Join(names, ",")
+	}
+	for _, c := range []struct {
+		method, target string
+		code           int
+		paused         string
+	}{
+		{"POST", "/pause?project=office", http.StatusOK, "office"},
+		{"POST", "/pause?project=garage", http.StatusNotFound, "office"},
+		{"POST", "/pause", http.StatusOK, "home,office"},
+		{"POST", "/resume?project=home", http.StatusOK, "office"},
+		{"POST", "/resume?project=garage", http.StatusNotFound, "office"},
+		{"GET", "/resume", http.StatusMethodNotAllowed, "office"},
+		{"POST", "/resume", http.StatusOK, ""},
+	} {
+		w := adminRequest(handler, c.method, c.target, "Bearer secret", "")
+		if w.Code != c.code {
+			t.Errorf("%v %v = %v %q, want %v", c.method, c.target, w.Code, w.Body, c.code)
+		}
+		if got := paused(); got != c.paused {
+			t.Errorf("after %v %v paused %q, want %q", c.method, c.target, got, c.paused)
+		}
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	s := newTestAdminServer(t, "home")
+	reloads := 0
+	var reloadErr error
+	s.reload = func() error {
+		reloads++
+		return reloadErr
+	}
+	handler := s.Handler()
+	w := adminRequest(handler, "POST", "/reload", "Bearer secret", "")
+	if w.Code != http.StatusOK || reloads != 1 {
+		t.Fatalf("POST /reload = %v %q after %v reloads, want 200 after 1", w.Code, w.Body, reloads)
+	}
+	if status := decodeAdminStatus(t, w); len(status.Projects) != 1 || status.Projects[0].Name != "home" {
+		t.Errorf("status after reload = %+v", status)
+	}
+	reloadErr = fmt.Errorf("notifiers[0]: unknown type")
+	w = adminRequest(handler, "POST", "/reload", "Bearer secret", "")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unknown type") || reloads != 2 {
+		t.Errorf("failed POST /reload = %v %q after %v reloads, want 400 with the error", w.Code, w.Body, reloads)
+	}
+	if w := adminRequest(handler, "GET", "/reload", "Bearer secret", ""); w.Code != http.StatusMethodNotAllowed || reloads != 2 {
+		t.Errorf("GET /reload = %v after %v reloads, want 405 without reloading", w.Code, reloads)
+	}
+}
+
+func TestAdminBandwidth(t *testing.T) {
+	s := newTestAdminServer(t)
+	handler := s.Handler()
+	if w := adminRequest(handler, "POST", "/bandwidth?limit=500000", "Bearer secret", ""); w.Code != http.StatusOK || decodeAdminStatus(t, w).BandwidthLimit != 500000 {
+		t.Errorf("POST /bandwidth?limit=500000 = %v %q", w.Code, w.Body)
+	}
+	for _, target := range []string{"/bandwidth", "/bandwidth?limit=-1", "/bandwidth?limit=fast"} {
+		if w := adminRequest(handler, "POST", target, "Bearer secret", ""); w.Code != http.StatusBadRequest {
+			t.Errorf("POST %v = %v, want 400", target, w.Code)
+		}
+	}
+	if s.bandwidth.Rate() != 500000 {
+		t.Errorf("rate = %v after invalid requests, want 500000", s.bandwidth.Rate())
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/processor"
+)
+
+// Config file given by -config
+type Config struct {
+	Notifiers []json.RawMessage               `json:"notifiers"` // each entry is decoded by notify.CreateNotifiers
+	Rules     *notify.NotificationRulesConfig `json:"rules"`     // applied to every notifier
+	Projects  []ProjectConfig                 `json:"projects"`  // replaces -nest-project-id and related flags when given
+	Devices   *processor.EventFilterConfig    `json:"devices"`   // events of filtered devices are neither downloaded nor notified
+	Pipeline  []processor.PipelineStageConfig `json:"pipeline"`  // stages of events instead of download then notify
+	Plugins   []notify.PluginConfig           `json:"plugins"`   // executables annotating or suppressing notifications
+}
+
+func loadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Global notification rules. Returns nil if not configured.
+func (c *Config) CreateNotificationRules() (*notify.NotificationRules, error) {
+	if c.Rules == nil {
+		return nil, nil
+	}
+	return notify.NewNotificationRules(c.Rules)
+}
+
+// Returns nil if not configured
+func (c *Config) CreateEventFilter() (*processor.EventFilter, error) {
+	if c.Devices == nil {
+		return nil, nil
+	}
+	return processor.NewEventFilter(c.Devices)
+}
+
+// Returns nil if not configured
+func (c *Config) CreatePipeline() (*processor.Pipeline, error) {
+	if len(c.Pipeline) == 0 {
+		return nil, nil
+	}
+	return processor.NewPipeline(c.Pipeline)
+}
+
+func (c *Config) CreatePlugins() ([]*notify.Plugin, error) {
+	return notify.CreatePlugins(c.Plugins)
+}
+
+func (c *Config) CreateNotifiers() ([]notify.Notifier, error) {
+	return notify.CreateNotifiers(c.Notifiers)
+}
+
+// Notifiers of the config appended to base, and the rules and device filter applied to them
+func (c *Config) CreateNotificationSettings(base []notify.Notifier) ([]notify.Notifier, *notify.NotificationRules, *processor.EventFilter, error) {
+	configNotifiers, err := c.CreateNotifiers()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	notifiers := append(append([]notify.Notifier{}, base...), configNotifiers...)
+	rules, err := c.CreateNotificationRules()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	filter, err := c.CreateEventFilter()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("devices: %v", err)
+	}
+	return notifiers, rules, filter, nil
+}
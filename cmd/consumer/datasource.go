@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/cormoran/NestDoorbellConsumer/datasource"
+)
+
+// Datasource API of -output-dir served by the consumer itself. Clips are indexed as soon as the consumer saves them,
+// instead of waiting for the index to rescan the directories.
+type embeddedDatasource struct {
+	outputDir string
+	index     *datasource.ClipIndex
+	handler   http.Handler
+}
+
+// indexPath is the file of the clip index, empty keeps it in memory
+func newEmbeddedDatasource(outputDir string, indexPath string, options datasource.Options) (*embeddedDatasource, error) {
+	if err := os.MkdirAll(outputDir, 0777); err != nil {
+		return nil, err
+	}
+	archive, err := datasource.OpenArchive(outputDir, true)
+	if err != nil {
+		return nil, err
+	}
+	if options.Index, err = datasource.OpenClipIndex(archive, options.Location, indexPath); err != nil {
+		return nil, err
+	}
+	return &embeddedDatasource{outputDir: outputDir, index: options.Index, handler: datasource.NewHandler(archive, options)}, nil
+}
+
+// Hook of nestconsumer.WithClipSavedHook
+func (d *embeddedDatasource) ClipSaved(path string) {
+	rel, err := filepath.Rel(d.outputDir, path)
+	if err != nil {
+		log.Printf("Saved clip %v is outside of %v: %v", path, d.outputDir, err)
+		return
+	}
+	d.index.Add(filepath.ToSlash(rel))
+}
+
+func (d *embeddedDatasource) Serve(addr string) {
+	log.Printf("Serving datasource on %v", addr)
+	if err := http.ListenAndServe(addr, d.handler); err != nil {
+		log.Printf("Datasource server stopped: %v", err)
+	}
+}
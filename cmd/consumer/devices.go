@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cormoran/NestDoorbellConsumer/auth"
+	"github.com/cormoran/NestDoorbellConsumer/processor"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"google.golang.org/api/option"
+	"google.golang.org/api/smartdevicemanagement/v1"
+)
+
+// `devices list`: print devices of every project with the names usable in -device and the config file
+func runDevicesList(configs []ProjectConfig) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROJECT\tID\tNAME\tTYPE\tLIVE STREAM")
+	for _, config := range configs {
+		client, err := auth.NewClient(config.SmartDeviceCredPath, config.TokenPath)
+		if err != nil {
+			return fmt.Errorf("[%v] %v", config.Name, err)
+		}
+		svc, err := smartdevicemanagement.NewService(context.Background(), option.WithHTTPClient(client))
+		if err != nil {
+			return fmt.Errorf("[%v] %v", config.Name, err)
+		}
+		var r *smartdevicemanagement.GoogleHomeEnterpriseSdmV1ListDevicesResponse
+		err = processor.RetrySDM(context.Background(), "devices.list", func(ctx context.Context) (err error) {
+			r, err = svc.Enterprises.Devices.List(config.NestProjectId).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("[%v] %v", config.Name, err)
+		}
+		for _, device := range r.Devices {
+			var liveStream sdmevents.DeviceTraitCameraLiveStreamValue
+			sdmevents.DecodeDeviceTrait(device, sdmevents.DeviceTraitCameraLiveStream, &liveStream)
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", config.Name, sdmevents.DeviceId(device.Name), sdmevents.DeviceDisplayName(device), device.Type, strings.Join(liveStream.SupportedProtocols, ","))
+		}
+	}
+	return w.Flush()
+}
+
+func devicesListCommand(args []string) {
+	fs := newFlagSet("devices list")
+	var httpFlags httpFlags
+	httpFlags.register(fs)
+	var projectFlags projectFlags
+	projectFlags.register(fs)
+	fs.Parse(args)
+	httpFlags.setup()
+	config, err := projectFlags.loadConfig()
+	if err != nil {
+		log.Fatalf("Unable to load config: %v", err)
+	}
+	if err := runDevicesList(projectFlags.projectConfigs(config)); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	nestconsumer "github.com/cormoran/NestDoorbellConsumer"
+	"github.com/cormoran/NestDoorbellConsumer/auth"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"google.golang.org/api/option"
+	"google.golang.org/api/smartdevicemanagement/v1"
+)
+
+type doctorCheck struct {
+	name string
+	hint string // how to fix the failure
+	run  func(ctx context.Context) error
+}
+
+// `doctor`: check prerequisites of every project without starting the consumer, and print how to fix failed ones.
+// Returns error if any check failed.
+func runDoctor(configs []ProjectConfig, outputDir string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	failed := 0
+	for _, config := range configs {
+		fmt.Printf("[%v]\n", config.Name)
+		for _, check := range projectChecks(config, filepath.Join(outputDir, config.OutputPrefix)) {
+			if err := check.run(ctx); err != nil {
+				fmt.Printf("FAIL %v: %v\n", check.name, err)
+				fmt.Printf("     hint: %v\n", check.hint)
+				failed++
+			} else {
+				fmt.Printf("OK   %v\n", check.name)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v checks failed", failed)
+	}
+	return nil
+}
+
+// Checks in order. Later checks use the results of earlier ones, and fail when those failed.
+func projectChecks(config ProjectConfig, outputDir string) []doctorCheck {
+	var devices []*smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device
+	var subscription *pubsub.Subscription
+	topic := config.PubsubTopic
+	if len(topic) == 0 {
+		topic = nestconsumer.SdmTopic(config.NestProjectId)
+	}
+	return []doctorCheck{
+		{
+			name: "OAuth credentials are valid",
+			hint: "give the OAuth client secret of the Google Cloud project linked to the Device Access project by -smart-device-cred-path, then run `consumer auth login`",
+			run: func(ctx context.Context) error {
+				scopes, err := auth.CheckToken(ctx, config.SmartDeviceCredPath, config.TokenPath)
+				if err != nil {
+					return err
+				}
+				if !slices.Contains(scopes, smartdevicemanagement.SdmServiceScope) {
+					return fmt.Errorf("token lacks %v scope: %v", smartdevicemanagement.SdmServiceScope, scopes)
+				}
+				return nil
+			},
+		},
+		{
+			name: "SDM project is reachable",
+			hint: "check -nest-project-id is enterprises/<project_id> of https://console.nest.google.com/device-access, and the account authorized by `consumer auth login` granted access to the home",
+			run: func(ctx context.Context) error {
+				client, err := auth.NewCachedClient(config.SmartDeviceCredPath, config.TokenPath)
+				if err != nil {
+					return err
+				}
+				svc, err := smartdevicemanagement.NewService(ctx, option.WithHTTPClient(client))
+				if err != nil {
+					return err
+				}
+				r, err := svc.Enterprises.Devices.List(config.NestProjectId).Context(ctx).Do()
+				if err != nil {
+					return err
+				}
+				devices = r.Devices
+				return nil
+			},
+		},
+		{
+			name: "Doorbell device is visible",
+			hint: "re-run `consumer auth login` and select the doorbell on the consent screen of Partner Connections Manager",
+			run: func(ctx context.Context) error {
+				if devices == nil {
+					return fmt.Errorf("devices were not listed")
+				}
+				for _, device := range devices {
+					if device.Type == sdmevents.DeviceTypeDoorbell {
+						return nil
+					}
+				}
+				return fmt.Errorf("no doorbell in %v devices", len(devices))
+			},
+		},
+		{
+			name: "Pub/Sub subscription exists",
+			hint: "create the subscription of " + topic + " in -pubsub-project-id, or add -pubsub-create-subscription. The service account of -pubsub-cred-path needs the Pub/Sub Subscriber role",
+			run: func(ctx context.Context) error {
+				client, err := pubsub.NewClient(ctx, config.PubsubProjectId, option.WithCredentialsFile(config.PubsubCredPath))
+				if err != nil {
+					return err
+				}
+				s := client.Subscription(config.PubsubSubscriptionId)
+				exists, err := s.Exists(ctx)
+				if err != nil {
+					return err
+				}
+				if !exists {
+					return fmt.Errorf("subscription %v not found in %v", config.PubsubSubscriptionId, config.PubsubProjectId)
+				}
+				subscription = s
+				return nil
+			},
+		},
+		{
+			name: "Pub/Sub subscription is attached to the SDM topic",
+			hint: "enable Pub/Sub in the Device Access console and recreate the subscription bound to the topic shown there",
+			run: func(ctx context.Context) error {
+				if subscription == nil {
+					return fmt.Errorf("subscription was not found")
+				}
+				subscriptionConfig, err := subscription.Config(ctx)
+				if err != nil {
+					return err
+				}
+				if subscriptionConfig.Topic == nil || subscriptionConfig.Topic.String() != topic {
+					return fmt.Errorf("subscription is bound to %v, not %v", subscriptionConfig.Topic, topic)
+				}
+				return nil
+			},
+		},
+		{
+			name: "Output directory is writable",
+			hint: "create " + outputDir + " writable by the user of the consumer, e.g. check the volume mount of the container",
+			run: func(ctx context.Context) error {
+				if err := os.MkdirAll(outputDir, 0777); err != nil {
+					return err
+				}
+				f, err := os.CreateTemp(outputDir, ".doctor-*")
+				if err != nil {
+					return err
+				}
+				f.Close()
+				return os.Remove(f.Name())
+			},
+		},
+	}
+}
+
+func doctorCommand(args []string) {
+	fs := newFlagSet("doctor")
+	var httpFlags httpFlags
+	httpFlags.register(fs)
+	var projectFlags projectFlags
+	projectFlags.register(fs)
+	outputDir := fs.String("output-dir", "output", "output directory to check")
+	fs.Parse(args)
+	httpFlags.setup()
+	config, err := projectFlags.loadConfig()
+	if err != nil {
+		log.Fatalf("Unable to load config: %v", err)
+	}
+	if err := runDoctor(projectFlags.projectConfigs(config), *outputDir); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cormoran/NestDoorbellConsumer/processor"
+)
+
+// faces list, faces register and faces delete: manage the gallery of the face recognition server
+func runFaces(command string, recognizer *processor.HttpFaceRecognizer, name string, images []string) error {
+	if recognizer == nil {
+		return fmt.Errorf("-face-url is required")
+	}
+	ctx := context.Background()
+	switch command {
+	case "faces list":
+		names, err := recognizer.List(ctx)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	case "faces register":
+		if len(name) == 0 || len(images) == 0 {
+			return fmt.Errorf("usage: consumer faces register -face-url <url> -face-name <name> <image files...>")
+		}
+		files := [][]byte{}
+		for _, image := range images {
+			b, err := os.ReadFile(image)
+			if err != nil {
+				return err
+			}
+			files = append(files, b)
+		}
+		if err := recognizer.Register(ctx, name, files); err != nil {
+			return err
+		}
+		fmt.Printf("Registered %v images of %v\n", len(files), name)
+		return nil
+	case "faces delete":
+		if len(name) == 0 {
+			return fmt.Errorf("-face-name is required")
+		}
+		return recognizer.Delete(ctx, name)
+	}
+	return fmt.Errorf("unknown command %v", command)
+}
+
+func facesCommand(command string, args []string) {
+	fs := newFlagSet(command)
+	var httpFlags httpFlags
+	httpFlags.register(fs)
+	var faceFlags faceFlags
+	faceFlags.register(fs)
+	name := fs.String("face-name", "", "name of the person to register or delete")
+	fs.Parse(args)
+	httpFlags.setup()
+	recognizer, err := faceFlags.recognizer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := runFaces(command, recognizer, *name, fs.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	nestconsumer "github.com/cormoran/NestDoorbellConsumer"
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/processor"
+	"github.com/cormoran/NestDoorbellConsumer/tracing"
+)
+
+// Flags of outbound HTTP requests, taken by every command
+type httpFlags struct {
+	connectTimeout  time.Duration
+	responseTimeout time.Duration
+	bandwidthLimit  int64
+}
+
+func (f *httpFlags) register(fs *flag.FlagSet) {
+	fs.DurationVar(&f.connectTimeout, "http-connect-timeout", 10*time.Second, "timeout of connecting (including TLS handshake) of outbound HTTP requests. 0 disables it")
+	fs.DurationVar(&f.responseTimeout, "http-response-timeout", 30*time.Second, "timeout of waiting response headers of outbound HTTP requests. 0 disables it")
+	fs.Int64Var(&f.bandwidthLimit, "bandwidth-limit", 0, "max bytes per second of all HTTP downloads and uploads together e.g. 500000 on a metered connection. 0 means no limit")
+}
+
+// Send requests of every HTTP client of the process (SDM API, OAuth, downloads and notifiers) through the limiter
+func (f *httpFlags) setup() *processor.BandwidthLimiter {
+	limiter := processor.NewBandwidthLimiter(f.bandwidthLimit)
+	http.DefaultTransport = tracing.NewTransport(processor.NewThrottledTransport(processor.NewHTTPTransport(f.connectTimeout, f.responseTimeout), limiter))
+	return limiter
+}
+
+// Flags of the Device Access project. "projects" of -config replace it
+type projectFlags struct {
+	projectId            string
+	smartDeviceCredPath  string
+	tokenPath            string
+	pubsubProject        string
+	pubsubCredPath       string
+	pubsubSubscriptionId string
+	pubsubTopic          string
+	configPath           string
+}
+
+func (f *projectFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.projectId, "nest-project-id", os.Getenv("NEST_PROJECT_ID"), "Device access console project id taken from https://console.nest.google.com/device-access e.g. enterprises/<project_id>")
+	fs.StringVar(&f.smartDeviceCredPath, "smart-device-cred-path", "credentials.json", "path to google cloud oauth credential json file for smart device API")
+	fs.StringVar(&f.tokenPath, "token-path", "token.json", "file path to save access token/update token taken from smart device API oauth")
+	fs.StringVar(&f.pubsubProject, "pubsub-project-id", os.Getenv("PUBSUB_PROJECT_ID"), "google could project id for pubsub")
+	fs.StringVar(&f.pubsubCredPath, "pubsub-cred-path", os.Getenv("PUBSUB_CRED_PATH"), "path to google cloud credential json file for pubsub")
+	fs.StringVar(&f.pubsubSubscriptionId, "pubsub-subscription-id", "test-subscription", "pubsub subscription id")
+	fs.StringVar(&f.pubsubTopic, "pubsub-topic", "", "topic of the subscription created by -pubsub-create-subscription. empty means the SDM topic of -nest-project-id (projects/sdm-prod/topics/enterprise-<project_id>)")
+	fs.StringVar(&f.configPath, "config", "", "path to JSON config file. See Readme for the format")
+}
+
+// Config file of -config, nil without it
+func (f *projectFlags) loadConfig() (*Config, error) {
+	if len(f.configPath) == 0 {
+		return nil, nil
+	}
+	return loadConfig(f.configPath)
+}
+
+// "projects" of config, or the project of the flags
+func (f *projectFlags) projectConfigs(config *Config) []ProjectConfig {
+	if config != nil && len(config.Projects) > 0 {
+		return config.Projects
+	}
+	return []ProjectConfig{{
+		Name:                 f.projectId,
+		NestProjectId:        f.projectId,
+		SmartDeviceCredPath:  f.smartDeviceCredPath,
+		TokenPath:            f.tokenPath,
+		PubsubProjectId:      f.pubsubProject,
+		PubsubCredPath:       f.pubsubCredPath,
+		PubsubSubscriptionId: f.pubsubSubscriptionId,
+		PubsubTopic:          f.pubsubTopic,
+	}}
+}
+
+// Flags of where and how clips are saved
+type outputFlags struct {
+	outputDir            string
+	outputFileNameFormat string
+	filePathTimeSource   string
+	timezone             string
+}
+
+func (f *outputFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.outputDir, "output-dir", "output", "output directory")
+	fs.StringVar(&f.outputFileNameFormat, "output-file-path-format", "2006/01/02/15/{eventSessionId}", "output file path format. Supports creating sub directory. go's time layout, {eventSessionId}, {eventType}, {familiarFace}, {room} and {structure} are supported as variable.")
+	fs.StringVar(&f.filePathTimeSource, "output-file-path-time", string(processor.FilePathTimeSourceEvent), "time used to format output-file-path-format. 'event' uses the event's timestamp so late-arriving events are placed at their original time, 'received' uses the time the event was received")
+	fs.StringVar(&f.timezone, "timezone", "Local", "IANA time zone of output paths and metadata timestamps e.g. Asia/Tokyo. Containers often run in UTC, so set it to where you live. Give the same to the datasource")
+}
+
+func (f *outputFlags) location() (*time.Location, error) {
+	location, err := time.LoadLocation(f.timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -timezone: %v", err)
+	}
+	return location, nil
+}
+
+// Options saving clips of the project into its directory of -output-dir
+func (f *outputFlags) options(projectConfig ProjectConfig, location *time.Location) []nestconsumer.Option {
+	return []nestconsumer.Option{
+		nestconsumer.WithStorage(f.projectOutputDir(projectConfig), f.outputFileNameFormat),
+		nestconsumer.WithLocation(location),
+		nestconsumer.WithFilePathTimeSource(processor.FilePathTimeSource(f.filePathTimeSource)),
+	}
+}
+
+func (f *outputFlags) projectOutputDir(projectConfig ProjectConfig) string {
+	return filepath.Join(f.outputDir, projectConfig.OutputPrefix)
+}
+
+// Flags of receiving messages from Pub/Sub, taken by serve
+type pubsubFlags struct {
+	maxOutstandingMsgs  int
+	maxOutstandingBytes int
+	numGoroutines       int
+	synchronousPull     bool
+	staleTimeout        time.Duration
+	maxIdle             time.Duration
+	pullMode            bool
+	pullInterval        time.Duration
+	pullTimeout         time.Duration
+	pullMaxMessages     int
+	createSubscription  bool
+	ackDeadline         time.Duration
+	retentionDuration   time.Duration
+	deadLetterTopic     string
+	maxDeliveryAttempts int
+}
+
+func (f *pubsubFlags) register(fs *flag.FlagSet) {
+	fs.IntVar(&f.maxOutstandingMsgs, "pubsub-max-outstanding-messages", pubsub.DefaultReceiveSettings.MaxOutstandingMessages, "max number of received but unprocessed messages. Lower it on small devices to avoid buffering many messages after an outage. negative means no limit")
+	fs.IntVar(&f.maxOutstandingBytes, "pubsub-max-outstanding-bytes", pubsub.DefaultReceiveSettings.MaxOutstandingBytes, "max size in bytes of received but unprocessed messages. negative means no limit")
+	fs.IntVar(&f.numGoroutines, "pubsub-num-goroutines", pubsub.DefaultReceiveSettings.NumGoroutines, "number of goroutines receiving messages of a subscription")
+	fs.BoolVar(&f.synchronousPull, "pubsub-synchronous", false, "receive messages by unary Pull RPCs instead of StreamingPull. Implies -pubsub-num-goroutines 1")
+	fs.DurationVar(&f.staleTimeout, "pubsub-stale-timeout", 5*time.Minute, "reconnect the streaming pull on a new Pub/Sub client when neither a message nor a keepalive probe succeeded for this long, e.g. after network outages. 0 disables it")
+	fs.DurationVar(&f.maxIdle, "pubsub-max-idle", 0, "reconnect the streaming pull also when no message arrived for this long although keepalive probes succeed e.g. 6h. 0 disables it")
+	fs.BoolVar(&f.pullMode, "pull-mode", false, "receive messages by polling unary Pull RPCs with explicit deadlines instead of streaming pull, for flaky connections where streaming pull hangs silently")
+	fs.DurationVar(&f.pullInterval, "pull-interval", 5*time.Second, "pull mode: wait between pulls which returned no message or failed")
+	fs.DurationVar(&f.pullTimeout, "pull-timeout", 30*time.Second, "pull mode: deadline of each Pull and Acknowledge RPC")
+	fs.IntVar(&f.pullMaxMessages, "pull-max-messages", 10, "pull mode: max messages per pull. They are processed before being acked, so keep it small enough to process within the ack deadline")
+	fs.BoolVar(&f.createSubscription, "pubsub-create-subscription", false, "create -pubsub-subscription-id if it doesn't exist, bound to -pubsub-topic")
+	fs.DurationVar(&f.ackDeadline, "pubsub-ack-deadline", 60*time.Second, "ack deadline of the created subscription")
+	fs.DurationVar(&f.retentionDuration, "pubsub-retention", 0, "message retention of the created subscription e.g. 72h. 0 uses the Pub/Sub default (7 days)")
+	fs.StringVar(&f.deadLetterTopic, "pubsub-dead-letter-topic", "", "dead letter topic projects/<project>/topics/<topic> of the created subscription. empty disables dead lettering")
+	fs.IntVar(&f.maxDeliveryAttempts, "pubsub-max-delivery-attempts", 5, "delivery attempts before a message goes to -pubsub-dead-letter-topic")
+}
+
+func (f *pubsubFlags) options() pubsubOptions {
+	opts := pubsubOptions{receiveSettings: pubsub.DefaultReceiveSettings}
+	opts.receiveSettings.MaxOutstandingMessages = f.maxOutstandingMsgs
+	opts.receiveSettings.MaxOutstandingBytes = f.maxOutstandingBytes
+	opts.receiveSettings.NumGoroutines = f.numGoroutines
+	opts.receiveSettings.Synchronous = f.synchronousPull
+	opts.staleTimeout = f.staleTimeout
+	opts.maxIdle = f.maxIdle
+	opts.pullMode = f.pullMode
+	opts.pull = &nestconsumer.PullSource{
+		MaxMessages: int32(f.pullMaxMessages),
+		Interval:    f.pullInterval,
+		Timeout:     f.pullTimeout,
+	}
+	if f.createSubscription {
+		opts.createSubscription = &nestconsumer.SubscriptionSettings{
+			AckDeadline:         f.ackDeadline,
+			RetentionDuration:   f.retentionDuration,
+			DeadLetterTopic:     f.deadLetterTopic,
+			MaxDeliveryAttempts: f.maxDeliveryAttempts,
+		}
+	}
+	return opts
+}
+
+// Flags of notifiers which don't need the config file, taken by serve, replay and test notify
+type notifierFlags struct {
+	webhookUrls         stringListFlag
+	webhookTemplatePath string
+	webhookAttempts     int
+	mqttBroker          string
+	mqttClientId        string
+	mqttUsername        string
+	mqttPassword        string
+	mqttTopicPrefix     string
+	mqttDiscoveryPrefix string
+	grpcAddr            string
+	grpcToken           string
+}
+
+func (f *notifierFlags) register(fs *flag.FlagSet) {
+	fs.Var(&f.webhookUrls, "webhook-url", "URL to POST JSON payload on chime/motion/person/sound events. Can be given multiple times")
+	fs.StringVar(&f.webhookTemplatePath, "webhook-template", "", "path to go text/template file rendering webhook JSON payload from the notification. default payload is the notification marshaled as JSON")
+	fs.IntVar(&f.webhookAttempts, "webhook-attempts", 3, "number of attempts to POST a webhook")
+	fs.StringVar(&f.mqttBroker, "mqtt-broker", "", "MQTT broker to publish events e.g. tcp://localhost:1883. empty disables MQTT")
+	fs.StringVar(&f.mqttClientId, "mqtt-client-id", "nest-doorbell-consumer", "MQTT client id")
+	fs.StringVar(&f.mqttUsername, "mqtt-username", os.Getenv("MQTT_USERNAME"), "MQTT username")
+	fs.StringVar(&f.mqttPassword, "mqtt-password", os.Getenv("MQTT_PASSWORD"), "MQTT password")
+	fs.StringVar(&f.mqttTopicPrefix, "mqtt-topic-prefix", "nest", "events are published to <prefix>/<device id>/<chime|motion|person|sound>")
+	fs.StringVar(&f.mqttDiscoveryPrefix, "mqtt-discovery-prefix", "homeassistant", "Home Assistant MQTT discovery prefix. empty disables discovery")
+	fs.StringVar(&f.grpcAddr, "grpc-addr", "", "address to serve gRPC streams of processed events e.g. :9090 (see notify/events.proto). empty disables it")
+	fs.StringVar(&f.grpcToken, "grpc-token", os.Getenv("GRPC_TOKEN"), "bearer token required by -grpc-addr in the authorization metadata. empty accepts every client")
+}
+
+// Notifiers given by the flags, with the default circuit breaker like the notifiers of the config
+func (f *notifierFlags) create() ([]notify.Notifier, error) {
+	webhookTemplate, err := notify.LoadWebhookTemplate(f.webhookTemplatePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load webhook template: %v", err)
+	}
+	notifiers := []notify.Notifier{}
+	add := func(notifier notify.Notifier, id string) error {
+		wrapped, err := notify.WrapNotifier(notifier, notify.NotifierConfigHeader{Name: id})
+		if err != nil {
+			return fmt.Errorf("invalid %v notifier: %v", id, err)
+		}
+		notifiers = append(notifiers, wrapped)
+		return nil
+	}
+	for _, url := range f.webhookUrls {
+		if err := add(notify.NewWebhookNotifier(url, webhookTemplate, f.webhookAttempts), "webhook"); err != nil {
+			return nil, err
+		}
+	}
+	if len(f.mqttBroker) > 0 {
+		mqttNotifier, err := notify.NewMqttNotifier(f.mqttBroker, f.mqttClientId, f.mqttUsername, f.mqttPassword, f.mqttTopicPrefix, f.mqttDiscoveryPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect MQTT broker: %v", err)
+		}
+		if err := add(mqttNotifier, "mqtt"); err != nil {
+			return nil, err
+		}
+	}
+	if len(f.grpcAddr) > 0 {
+		grpcNotifier, err := notify.NewGrpcNotifier(f.grpcAddr, f.grpcToken)
+		if err != nil {
+			return nil, fmt.Errorf("unable to serve gRPC: %v", err)
+		}
+		if err := add(grpcNotifier, "grpc"); err != nil {
+			return nil, err
+		}
+	}
+	return notifiers, nil
+}
+
+// Notifiers, rules and filters of the config file on top of the notifiers of the flags
+type notificationSettings struct {
+	flagNotifiers []notify.Notifier // kept on config reload
+	notifiers     []notify.Notifier // flagNotifiers followed by the ones of the config
+	rules         *notify.NotificationRules
+	filter        *processor.EventFilter
+	pipeline      *processor.Pipeline
+	plugins       []*notify.Plugin
+}
+
+// Settings of config on top of flagNotifiers. config may be nil
+func newNotificationSettings(config *Config, flagNotifiers []notify.Notifier) (*notificationSettings, error) {
+	s := &notificationSettings{flagNotifiers: flagNotifiers, notifiers: flagNotifiers}
+	if config == nil {
+		return s, nil
+	}
+	var err error
+	if s.notifiers, s.rules, s.filter, err = config.CreateNotificationSettings(flagNotifiers); err != nil {
+		return nil, err
+	}
+	if s.pipeline, err = config.CreatePipeline(); err != nil {
+		return nil, fmt.Errorf("pipeline: %v", err)
+	}
+	if s.pipeline != nil {
+		if err := s.pipeline.CheckNotifiers(s.notifiers); err != nil {
+			return nil, fmt.Errorf("pipeline: %v", err)
+		}
+	}
+	if s.plugins, err = config.CreatePlugins(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Flags of the face recognition server, taken by serve, replay and faces
+type faceFlags struct {
+	url        string
+	confidence float64
+}
+
+func (f *faceFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.url, "face-url", "", "self-hosted DeepStack or CodeProject.AI server on a local address to recognize faces of person clips against its gallery e.g. http://localhost:5000. empty disables face recognition")
+	fs.Float64Var(&f.confidence, "face-min-confidence", 0.6, "faces matched less confident than this are unknown")
+}
+
+// Recognizer of -face-url, nil without it
+func (f *faceFlags) recognizer() (*processor.HttpFaceRecognizer, error) {
+	if len(f.url) == 0 {
+		return nil, nil
+	}
+	recognizer, err := processor.NewHttpFaceRecognizer(f.url, f.confidence, http.DefaultClient)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -face-url: %v", err)
+	}
+	return recognizer, nil
+}
+
+// Flags of exporting traces, taken by serve and replay
+type tracingFlags struct {
+	endpoint    string
+	headers     string
+	serviceName string
+}
+
+func (f *tracingFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.endpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector to export traces of the pipeline (receipt, parse, download, store, notify) to e.g. http://localhost:4318 (OpenTelemetry Collector, Jaeger, Tempo). empty disables tracing")
+	fs.StringVar(&f.headers, "otlp-headers", os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), "headers key1=value1,key2=value2 of requests to -otlp-endpoint e.g. authorization of hosted collectors")
+	fs.StringVar(&f.serviceName, "otlp-service-name", "nest-doorbell-consumer", "service.name of exported traces")
+}
+
+// Start exporting traces of -otlp-endpoint. Returns the function flushing them before exit
+func (f *tracingFlags) setup() (func(), error) {
+	if len(f.endpoint) == 0 {
+		return func() {}, nil
+	}
+	headers, err := tracing.ParseHeaders(f.headers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -otlp-headers: %v", err)
+	}
+	exporter := tracing.NewExporter(f.endpoint, f.serviceName, headers)
+	tracing.SetExporter(exporter)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		exporter.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/cormoran/NestDoorbellConsumer/datasource"
+	"github.com/cormoran/NestDoorbellConsumer/processor"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// datasource.LiveStreams of the WebRTC devices of every project, for the live view of the embedded datasource
+type projectLiveStreams struct {
+	projects []*Project // set once the projects are opened, before the datasource is served
+}
+
+func (l *projectLiveStreams) LiveDevices() []datasource.LiveDevice {
+	devices := []datasource.LiveDevice{}
+	for _, project := range l.projects {
+		for _, device := range project.consumer.Devices().Devices() {
+			var liveStream sdmevents.DeviceTraitCameraLiveStreamValue
+			if ok, _ := sdmevents.DecodeDeviceTrait(device, sdmevents.DeviceTraitCameraLiveStream, &liveStream); ok && slices.Contains(liveStream.SupportedProtocols, "WEB_RTC") {
+				devices = append(devices, datasource.LiveDevice{Name: device.Name, DisplayName: sdmevents.DeviceDisplayName(device)})
+			}
+		}
+	}
+	return devices
+}
+
+func (l *projectLiveStreams) project(device string) (*Project, error) {
+	for _, project := range l.projects {
+		if project.consumer.Devices().Device(device) != nil {
+			return project, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown device %v", device)
+}
+
+func (l *projectLiveStreams) GenerateWebRtcStream(device string, offerSdp string) (*sdmevents.GenerateWebRtcStreamResponse, error) {
+	project, err := l.project(device)
+	if err != nil {
+		return nil, err
+	}
+	var stream sdmevents.GenerateWebRtcStreamResponse
+	if err := processor.ExecuteDeviceCommand(context.Background(), project.consumer.Service(), device, "sdm.devices.commands.CameraLiveStream.GenerateWebRtcStream", sdmevents.GenerateWebRtcStreamRequestParam{OfferSdp: offerSdp}, &stream); err != nil {
+		return nil, err
+	}
+	return &stream, nil
+}
+
+func (l *projectLiveStreams) ExtendWebRtcStream(device string, mediaSessionId string) (*sdmevents.ExtendWebRtcStreamResponse, error) {
+	project, err := l.project(device)
+	if err != nil {
+		return nil, err
+	}
+	var stream sdmevents.ExtendWebRtcStreamResponse
+	if err := processor.ExecuteDeviceCommand(context.Background(), project.consumer.Service(), device, "sdm.devices.commands.CameraLiveStream.ExtendWebRtcStream", sdmevents.ExtendWebRtcStreamRequestParam{MediaSessionId: mediaSessionId}, &stream); err != nil {
+		return nil, err
+	}
+	return &stream, nil
+}
+
+func (l *projectLiveStreams) StopWebRtcStream(device string, mediaSessionId string) error {
+	project, err := l.project(device)
+	if err != nil {
+		return err
+	}
+	return processor.ExecuteDeviceCommand(context.Background(), project.consumer.Service(), device, "sdm.devices.commands.CameraLiveStream.StopWebRtcStream", sdmevents.StopWebRtcStreamRequestParam{MediaSessionId: mediaSessionId}, nil)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	_ "time/tzdata" // containers may have no zoneinfo
+)
+
+// Flag which can be given multiple times
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Whether path is dir or under it
+func isInsideDir(path string, dir string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+const commandsUsage = `Usage: consumer [command] [flags]
+
+Commands:
+  serve          consume events of the projects (default)
+  replay         re-process events recorded by -event-log
+  snapshot       record the live stream of -device now
+  devices list   print devices of the projects
+  auth login     run the OAuth flow and save the token to -token-path
+  doctor         check credentials, the subscription and the output directory
+  test notify    send a synthetic notification to the sinks
+  test capture   start and stop a live stream of -device
+  faces list     print names in the gallery of -face-url
+  faces register add images (arguments after the flags) of -face-name to the gallery
+  faces delete   remove -face-name from the gallery
+`
+
+// Run function of each command, which parses the flags of the command from args
+var commands = map[string]func(args []string){
+	"serve":          serveCommand,
+	"replay":         replayCommand,
+	"snapshot":       snapshotCommand,
+	"devices list":   devicesListCommand,
+	"auth login":     authLoginCommand,
+	"doctor":         doctorCommand,
+	"test notify":    testNotifyCommand,
+	"test capture":   testCaptureCommand,
+	"faces list":     func(args []string) { facesCommand("faces list", args) },
+	"faces register": func(args []string) { facesCommand("faces register", args) },
+	"faces delete":   func(args []string) { facesCommand("faces delete", args) },
+}
+
+// FlagSet of command, whose usage lists the commands and the flags of command
+func newFlagSet(command string) *flag.FlagSet {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%v\nFlags of %v:\n", commandsUsage, command)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func main() {
+	// no subcommand means serve
+	args := os.Args[1:]
+	command := "serve"
+	if len(args) >= 1 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+		if (command == "test" || command == "devices" || command == "auth" || command == "faces") && len(args) >= 1 {
+			command += " " + args[0]
+			args = args[1:]
+		}
+	}
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %v\n%v", command, commandsUsage)
+		os.Exit(2)
+	}
+	run(args)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	nestconsumer "github.com/cormoran/NestDoorbellConsumer"
+	"github.com/cormoran/NestDoorbellConsumer/auth"
+	"google.golang.org/api/option"
+	"google.golang.org/api/smartdevicemanagement/v1"
+)
+
+// Device Access project (account) consumed by this process. Given by -nest-project-id and related flags,
+// or by "projects" in the config file to consume multiple projects at once.
+type ProjectConfig struct {
+	Name                 string `json:"name"` // used in logs
+	NestProjectId        string `json:"nestProjectId"`
+	SmartDeviceCredPath  string `json:"smartDeviceCredPath"`
+	TokenPath            string `json:"tokenPath"`
+	PubsubProjectId      string `json:"pubsubProjectId"`
+	PubsubCredPath       string `json:"pubsubCredPath"`
+	PubsubSubscriptionId string `json:"pubsubSubscriptionId"`
+	OutputPrefix         string `json:"outputPrefix"` // sub directory of -output-dir to save clips. empty means -output-dir itself
+	ClipBaseUrl          string `json:"clipBaseUrl"`  // defaults to -clip-base-url + outputPrefix
+	PubsubTopic          string `json:"pubsubTopic"`  // topic to bind the subscription created by -pubsub-create-subscription. defaults to the SDM topic of nestProjectId
+	PullMode             bool   `json:"pullMode"`     // receive by polling unary Pull RPCs. -pull-mode enables it for every project
+}
+
+// Pub/Sub settings shared by projects
+type pubsubOptions struct {
+	receiveSettings    pubsub.ReceiveSettings
+	createSubscription *nestconsumer.SubscriptionSettings // nil doesn't create missing subscriptions. Topic is taken from ProjectConfig
+	staleTimeout       time.Duration                      // reconnect silent streams. 0 disables it
+	maxIdle            time.Duration
+	pullMode           bool
+	pull               *nestconsumer.PullSource // settings of pull mode. Client and Subscription are set per project
+}
+
+type Project struct {
+	config   ProjectConfig
+	consumer *nestconsumer.Consumer
+}
+
+// Authenticate to SDM and Pub/Sub, and load devices of the project. Events are received from source instead of
+// Pub/Sub unless it's nil.
+func openProject(config ProjectConfig, pubsubOpts pubsubOptions, source nestconsumer.MessageSource, opts ...nestconsumer.Option) (*Project, error) {
+	client, err := auth.NewClient(config.SmartDeviceCredPath, config.TokenPath)
+	if err != nil {
+		return nil, err
+	}
+	if source == nil {
+		pubsubClient, err := pubsub.NewClient(context.Background(), config.PubsubProjectId, option.WithCredentialsFile(config.PubsubCredPath))
+		if err != nil {
+			return nil, err
+		}
+		subscription := pubsubClient.Subscription(config.PubsubSubscriptionId)
+		if pubsubOpts.createSubscription != nil {
+			settings := *pubsubOpts.createSubscription
+			settings.Topic = config.PubsubTopic
+			if len(settings.Topic) == 0 {
+				settings.Topic = nestconsumer.SdmTopic(config.NestProjectId)
+			}
+			if subscription, err = nestconsumer.EnsureSubscription(context.Background(), pubsubClient, config.PubsubSubscriptionId, settings); err != nil {
+				return nil, err
+			}
+		}
+		if pubsubOpts.pullMode || config.PullMode {
+			subscriberClient, err := nestconsumer.NewPullClient(context.Background(), option.WithCredentialsFile(config.PubsubCredPath))
+			if err != nil {
+				return nil, err
+			}
+			source = &nestconsumer.PullSource{
+				Client:       subscriberClient,
+				Subscription: subscription.String(),
+				MaxMessages:  pubsubOpts.pull.MaxMessages,
+				Interval:     pubsubOpts.pull.Interval,
+				Timeout:      pubsubOpts.pull.Timeout,
+			}
+		} else {
+			subscription.ReceiveSettings = pubsubOpts.receiveSettings
+			source = &nestconsumer.PubsubSource{
+				Subscription: subscription,
+				NewClient: func(ctx context.Context) (*pubsub.Client, error) {
+					return pubsub.NewClient(ctx, config.PubsubProjectId, option.WithCredentialsFile(config.PubsubCredPath))
+				},
+				StaleTimeout: pubsubOpts.staleTimeout,
+				MaxIdle:      pubsubOpts.maxIdle,
+			}
+		}
+	}
+	opts = append([]nestconsumer.Option{
+		nestconsumer.WithName(config.Name),
+		nestconsumer.WithSmartDeviceManagement(config.NestProjectId, client),
+		nestconsumer.WithMessageSource(source),
+	}, opts...)
+	consumer, err := nestconsumer.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := consumer.LoadDevices(); err != nil {
+		return nil, err
+	}
+	return &Project{config: config, consumer: consumer}, nil
+}
+
+// Find device by full name from every project, nil if none
+func findProjectDevice(projects []*Project, deviceName string) *smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device {
+	for _, project := range projects {
+		if device := project.consumer.Devices().Device(deviceName); device != nil {
+			return device
+		}
+	}
+	return nil
+}
+
+// Source of commands which use the SDM API of a project but don't consume its events, e.g. snapshot
+type noMessageSource struct{}
+
+func (noMessageSource) Receive(ctx context.Context, handle func(ctx context.Context, data []byte)) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// `auth login`: run the OAuth flow of every project and save the tokens
+func authLoginCommand(args []string) {
+	fs := newFlagSet("auth login")
+	var httpFlags httpFlags
+	httpFlags.register(fs)
+	var projectFlags projectFlags
+	projectFlags.register(fs)
+	fs.Parse(args)
+	httpFlags.setup()
+	config, err := projectFlags.loadConfig()
+	if err != nil {
+		log.Fatalf("Unable to load config: %v", err)
+	}
+	for _, projectConfig := range projectFlags.projectConfigs(config) {
+		if err := auth.Login(projectConfig.SmartDeviceCredPath, projectConfig.TokenPath); err != nil {
+			log.Fatalf("[%v] %v", projectConfig.Name, err)
+		}
+	}
+}
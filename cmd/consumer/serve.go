@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	nestconsumer "github.com/cormoran/NestDoorbellConsumer"
+	"github.com/cormoran/NestDoorbellConsumer/datasource"
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/processor"
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+// Flags of processing events, taken by serve and replay
+type pipelineFlags struct {
+	http      httpFlags
+	project   projectFlags
+	output    outputFlags
+	notifiers notifierFlags
+	face      faceFlags
+	tracing   tracingFlags
+
+	stateDir             string
+	eventLogPath         string
+	lateArrivalThreshold time.Duration
+	readTimeout          time.Duration
+	maxDownloadSize      int64
+	downloadAttempts     int
+	deferredEvents       stringListFlag
+	downloadWindows      stringListFlag
+	analyzerUrl          string
+	analyzerApi          string
+	analyzerConfidence   float64
+	audioAnalysis        bool
+	clipBaseUrl          string
+	sdmQuotas            string
+	sdmQueueTimeout      time.Duration
+	dryRun               bool
+}
+
+func (f *pipelineFlags) register(fs *flag.FlagSet) {
+	f.http.register(fs)
+	f.project.register(fs)
+	f.output.register(fs)
+	f.notifiers.register(fs)
+	f.face.register(fs)
+	f.tracing.register(fs)
+	fs.StringVar(&f.stateDir, "state-dir", "state", "directory of the journals of pending and deferred downloads. Projects with outputPrefix keep them in <dir>/<outputPrefix>. Must be outside -output-dir, which the datasource serves")
+	fs.StringVar(&f.eventLogPath, "event-log", "", "file path to append every received raw event as JSONL e.g. events.jsonl. Projects with outputPrefix log into <dir>/<outputPrefix>/<file name>. Must be outside -output-dir, which the datasource serves. Read by replay. empty disables it")
+	fs.DurationVar(&f.lateArrivalThreshold, "late-arrival-threshold", 10*time.Minute, "events received later than this after their timestamp are marked as lateArrival in the metadata sidecar. 0 disables marking")
+	fs.DurationVar(&f.readTimeout, "download-read-timeout", 30*time.Second, "abort a clip download receiving no data for this long. 0 disables it")
+	fs.Int64Var(&f.maxDownloadSize, "max-download-size", 100<<20, "abort a clip download larger than this in bytes. 0 means no limit")
+	fs.IntVar(&f.downloadAttempts, "download-attempts", 3, "number of attempts to download a clip preview when the download fails or is truncated")
+	fs.Var(&f.deferredEvents, "defer-download", "event type (chime, motion, person or sound) whose clip download is deferred to -download-window. Can be given multiple times")
+	fs.Var(&f.downloadWindows, "download-window", "daily time window HH:MM-HH:MM (e.g. off-peak 01:00-06:00) to download deferred clips. Can be given multiple times")
+	fs.StringVar(&f.analyzerUrl, "analyzer-url", "", "object detection API to label saved clips with e.g. http://deepstack:5000/v1/vision/detection (DeepStack, CodeProject.AI). Labels go to the metadata sidecar and notifications. Videos need ffmpeg. empty disables it")
+	fs.StringVar(&f.analyzerApi, "analyzer-api", string(processor.AnalyzerApiDeepStack), "request format of -analyzer-url. 'deepstack' posts a multipart form with the frame as image, 'raw' posts the JPEG frame as body")
+	fs.Float64Var(&f.analyzerConfidence, "analyzer-min-confidence", 0.5, "drop detections of -analyzer-url less confident than this")
+	fs.BoolVar(&f.audioAnalysis, "audio-analysis", false, "tag sounds heard in saved video clips (knock, bark) by simple heuristics into the metadata sidecar and notifications. Needs ffmpeg")
+	fs.StringVar(&f.clipBaseUrl, "clip-base-url", "", "base URL of saved clips used in notifications e.g. http://<grafana-datasource host>:8080/file/")
+	fs.StringVar(&f.sdmQuotas, "sdm-quotas", "", "client side quotas of SDM commands per project, e.g. GenerateImage=10/m,GenerateImage=500/d,*=10/m. <command>=<count>/m or /d limits the command (full name or its last part, * for all the others together) per minute, or per calendar day reset at midnight Pacific Time. Commands over the quota wait up to -sdm-queue-timeout. Usage is served on /metrics of -http-addr. Live stream Extend and Stop commands are never limited. empty disables it")
+	fs.DurationVar(&f.sdmQueueTimeout, "sdm-queue-timeout", 30*time.Second, "longest time an SDM command waits for -sdm-quotas before failing")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "log received events and what would be done for them (downloads, output paths, notification payloads) without writing files or sending notifications")
+}
+
+// What serve and replay build from pipelineFlags before opening the projects
+type consumerSetup struct {
+	flags          *pipelineFlags
+	bandwidth      *processor.BandwidthLimiter
+	flushTraces    func()
+	location       *time.Location
+	config         *Config // nil without -config
+	settings       *notificationSettings
+	projectConfigs []ProjectConfig
+	history        *nestconsumer.EventHistory
+	deviceStates   *processor.DeviceStateTracker
+	commandQuotas  map[string]processor.CommandQuota
+	analyzer       processor.Analyzer
+	faceRecognizer *processor.HttpFaceRecognizer
+	deferPolicy    *processor.DeferredDownloadPolicy
+}
+
+// Validate the flags and create what they configure. Exits on invalid ones
+func (f *pipelineFlags) setup() *consumerSetup {
+	s := &consumerSetup{flags: f, history: nestconsumer.NewEventHistory(100), deviceStates: processor.NewDeviceStateTracker()}
+	s.bandwidth = f.http.setup()
+	var err error
+	if s.flushTraces, err = f.tracing.setup(); err != nil {
+		log.Fatal(err)
+	}
+	if s.location, err = f.output.location(); err != nil {
+		log.Fatal(err)
+	}
+	if len(f.eventLogPath) > 0 && isInsideDir(f.eventLogPath, f.output.outputDir) {
+		log.Fatal("-event-log must be outside -output-dir, raw events would be served by the datasource")
+	}
+	if isInsideDir(f.stateDir, f.output.outputDir) {
+		log.Fatal("-state-dir must be outside -output-dir, download journals would be served by the datasource")
+	}
+	if s.commandQuotas, err = processor.ParseCommandQuotas(f.sdmQuotas); err != nil {
+		log.Fatalf("Invalid -sdm-quotas: %v", err)
+	}
+	if len(f.analyzerUrl) > 0 {
+		if s.analyzer, err = processor.NewHttpAnalyzer(f.analyzerUrl, processor.AnalyzerApi(f.analyzerApi), f.analyzerConfidence, http.DefaultClient); err != nil {
+			log.Fatalf("Invalid -analyzer-api: %v", err)
+		}
+	}
+	if s.faceRecognizer, err = f.face.recognizer(); err != nil {
+		log.Fatal(err)
+	}
+	if s.deferPolicy, err = processor.NewDeferredDownloadPolicy(f.deferredEvents, f.downloadWindows); err != nil {
+		log.Fatalf("Invalid deferred download setting: %v", err)
+	}
+	flagNotifiers, err := f.notifiers.create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s.config, err = f.project.loadConfig(); err != nil {
+		log.Fatalf("Unable to load config: %v", err)
+	}
+	if s.settings, err = newNotificationSettings(s.config, flagNotifiers); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	s.projectConfigs = f.project.projectConfigs(s.config)
+	return s
+}
+
+// -event-log of the project, in the sub directory of its outputPrefix
+func (f *pipelineFlags) projectEventLogPath(projectConfig ProjectConfig) string {
+	return filepath.Join(filepath.Dir(f.eventLogPath), projectConfig.OutputPrefix, filepath.Base(f.eventLogPath))
+}
+
+// Options of the project common to serve and replay. Notifiers are added if withNotifiers
+func (s *consumerSetup) projectOptions(projectConfig ProjectConfig, withNotifiers bool) []nestconsumer.Option {
+	f := s.flags
+	projectClipBaseUrl := projectConfig.ClipBaseUrl
+	if len(projectClipBaseUrl) == 0 && len(f.clipBaseUrl) > 0 {
+		projectClipBaseUrl = f.clipBaseUrl
+		if len(projectConfig.OutputPrefix) > 0 {
+			projectClipBaseUrl += filepath.ToSlash(projectConfig.OutputPrefix) + "/"
+		}
+	}
+	opts := append(f.output.options(projectConfig, s.location),
+		nestconsumer.WithStateDir(filepath.Join(f.stateDir, projectConfig.OutputPrefix)),
+		nestconsumer.WithDownloadAttempts(f.downloadAttempts),
+		nestconsumer.WithDownloadLimits(f.readTimeout, f.maxDownloadSize),
+		nestconsumer.WithLateArrivalThreshold(f.lateArrivalThreshold),
+		nestconsumer.WithClipBaseUrl(projectClipBaseUrl),
+		nestconsumer.WithDeferredDownloadPolicy(s.deferPolicy),
+		nestconsumer.WithNotificationRules(s.settings.rules),
+		nestconsumer.WithEventFilter(s.settings.filter),
+		nestconsumer.WithPipeline(s.settings.pipeline),
+		nestconsumer.WithDeviceStateTracker(s.deviceStates),
+		nestconsumer.WithEventHistory(s.history),
+	)
+	if len(s.commandQuotas) > 0 {
+		opts = append(opts, nestconsumer.WithCommandQuotas(s.commandQuotas, f.sdmQueueTimeout))
+	}
+	if s.analyzer != nil {
+		opts = append(opts, nestconsumer.WithAnalyzer(s.analyzer))
+	}
+	if s.faceRecognizer != nil {
+		opts = append(opts, nestconsumer.WithFaceRecognizer(s.faceRecognizer))
+	}
+	if f.audioAnalysis {
+		opts = append(opts, nestconsumer.WithAudioTagger(processor.HeuristicAudioTagger{}))
+	}
+	if f.dryRun {
+		opts = append(opts, nestconsumer.WithDryRun())
+	}
+	for _, plugin := range s.settings.plugins {
+		opts = append(opts, nestconsumer.WithPlugin(plugin))
+	}
+	if withNotifiers {
+		for _, notifier := range s.settings.notifiers {
+			opts = append(opts, nestconsumer.WithNotifier(notifier))
+		}
+	}
+	return opts
+}
+
+// `serve`: consume events of the projects until killed
+func serveCommand(args []string) {
+	fs := newFlagSet("serve")
+	var flags pipelineFlags
+	flags.register(fs)
+	var pubsubs pubsubFlags
+	pubsubs.register(fs)
+	var (
+		eventsFile        = fs.String("events-file", "", "process recorded event JSON messages (one per line, or concatenated) of the file instead of Pub/Sub, then exit. - reads stdin. Only the first project is consumed")
+		summaryPeriod     = fs.String("summary", "", "notify a \"summary\" of the saved clips (event counts, busiest hours, storage, notable events) 'daily' for the previous day or 'weekly' on Mondays for the previous week. empty disables it")
+		summaryAt         = fs.String("summary-at", "08:00", "time of the day HH:MM in -timezone to send -summary")
+		latencyBudget     = fs.Duration("latency-budget", 0, "notify \"latency\" when an event is notified later than this after it happened (including the clip download) e.g. 30s, at most once per 15 minutes. 0 disables alerts. Latencies are served on /metrics of -http-addr either way")
+		pollInterval      = fs.Duration("poll-interval", 0, "interval to poll device state from SDM in addition to events e.g. 10m. 0 disables polling")
+		offlineThreshold  = fs.Duration("offline-alert-threshold", 30*time.Minute, "notify \"offline\" event when a device has been offline longer than this. Checked by -poll-interval. 0 disables alerts")
+		clipWait          = fs.String("clip-wait", "", "how notifications of battery doorbells get the clip arriving up to a minute after the event. 'defer' notifies once the clip is saved (or after -clip-wait-timeout without it), 'edit' notifies at once and edits the discord and telegram messages to add the clip, 'snapshot' does the same with the image of the event generated by SDM in the first notification, also for cameras sending the clip with the event. empty notifies at once without the clip")
+		clipWaitTimeout   = fs.Duration("clip-wait-timeout", processor.DefaultClipWaitTimeout, "longest time -clip-wait=defer holds a notification")
+		deviceRefresh     = fs.Duration("device-refresh-interval", time.Hour, "interval to reload devices, structures and rooms from SDM for /devices of -datasource-addr and device names, in addition to relation update events. 0 disables it")
+		httpAddr          = fs.String("http-addr", "", "address to serve device status (/devices) and metrics (/metrics) e.g. :9100. empty disables it")
+		adminAddr         = fs.String("admin-addr", "", "address to serve the admin API (devices, recent events, pause/resume, config reload) e.g. localhost:9101. empty disables it")
+		adminToken        = fs.String("admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token required by the admin API")
+		adminCommands     = fs.String("admin-commands", "sdm.devices.commands.CameraEventImage.GenerateImage,sdm.devices.commands.CameraLiveStream.*", "comma separated SDM commands which POST /devices/{id}/commands of the admin API may execute. trait.* allows every command of the trait. empty disables it")
+		datasourceAddr    = fs.String("datasource-addr", "", "address to serve the grafana-datasource API of -output-dir from this process e.g. :8080, instead of running grafana-datasource. empty disables it")
+		datasourceToken   = fs.String("datasource-token", os.Getenv("DATASOURCE_TOKEN"), "bearer token required by -datasource-addr. empty accepts every request")
+		datasourceIndexDb = fs.String("datasource-index-db", "", "bbolt file to persist the clip index of -datasource-addr, so that restarts answer from it at once instead of walking -output-dir. Keep it outside -output-dir. empty keeps the index only in memory")
+		datasourceUrl     = fs.String("datasource-url", "", "URL of grafana-datasource serving -output-dir e.g. http://localhost:8080. When given, its layout is checked against this consumer at startup")
+	)
+	fs.Parse(args)
+
+	if *summaryPeriod != "" && *summaryPeriod != string(processor.SummaryPeriodDaily) && *summaryPeriod != string(processor.SummaryPeriodWeekly) {
+		log.Fatalf("Invalid -summary: %v", *summaryPeriod)
+	}
+	summaryTime, err := time.Parse("15:04", *summaryAt)
+	if err != nil {
+		log.Fatalf("Invalid -summary-at: %v", err)
+	}
+	if len(*adminAddr) > 0 && len(*adminToken) == 0 {
+		log.Fatal("-admin-addr requires -admin-token (or ADMIN_TOKEN)")
+	}
+	setup := flags.setup()
+	outputDir := flags.output.outputDir
+	var embedded *embeddedDatasource
+	live := &projectLiveStreams{}
+	devices := &projectDevices{states: setup.deviceStates}
+	if len(*datasourceAddr) > 0 && len(*eventsFile) == 0 {
+		options := datasource.DefaultOptions()
+		options.ReadOnly = true
+		options.Location = setup.location
+		options.Token = *datasourceToken
+		options.Live = live
+		options.Devices = devices
+		if embedded, err = newEmbeddedDatasource(outputDir, *datasourceIndexDb, options); err != nil {
+			log.Fatalf("Unable to serve datasource: %v", err)
+		}
+	}
+	if len(*datasourceUrl) > 0 {
+		meta, err := storage.FetchDatasourceMeta(*datasourceUrl)
+		if err != nil {
+			log.Fatalf("Unable to get datasource meta: %v", err)
+		}
+		if err := storage.CheckDatasourceCompatibility(meta, flags.output.outputFileNameFormat, setup.location); err != nil {
+			log.Fatalf("Datasource is not compatible with this consumer: %v", err)
+		}
+	}
+	pubsubOpts := pubsubs.options()
+	projects := []*Project{}
+	for _, projectConfig := range setup.projectConfigs {
+		opts := setup.projectOptions(projectConfig, true)
+		opts = append(opts, nestconsumer.WithPolling(*pollInterval, *offlineThreshold), nestconsumer.WithDeviceRefresh(*deviceRefresh), nestconsumer.WithClipWait(processor.ClipWait(*clipWait), *clipWaitTimeout))
+		if embedded != nil {
+			opts = append(opts, nestconsumer.WithClipSavedHook(embedded.ClipSaved))
+		}
+		if len(*eventsFile) == 0 {
+			// recorded events are always late
+			opts = append(opts, nestconsumer.WithLatencyBudget(*latencyBudget))
+		}
+		if len(*summaryPeriod) > 0 {
+			at := time.Duration(summaryTime.Hour())*time.Hour + time.Duration(summaryTime.Minute())*time.Minute
+			opts = append(opts, nestconsumer.WithSummaryReport(processor.SummaryPeriod(*summaryPeriod), at))
+		}
+		if len(flags.eventLogPath) > 0 {
+			projectEventLogPath := flags.projectEventLogPath(projectConfig)
+			if err := os.MkdirAll(filepath.Dir(projectEventLogPath), 0777); err != nil {
+				log.Fatalf("[%v] %v", projectConfig.Name, err)
+			}
+			opts = append(opts, nestconsumer.WithEventLog(nestconsumer.NewEventLog(projectEventLogPath)))
+		}
+		var source nestconsumer.MessageSource
+		if len(*eventsFile) > 0 {
+			fileSource, err := nestconsumer.OpenFileSource(*eventsFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer fileSource.Close()
+			source = fileSource
+		}
+		project, err := openProject(projectConfig, pubsubOpts, source, opts...)
+		if err != nil {
+			log.Fatalf("[%v] %v", projectConfig.Name, err)
+		}
+		projects = append(projects, project)
+		if len(*eventsFile) > 0 {
+			break
+		}
+	}
+	if embedded != nil {
+		live.projects = projects
+		devices.projects = projects
+		// clips saved by other processes and removed ones
+		go embedded.index.Watch(context.Background(), time.Minute, time.Hour)
+		go embedded.Serve(*datasourceAddr)
+	}
+	if len(*httpAddr) > 0 {
+		go serveStatus(*httpAddr, projects, setup.deviceStates)
+	}
+	if len(*adminAddr) > 0 {
+		settings := setup.settings
+		configPath := flags.project.configPath
+		// notifiers of the config replaced by the next reload
+		var reloadMu sync.Mutex
+		configNotifiers := settings.notifiers[len(settings.flagNotifiers):]
+		admin := adminServer{
+			token:     *adminToken,
+			projects:  projects,
+			history:   setup.history,
+			bandwidth: setup.bandwidth,
+			commands:  strings.FieldsFunc(*adminCommands, func(r rune) bool { return r == ',' || r == ' ' }),
+			reload: func() error {
+				reloadMu.Lock()
+				defer reloadMu.Unlock()
+				if len(configPath) == 0 {
+					return fmt.Errorf("no -config to reload")
+				}
+				config, err := loadConfig(configPath)
+				if err != nil {
+					return err
+				}
+				notifiers, rules, filter, err := config.CreateNotificationSettings(settings.flagNotifiers)
+				if err != nil {
+					return err
+				}
+				// projects and the pipeline are not reloaded, but notifiers of the pipeline should still exist
+				if settings.pipeline != nil {
+					if err := settings.pipeline.CheckNotifiers(notifiers); err != nil {
+						return fmt.Errorf("pipeline: %v", err)
+					}
+				}
+				for _, project := range projects {
+					project.consumer.Reconfigure(notifiers, rules, filter)
+				}
+				// flag notifiers are kept, and their circuit breakers with them
+				notify.CloseNotifiers(configNotifiers)
+				configNotifiers = notifiers[len(settings.flagNotifiers):]
+				return nil
+			},
+		}
+		go admin.Serve(*adminAddr)
+	}
+	if len(*eventsFile) > 0 {
+		if err := projects[0].consumer.Run(context.Background()); err != nil {
+			log.Fatalf("[%v] %v", projects[0].config.Name, err)
+		}
+		setup.flushTraces()
+		return
+	}
+	for _, project := range projects {
+		go func(project *Project) {
+			if err := project.consumer.Run(context.Background()); err != nil {
+				log.Fatalf("[%v] %v", project.config.Name, err)
+			}
+		}(project)
+	}
+	go runSystemdNotify(projects)
+	for {
+		time.Sleep(time.Second)
+	}
+}
+
+// `replay`: process the events of -event-log again, saving clips missing in -output-dir
+func replayCommand(args []string) {
+	fs := newFlagSet("replay")
+	var flags pipelineFlags
+	flags.register(fs)
+	var (
+		replaySince  = fs.String("since", "", "replay events at or after the RFC3339 time. empty means from the beginning")
+		replayUntil  = fs.String("until", "", "replay events before the RFC3339 time. empty means to the end")
+		replayNotify = fs.Bool("notify", false, "send notifications of the replayed events. By default they are only saved")
+	)
+	fs.Parse(args)
+
+	if len(flags.eventLogPath) == 0 {
+		log.Fatal("replay reads events from -event-log")
+	}
+	var since, until time.Time
+	var err error
+	if len(*replaySince) > 0 {
+		if since, err = time.Parse(time.RFC3339, *replaySince); err != nil {
+			log.Fatalf("Invalid -since: %v", err)
+		}
+	}
+	if len(*replayUntil) > 0 {
+		if until, err = time.Parse(time.RFC3339, *replayUntil); err != nil {
+			log.Fatalf("Invalid -until: %v", err)
+		}
+	}
+	setup := flags.setup()
+	projects := []*Project{}
+	for _, projectConfig := range setup.projectConfigs {
+		opts := setup.projectOptions(projectConfig, *replayNotify)
+		fileSource, err := nestconsumer.OpenFileSource(flags.projectEventLogPath(projectConfig))
+		if err != nil {
+			log.Fatalf("[%v] %v", projectConfig.Name, err)
+		}
+		defer fileSource.Close()
+		source := &nestconsumer.TimeRangeSource{Source: fileSource, Since: since, Until: until}
+		opts = append(opts, nestconsumer.WithSkipSavedClips())
+		project, err := openProject(projectConfig, pubsubOptions{}, source, opts...)
+		if err != nil {
+			log.Fatalf("[%v] %v", projectConfig.Name, err)
+		}
+		projects = append(projects, project)
+	}
+	for _, project := range projects {
+		log.Printf("[%v] Replaying events of %v", project.config.Name, flags.eventLogPath)
+		if err := project.consumer.Run(context.Background()); err != nil {
+			log.Fatalf("[%v] %v", project.config.Name, err)
+		}
+	}
+	setup.flushTraces()
+}
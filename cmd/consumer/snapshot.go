@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+const defaultSnapshotDuration = 10 * time.Second
+
+// Record the live stream of the device given by id, full name or custom name with the project having it.
+// Returns the saved file.
+func snapshot(ctx context.Context, projects []*Project, deviceQuery string, duration time.Duration) (string, error) {
+	if len(deviceQuery) == 0 {
+		return "", fmt.Errorf("device is required")
+	}
+	for _, project := range projects {
+		if _, err := sdmevents.FindDevice(project.consumer.Devices().Devices(), deviceQuery); err == nil {
+			return project.consumer.Snapshot(ctx, deviceQuery, duration)
+		}
+	}
+	return "", fmt.Errorf("device not found in any project: %v", deviceQuery)
+}
+
+// `snapshot`: record the live stream of -device into -output-dir and print the saved file
+func snapshotCommand(args []string) {
+	fs := newFlagSet("snapshot")
+	var httpFlags httpFlags
+	httpFlags.register(fs)
+	var projectFlags projectFlags
+	projectFlags.register(fs)
+	var outputFlags outputFlags
+	outputFlags.register(fs)
+	var (
+		device   = fs.String("device", "", "device id or custom name")
+		duration = fs.Duration("snapshot-duration", defaultSnapshotDuration, "length of the live stream to record. At most 5m")
+	)
+	fs.Parse(args)
+	httpFlags.setup()
+	location, err := outputFlags.location()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config, err := projectFlags.loadConfig()
+	if err != nil {
+		log.Fatalf("Unable to load config: %v", err)
+	}
+	projects := []*Project{}
+	for _, projectConfig := range projectFlags.projectConfigs(config) {
+		project, err := openProject(projectConfig, pubsubOptions{}, noMessageSource{}, outputFlags.options(projectConfig, location)...)
+		if err != nil {
+			log.Fatalf("[%v] %v", projectConfig.Name, err)
+		}
+		projects = append(projects, project)
+	}
+	path, err := snapshot(context.Background(), projects, *device, *duration)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(path)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	nestconsumer "github.com/cormoran/NestDoorbellConsumer"
+	"github.com/cormoran/NestDoorbellConsumer/datasource"
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/processor"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Serve device status of the consumer
+//   - /devices: last known trait state of devices in JSON
+//   - /metrics: the same in prometheus text format, reconnects of Pub/Sub streams, latencies of events, usage of
+//     SDM command quotas and circuit breakers of notifiers
+func serveStatus(addr string, projects []*Project, states *processor.DeviceStateTracker) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(states.States())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeDeviceMetrics(w, projects, states)
+		writeSourceMetrics(w, projects)
+		writeLatencyMetrics(w, projects)
+		writeCommandMetrics(w, projects)
+		writeNotifierMetrics(w, projects)
+	})
+	log.Printf("Serving status on %v", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Status server stopped: %v", err)
+	}
+}
+
+func writeDeviceMetrics(w http.ResponseWriter, projects []*Project, states *processor.DeviceStateTracker) {
+	all := states.States()
+	labels := func(state *processor.DeviceState) string {
+		name := sdmevents.DeviceId(state.Device)
+		if device := findProjectDevice(projects, state.Device); device != nil {
+			name = sdmevents.DeviceDisplayName(device)
+		}
+		return fmt.Sprintf(`device=%v,name=%v`, strconv.Quote(sdmevents.DeviceId(state.Device)), strconv.Quote(name))
+	}
+	fmt.Fprintln(w, "# HELP nest_device_online 1 if the device is online")
+	fmt.Fprintln(w, "# TYPE nest_device_online gauge")
+	for i := range all {
+		if len(all[i].Connectivity) == 0 {
+			continue
+		}
+		online := 0
+		if all[i].Online() {
+			online = 1
+		}
+		fmt.Fprintf(w, "nest_device_online{%v} %v\n", labels(&all[i]), online)
+	}
+	fmt.Fprintln(w, "# HELP nest_device_connectivity_changes_total Number of online/offline transitions")
+	fmt.Fprintln(w, "# TYPE nest_device_connectivity_changes_total counter")
+	for i := range all {
+		fmt.Fprintf(w, "nest_device_connectivity_changes_total{%v} %v\n", labels(&all[i]), all[i].ConnectivityChanges)
+	}
+	fmt.Fprintln(w, "# HELP nest_device_battery_level Battery level in percent")
+	fmt.Fprintln(w, "# TYPE nest_device_battery_level gauge")
+	for i := range all {
+		if all[i].BatteryLevel != nil {
+			fmt.Fprintf(w, "nest_device_battery_level{%v} %v\n", labels(&all[i]), *all[i].BatteryLevel)
+		}
+	}
+	fmt.Fprintln(w, "# HELP nest_device_battery_charging 1 if the battery is charging")
+	fmt.Fprintln(w, "# TYPE nest_device_battery_charging gauge")
+	for i := range all {
+		if len(all[i].ChargingStatus) == 0 {
+			continue
+		}
+		charging := 0
+		if all[i].Charging() {
+			charging = 1
+		}
+		fmt.Fprintf(w, "nest_device_battery_charging{%v} %v\n", labels(&all[i]), charging)
+	}
+	fmt.Fprintln(w, "# HELP nest_device_wifi_rssi_dbm Wi-Fi signal strength in dBm")
+	fmt.Fprintln(w, "# TYPE nest_device_wifi_rssi_dbm gauge")
+	for i := range all {
+		if all[i].WifiRssi != nil {
+			fmt.Fprintf(w, "nest_device_wifi_rssi_dbm{%v} %v\n", labels(&all[i]), *all[i].WifiRssi)
+		}
+	}
+}
+
+// Devices of every project with their states, for /devices and /stats of the datasource
+type projectDevices struct {
+	projects []*Project // set once the projects are opened, before the datasource is served
+	states   *processor.DeviceStateTracker
+}
+
+func (d *projectDevices) Devices() []datasource.Device {
+	states := map[string]processor.DeviceState{}
+	for _, state := range d.states.States() {
+		states[state.Device] = state
+	}
+	devices := []datasource.Device{}
+	for _, project := range d.projects {
+		registry := project.consumer.Devices()
+		for _, device := range registry.Devices() {
+			entry := datasource.Device{
+				DeviceHealth: datasource.DeviceHealth{Device: sdmevents.DeviceId(device.Name), DeviceName: sdmevents.DeviceDisplayName(device)},
+				Name:         device.Name,
+				Type:         device.Type,
+				Traits:       json.RawMessage(device.Traits),
+			}
+			entry.Room, entry.Structure = registry.Placement(device.Name)
+			if state, ok := states[device.Name]; ok {
+				entry.BatteryStatus = state.BatteryStatus
+				entry.BatteryLevel = state.BatteryLevel
+				entry.ChargingStatus = state.ChargingStatus
+				entry.WifiRssi = state.WifiRssi
+				entry.UpdatedAt = state.UpdatedAt.UnixMilli()
+				if len(state.Connectivity) > 0 {
+					online := state.Online()
+					entry.Online = &online
+				}
+				entry.LastEvent = state.LastEvent
+				if !state.LastEventAt.IsZero() {
+					entry.LastEventAt = state.LastEventAt.UnixMilli()
+				}
+			}
+			devices = append(devices, entry)
+		}
+	}
+	return devices
+}
+
+func writeSourceMetrics(w http.ResponseWriter, projects []*Project) {
+	sources := map[string]*nestconsumer.PubsubSource{}
+	for _, project := range projects {
+		if source, ok := project.consumer.Source().(*nestconsumer.PubsubSource); ok {
+			sources[strconv.Quote(project.config.Name)] = source
+		}
+	}
+	if len(sources) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "# HELP nest_pubsub_reconnects_total Number of stale Pub/Sub streams torn down and received again")
+	fmt.Fprintln(w, "# TYPE nest_pubsub_reconnects_total counter")
+	for project, source := range sources {
+		fmt.Fprintf(w, "nest_pubsub_reconnects_total{project=%v} %v\n", project, source.Reconnects())
+	}
+	fmt.Fprintln(w, "# HELP nest_pubsub_last_message_timestamp_seconds Time of the last received message, or when receiving (re)started")
+	fmt.Fprintln(w, "# TYPE nest_pubsub_last_message_timestamp_seconds gauge")
+	for project, source := range sources {
+		fmt.Fprintf(w, "nest_pubsub_last_message_timestamp_seconds{project=%v} %v\n", project, source.LastMessage().Unix())
+	}
+}
+
+func writeLatencyMetrics(w http.ResponseWriter, projects []*Project) {
+	fmt.Fprintln(w, "# HELP nest_event_latency_seconds Delay from the event timestamp to a milestone of the pipeline (received, saved, notified). Quantiles of the latest 1000 events")
+	fmt.Fprintln(w, "# TYPE nest_event_latency_seconds summary")
+	for _, project := range projects {
+		for _, stats := range project.consumer.Latency().Stats() {
+			labels := fmt.Sprintf(`project=%v,milestone=%v,event=%v`, strconv.Quote(project.config.Name), strconv.Quote(string(stats.Milestone)), strconv.Quote(stats.Event))
+			fmt.Fprintf(w, "nest_event_latency_seconds{%v,quantile=\"0.5\"} %v\n", labels, stats.P50)
+			fmt.Fprintf(w, "nest_event_latency_seconds{%v,quantile=\"0.95\"} %v\n", labels, stats.P95)
+			fmt.Fprintf(w, "nest_event_latency_seconds{%v,quantile=\"0.99\"} %v\n", labels, stats.P99)
+			fmt.Fprintf(w, "nest_event_latency_seconds_sum{%v} %v\n", labels, stats.SumSeconds)
+			fmt.Fprintf(w, "nest_event_latency_seconds_count{%v} %v\n", labels, stats.Count)
+		}
+	}
+}
+
+func writeCommandMetrics(w http.ResponseWriter, projects []*Project) {
+	type usage struct {
+		labels string
+		processor.CommandUsage
+	}
+	usages := []usage{}
+	for _, project := range projects {
+		limiter := project.consumer.CommandLimiter()
+		if limiter == nil {
+			continue
+		}
+		for _, u := range limiter.Usage() {
+			usages = append(usages, usage{fmt.Sprintf(`project=%v,command=%v`, strconv.Quote(project.config.Name), strconv.Quote(u.Command)), u})
+		}
+	}
+	counter := func(name, help string, value func(u *usage) float64) {
+		fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+		fmt.Fprintf(w, "# TYPE %v counter\n", name)
+		for i := range usages {
+			fmt.Fprintf(w, "%v{%v} %v\n", name, usages[i].labels, value(&usages[i]))
+		}
+	}
+	counter("nest_sdm_command_requests_total", "SDM commands sent within the client side quota", func(u *usage) float64 { return float64(u.Requests) })
+	counter("nest_sdm_command_rejected_total", "SDM commands failed without sending since the quota wasn't available within -sdm-queue-timeout", func(u *usage) float64 { return float64(u.Rejected) })
+	counter("nest_sdm_command_throttled_total", "SDM commands answered 429 by SDM", func(u *usage) float64 { return float64(u.Throttled) })
+	counter("nest_sdm_command_queue_seconds_total", "Time SDM commands waited for the quota", func(u *usage) float64 { return u.QueuedSeconds })
+	fmt.Fprintln(w, "# HELP nest_sdm_command_quota_remaining Requests left of the client side quota of SDM commands per window")
+	fmt.Fprintln(w, "# TYPE nest_sdm_command_quota_remaining gauge")
+	for _, u := range usages {
+		if u.Quota.PerMinute > 0 {
+			fmt.Fprintf(w, "nest_sdm_command_quota_remaining{%v,window=\"minute\"} %v\n", u.labels, u.MinuteRemaining)
+		}
+		if u.Quota.PerDay > 0 {
+			fmt.Fprintf(w, "nest_sdm_command_quota_remaining{%v,window=\"day\"} %v\n", u.labels, u.DayRemaining)
+		}
+	}
+}
+
+func writeNotifierMetrics(w http.ResponseWriter, projects []*Project) {
+	// projects share the notifiers of the flags and the config file
+	seen := map[string]bool{}
+	breakers := []notify.CircuitBreakerStats{}
+	for _, project := range projects {
+		for _, stats := range notify.CircuitBreakers(project.consumer.Notifiers()) {
+			if !seen[stats.Notifier] {
+				seen[stats.Notifier] = true
+				breakers = append(breakers, stats)
+			}
+		}
+	}
+	metric := func(name, kind, help string, value func(s *notify.CircuitBreakerStats) any) {
+		fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+		fmt.Fprintf(w, "# TYPE %v %v\n", name, kind)
+		for i := range breakers {
+			fmt.Fprintf(w, "%v{notifier=%v} %v\n", name, strconv.Quote(breakers[i].Notifier), value(&breakers[i]))
+		}
+	}
+	metric("nest_notifier_circuit_open", "gauge", "1 while the circuit breaker of the notifier is open or half-open", func(s *notify.CircuitBreakerStats) any {
+		if s.State == notify.CircuitClosed {
+			return 0
+		}
+		return 1
+	})
+	metric("nest_notifier_circuit_opens_total", "counter", "Times the circuit breaker of the notifier opened", func(s *notify.CircuitBreakerStats) any { return s.Opens })
+	metric("nest_notifier_short_circuited_total", "counter", "Notifications not sent since the circuit was open", func(s *notify.CircuitBreakerStats) any { return s.ShortCircuited })
+	metric("nest_notifier_retry_buffered", "gauge", "Failed notifications waiting for retry", func(s *notify.CircuitBreakerStats) any { return s.Buffered })
+	metric("nest_notifier_retried_total", "counter", "Failed notifications sent later", func(s *notify.CircuitBreakerStats) any { return s.Retried })
+	metric("nest_notifier_retry_dropped_total", "counter", "Failed notifications dropped since the retry buffer was full or they got too old", func(s *notify.CircuitBreakerStats) any { return s.Dropped })
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Send state e.g. "READY=1" to the service manager of a Type=notify systemd service. No-op outside of systemd
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if len(socket) == 0 {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Half of WatchdogSec= of the service, 0 if the watchdog is disabled
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// First unhealthy message source of the projects
+func checkProjectsHealth(ctx context.Context, projects []*Project) error {
+	for _, project := range projects {
+		if err := project.consumer.CheckHealth(ctx); err != nil {
+			return fmt.Errorf("[%v] %v", project.config.Name, err)
+		}
+	}
+	return nil
+}
+
+// Notify READY=1 once every project receives events, then WATCHDOG=1 while they stay healthy, so that systemd restarts
+// the consumer when a subscription silently stops receiving
+func runSystemdNotify(projects []*Project) {
+	if len(os.Getenv("NOTIFY_SOCKET")) == 0 {
+		return
+	}
+	ctx := context.Background()
+	for {
+		err := checkProjectsHealth(ctx, projects)
+		if err == nil {
+			break
+		}
+		sdNotify("STATUS=Waiting for subscriptions: " + err.Error())
+		time.Sleep(time.Second)
+	}
+	if err := sdNotify("READY=1\nSTATUS=Receiving events"); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+		return
+	}
+	interval := sdWatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	log.Printf("Pinging the systemd watchdog every %v", interval)
+	healthy := true
+	for range time.Tick(interval) {
+		if err := checkProjectsHealth(ctx, projects); err != nil {
+			// systemd restarts the service when pings stop for WatchdogSec
+			if healthy {
+				log.Printf("Stopped pinging the systemd watchdog: %v", err)
+			}
+			healthy = false
+			sdNotify("STATUS=Unhealthy: " + err.Error())
+			continue
+		}
+		if !healthy {
+			log.Printf("Resumed pinging the systemd watchdog")
+			sdNotify("STATUS=Receiving events")
+		}
+		healthy = true
+		sdNotify("WATCHDOG=1")
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/auth"
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/processor"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"github.com/pion/webrtc/v3"
+	"google.golang.org/api/option"
+	"google.golang.org/api/smartdevicemanagement/v1"
+)
+
+// Write a synthetic snapshot (gradient) so that attachments can be tested without a real event
+func writeTestSnapshot(dir string) (string, error) {
+	img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	for y := 0; y < 240; y++ {
+		for x := 0; x < 320; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / 320), uint8(y * 255 / 240), 128, 255})
+		}
+	}
+	fileName := filepath.Join(dir, "test_snapshot.png")
+	f, err := os.Create(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		return "", err
+	}
+	return fileName, nil
+}
+
+// `test notify`: send a synthetic notification to the sinks whose id matches sink (all sinks if empty).
+// Returns error if any sink failed.
+func runTestNotify(notifiers []notify.Notifier, sink string, eventType sdmevents.ResourceUpdateEventType) error {
+	dir, err := os.MkdirTemp("", "nest-doorbell-consumer-test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	snapshot, err := writeTestSnapshot(dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Format(time.RFC3339)
+	device := "enterprises/test-project/devices/test-device"
+	notification := notify.Notification{
+		EventType: eventType,
+		Event: &sdmevents.DeviceEvent{
+			EventId:        "test-event",
+			Timestamp:      now,
+			ResourceUpdate: &sdmevents.ResourceUpdate{Name: device},
+		},
+		Device:         device,
+		EventSessionId: "test-session",
+		Timestamp:      now,
+		ClipPath:       filepath.Base(snapshot),
+		ClipFile:       snapshot,
+	}
+	failed := 0
+	tested := 0
+	for _, notifier := range notifiers {
+		if len(sink) > 0 && notify.NotifierId(notifier) != sink {
+			continue
+		}
+		tested++
+		if err := notifier.Notify(context.Background(), &notification); err != nil {
+			fmt.Printf("FAIL %v: %v\n", notify.NotifierId(notifier), err)
+			failed++
+		} else {
+			fmt.Printf("OK   %v\n", notify.NotifierId(notifier))
+		}
+	}
+	if tested == 0 {
+		return fmt.Errorf("no sink matched %q", sink)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v sinks failed", failed, tested)
+	}
+	return nil
+}
+
+// `test capture`: start a live stream of the device and stop it, to verify SDM commands work end-to-end.
+// For WebRTC devices this also waits until the first media track arrives.
+func runTestCapture(svc *smartdevicemanagement.Service, projectId string, deviceQuery string) error {
+	var r *smartdevicemanagement.GoogleHomeEnterpriseSdmV1ListDevicesResponse
+	err := processor.RetrySDM(context.Background(), "devices.list", func(ctx context.Context) (err error) {
+		r, err = svc.Enterprises.Devices.List(projectId).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	device, err := sdmevents.FindDevice(r.Devices, deviceQuery)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Device: %v (%v)\n", sdmevents.DeviceDisplayName(device), device.Name)
+	var liveStream sdmevents.DeviceTraitCameraLiveStreamValue
+	ok, err := sdmevents.DecodeDeviceTrait(device, sdmevents.DeviceTraitCameraLiveStream, &liveStream)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("device doesn't have %v trait", sdmevents.DeviceTraitCameraLiveStream)
+	}
+	for _, protocol := range liveStream.SupportedProtocols {
+		switch protocol {
+		case "WEB_RTC":
+			return testCaptureWebRtc(svc, device.Name)
+		case "RTSP":
+			return testCaptureRtsp(svc, device.Name)
+		}
+	}
+	return fmt.Errorf("no supported live stream protocol in %v", liveStream.SupportedProtocols)
+}
+
+func testCaptureRtsp(svc *smartdevicemanagement.Service, deviceName string) error {
+	var stream sdmevents.GenerateRtspStreamResponse
+	if err := processor.ExecuteDeviceCommand(context.Background(), svc, deviceName, "sdm.devices.commands.CameraLiveStream.GenerateRtspStream", struct{}{}, &stream); err != nil {
+		return err
+	}
+	fmt.Printf("OK   GenerateRtspStream (expires at %v)\n", stream.ExpiresAt)
+	if err := processor.ExecuteDeviceCommand(context.Background(), svc, deviceName, "sdm.devices.commands.CameraLiveStream.StopRtspStream", sdmevents.StopRtspStreamRequestParam{StreamExtensionToken: stream.StreamExtensionToken}, nil); err != nil {
+		return err
+	}
+	fmt.Printf("OK   StopRtspStream\n")
+	return nil
+}
+
+func testCaptureWebRtc(svc *smartdevicemanagement.Service, deviceName string) error {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	// SDM requires audio, video and application m-lines in this order
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return err
+		}
+	}
+	if _, err := pc.CreateDataChannel("dataSendChannel", nil); err != nil {
+		return err
+	}
+	trackReceived := make(chan string, 2)
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		trackReceived <- track.Codec().MimeType
+	})
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-gatherComplete
+	var stream sdmevents.GenerateWebRtcStreamResponse
+	if err := processor.ExecuteDeviceCommand(context.Background(), svc, deviceName, "sdm.devices.commands.CameraLiveStream.GenerateWebRtcStream", sdmevents.GenerateWebRtcStreamRequestParam{OfferSdp: pc.LocalDescription().SDP}, &stream); err != nil {
+		return err
+	}
+	fmt.Printf("OK   GenerateWebRtcStream (expires at %v)\n", stream.ExpiresAt)
+	defer func() {
+		if err := processor.ExecuteDeviceCommand(context.Background(), svc, deviceName, "sdm.devices.commands.CameraLiveStream.StopWebRtcStream", sdmevents.StopWebRtcStreamRequestParam{MediaSessionId: stream.MediaSessionId}, nil); err != nil {
+			fmt.Printf("FAIL StopWebRtcStream: %v\n", err)
+		} else {
+			fmt.Printf("OK   StopWebRtcStream\n")
+		}
+	}()
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: stream.AnswerSdp}); err != nil {
+		return err
+	}
+	select {
+	case mimeType := <-trackReceived:
+		fmt.Printf("OK   received %v track\n", mimeType)
+		return nil
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("no media track received in 30s")
+	}
+}
+
+func testNotifyCommand(args []string) {
+	fs := newFlagSet("test notify")
+	var httpFlags httpFlags
+	httpFlags.register(fs)
+	var notifierFlags notifierFlags
+	notifierFlags.register(fs)
+	var (
+		configPath = fs.String("config", "", "path to JSON config file whose notifiers are tested")
+		sink       = fs.String("sink", "", "id of the sink to test (config name/type, webhook, mqtt or grpc). empty means all")
+		event      = fs.String("event", "chime", "event type of the synthetic notification")
+	)
+	fs.Parse(args)
+	httpFlags.setup()
+	eventType, ok := sdmevents.EventTypeByName(*event)
+	if !ok {
+		log.Fatalf("Unknown event type: %v", *event)
+	}
+	flagNotifiers, err := notifierFlags.create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var config *Config
+	if len(*configPath) > 0 {
+		if config, err = loadConfig(*configPath); err != nil {
+			log.Fatalf("Unable to load config: %v", err)
+		}
+	}
+	settings, err := newNotificationSettings(config, flagNotifiers)
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	if err := runTestNotify(settings.notifiers, *sink, eventType); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func testCaptureCommand(args []string) {
+	fs := newFlagSet("test capture")
+	var httpFlags httpFlags
+	httpFlags.register(fs)
+	var projectFlags projectFlags
+	projectFlags.register(fs)
+	device := fs.String("device", "", "device id or custom name")
+	fs.Parse(args)
+	httpFlags.setup()
+	config, err := projectFlags.loadConfig()
+	if err != nil {
+		log.Fatalf("Unable to load config: %v", err)
+	}
+	// against the first project
+	projectConfig := projectFlags.projectConfigs(config)[0]
+	client, err := auth.NewClient(projectConfig.SmartDeviceCredPath, projectConfig.TokenPath)
+	if err != nil {
+		log.Fatalf("[%v] %v", projectConfig.Name, err)
+	}
+	svc, err := smartdevicemanagement.NewService(context.Background(), option.WithHTTPClient(client))
+	if err != nil {
+		log.Fatalf("[%v] %v", projectConfig.Name, err)
+	}
+	if err := runTestCapture(svc, projectConfig.NestProjectId, *device); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	_ "time/tzdata" // containers may have no zoneinfo
+
+	"github.com/cormoran/NestDoorbellConsumer/datasource"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func main() {
+	defaults := datasource.DefaultOptions()
+	var (
+		port         = flag.String("port", "8080", "server port to listen")
+		addr         = flag.String("addr", "", "address to listen e.g. 127.0.0.1:8080. Overrides -port, which listens on every interface")
+		token        = flag.String("token", os.Getenv("DATASOURCE_TOKEN"), "require \"Authorization: Bearer <token>\" or ?token=<token>. Defaults to $DATASOURCE_TOKEN")
+		basicAuth    = flag.String("basic-auth", os.Getenv("DATASOURCE_BASIC_AUTH"), "require basic auth of <user>:<password>. Defaults to $DATASOURCE_BASIC_AUTH")
+		tlsCert      = flag.String("tls-cert", "", "serve HTTPS with the certificate file. Needs -tls-key")
+		tlsKey       = flag.String("tls-key", "", "private key file of -tls-cert")
+		autocertHost = flag.String("autocert-domains", "", "comma separated domains to serve HTTPS with certificates from Let's Encrypt. -addr must be reachable on :443")
+		corsOrigins  = flag.String("cors-origins", "", "comma separated origins allowed to fetch from browsers e.g. https://grafana.example.com, or *")
+		corsMethods  = flag.String("cors-methods", "", "comma separated methods allowed by CORS. Defaults to GET,HEAD,POST,OPTIONS")
+		corsHeaders  = flag.String("cors-headers", "", "comma separated request headers allowed by CORS. Defaults to Authorization,Content-Type,Range")
+		cacheTTL     = flag.Duration("cache-ttl", defaults.CacheTTL, "cache /list and /stats responses for this long, or until the clip index changes. 0 disables caching")
+		accessLog    = flag.String("access-log", "text", "format of the access log on stderr, text or json. Empty disables it")
+		ui           = flag.Bool("ui", defaults.UI, "serve a clip browser on /ui/ for use without Grafana")
+		gzip         = flag.Bool("gzip", defaults.Gzip, "compress JSON and text responses for clients accepting gzip")
+		thumbnailDir = flag.String("thumbnail-cache", defaults.ThumbnailDir, "directory to cache poster frames of /thumb/ generated by ffmpeg. Empty disables /thumb/")
+		hlsDir       = flag.String("hls-cache", defaults.HlsDir, "directory to cache clips transcoded into HLS for /hls/ by ffmpeg. Empty disables /hls/")
+		hlsClips     = flag.Int("hls-cache-clips", defaults.HlsClips, "transcoded clips kept in -hls-cache. Least recently played ones are removed")
+		autocertDir  = flag.String("autocert-cache", "autocert", "directory to cache certificates of -autocert-domains")
+		directory    = flag.String("directory", "", "directory which contains image")
+		curation     = flag.Bool("allow-curation", false, "enable DELETE /file/<path> and POST /archive/<path>, which moves the clip into archived/. Needs -token or -basic-auth")
+		readOnly     = flag.Bool("read-only", false, "reject every request other than GET/HEAD/OPTIONS, so that the archive can be mounted read-only")
+		sandbox      = flag.Bool("sandbox", false, "confine all file access to -directory using os.Root (symlinks pointing outside are not followed)")
+		timezone     = flag.String("timezone", "Local", "IANA time zone of the consumer's directory layout e.g. Asia/Tokyo. Must match -timezone of the consumer")
+		listLimit    = flag.Int("list-limit", defaults.ListLimit, "entries of /list returned when the request doesn't give limit. 0 means no limit")
+		indexRefresh = flag.Duration("index-refresh", 30*time.Second, "interval to rescan recent directories of the in-memory clip index. 0 disables the index and walks the archive per request")
+		anyLayout    = flag.Bool("any-layout", false, "with -index-refresh=0, walk the whole archive per request to list clips whose -output-file-path-format of the consumer is not 2006/01/02/15/... The index lists them anyway")
+		indexRebuild = flag.Duration("index-rebuild", time.Hour, "interval to walk the whole archive again to pick up clips written into older directories or removed. 0 never rebuilds")
+		indexDb      = flag.String("index-db", "", "bbolt file to persist the clip index e.g. /var/lib/nest/index.db, so that restarts answer from it at once instead of walking the archive. Keep it outside -directory. empty keeps the index only in memory")
+	)
+	flag.Parse()
+	location, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("Invalid -timezone: %v", err)
+	}
+	archive, err := datasource.OpenArchive(*directory, *sandbox)
+	if err != nil {
+		log.Fatal(err)
+	}
+	options := datasource.Options{ReadOnly: *readOnly, Location: location, ListLimit: *listLimit, AnyLayout: *anyLayout, Token: *token, ThumbnailDir: *thumbnailDir, HlsDir: *hlsDir, HlsClips: *hlsClips, CacheTTL: *cacheTTL, Gzip: *gzip, UI: *ui, Directory: *directory, AllowCuration: *curation}
+	for _, v := range []struct {
+		flag   string
+		target *[]string
+	}{{*corsOrigins, &options.CorsOrigins}, {*corsMethods, &options.CorsMethods}, {*corsHeaders, &options.CorsHeaders}} {
+		for _, item := range strings.Split(v.flag, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				*v.target = append(*v.target, item)
+			}
+		}
+	}
+	switch *accessLog {
+	case "":
+	case "text":
+		options.AccessLog = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	case "json":
+		options.AccessLog = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	default:
+		log.Fatalf("-access-log must be text, json or empty")
+	}
+	if len(*basicAuth) > 0 {
+		user, password, ok := strings.Cut(*basicAuth, ":")
+		if !ok || len(user) == 0 {
+			log.Fatalf("-basic-auth must be <user>:<password>")
+		}
+		options.BasicAuthUser, options.BasicAuthPassword = user, password
+	}
+	if *indexRefresh > 0 {
+		if options.Index, err = datasource.OpenClipIndex(archive, location, *indexDb); err != nil {
+			log.Fatalf("Unable to open -index-db: %v", err)
+		}
+		go options.Index.Watch(context.Background(), *indexRefresh, *indexRebuild)
+	}
+	if len(*addr) == 0 {
+		*addr = "0.0.0.0:" + *port
+	}
+	if len(options.Token) == 0 && len(options.BasicAuthUser) == 0 {
+		log.Printf("Serving the archive without authentication. Give -token or -basic-auth unless %v is only reachable by Grafana", *addr)
+	}
+	server := &http.Server{Addr: *addr, Handler: datasource.NewHandler(archive, options)}
+	switch {
+	case len(*autocertHost) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(*autocertHost, ",")...),
+			Cache:      autocert.DirCache(*autocertDir),
+		}
+		server.TLSConfig = m.TLSConfig()
+		err = server.ListenAndServeTLS("", "")
+	case len(*tlsCert) > 0 || len(*tlsKey) > 0:
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	default:
+		err = server.ListenAndServe()
+	}
+	log.Fatal(err)
+}
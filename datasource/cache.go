@@ -0,0 +1,113 @@
+package datasource
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Cached responses kept at most. Expired ones are dropped first
+const maxCachedResponses = 256
+
+// Successful responses of expensive queries (/list, /stats) cached for ttl by the path and query parameters, and
+// invalidated when the index changes. Responses don't depend on the credentials, so the cache is shared by clients.
+type responseCache struct {
+	ttl        time.Duration
+	generation func() uint64 // of the index. nil without the index
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+type cachedResponse struct {
+	header     http.Header
+	body       []byte
+	expires    time.Time
+	generation uint64
+}
+
+func newResponseCache(ttl time.Duration, index *ClipIndex) *responseCache {
+	c := &responseCache{ttl: ttl, entries: map[string]*cachedResponse{}}
+	if index != nil {
+		c.generation = index.Generation
+	}
+	return c
+}
+
+func (c *responseCache) currentGeneration() uint64 {
+	if c.generation == nil {
+		return 0
+	}
+	return c.generation()
+}
+
+func (c *responseCache) Handler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Method + " " + r.URL.Path + "?" + r.URL.Query().Encode()
+		generation := c.currentGeneration()
+		c.mu.Lock()
+		cached, ok := c.entries[key]
+		c.mu.Unlock()
+		if ok && time.Now().Before(cached.expires) && cached.generation == generation {
+			for name, values := range cached.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.Write(cached.body)
+			return
+		}
+		recorder := &recordingResponseWriter{ResponseWriter: w}
+		next(recorder, r)
+		if recorder.status != http.StatusOK {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if len(c.entries) >= maxCachedResponses {
+			c.evict()
+		}
+		c.entries[key] = &cachedResponse{header: recorder.header, body: recorder.body.Bytes(), expires: time.Now().Add(c.ttl), generation: generation}
+	}
+}
+
+// Drop expired responses, or every response if none expired. c.mu must be held
+func (c *responseCache) evict() {
+	now := time.Now()
+	for key, cached := range c.entries {
+		if !now.Before(cached.expires) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) >= maxCachedResponses {
+		clear(c.entries)
+	}
+}
+
+// Pass the response through while keeping a copy of it. Headers are copied before outer middlewares (e.g. gzip)
+// modify them on WriteHeader.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.header == nil {
+		w.status = status
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.header == nil {
+		if len(w.Header().Get("Content-Type")) == 0 {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,179 @@
+package datasource
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+// Clip file of the archive and its metadata sidecar
+type clip struct {
+	Path     string
+	Time     time.Time             // event timestamp of the sidecar, or the modification time of the file
+	Metadata *storage.ClipMetadata // nil if the sidecar is missing or broken
+}
+
+func loadClip(archive fs.FS, p string) clip {
+	c := clip{Path: p}
+	if b, err := fs.ReadFile(archive, storage.ClipMetadataPath(p)); err == nil {
+		var metadata storage.ClipMetadata
+		if err := json.Unmarshal(b, &metadata); err == nil {
+			c.Metadata = &metadata
+			if t, err := time.Parse(time.RFC3339Nano, metadata.EventTimestamp); err == nil {
+				c.Time = t
+			}
+		}
+	}
+	if c.Time.IsZero() {
+		if info, err := fs.Stat(archive, p); err == nil {
+			c.Time = info.ModTime()
+		}
+	}
+	return c
+}
+
+// Event name of the clip e.g. "chime". Empty without metadata.
+func (c *clip) EventName() string {
+	if c.Metadata == nil {
+		return ""
+	}
+	return sdmevents.EventName(c.Metadata.EventType)
+}
+
+func (c *clip) Device() string {
+	if c.Metadata == nil {
+		return ""
+	}
+	return c.Metadata.Device
+}
+
+// Clip outside of storage.PathTemplate e.g. written with another -output-file-path-format. Other files are listed only
+// with the metadata sidecar or a media extension, to skip e.g. the consumer's event log.
+func isLooseClip(c *clip) bool {
+	if strings.HasPrefix(path.Base(c.Path), ".") {
+		return false
+	}
+	contentType := contentTypes[strings.ToLower(path.Ext(c.Path))]
+	return c.Metadata != nil || strings.HasPrefix(contentType, "video/") || strings.HasPrefix(contentType, "image/")
+}
+
+// Entry of /list
+type listEntry struct {
+	Path         string  `json:"path"` // relative to the archive
+	Url          string  `json:"url"`  // URL path of the file served by /file/
+	Timestamp    string  `json:"timestamp"`
+	EventType    string  `json:"eventType,omitempty"` // e.g. "chime". empty without metadata
+	Device       string  `json:"device,omitempty"`
+	DeviceName   string  `json:"deviceName,omitempty"` // custom name of the device e.g. "Front door"
+	SizeBytes    int64   `json:"sizeBytes"`
+	DurationSec  float64 `json:"durationSec,omitempty"` // 0 if unknown e.g. not mp4
+	ThumbnailUrl string  `json:"thumbnailUrl,omitempty"`
+}
+
+// thumbnails: /thumb/ is served
+func (c *clip) ListEntry(archive fs.FS, location *time.Location, thumbnails bool) listEntry {
+	entry := listEntry{
+		Path:      c.Path,
+		Url:       path.Join("/file", c.Path),
+		Timestamp: c.Time.In(location).Format(time.RFC3339),
+		EventType: c.EventName(),
+		Device:    c.Device(),
+	}
+	if c.Metadata != nil {
+		entry.DeviceName = c.Metadata.DeviceName
+	}
+	if thumbnails {
+		entry.ThumbnailUrl = path.Join("/thumb", c.Path)
+	}
+	if c.Metadata != nil && c.Metadata.Download.Bytes > 0 {
+		entry.SizeBytes = c.Metadata.Download.Bytes
+	} else if info, err := fs.Stat(archive, c.Path); err == nil {
+		entry.SizeBytes = info.Size()
+	}
+	if duration, err := mp4Duration(archive, c.Path); err == nil {
+		entry.DurationSec = duration.Seconds()
+	}
+	return entry
+}
+
+// Clips in [fromTs, toTs) sorted by time
+func loadClips(archive fs.FS, fromTs time.Time, toTs time.Time) []clip {
+	clips := []clip{}
+	for _, p := range listClips(archive, fromTs, toTs) {
+		clips = append(clips, loadClip(archive, p))
+	}
+	sort.SliceStable(clips, func(i, j int) bool { return clips[i].Time.Before(clips[j].Time) })
+	return clips
+}
+
+// Filter by comma separated query parameters eventType (e.g. chime,person) and device (id, full name or custom name
+// e.g. front-door). Empty parameters match every clip.
+type clipFilter struct {
+	eventNames map[string]bool
+	devices    map[string]bool // normalized by normalizeDeviceName
+}
+
+func newClipFilter(query url.Values) *clipFilter {
+	f := &clipFilter{eventNames: map[string]bool{}, devices: map[string]bool{}}
+	for _, name := range splitList(query.Get("eventType")) {
+		f.eventNames[name] = true
+	}
+	for _, device := range splitList(query.Get("device")) {
+		f.devices[normalizeDeviceName(device)] = true
+	}
+	return f
+}
+
+func splitList(value string) []string {
+	result := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// "Front door" and "front_door" are the same as "front-door"
+func normalizeDeviceName(name string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '/' {
+			return unicode.ToLower(r)
+		}
+		return '-'
+	}, name), "-")
+}
+
+func (f *clipFilter) Match(c *clip) bool {
+	if len(f.eventNames) == 0 && len(f.devices) == 0 {
+		return true
+	}
+	if c.Metadata == nil {
+		return false
+	}
+	if len(f.eventNames) > 0 && !f.eventNames[c.EventName()] {
+		return false
+	}
+	return f.MatchDevice(c.Metadata.Device, c.Metadata.DeviceName)
+}
+
+// Match by the device parameter only. device is the full name or id
+func (f *clipFilter) MatchDevice(device string, deviceName string) bool {
+	if len(f.devices) == 0 {
+		return true
+	}
+	for _, name := range []string{device, sdmevents.DeviceId(device), deviceName} {
+		if len(name) > 0 && f.devices[normalizeDeviceName(name)] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package datasource
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	defaultCorsMethods = []string{"GET", "HEAD", "POST", "OPTIONS"}
+	defaultCorsHeaders = []string{"Authorization", "Content-Type", "Range"}
+	// players need them to seek and cache clips of /file/
+	corsExposedHeaders = []string{"Accept-Ranges", "Content-Length", "Content-Range", "ETag"}
+)
+
+// Allow browsers on origins (e.g. Grafana panels on another host) to fetch the endpoints. "*" allows every origin.
+// Preflight requests are answered here, before authentication, since browsers don't send credentials with them.
+func corsMiddleware(next http.Handler, origins []string, methods []string, headers []string) http.Handler {
+	if len(methods) == 0 {
+		methods = defaultCorsMethods
+	}
+	if len(headers) == 0 {
+		headers = defaultCorsHeaders
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 || !(slices.Contains(origins, "*") || slices.Contains(origins, origin)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if slices.Contains(origins, "*") {
+			// without credentials, so that any site can't use the cookies or basic auth cached by the browser
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Add("Vary", "Origin")
+		}
+		if r.Method == http.MethodOptions && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(10*60))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,113 @@
+package datasource
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+// Directory of the archive which POST /archive/ moves clips into. It's outside of the dated directories, so that
+// removing old directories for retention doesn't remove archived clips. The index still lists them by their time.
+const archivedDir = "archived"
+
+// Delete and move clips of the archive directory on disk, along with their metadata sidecar
+type clipCurator struct {
+	directory string
+	archive   fs.FS      // of directory, which confines the paths in sandbox mode
+	index     *ClipIndex // nil without the index
+}
+
+// Path of the clip file on disk. false unless p is a clip of the archive. Symlinks are refused, so that what they
+// point to is never removed or moved.
+func (c *clipCurator) clipFile(p string) (string, bool) {
+	if ext := path.Ext(p); len(p) == 0 || ext == ".json" || ext == storage.TempFileExtension {
+		return "", false
+	}
+	if info, err := fs.Stat(c.archive, p); err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	file := filepath.Join(c.directory, filepath.FromSlash(p))
+	if info, err := os.Lstat(file); err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	return file, true
+}
+
+// Remove the clip file and its sidecar
+func (c *clipCurator) Delete(p string, file string) error {
+	if err := os.Remove(file); err != nil {
+		return fmt.Errorf("failed to delete %v: %v", p, err)
+	}
+	if err := os.Remove(storage.ClipMetadataPath(file)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("deleted %v but not its metadata: %v", p, err)
+	}
+	if c.index != nil {
+		c.index.Remove(p)
+	}
+	return nil
+}
+
+// Move the clip file and its sidecar to archived, the path in the archive
+func (c *clipCurator) Archive(p string, file string, archived string) error {
+	archivedFile := filepath.Join(c.directory, filepath.FromSlash(archived))
+	if err := os.MkdirAll(filepath.Dir(archivedFile), 0777); err != nil {
+		return fmt.Errorf("failed to archive %v: %v", p, err)
+	}
+	if err := os.Rename(file, archivedFile); err != nil {
+		return fmt.Errorf("failed to archive %v: %v", p, err)
+	}
+	if err := os.Rename(storage.ClipMetadataPath(file), storage.ClipMetadataPath(archivedFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("archived %v but not its metadata: %v", p, err)
+	}
+	if c.index != nil {
+		c.index.Remove(p)
+		c.index.Add(archived)
+	}
+	return nil
+}
+
+// DELETE /file/<path> and POST /archive/<path>
+func registerCurateApi(mux *http.ServeMux, curator *clipCurator) {
+	mux.HandleFunc("DELETE /file/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(path.Clean("/"+r.PathValue("path")), "/")
+		file, ok := curator.clipFile(p)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if err := curator.Delete(p, file); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /archive/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(path.Clean("/"+r.PathValue("path")), "/")
+		file, ok := curator.clipFile(p)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasPrefix(p, archivedDir+"/") {
+			http.Error(w, p+" is already archived", http.StatusBadRequest)
+			return
+		}
+		archived := path.Join(archivedDir, p)
+		if _, err := fs.Stat(curator.archive, archived); err == nil {
+			http.Error(w, archived+" already exists", http.StatusConflict)
+			return
+		}
+		if err := curator.Archive(p, file, archived); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, map[string]string{"path": archived, "file": "/file/" + archived})
+	})
+}
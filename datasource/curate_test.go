@@ -0,0 +1,190 @@
+package datasource
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Archive on disk with a clip and its sidecar, and symlinks to a clip and a directory outside of it.
+// Returns the directory of the archive and of the files outside
+func writeCurateArchive(t *testing.T) (string, string) {
+	directory, outside := t.TempDir(), t.TempDir()
+	for _, file := range []string{
+		filepath.Join(directory, "2024/03/04/05/a_0.mp4"),
+		filepath.Join(directory, "2024/03/04/05/a_0.mp4.json"),
+		filepath.Join(directory, "2024/03/04/05/b_0.mp4"),
+		filepath.Join(directory, "2024/03/04/05/c_0.mp4.tmp"),
+		filepath.Join(outside, "outside.mp4"),
+		filepath.Join(outside, "dir/clip.mp4"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		data := []byte("clip")
+		if filepath.Ext(file) == ".json" {
+			data = sidecar("2024-03-04T05:50:00Z").Data
+		}
+		if err := os.WriteFile(file, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "outside.mp4"), filepath.Join(directory, "2024/03/04/05/link.mp4")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "dir"), filepath.Join(directory, "2024/03/04/linked")); err != nil {
+		t.Fatal(err)
+	}
+	return directory, outside
+}
+
+func newCurateHandler(t *testing.T, directory string, options Options) http.Handler {
+	archive, err := OpenArchive(directory, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.Location, options.Directory, options.AllowCuration = time.UTC, directory, true
+	return NewHandler(archive, options)
+}
+
+func curateRequest(handler http.Handler, method, target, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if len(token) > 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func checkExists(t *testing.T, file string, want bool) {
+	t.Helper()
+	if _, err := os.Lstat(file); (err == nil) != want {
+		t.Errorf("%v exists = %v, want %v", file, err == nil, want)
+	}
+}
+
+func TestCurateDelete(t *testing.T) {
+	directory, outside := writeCurateArchive(t)
+	index := NewClipIndex(os.DirFS(directory), time.UTC)
+	handler := newCurateHandler(t, directory, Options{Token: "secret", Index: index})
+	for _, target := range []string{
+		// traversal out of the archive, which the mux doesn't clean when escaped
+		"/file/..%2F" + filepath.Base(outside) + "%2Foutside.mp4",
+		"/file/2024%2F..%2F..%2F" + filepath.Base(outside) + "%2Foutside.mp4",
+		// absolute paths are relative to the archive
+		"/file/%2F" + filepath.ToSlash(filepath.Join(outside, "outside.mp4"))[1:],
+		"/file/" + filepath.ToSlash(filepath.Join(outside, "outside.mp4"))[1:],
+		// symlinks out of the archive
+		"/file/2024/03/04/05/link.mp4",
+		"/file/2024/03/04/linked/clip.mp4",
+		// sidecars, partial downloads, directories and missing files
+		"/file/2024/03/04/05/a_0.mp4.json",
+		"/file/2024/03/04/05/c_0.mp4.tmp",
+		"/file/2024/03/04/05",
+		"/file/",
+		"/file/2024/03/04/05/z_0.mp4",
+	} {
+		if w := curateRequest(handler, http.MethodDelete, target, "secret"); w.Code != http.StatusNotFound {
+			t.Errorf("DELETE %v = %v %q, want 404", target, w.Code, w.Body)
+		}
+	}
+	checkExists(t, filepath.Join(outside, "outside.mp4"), true)
+	checkExists(t, filepath.Join(outside, "dir/clip.mp4"), true)
+	checkExists(t, filepath.Join(directory, "2024/03/04/05/link.mp4"), true)
+	checkExists(t, filepath.Join(directory, "2024/03/04/05/a_0.mp4.json"), true)
+	checkExists(t, filepath.Join(directory, "2024/03/04/05/c_0.mp4.tmp"), true)
+
+	for _, token := range []string{"", "wrong"} {
+		if w := curateRequest(handler, http.MethodDelete, "/file/2024/03/04/05/a_0.mp4", token); w.Code != http.StatusUnauthorized {
+			t.Errorf("DELETE with token %q = %v, want 401", token, w.Code)
+		}
+	}
+	checkExists(t, filepath.Join(directory, "2024/03/04/05/a_0.mp4"), true)
+
+	// the clip goes with its sidecar and out of the index
+	if w := curateRequest(handler, http.MethodDelete, "/file/2024/03/04/05/a_0.mp4", "secret"); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE of a clip = %v %q, want 204", w.Code, w.Body)
+	}
+	checkExists(t, filepath.Join(directory, "2024/03/04/05/a_0.mp4"), false)
+	checkExists(t, filepath.Join(directory, "2024/03/04/05/a_0.mp4.json"), false)
+	checkClips(t, index, at(0, 0), at(12, 0), "2024/03/04/05/b_0.mp4")
+	if w := curateRequest(handler, http.MethodDelete, "/file/2024/03/04/05/a_0.mp4", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE of a deleted clip = %v, want 404", w.Code)
+	}
+}
+
+func TestCurateArchive(t *testing.T) {
+	directory, outside := writeCurateArchive(t)
+	index := NewClipIndex(os.DirFS(directory), time.UTC)
+	handler := newCurateHandler(t, directory, Options{BasicAuthUser: "admin", BasicAuthPassword: "pw", Index: index})
+	archive := func(target, user, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		r.SetBasicAuth(user, password)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	for _, target := range []string{"/archive/..%2F" + filepath.Base(outside) + "%2Foutside.mp4", "/archive/2024/03/04/05/link.mp4", "/archive/2024/03/04/linked/clip.mp4", "/archive/2024/03/04/05/a_0.mp4.json"} {
+		if w := archive(target, "admin", "pw"); w.Code != http.StatusNotFound {
+			t.Errorf("POST %v = %v %q, want 404", target, w.Code, w.Body)
+		}
+	}
+	if w := archive("/archive/2024/03/04/05/a_0.mp4", "admin", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("POST with a wrong password = %v, want 401", w.Code)
+	}
+	checkExists(t, filepath.Join(outside, "outside.mp4"), true)
+	checkExists(t, filepath.Join(outside, "dir/clip.mp4"), true)
+	checkExists(t, filepath.Join(directory, archivedDir), false)
+
+	w := archive("/archive/2024/03/04/05/a_0.mp4", "admin", "pw")
+	var result map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &result); w.Code != http.StatusOK || err != nil || result["path"] != "archived/2024/03/04/05/a_0.mp4" || result["file"] != "/file/archived/2024/03/04/05/a_0.mp4" {
+		t.Fatalf("POST of a clip = %v %q, want the archived path", w.Code, w.Body)
+	}
+	checkExists(t, filepath.Join(directory, "2024/03/04/05/a_0.mp4"), false)
+	checkExists(t, filepath.Join(directory, "archived/2024/03/04/05/a_0.mp4"), true)
+	checkExists(t, filepath.Join(directory, "archived/2024/03/04/05/a_0.mp4.json"), true)
+	// listed by the time of the moved sidecar, before b_0 of its modification time
+	checkClips(t, index, at(0, 0), at(12, 0), "archived/2024/03/04/05/a_0.mp4", "2024/03/04/05/b_0.mp4")
+
+	if w := archive("/archive/archived/2024/03/04/05/a_0.mp4", "admin", "pw"); w.Code != http.StatusBadRequest {
+		t.Errorf("POST of an archived clip = %v, want 400", w.Code)
+	}
+	// an archived clip of the same path isn't overwritten
+	if err := os.WriteFile(filepath.Join(directory, "archived/2024/03/04/05/b_0.mp4"), []byte("archived"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if w := archive("/archive/2024/03/04/05/b_0.mp4", "admin", "pw"); w.Code != http.StatusConflict {
+		t.Errorf("POST of a clip archived before = %v, want 409", w.Code)
+	}
+	checkExists(t, filepath.Join(directory, "2024/03/04/05/b_0.mp4"), true)
+}
+
+func TestCurateDisabled(t *testing.T) {
+	directory, _ := writeCurateArchive(t)
+	for _, c := range []struct {
+		options Options
+		code    int // of POST /archive/
+	}{
+		// read-only mode rejects the mutations
+		{Options{ReadOnly: true, Token: "secret"}, http.StatusMethodNotAllowed},
+		// without authentication there is no curation
+		{Options{}, http.StatusNotFound},
+	} {
+		handler := newCurateHandler(t, directory, c.options)
+		if w := curateRequest(handler, http.MethodDelete, "/file/2024/03/04/05/a_0.mp4", "secret"); w.Code == http.StatusNoContent {
+			t.Errorf("DELETE with ReadOnly %v and token %q = %v", c.options.ReadOnly, c.options.Token, w.Code)
+		}
+		if w := curateRequest(handler, http.MethodPost, "/archive/2024/03/04/05/a_0.mp4", "secret"); w.Code != c.code {
+			t.Errorf("POST /archive/ with ReadOnly %v and token %q = %v, want %v", c.options.ReadOnly, c.options.Token, w.Code, c.code)
+		}
+		checkExists(t, filepath.Join(directory, "2024/03/04/05/a_0.mp4"), true)
+		checkExists(t, filepath.Join(directory, "2024/03/04/05/a_0.mp4.json"), true)
+		checkExists(t, filepath.Join(directory, archivedDir), false)
+	}
+}
@@ -0,0 +1,447 @@
+// Package datasource serves clips saved by the consumer over HTTP for Grafana.
+package datasource
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+var features = []string{
+	"list",
+	"list-entries", // /list returns objects with metadata instead of bare paths
+	"list-pages",   // /list takes limit and offset, and returns {total, offset, limit, entries}
+	"list-filters", // /list takes eventType and device
+	"file",
+	"file-ranges",       // /file/ serves Range requests with Content-Type and ETag
+	"skip-sidecar-json", // <clip>.json metadata sidecar is not listed
+	"skip-tmp",          // <name>.tmp files being written are not listed
+	"json-api",          // Grafana JSON datasource contract (/, POST /metrics, /search, /query)
+	"annotations",       // POST /annotations of the JSON datasource
+	"prometheus",        // GET /metrics request counts, latencies and bytes served in prometheus text format
+	"stats",             // /stats event counts per interval grouped by event type and device
+	"ics",               // /events.ics chime and person events as iCalendar
+	"export",            // /export clips of a range with their metadata as CSV or JSON
+	"thumbnails",        // /thumb/<path> poster frames, and thumbnailUrl of /list entries when ffmpeg is available
+	"hls",               // /hls/<path>/index.m3u8 transcoded by ffmpeg when available
+	"cors",              // CORS headers and preflight for -cors-origins
+	"index",             // range queries may be answered from the in-memory index, which lags behind the archive
+}
+
+func parseUnixTimeOrDefault(unixTsStr string, defaultTime time.Time, location *time.Location) (time.Time, error) {
+	if len(unixTsStr) == 0 {
+		return defaultTime.In(location), nil
+	}
+	unixTs, err := strconv.ParseInt(unixTsStr, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(unixTs), 0).In(location), nil
+}
+
+// from and to of the query in unix seconds. Defaults to the last 24 hours
+func parseRange(r *http.Request, location *time.Location) (time.Time, time.Time, error) {
+	fromTs, err := parseUnixTimeOrDefault(r.URL.Query().Get("from"), time.Now().Add(-24*time.Hour), location)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	toTs, err := parseUnixTimeOrDefault(r.URL.Query().Get("to"), fromTs.Add(24*time.Hour), location)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !fromTs.Before(toTs) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from should be less than to")
+	}
+	return fromTs, toTs, nil
+}
+
+// Directories of storage.PathTemplate covering the hours overlapping [fromTs, toTs). Years, months and days entirely
+// in the range are given as a whole e.g. "2024", "2024/03" or "2024/03/04" instead of their hours.
+func listTargetDirectories(fromTs time.Time, toTs time.Time) []string {
+	result := []string{}
+	location := fromTs.Location()
+	t := time.Date(fromTs.Year(), fromTs.Month(), fromTs.Day(), fromTs.Hour(), 0, 0, 0, location)
+	for t.Before(toTs) {
+		year, month, day := t.Date()
+		dayStart := t.Hour() == 0
+		nextDay := time.Date(year, month, day+1, 0, 0, 0, 0, location)
+		nextMonth := time.Date(year, month+1, 1, 0, 0, 0, 0, location)
+		nextYear := time.Date(year+1, time.January, 1, 0, 0, 0, 0, location)
+		switch {
+		case dayStart && month == time.January && day == 1 && !nextYear.After(toTs):
+			result = append(result, t.Format("2006"))
+			t = nextYear
+		case dayStart && day == 1 && !nextMonth.After(toTs):
+			result = append(result, t.Format("2006/01"))
+			t = nextMonth
+		case dayStart && !nextDay.After(toTs):
+			result = append(result, t.Format("2006/01/02"))
+			t = nextDay
+		default:
+			dir := t.Format(storage.PathTemplate)
+			// the hour repeated when DST ends
+			if len(result) == 0 || result[len(result)-1] != dir {
+				result = append(result, dir)
+			}
+			t = t.Add(time.Hour)
+		}
+	}
+	return result
+}
+
+// Clip files saved in [fromTs, toTs)
+func listClips(archive fs.FS, fromTs time.Time, toTs time.Time) []string {
+	result := []string{}
+	for _, d := range listTargetDirectories(fromTs, toTs) {
+		result = append(result, walkClips(archive, filepath.ToSlash(d))...)
+	}
+	return result
+}
+
+// Clips anywhere in the archive whose time is in [fromTs, toTs) sorted by time, for layouts other than
+// storage.PathTemplate. Walks the whole archive.
+func walkAllClips(archive fs.FS, fromTs time.Time, toTs time.Time) []clip {
+	clips := []clip{}
+	for _, p := range walkClips(archive, ".") {
+		if c := loadClip(archive, p); isLooseClip(&c) && !c.Time.Before(fromTs) && c.Time.Before(toTs) {
+			clips = append(clips, c)
+		}
+	}
+	sort.SliceStable(clips, func(i, j int) bool { return clips[i].Time.Before(clips[j].Time) })
+	return clips
+}
+
+// Clip files under dir
+func walkClips(archive fs.FS, dir string) []string {
+	result := []string{}
+	fs.WalkDir(archive, dir, func(path string, d fs.DirEntry, err error) error {
+		if d == nil {
+			return nil
+		}
+		// skip metadata sidecar (<clip>.json) and files being written (<name>.tmp) by the consumer
+		if ext := filepath.Ext(path); d.Type().IsRegular() && ext != ".json" && ext != storage.TempFileExtension {
+			result = append(result, path)
+		}
+		return nil
+	})
+	return result
+}
+
+// POST endpoints which only read the archive
+var readOnlyPostPaths = map[string]bool{
+	"/metrics":     true,
+	"/search":      true,
+	"/query":       true,
+	"/annotations": true,
+	// they start and stop live streams of the devices without touching the archive
+	"/live/stream": true,
+	"/live/extend": true,
+	"/live/stop":   true,
+}
+
+// Reject any request which may modify the archive.
+func readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet, r.Method == http.MethodHead, r.Method == http.MethodOptions:
+			next.ServeHTTP(w, r)
+		case r.Method == http.MethodPost && readOnlyPostPaths[r.URL.Path]:
+			next.ServeHTTP(w, r)
+		default:
+			http.Error(w, "datasource is running in read-only mode", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// Reject requests without the bearer token (Authorization header, or ?token= for <video> elements which can't send
+// headers) or the basic auth credentials. Each is checked only when configured.
+func authMiddleware(next http.Handler, token string, username string, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(token) > 0 {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if v := r.URL.Query().Get("token"); len(v) > 0 {
+				given = v
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if len(username) > 0 {
+			user, pass, ok := r.BasicAuth()
+			if ok && subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1 && subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="datasource"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// Open the archive directory. When sandbox is true, the returned fs.FS is confined to the directory by os.Root,
+// so that neither "../" nor symlinks can escape it.
+func OpenArchive(directory string, sandbox bool) (fs.FS, error) {
+	if len(directory) == 0 {
+		directory = "."
+	}
+	if !sandbox {
+		return os.DirFS(directory), nil
+	}
+	root, err := os.OpenRoot(directory)
+	if err != nil {
+		return nil, err
+	}
+	return root.FS(), nil
+}
+
+type Options struct {
+	ReadOnly  bool           // reject requests other than GET/HEAD/OPTIONS and the read-only POST queries
+	Location  *time.Location // time zone of the archive's directory layout. nil means the local time zone
+	ListLimit int            // entries of /list returned when limit is not given. 0 means no limit
+	Index     *ClipIndex     // answer range queries from the index instead of walking the archive. nil walks per request
+	AnyLayout bool           // without Index, walk the whole archive per request since clips may not be in storage.PathTemplate
+	// Require either of them when given. Empty accepts every request
+	Token             string
+	BasicAuthUser     string
+	BasicAuthPassword string
+	// Origins allowed by CORS e.g. https://grafana.example.com, or "*". Empty doesn't send CORS headers.
+	// Methods and headers default to GET/HEAD/POST/OPTIONS and Authorization/Content-Type/Range
+	CorsOrigins  []string
+	CorsMethods  []string
+	CorsHeaders  []string
+	ThumbnailDir string        // cache of /thumb/ poster frames. Empty disables /thumb/. Needs ffmpeg
+	HlsDir       string        // cache of /hls/ transcoded clips. Empty disables /hls/. Needs ffmpeg
+	HlsClips     int           // transcoded clips kept in HlsDir
+	CacheTTL     time.Duration // cache /list and /stats responses for this long, or until the index changes. 0 disables it
+	Gzip         bool          // compress JSON and text responses
+	AccessLog    *slog.Logger  // logs every request when not nil
+	UI           bool          // serve the clip browser on /ui/
+	Live         LiveStreams   // signaling of live streams on /live/ for the live view of /ui/. Needs Token or BasicAuthUser
+	Devices      DeviceSource  // devices on /devices, and their battery and Wi-Fi in /stats. nil omits them
+	// Directory of the archive on disk, where DELETE /file/ and POST /archive/ remove and move clips when AllowCuration
+	// is true. Curation needs Token or BasicAuthUser, and is disabled with ReadOnly
+	Directory     string
+	AllowCuration bool
+}
+
+// Defaults of cmd/grafana-datasource, also used when the consumer serves the datasource
+func DefaultOptions() Options {
+	return Options{
+		ListLimit:    1000,
+		ThumbnailDir: filepath.Join(os.TempDir(), "nest-doorbell-thumbnails"),
+		HlsDir:       filepath.Join(os.TempDir(), "nest-doorbell-hls"),
+		HlsClips:     16,
+		CacheTTL:     10 * time.Second,
+		Gzip:         true,
+		UI:           true,
+	}
+}
+
+// Page of /list
+type listResponse struct {
+	Total   int         `json:"total"` // entries in the range
+	Offset  int         `json:"offset"`
+	Limit   int         `json:"limit"` // 0 means no limit
+	Entries []listEntry `json:"entries"`
+}
+
+// Handler serving /list, /meta, /file/ and the Grafana JSON datasource API of the archive
+func NewHandler(archive fs.FS, options Options) http.Handler {
+	location := options.Location
+	if location == nil {
+		location = time.Local
+	}
+	clips := func(fromTs, toTs time.Time) []clip { return loadClips(archive, fromTs, toTs) }
+	pathTemplate := storage.PathTemplate
+	if options.Index != nil {
+		clips = options.Index.Clips
+	} else if options.AnyLayout {
+		clips = func(fromTs, toTs time.Time) []clip { return walkAllClips(archive, fromTs, toTs) }
+		pathTemplate = ""
+	}
+	metaFeatures := slices.Clone(features)
+	if options.Index != nil || options.AnyLayout {
+		metaFeatures = append(metaFeatures, storage.FeatureAnyLayout)
+	}
+	if options.Index != nil {
+		metaFeatures = append(metaFeatures, "stream") // /stream Server-Sent Events of new clips
+	}
+	if options.Gzip {
+		metaFeatures = append(metaFeatures, "gzip") // JSON and text responses are compressed when accepted
+	}
+	if options.UI {
+		metaFeatures = append(metaFeatures, "ui") // /ui/ clip browser
+	}
+	live := options.Live != nil
+	if live && len(options.Token) == 0 && len(options.BasicAuthUser) == 0 {
+		log.Printf("Disabled /live/ without authentication")
+		live = false
+	}
+	if live {
+		metaFeatures = append(metaFeatures, "live") // /live/ WebRTC signaling of the devices' live streams
+	}
+	if options.Devices != nil {
+		metaFeatures = append(metaFeatures, "devices") // /devices, and battery and Wi-Fi of the devices in /stats
+	}
+	curation := false
+	if options.AllowCuration {
+		switch {
+		case options.ReadOnly:
+			log.Printf("Disabled DELETE /file/ and POST /archive/ in read-only mode")
+		case len(options.Token) == 0 && len(options.BasicAuthUser) == 0:
+			log.Printf("Disabled DELETE /file/ and POST /archive/ without authentication")
+		default:
+			curation = true
+			metaFeatures = append(metaFeatures, "curation") // DELETE /file/<path> and POST /archive/<path>
+		}
+	}
+	var thumbnails *thumbnailer
+	if len(options.ThumbnailDir) > 0 {
+		var err error
+		if thumbnails, err = newThumbnailer(archive, options.ThumbnailDir); err != nil {
+			log.Printf("Disabled /thumb/: %v", err)
+		}
+	}
+	var hls *hlsTranscoder
+	if len(options.HlsDir) > 0 {
+		var err error
+		if hls, err = newHlsTranscoder(archive, options.HlsDir, options.HlsClips); err != nil {
+			log.Printf("Disabled /hls/: %v", err)
+		}
+	}
+	cached := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	if options.CacheTTL > 0 {
+		cached = newResponseCache(options.CacheTTL, options.Index).Handler
+	}
+	metrics := newServerMetrics()
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics)
+	mux.HandleFunc("/list", cached(func(w http.ResponseWriter, r *http.Request) {
+		fromTs, toTs, err := parseRange(r, location)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		limit := options.ListLimit
+		if v := r.URL.Query().Get("limit"); len(v) > 0 {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+				http.Error(w, "limit should be a positive integer", http.StatusBadRequest)
+				return
+			}
+		}
+		offset := 0
+		if v := r.URL.Query().Get("offset"); len(v) > 0 {
+			if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+				http.Error(w, "offset should be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+		}
+		filter := newClipFilter(r.URL.Query())
+		matched := []clip{}
+		for _, c := range clips(fromTs, toTs) {
+			if filter.Match(&c) {
+				matched = append(matched, c)
+			}
+		}
+		page := matched[min(offset, len(matched)):]
+		if limit > 0 && len(page) > limit {
+			page = page[:limit]
+		}
+		result := listResponse{Total: len(matched), Offset: offset, Limit: limit, Entries: []listEntry{}}
+		for _, c := range page {
+			result.Entries = append(result.Entries, c.ListEntry(archive, location, thumbnails != nil))
+		}
+		writeJson(w, result)
+	}))
+	mux.HandleFunc("/meta", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(storage.DatasourceMeta{
+			LayoutVersion: storage.LayoutVersion,
+			PathTemplate:  pathTemplate,
+			Features:      metaFeatures,
+			Timezone:      location.String(),
+		})
+	})
+	mux.Handle("/file/", http.StripPrefix("/file/", newFileHandler(archive)))
+	mux.HandleFunc("GET /stats", cached(func(w http.ResponseWriter, r *http.Request) {
+		fromTs, toTs, err := parseRange(r, location)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		interval := time.Hour
+		if v := r.URL.Query().Get("interval"); len(v) > 0 {
+			if interval, err = time.ParseDuration(v); err != nil || interval < time.Minute {
+				http.Error(w, "interval should be a duration of at least 1m e.g. 1h", http.StatusBadRequest)
+				return
+			}
+		}
+		if toTs.Sub(fromTs)/interval >= maxStatsBuckets {
+			http.Error(w, fmt.Sprintf("too many buckets. Give interval larger than %v", toTs.Sub(fromTs)/maxStatsBuckets), http.StatusBadRequest)
+			return
+		}
+		filter := newClipFilter(r.URL.Query())
+		stats := newStats(clips(fromTs, toTs), filter, fromTs, toTs, interval)
+		if options.Devices != nil {
+			for _, d := range options.Devices.Devices() {
+				if filter.MatchDevice(d.Device, d.DeviceName) {
+					stats.Devices = append(stats.Devices, d.DeviceHealth)
+				}
+			}
+		}
+		writeJson(w, stats)
+	}))
+	mux.HandleFunc("GET /export", cached(exportHandler(clips, archive, location)))
+	mux.HandleFunc("GET /events.ics", icsHandler(clips, location)) // not cached, links are of the host of the request
+	if options.Index != nil {
+		mux.HandleFunc("GET /stream", streamHandler(options.Index, func(c *clip) listEntry { return c.ListEntry(archive, location, thumbnails != nil) }))
+	}
+	if thumbnails != nil {
+		mux.Handle("GET /thumb/{path...}", thumbnails)
+	}
+	if hls != nil {
+		mux.Handle("GET /hls/{path...}", hls)
+	}
+	registerJsonApi(mux, clips, location)
+	if options.UI {
+		mux.Handle("GET /ui/", newUiHandler())
+	}
+	if live {
+		registerLiveApi(mux, options.Live)
+	}
+	if options.Devices != nil {
+		mux.HandleFunc("GET /devices", devicesHandler(options.Devices))
+	}
+	if curation {
+		registerCurateApi(mux, &clipCurator{directory: options.Directory, archive: archive, index: options.Index})
+	}
+	var handler http.Handler = mux
+	if options.ReadOnly {
+		handler = readOnlyMiddleware(handler)
+	}
+	if options.Gzip {
+		handler = gzipMiddleware(handler)
+	}
+	if len(options.Token) > 0 || len(options.BasicAuthUser) > 0 {
+		handler = authMiddleware(handler, options.Token, options.BasicAuthUser, options.BasicAuthPassword)
+	}
+	if len(options.CorsOrigins) > 0 {
+		handler = corsMiddleware(handler, options.CorsOrigins, options.CorsMethods, options.CorsHeaders)
+	}
+	return observeMiddleware(handler, metrics, options.AccessLog)
+}
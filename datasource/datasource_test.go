@@ -0,0 +1,184 @@
+package datasource
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+// Every hour directory overlapping [fromTs, toTs), one by one
+func bruteForceHourDirectories(fromTs time.Time, toTs time.Time) []string {
+	result := []string{}
+	location := fromTs.Location()
+	for t := time.Date(fromTs.Year(), fromTs.Month(), fromTs.Day(), fromTs.Hour(), 0, 0, 0, location); t.Before(toTs); t = t.Add(time.Hour) {
+		if dir := t.Format(storage.PathTemplate); len(result) == 0 || result[len(result)-1] != dir {
+			result = append(result, dir)
+		}
+	}
+	return result
+}
+
+// Hour directories under dir given by listTargetDirectories
+func expandDirectory(t *testing.T, dir string, location *time.Location) []string {
+	layouts := strings.Split(storage.PathTemplate, "/")
+	depth := strings.Count(dir, "/") + 1
+	start, err := time.ParseInLocation(strings.Join(layouts[:depth], "/"), dir, location)
+	if err != nil {
+		t.Fatalf("unexpected directory %v: %v", dir, err)
+	}
+	var end time.Time
+	switch depth {
+	case 1:
+		end = start.AddDate(1, 0, 0)
+	case 2:
+		end = start.AddDate(0, 1, 0)
+	case 3:
+		end = start.AddDate(0, 0, 1)
+	default:
+		return []string{dir}
+	}
+	return bruteForceHourDirectories(start, end)
+}
+
+func checkTargetDirectories(t *testing.T, fromTs time.Time, toTs time.Time) {
+	t.Helper()
+	dirs := listTargetDirectories(fromTs, toTs)
+	got := []string{}
+	for _, dir := range dirs {
+		got = append(got, expandDirectory(t, dir, fromTs.Location())...)
+	}
+	want := bruteForceHourDirectories(fromTs, toTs)
+	if !slices.Equal(got, want) {
+		t.Fatalf("listTargetDirectories(%v, %v) = %v\ncovers %v hours, want %v hours", fromTs, toTs, dirs, len(got), len(want))
+	}
+}
+
+func TestListTargetDirectories(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		from, to time.Time
+		want     []string
+	}{
+		{time.Date(2024, 3, 4, 5, 6, 0, 0, tokyo), time.Date(2024, 3, 4, 5, 30, 0, 0, tokyo), []string{"2024/03/04/05"}},
+		{time.Date(2024, 3, 4, 5, 0, 0, 0, tokyo), time.Date(2024, 3, 4, 7, 0, 0, 0, tokyo), []string{"2024/03/04/05", "2024/03/04/06"}},
+		{time.Date(2024, 3, 4, 0, 0, 0, 0, tokyo), time.Date(2024, 3, 5, 0, 0, 0, 0, tokyo), []string{"2024/03/04"}},
+		{time.Date(2023, 11, 30, 23, 0, 0, 0, tokyo), time.Date(2024, 2, 1, 1, 0, 0, 0, tokyo), []string{"2023/11/30/23", "2023/12", "2024/01", "2024/02/01/00"}},
+		{time.Date(2022, 12, 31, 23, 0, 0, 0, tokyo), time.Date(2025, 1, 1, 0, 0, 0, 0, tokyo), []string{"2022/12/31/23", "2023", "2024"}},
+	} {
+		if got := listTargetDirectories(c.from, c.to); !slices.Equal(got, c.want) {
+			t.Errorf("listTargetDirectories(%v, %v) = %v, want %v", c.from, c.to, got, c.want)
+		}
+	}
+}
+
+// Ranges of up to 3 years in zones with DST and non-hour offsets must cover the same hours as enumerating them
+func TestListTargetDirectoriesMatchesHours(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	base := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"UTC", "Asia/Tokyo", "America/New_York", "Europe/London", "Asia/Kolkata"} {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 300; i++ {
+			fromTs := base.Add(time.Duration(r.Int63n(int64(8 * 365 * 24 * time.Hour)))).In(location)
+			if r.Intn(2) == 0 {
+				// aligned to an hour, where partial ranges used to be dropped
+				fromTs = time.Date(fromTs.Year(), fromTs.Month(), fromTs.Day(), r.Intn(2)*fromTs.Hour(), 0, 0, 0, location)
+			}
+			durations := []time.Duration{time.Hour, 24 * time.Hour, 31 * 24 * time.Hour, 3 * 365 * 24 * time.Hour}
+			toTs := fromTs.Add(time.Minute + time.Duration(r.Int63n(int64(durations[r.Intn(len(durations))]))))
+			if r.Intn(2) == 0 {
+				toTs = time.Date(toTs.Year(), toTs.Month(), toTs.Day(), r.Intn(2)*toTs.Hour(), 0, 0, 0, location)
+				if !fromTs.Before(toTs) {
+					continue
+				}
+			}
+			checkTargetDirectories(t, fromTs, toTs)
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, c := range []struct {
+		token, username, password string
+		target                    string
+		authorization             string
+		basicUser, basicPassword  string
+		code                      int
+	}{
+		{token: "secret", target: "/list", code: http.StatusUnauthorized},
+		{token: "secret", target: "/list", authorization: "Bearer secret", code: http.StatusOK},
+		{token: "secret", target: "/list", authorization: "Bearer secret2", code: http.StatusUnauthorized},
+		{token: "secret", target: "/list", authorization: "Bearer ", code: http.StatusUnauthorized},
+		{token: "secret", target: "/file/a.mp4?token=secret", code: http.StatusOK},
+		{token: "secret", target: "/file/a.mp4?token=wrong", code: http.StatusUnauthorized},
+		// ?token= takes precedence over the header
+		{token: "secret", target: "/file/a.mp4?token=wrong", authorization: "Bearer secret", code: http.StatusUnauthorized},
+		// basic auth isn't checked unless configured
+		{token: "secret", target: "/list", basicUser: "admin", basicPassword: "secret", code: http.StatusUnauthorized},
+		{username: "admin", password: "pw", target: "/list", basicUser: "admin", basicPassword: "pw", code: http.StatusOK},
+		{username: "admin", password: "pw", target: "/list", basicUser: "admin", basicPassword: "wrong", code: http.StatusUnauthorized},
+		{username: "admin", password: "pw", target: "/list", basicUser: "guest", basicPassword: "pw", code: http.StatusUnauthorized},
+		{username: "admin", password: "pw", target: "/list", basicUser: "admin", code: http.StatusUnauthorized},
+		{username: "admin", password: "pw", target: "/list?token=", authorization: "Bearer ", code: http.StatusUnauthorized},
+		// either is accepted when both are configured
+		{token: "secret", username: "admin", password: "pw", target: "/list", authorization: "Bearer secret", code: http.StatusOK},
+		{token: "secret", username: "admin", password: "pw", target: "/list", basicUser: "admin", basicPassword: "pw", code: http.StatusOK},
+		{token: "secret", username: "admin", password: "pw", target: "/list", code: http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, c.target, nil)
+		if len(c.authorization) > 0 {
+			r.Header.Set("Authorization", c.authorization)
+		} else if len(c.basicUser) > 0 {
+			r.SetBasicAuth(c.basicUser, c.basicPassword)
+		}
+		w := httptest.NewRecorder()
+		authMiddleware(ok, c.token, c.username, c.password).ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%+v = %v, want %v", c, w.Code, c.code)
+		}
+		// browsers prompt for basic auth only when it's configured
+		if challenge := w.Header().Get("WWW-Authenticate"); (w.Code == http.StatusUnauthorized && len(c.username) > 0) != (len(challenge) > 0) {
+			t.Errorf("%+v answered WWW-Authenticate %q", c, challenge)
+		}
+	}
+}
+
+func TestReadOnlyMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, c := range []struct {
+		method, target string
+		code           int
+	}{
+		{http.MethodGet, "/list", http.StatusOK},
+		{http.MethodHead, "/file/a.mp4", http.StatusOK},
+		{http.MethodOptions, "/query", http.StatusOK},
+		{http.MethodPost, "/query", http.StatusOK},
+		{http.MethodPost, "/annotations", http.StatusOK},
+		{http.MethodPost, "/live/stop", http.StatusOK},
+		{http.MethodDelete, "/file/a.mp4", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/archive/a.mp4", http.StatusMethodNotAllowed},
+		{http.MethodPut, "/file/a.mp4", http.StatusMethodNotAllowed},
+		{http.MethodPatch, "/query", http.StatusMethodNotAllowed},
+		// only the exact paths of the queries
+		{http.MethodPost, "/query/../archive/a.mp4", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/query/", http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		readOnlyMiddleware(ok).ServeHTTP(w, httptest.NewRequest(c.method, c.target, nil))
+		if w.Code != c.code {
+			t.Errorf("%v %v = %v, want %v", c.method, c.target, w.Code, c.code)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package datasource
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+)
+
+// Devices of the SDM projects, which only the consumer knows
+type DeviceSource interface {
+	Devices() []Device
+}
+
+// Device of /devices, with the state also in /stats
+type Device struct {
+	DeviceHealth
+	Name        string          `json:"name"` // full name e.g. enterprises/<project>/devices/<device>
+	Type        string          `json:"type"` // e.g. sdm.devices.types.DOORBELL
+	Room        string          `json:"room,omitempty"`
+	Structure   string          `json:"structure,omitempty"`
+	Traits      json.RawMessage `json:"traits,omitempty"`      // traits as returned by SDM
+	LastEvent   string          `json:"lastEvent,omitempty"`   // e.g. chime
+	LastEventAt int64           `json:"lastEventAt,omitempty"` // unix millis
+}
+
+// GET /devices?device=: []Device matching device
+func devicesHandler(devices DeviceSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := newClipFilter(r.URL.Query())
+		writeJson(w, slices.DeleteFunc(devices.Devices(), func(d Device) bool { return !filter.MatchDevice(d.Device, d.DeviceName) }))
+	}
+}
@@ -0,0 +1,105 @@
+package datasource
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Row of /export: the /list entry with the details of the metadata sidecar
+type exportRecord struct {
+	listEntry
+	ReceivedAt   string   `json:"receivedAt,omitempty"`
+	SavedAt      string   `json:"savedAt,omitempty"`
+	LateArrival  bool     `json:"lateArrival"`
+	FamiliarFace string   `json:"familiarFace,omitempty"`
+	Detections   []string `json:"detections,omitempty"` // distinct labels
+	Faces        []string `json:"faces,omitempty"`      // names, "unknown" for unknown faces
+	Sounds       []string `json:"sounds,omitempty"`
+}
+
+var exportCsvHeader = []string{"timestamp", "eventType", "device", "deviceName", "path", "url", "sizeBytes", "durationSec", "receivedAt", "savedAt", "lateArrival", "familiarFace", "detections", "faces", "sounds"}
+
+func newExportRecord(c *clip, archive fs.FS, location *time.Location) exportRecord {
+	record := exportRecord{listEntry: c.ListEntry(archive, location, false)}
+	if c.Metadata == nil {
+		return record
+	}
+	record.ReceivedAt = c.Metadata.ReceivedAt
+	record.SavedAt = c.Metadata.SavedAt
+	record.LateArrival = c.Metadata.LateArrival
+	record.FamiliarFace = c.Metadata.FamiliarFace
+	for _, detection := range c.Metadata.Detections {
+		if !slices.Contains(record.Detections, detection.Label) {
+			record.Detections = append(record.Detections, detection.Label)
+		}
+	}
+	for _, face := range c.Metadata.Faces {
+		name := face.Name
+		if len(name) == 0 {
+			name = "unknown"
+		}
+		record.Faces = append(record.Faces, name)
+	}
+	record.Sounds = c.Metadata.Sounds
+	return record
+}
+
+func (r *exportRecord) csvRow() []string {
+	duration := ""
+	if r.DurationSec > 0 {
+		duration = strconv.FormatFloat(r.DurationSec, 'f', 3, 64)
+	}
+	return []string{
+		r.Timestamp, r.EventType, r.Device, r.DeviceName, r.Path, r.Url, strconv.FormatInt(r.SizeBytes, 10), duration,
+		r.ReceivedAt, r.SavedAt, strconv.FormatBool(r.LateArrival), r.FamiliarFace,
+		strings.Join(r.Detections, ";"), strings.Join(r.Faces, ";"), strings.Join(r.Sounds, ";"),
+	}
+}
+
+// /export?from=&to=&format=csv|json of every clip in the range (default the last 24 hours) oldest first, filtered by
+// eventType and device like /list. Unlike /list it isn't paged, for spreadsheets and notebooks
+func exportHandler(clips func(fromTs, toTs time.Time) []clip, archive fs.FS, location *time.Location) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fromTs, toTs, err := parseRange(r, location)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if len(format) == 0 {
+			format = "json"
+		}
+		if format != "json" && format != "csv" {
+			http.Error(w, "format should be csv or json", http.StatusBadRequest)
+			return
+		}
+		filter := newClipFilter(r.URL.Query())
+		records := []exportRecord{}
+		for _, c := range clips(fromTs, toTs) {
+			if filter.Match(&c) {
+				records = append(records, newExportRecord(&c, archive, location))
+			}
+		}
+		fileName := fmt.Sprintf("events-%v-%v.%v", fromTs.Format("20060102T1504"), toTs.Format("20060102T1504"), format)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+		if format == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(records)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Write(exportCsvHeader)
+		for _, record := range records {
+			cw.Write(record.csvRow())
+		}
+		cw.Flush()
+	}
+}
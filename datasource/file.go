@@ -0,0 +1,59 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+// Content types of the files saved by the consumer. mime.TypeByExtension depends on /etc/mime.types, which slim
+// containers don't have, and falls back to sniffing e.g. application/octet-stream for raw H.264.
+var contentTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".h264": "video/h264",
+	".webm": "video/webm",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".json": "application/json",
+}
+
+// Serve files of the archive by http.FileServer, which handles Range, If-Range and Last-Modified, with the
+// Content-Type and ETag it can't know. Files of unknown extension (e.g. .video.unknown) get the Content-Type of the
+// download recorded in the metadata sidecar.
+func newFileHandler(archive fs.FS) http.Handler {
+	fileServer := http.FileServer(http.FS(archive))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if info, err := fs.Stat(archive, p); err == nil && info.Mode().IsRegular() {
+			if contentType := fileContentType(archive, p); len(contentType) > 0 {
+				w.Header().Set("Content-Type", contentType)
+			}
+			w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// Empty if unknown, which lets http.FileServer sniff the content
+func fileContentType(archive fs.FS, p string) string {
+	ext := strings.ToLower(path.Ext(p))
+	if contentType, ok := contentTypes[ext]; ok {
+		return contentType
+	}
+	if b, err := fs.ReadFile(archive, storage.ClipMetadataPath(p)); err == nil {
+		var metadata storage.ClipMetadata
+		if err := json.Unmarshal(b, &metadata); err == nil && len(metadata.Download.ContentType) > 0 {
+			return metadata.Download.ContentType
+		}
+	}
+	return mime.TypeByExtension(ext)
+}
@@ -0,0 +1,160 @@
+package datasource
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+const hlsPlaylist = "index.m3u8"
+
+// segment files written by ffmpeg, and the playlist
+var hlsFileName = regexp.MustCompile(`^(index\.m3u8|segment[0-9]+\.ts)$`)
+
+// Clips transcoded on demand by ffmpeg into H.264/AAC HLS, which every browser plays. Transcoded clips are cached in
+// dir, and the least recently used ones are removed beyond maxClips.
+type hlsTranscoder struct {
+	archive  fs.FS
+	dir      string
+	ffmpeg   string
+	maxClips int
+
+	transcodeMu sync.Mutex // one ffmpeg at a time like thumbnails
+
+	mu      sync.Mutex
+	lru     *list.List               // cache keys, most recently used first
+	entries map[string]*list.Element // cache key -> element of lru
+}
+
+func newHlsTranscoder(archive fs.FS, dir string, maxClips int) (*hlsTranscoder, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("HLS needs ffmpeg: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	if maxClips < 1 {
+		maxClips = 1
+	}
+	t := &hlsTranscoder{archive: archive, dir: dir, ffmpeg: ffmpeg, maxClips: maxClips, lru: list.New(), entries: map[string]*list.Element{}}
+	// clips transcoded by the previous run are not in the LRU
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && len(strings.TrimSuffix(entry.Name(), storage.TempFileExtension)) == 64 {
+			os.RemoveAll(filepath.Join(dir, entry.Name()))
+		}
+	}
+	return t, nil
+}
+
+// Directory of the playlist and segments of the clip, transcoded if missing
+func (t *hlsTranscoder) Transcode(ctx context.Context, p string) (string, error) {
+	key, err := clipCacheKey(t.archive, p)
+	if err != nil {
+		return "", err
+	}
+	outDir := filepath.Join(t.dir, key)
+	if t.touch(key) {
+		return outDir, nil
+	}
+
+	t.transcodeMu.Lock()
+	defer t.transcodeMu.Unlock()
+	if t.touch(key) {
+		// transcoded while waiting
+		return outDir, nil
+	}
+	input, err := copyClipToTemp(t.archive, t.dir, p)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(input)
+	tempDir := outDir + storage.TempFileExtension
+	os.RemoveAll(tempDir)
+	if err := os.Mkdir(tempDir, 0777); err != nil {
+		return "", err
+	}
+	cmd := exec.CommandContext(ctx, t.ffmpeg, "-loglevel", "error", "-i", input,
+		"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p", "-c:a", "aac",
+		"-f", "hls", "-hls_time", "4", "-hls_playlist_type", "vod", "-hls_segment_filename", filepath.Join(tempDir, "segment%03d.ts"),
+		filepath.Join(tempDir, hlsPlaylist))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.RemoveAll(tempDir)
+		return "", fmt.Errorf("ffmpeg failed: %v: %s", err, out)
+	}
+	if err := os.Rename(tempDir, outDir); err != nil {
+		os.RemoveAll(tempDir)
+		return "", err
+	}
+	t.add(key)
+	return outDir, nil
+}
+
+// Mark the transcoded clip as used. false if it's not cached
+func (t *hlsTranscoder) touch(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elem, ok := t.entries[key]
+	if ok {
+		t.lru.MoveToFront(elem)
+	}
+	return ok
+}
+
+func (t *hlsTranscoder) add(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[key] = t.lru.PushFront(key)
+	for t.lru.Len() > t.maxClips {
+		oldest := t.lru.Remove(t.lru.Back()).(string)
+		delete(t.entries, oldest)
+		if err := os.RemoveAll(filepath.Join(t.dir, oldest)); err != nil {
+			log.Printf("Failed to remove transcoded clip %v: %v", oldest, err)
+		}
+	}
+}
+
+// /hls/<clip path>/index.m3u8 and the segments it refers
+func (t *hlsTranscoder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(path.Clean("/"+r.PathValue("path")), "/")
+	clipPath, fileName := path.Dir(p), path.Base(p)
+	if !hlsFileName.MatchString(fileName) || clipPath == "." {
+		http.NotFound(w, r)
+		return
+	}
+	if ext := path.Ext(clipPath); ext == ".json" || ext == storage.TempFileExtension {
+		http.NotFound(w, r)
+		return
+	}
+	if info, err := fs.Stat(t.archive, clipPath); err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	dir, err := t.Transcode(r.Context(), clipPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if fileName == hlsPlaylist {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	} else {
+		w.Header().Set("Content-Type", "video/mp2t")
+	}
+	http.ServeFile(w, r, filepath.Join(dir, fileName))
+}
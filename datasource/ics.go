@@ -0,0 +1,131 @@
+package datasource
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Days of events in /events.ics without from
+const icsDefaultDays = 30
+
+// Length of calendar entries, as clips have no end
+const icsEventDuration = time.Minute
+
+// /events.ics of chime and person events (or eventType) as iCalendar, to subscribe from calendar apps. Without from
+// and to, the last 30 days. Calendar apps can't send the Authorization header, so give ?token= when required, which
+// links of the entries carry on.
+func icsHandler(clips func(fromTs, toTs time.Time) []clip, location *time.Location) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		query := r.URL.Query()
+		fromTs, err := parseUnixTimeOrDefault(query.Get("from"), now.AddDate(0, 0, -icsDefaultDays), location)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		toTs, err := parseUnixTimeOrDefault(query.Get("to"), now, location)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !fromTs.Before(toTs) {
+			http.Error(w, "from should be less than to", http.StatusBadRequest)
+			return
+		}
+		if len(query.Get("eventType")) == 0 {
+			query.Set("eventType", "chime,person")
+		}
+		filter := newClipFilter(query)
+		base := requestBaseUrl(r)
+		var b strings.Builder
+		b.WriteString("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//NestDoorbellConsumer//datasource//EN\r\nCALSCALE:GREGORIAN\r\n")
+		writeIcsLine(&b, "X-WR-CALNAME", "Doorbell")
+		if location != time.Local {
+			writeIcsLine(&b, "X-WR-TIMEZONE", location.String())
+		}
+		for _, c := range clips(fromTs, toTs) {
+			if c.Metadata == nil || !filter.Match(&c) {
+				continue
+			}
+			link := base + path.Join("/file", c.Path)
+			if token := r.URL.Query().Get("token"); len(token) > 0 {
+				link += "?token=" + url.QueryEscape(token)
+			}
+			device := c.Metadata.DeviceName
+			if len(device) == 0 {
+				device = sdmevents.DeviceId(c.Device())
+			}
+			summary := "Doorbell " + c.EventName()
+			if len(c.Metadata.FamiliarFace) > 0 {
+				summary += " (" + c.Metadata.FamiliarFace + ")"
+			}
+			description := []string{"Device: " + device}
+			labels := []string{}
+			for _, detection := range c.Metadata.Detections {
+				if !slices.Contains(labels, detection.Label) {
+					labels = append(labels, detection.Label)
+				}
+			}
+			if len(labels) > 0 {
+				description = append(description, "Detected: "+strings.Join(labels, ", "))
+			}
+			description = append(description, link)
+			start := c.Time.UTC()
+			b.WriteString("BEGIN:VEVENT\r\n")
+			writeIcsLine(&b, "UID", c.Path+"@nest-doorbell-consumer")
+			writeIcsLine(&b, "DTSTAMP", start.Format("20060102T150405Z"))
+			writeIcsLine(&b, "DTSTART", start.Format("20060102T150405Z"))
+			writeIcsLine(&b, "DTEND", start.Add(icsEventDuration).Format("20060102T150405Z"))
+			writeIcsLine(&b, "SUMMARY", escapeIcsText(summary+" at "+device))
+			writeIcsLine(&b, "DESCRIPTION", escapeIcsText(strings.Join(description, "\n")))
+			writeIcsLine(&b, "LOCATION", escapeIcsText(device))
+			writeIcsLine(&b, "URL", link)
+			writeIcsLine(&b, "TRANSP", "TRANSPARENT")
+			b.WriteString("END:VEVENT\r\n")
+		}
+		b.WriteString("END:VCALENDAR\r\n")
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Write([]byte(b.String()))
+	}
+}
+
+// scheme://host of the request, behind reverse proxies setting X-Forwarded-Proto
+func requestBaseUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); len(proto) > 0 {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// TEXT value of RFC 5545
+func escapeIcsText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// Content line folded at 75 octets without splitting UTF-8 characters
+func writeIcsLine(b *strings.Builder, name string, value string) {
+	line := name + ":" + value
+	width := 75
+	for len(line) > width {
+		cut := width
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		fmt.Fprintf(b, "%v\r\n ", line[:cut])
+		line = line[cut:]
+		// the leading space of continuation lines counts
+		width = 74
+	}
+	b.WriteString(line + "\r\n")
+}
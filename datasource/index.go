@@ -0,0 +1,456 @@
+package datasource
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+// In-memory index of the clips in the archive, so that range queries don't walk the archive per request.
+//
+// The consumer writes clips into the directory of the current hour, which Watch rescans frequently. Clips written into
+// older directories (e.g. deferred downloads) or removed from the archive are picked up by the periodic rebuild.
+// Clips outside of storage.PathTemplate (another -output-file-path-format) are listed by their time, and are indexed
+// only by the rebuild or Add.
+//
+// Indexes opened by OpenClipIndex with a file persist the clips into it, so that a restart answers from the file at
+// once. Watch rebuilds such an index first to pick up what changed while it was stopped.
+type ClipIndex struct {
+	archive  fs.FS
+	location *time.Location
+	store    *clipStore // nil keeps the clips only in memory
+	stale    bool       // loaded from the store, not rebuilt yet
+
+	mu    sync.RWMutex
+	dirs  []indexDir // sorted by start
+	loose indexDir   // clips outside of the layout
+
+	generation atomic.Uint64 // incremented whenever indexed clips change
+
+	subscribersMu sync.Mutex
+	subscribers   map[chan clip]bool
+}
+
+// Hour directory of the layout e.g. 2024/03/04/05
+type indexDir struct {
+	path  string
+	start time.Time
+	clips []clip
+}
+
+// Index every clip of the archive in memory. Takes a while for a large archive.
+func NewClipIndex(archive fs.FS, location *time.Location) *ClipIndex {
+	if location == nil {
+		location = time.Local
+	}
+	index := &ClipIndex{archive: archive, location: location}
+	index.Rebuild()
+	return index
+}
+
+// Index persisted in the bbolt file at path, which is created if missing. Clips stored by the last run are loaded
+// without walking the archive; the archive is indexed only when the file has none. Empty path is NewClipIndex
+func OpenClipIndex(archive fs.FS, location *time.Location, path string) (*ClipIndex, error) {
+	if len(path) == 0 {
+		return NewClipIndex(archive, location), nil
+	}
+	if location == nil {
+		location = time.Local
+	}
+	store, err := openClipStore(path)
+	if err != nil {
+		return nil, err
+	}
+	clips, err := store.load()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	index := &ClipIndex{archive: archive, location: location, store: store}
+	if len(clips) == 0 {
+		index.Rebuild()
+		return index, nil
+	}
+	index.load(clips)
+	index.stale = true
+	log.Printf("Loaded %v clips of the index from %v", len(clips), path)
+	return index, nil
+}
+
+// Place stored clips into their directories
+func (index *ClipIndex) load(clips []clip) {
+	byDir := map[string]*indexDir{}
+	for _, c := range clips {
+		dir, ok := index.hourDir(c.Path)
+		if !ok {
+			if isLooseClip(&c) {
+				index.loose.Add(c)
+			}
+			continue
+		}
+		d, ok := byDir[dir]
+		if !ok {
+			start, _ := time.ParseInLocation(storage.PathTemplate, dir, index.location)
+			d = &indexDir{path: dir, start: start, clips: []clip{}}
+			byDir[dir] = d
+		}
+		d.clips = append(d.clips, c)
+	}
+	for _, d := range byDir {
+		index.dirs = append(index.dirs, *d)
+	}
+	sort.Slice(index.dirs, func(i, j int) bool { return index.dirs[i].start.Before(index.dirs[j].start) })
+	index.generation.Add(1)
+}
+
+// Close the file of the index opened by OpenClipIndex. The index is still usable in memory.
+func (index *ClipIndex) Close() error {
+	index.mu.Lock()
+	store := index.store
+	index.store = nil
+	index.mu.Unlock()
+	return store.Close()
+}
+
+// Persist clips of dirs not in known, and delete previous ones not in dirs. Failures are logged, the next rebuild
+// writes them again
+func (index *ClipIndex) persist(dirs []indexDir, known map[string]clip, previous map[string]bool) {
+	index.mu.RLock()
+	store := index.store
+	index.mu.RUnlock()
+	if store == nil {
+		return
+	}
+	put := []clip{}
+	current := map[string]bool{}
+	for _, d := range dirs {
+		for _, c := range d.clips {
+			current[c.Path] = true
+			if _, ok := known[c.Path]; !ok {
+				put = append(put, c)
+			}
+		}
+	}
+	removed := []string{}
+	for p := range previous {
+		if !current[p] {
+			removed = append(removed, p)
+		}
+	}
+	if err := store.update(put, removed); err != nil {
+		log.Printf("Failed to store the clip index: %v", err)
+	}
+}
+
+// Walk the whole archive again. Metadata of already indexed clips is reused.
+func (index *ClipIndex) Rebuild() {
+	started := time.Now()
+	paths := map[string][]string{}
+	loosePaths := []string{}
+	for _, p := range walkClips(index.archive, ".") {
+		if dir, ok := index.hourDir(p); ok {
+			paths[dir] = append(paths[dir], p)
+		} else {
+			loosePaths = append(loosePaths, p)
+		}
+	}
+	index.mu.RLock()
+	known := knownClips(append([]indexDir{index.loose}, index.dirs...))
+	previous := clipPaths(append([]indexDir{index.loose}, index.dirs...))
+	index.mu.RUnlock()
+
+	dirs := []indexDir{}
+	count := 0
+	for dir, dirPaths := range paths {
+		d, _ := index.loadDir(dir, dirPaths, known)
+		dirs = append(dirs, d)
+		count += len(d.clips)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].start.Before(dirs[j].start) })
+	loose := indexDir{clips: []clip{}}
+	looseDir, _ := index.loadDir("", loosePaths, known)
+	for _, c := range looseDir.clips {
+		if isLooseClip(&c) {
+			loose.clips = append(loose.clips, c)
+		}
+	}
+	count += len(loose.clips)
+	index.mu.Lock()
+	index.dirs = dirs
+	index.loose = loose
+	index.stale = false
+	index.mu.Unlock()
+	index.generation.Add(1)
+	index.persist(append(dirs, loose), known, previous)
+	index.notifyNew(previous, append(dirs, loose))
+	log.Printf("Indexed %v clips in %v directories (took %v)", count, len(dirs), time.Since(started))
+}
+
+// Rescan the hour directories overlapping [fromTs, toTs)
+func (index *ClipIndex) Refresh(fromTs time.Time, toTs time.Time) {
+	from := fromTs.In(index.location)
+	for t := time.Date(from.Year(), from.Month(), from.Day(), from.Hour(), 0, 0, 0, index.location); t.Before(toTs); t = t.Add(time.Hour) {
+		dir := t.Format(storage.PathTemplate)
+		index.mu.RLock()
+		var known map[string]clip
+		var previous map[string]bool
+		if i, ok := index.find(dir); ok {
+			known = knownClips(index.dirs[i : i+1])
+			previous = clipPaths(index.dirs[i : i+1])
+		}
+		index.mu.RUnlock()
+
+		d, loaded := index.loadDir(dir, walkClips(index.archive, dir), known)
+		index.mu.Lock()
+		i, ok := index.find(dir)
+		switch {
+		case ok && len(d.clips) == 0:
+			index.dirs = append(index.dirs[:i], index.dirs[i+1:]...)
+		case ok:
+			index.dirs[i] = d
+		case len(d.clips) > 0:
+			index.dirs = append(index.dirs[:i], append([]indexDir{d}, index.dirs[i:]...)...)
+		}
+		index.mu.Unlock()
+		if loaded > 0 || len(d.clips) != len(previous) {
+			index.generation.Add(1)
+			index.persist([]indexDir{d}, known, previous)
+		}
+		index.notifyNew(previous, []indexDir{d})
+	}
+}
+
+// Index the clip at p without waiting for Watch e.g. when the consumer in the same process saved it
+func (index *ClipIndex) Add(p string) {
+	c := loadClip(index.archive, p)
+	added := index.add(c)
+	index.generation.Add(1)
+	if _, ok := index.hourDir(p); ok || isLooseClip(&c) {
+		index.persist([]indexDir{{clips: []clip{c}}}, nil, nil)
+	}
+	if added {
+		index.notify(c)
+	}
+}
+
+// true if c is newly indexed
+func (index *ClipIndex) add(c clip) bool {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	dir, ok := index.hourDir(c.Path)
+	if !ok {
+		return isLooseClip(&c) && index.loose.Add(c)
+	}
+	i, ok := index.find(dir)
+	if !ok {
+		start, _ := time.ParseInLocation(storage.PathTemplate, dir, index.location)
+		index.dirs = append(index.dirs[:i], append([]indexDir{{path: dir, start: start, clips: []clip{c}}}, index.dirs[i:]...)...)
+		return true
+	}
+	return index.dirs[i].Add(c)
+}
+
+// Drop the clip at p without waiting for Watch e.g. when it's deleted or moved by the datasource
+func (index *ClipIndex) Remove(p string) {
+	index.mu.Lock()
+	if dir, ok := index.hourDir(p); !ok {
+		index.loose.Remove(p)
+	} else if i, ok := index.find(dir); ok {
+		index.dirs[i].Remove(p)
+		if len(index.dirs[i].clips) == 0 {
+			index.dirs = append(index.dirs[:i], index.dirs[i+1:]...)
+		}
+	}
+	index.mu.Unlock()
+	index.generation.Add(1)
+	index.persist(nil, nil, map[string]bool{p: true})
+}
+
+func (d *indexDir) Remove(p string) {
+	d.clips = slices.DeleteFunc(d.clips, func(c clip) bool { return c.Path == p })
+}
+
+// Add or replace the clip of the same path. true if added
+func (d *indexDir) Add(c clip) bool {
+	for i := range d.clips {
+		if d.clips[i].Path == c.Path {
+			d.clips[i] = c
+			return false
+		}
+	}
+	d.clips = append(d.clips, c)
+	return true
+}
+
+// Receive clips newly indexed until unsubscribed. Clips are dropped while the receiver is behind.
+func (index *ClipIndex) Subscribe() (<-chan clip, func()) {
+	ch := make(chan clip, 16)
+	index.subscribersMu.Lock()
+	if index.subscribers == nil {
+		index.subscribers = map[chan clip]bool{}
+	}
+	index.subscribers[ch] = true
+	index.subscribersMu.Unlock()
+	return ch, func() {
+		index.subscribersMu.Lock()
+		delete(index.subscribers, ch)
+		index.subscribersMu.Unlock()
+	}
+}
+
+func (index *ClipIndex) notify(c clip) {
+	index.subscribersMu.Lock()
+	defer index.subscribersMu.Unlock()
+	for ch := range index.subscribers {
+		select {
+		case ch <- c:
+		default:
+		}
+	}
+}
+
+// Notify clips of dirs not in previous
+func (index *ClipIndex) notifyNew(previous map[string]bool, dirs []indexDir) {
+	index.subscribersMu.Lock()
+	subscribed := len(index.subscribers) > 0
+	index.subscribersMu.Unlock()
+	if !subscribed {
+		return
+	}
+	for _, d := range dirs {
+		for _, c := range d.clips {
+			if !previous[c.Path] {
+				index.notify(c)
+			}
+		}
+	}
+}
+
+// Refresh recent directories every refresh, and rebuild every rebuild until ctx is done. 0 rebuild never rebuilds.
+// An index loaded from its file is rebuilt first.
+func (index *ClipIndex) Watch(ctx context.Context, refresh time.Duration, rebuild time.Duration) {
+	index.mu.RLock()
+	stale := index.stale
+	index.mu.RUnlock()
+	if stale {
+		index.Rebuild()
+	}
+	refreshTicker := time.NewTicker(refresh)
+	defer refreshTicker.Stop()
+	var rebuildC <-chan time.Time
+	if rebuild > 0 {
+		rebuildTicker := time.NewTicker(rebuild)
+		defer rebuildTicker.Stop()
+		rebuildC = rebuildTicker.C
+	}
+	lastRefresh := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-refreshTicker.C:
+			// clips are placed by the event time, so downloads finishing after the hour go to the previous directory
+			index.Refresh(lastRefresh.Add(-time.Hour), now.Add(time.Nanosecond))
+			lastRefresh = now
+		case <-rebuildC:
+			index.Rebuild()
+		}
+	}
+}
+
+// Incremented whenever indexed clips change e.g. to invalidate cached responses
+func (index *ClipIndex) Generation() uint64 {
+	return index.generation.Load()
+}
+
+// Clips in [fromTs, toTs) sorted by time, same as loadClips
+func (index *ClipIndex) Clips(fromTs time.Time, toTs time.Time) []clip {
+	clips := []clip{}
+	index.mu.RLock()
+	i := sort.Search(len(index.dirs), func(i int) bool { return index.dirs[i].start.Add(time.Hour).After(fromTs) })
+	for ; i < len(index.dirs) && index.dirs[i].start.Before(toTs); i++ {
+		clips = append(clips, index.dirs[i].clips...)
+	}
+	for _, c := range index.loose.clips {
+		if !c.Time.Before(fromTs) && c.Time.Before(toTs) {
+			clips = append(clips, c)
+		}
+	}
+	index.mu.RUnlock()
+	sort.SliceStable(clips, func(i, j int) bool { return clips[i].Time.Before(clips[j].Time) })
+	return clips
+}
+
+// Hour directory of the clip file. false if the file is not in the layout
+func (index *ClipIndex) hourDir(p string) (string, bool) {
+	depth := strings.Count(storage.PathTemplate, "/") + 1
+	components := strings.SplitN(p, "/", depth+1)
+	if len(components) <= depth {
+		return "", false
+	}
+	dir := strings.Join(components[:depth], "/")
+	if _, err := time.ParseInLocation(storage.PathTemplate, dir, index.location); err != nil {
+		return "", false
+	}
+	return dir, true
+}
+
+// Position of dir in index.dirs, or where it should be inserted. index.mu must be held.
+func (index *ClipIndex) find(dir string) (int, bool) {
+	start, _ := time.ParseInLocation(storage.PathTemplate, dir, index.location)
+	i := sort.Search(len(index.dirs), func(i int) bool { return !index.dirs[i].start.Before(start) })
+	for j := i; j < len(index.dirs) && index.dirs[j].start.Equal(start); j++ {
+		if index.dirs[j].path == dir {
+			return j, true
+		}
+	}
+	return i, false
+}
+
+// Clips of paths reusing known ones, and the number of clips loaded from the archive
+func (index *ClipIndex) loadDir(dir string, paths []string, known map[string]clip) (indexDir, int) {
+	start, _ := time.ParseInLocation(storage.PathTemplate, dir, index.location)
+	d := indexDir{path: dir, start: start, clips: []clip{}}
+	loaded := 0
+	for _, p := range paths {
+		if c, ok := known[p]; ok {
+			d.clips = append(d.clips, c)
+		} else {
+			d.clips = append(d.clips, loadClip(index.archive, p))
+			loaded++
+		}
+	}
+	return d, loaded
+}
+
+// Indexed clips which don't need to be loaded again. Clips without metadata are loaded again, since the consumer
+// writes the sidecar after the clip.
+func knownClips(dirs []indexDir) map[string]clip {
+	known := map[string]clip{}
+	for _, d := range dirs {
+		for _, c := range d.clips {
+			if c.Metadata != nil {
+				known[c.Path] = c
+			}
+		}
+	}
+	return known
+}
+
+func clipPaths(dirs []indexDir) map[string]bool {
+	paths := map[string]bool{}
+	for _, d := range dirs {
+		for _, c := range d.clips {
+			paths[c.Path] = true
+		}
+	}
+	return paths
+}
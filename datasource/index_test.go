@@ -0,0 +1,212 @@
+package datasource
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func sidecar(timestamp string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(`{"eventType":"sdm.devices.events.DoorbellChime.Chime","eventTimestamp":"` + timestamp + `"}`)}
+}
+
+// Clips of 2024/03/04 05:00-07:00 UTC and one archived outside of the layout
+func testArchive() fstest.MapFS {
+	modTime := time.Date(2024, 3, 4, 6, 30, 0, 0, time.UTC)
+	return fstest.MapFS{
+		"2024/03/04/05/b_0.mp4":      {},
+		"2024/03/04/05/b_0.mp4.json": sidecar("2024-03-04T05:40:00Z"),
+		// listed after b_0 by its time, though walked first
+		"2024/03/04/05/a_0.mp4":      {},
+		"2024/03/04/05/a_0.mp4.json": sidecar("2024-03-04T05:50:00Z"),
+		"2024/03/04/05/c_0.mp4.tmp":  {},
+		// without sidecar, by the modification time
+		"2024/03/04/06/d_0.mp4":            {ModTime: modTime},
+		"archived/2024/03/01/e_0.mp4":      {},
+		"archived/2024/03/01/e_0.mp4.json": sidecar("2024-03-04T05:45:00Z"),
+		"notes.txt":                        {ModTime: modTime},
+		".pending_downloads.json":          {ModTime: modTime},
+	}
+}
+
+func clipPathsOf(clips []clip) []string {
+	paths := []string{}
+	for _, c := range clips {
+		paths = append(paths, c.Path)
+	}
+	return paths
+}
+
+func checkClips(t *testing.T, index *ClipIndex, from, to time.Time, want ...string) {
+	t.Helper()
+	if got := clipPathsOf(index.Clips(from, to)); !slices.Equal(got, want) {
+		t.Errorf("Clips(%v, %v) = %v, want %v", from.Format("15:04"), to.Format("15:04"), got, want)
+	}
+}
+
+func at(hour, minute int) time.Time {
+	return time.Date(2024, 3, 4, hour, minute, 0, 0, time.UTC)
+}
+
+func TestClipIndexClips(t *testing.T) {
+	index := NewClipIndex(testArchive(), time.UTC)
+	checkClips(t, index, at(0, 0), at(12, 0), "2024/03/04/05/b_0.mp4", "archived/2024/03/01/e_0.mp4", "2024/03/04/05/a_0.mp4", "2024/03/04/06/d_0.mp4")
+	// hour directories overlapping the range, and loose clips by their time
+	checkClips(t, index, at(5, 45), at(6, 0), "2024/03/04/05/b_0.mp4", "archived/2024/03/01/e_0.mp4", "2024/03/04/05/a_0.mp4")
+	checkClips(t, index, at(6, 0), at(7, 0), "2024/03/04/06/d_0.mp4")
+	checkClips(t, index, at(7, 0), at(8, 0))
+	if len(index.dirs) != 2 {
+		t.Errorf("indexed %v directories, want 2", len(index.dirs))
+	}
+	c := index.Clips(at(5, 0), at(6, 0))[0]
+	if c.Metadata == nil || c.EventName() != "chime" || !c.Time.Equal(at(5, 40)) {
+		t.Errorf("clip = %+v, want chime at 05:40 with metadata", c)
+	}
+}
+
+func TestClipIndexAddRemove(t *testing.T) {
+	archive := testArchive()
+	index := NewClipIndex(archive, time.UTC)
+	added, unsubscribe := index.Subscribe()
+	defer unsubscribe()
+	generation := index.Generation()
+
+	archive["2024/03/04/07/f_0.mp4"] = &fstest.MapFile{}
+	archive["2024/03/04/07/f_0.mp4.json"] = sidecar("2024-03-04T07:10:00Z")
+	index.Add("2024/03/04/07/f_0.mp4")
+	checkClips(t, index, at(7, 0), at(8, 0), "2024/03/04/07/f_0.mp4")
+	if index.Generation() == generation {
+		t.Error("generation is not incremented by Add")
+	}
+	select {
+	case c := <-added:
+		if c.Path != "2024/03/04/07/f_0.mp4" {
+			t.Errorf("subscriber got %v", c.Path)
+		}
+	default:
+		t.Error("subscriber got nothing")
+	}
+	// adding again replaces the clip without notifying it again
+	archive["2024/03/04/07/f_0.mp4.json"] = sidecar("2024-03-04T07:20:00Z")
+	index.Add("2024/03/04/07/f_0.mp4")
+	if clips := index.Clips(at(7, 0), at(8, 0)); len(clips) != 1 || !clips[0].Time.Equal(at(7, 20)) {
+		t.Errorf("clips after adding again = %+v, want replaced by the new sidecar", clips)
+	}
+	select {
+	case c := <-added:
+		t.Errorf("subscriber got replaced clip %v", c.Path)
+	default:
+	}
+	// loose files which aren't clips are not indexed
+	index.Add("notes.txt")
+	checkClips(t, index, at(6, 0), at(7, 0), "2024/03/04/06/d_0.mp4")
+
+	index.Remove("2024/03/04/07/f_0.mp4")
+	checkClips(t, index, at(7, 0), at(8, 0))
+	index.Remove("archived/2024/03/01/e_0.mp4")
+	checkClips(t, index, at(5, 0), at(6, 0), "2024/03/04/05/b_0.mp4", "2024/03/04/05/a_0.mp4")
+	if len(index.dirs) != 2 {
+		t.Errorf("indexed %v directories after removing the only clip of 07, want 2", len(index.dirs))
+	}
+	// unknown paths are ignored
+	index.Remove("2024/03/04/09/x_0.mp4")
+	index.Remove("nothing.mp4")
+}
+
+func TestClipIndexRefresh(t *testing.T) {
+	archive := testArchive()
+	index := NewClipIndex(archive, time.UTC)
+	added, unsubscribe := index.Subscribe()
+	defer unsubscribe()
+
+	// written by another process
+	archive["2024/03/04/06/g_0.mp4"] = &fstest.MapFile{}
+	archive["2024/03/04/06/g_0.mp4.json"] = sidecar("2024-03-04T06:40:00Z")
+	delete(archive, "2024/03/04/05/a_0.mp4")
+	delete(archive, "2024/03/04/05/a_0.mp4.json")
+	delete(archive, "2024/03/04/05/b_0.mp4")
+	delete(archive, "2024/03/04/05/b_0.mp4.json")
+	// clips without sidecar are loaded again until it's written
+	archive["2024/03/04/06/d_0.mp4.json"] = sidecar("2024-03-04T06:30:00Z")
+	// a clip outside of the range isn't picked up
+	archive["2024/03/04/08/h_0.mp4"] = &fstest.MapFile{}
+
+	generation := index.Generation()
+	index.Refresh(at(5, 30), at(6, 30))
+	checkClips(t, index, at(0, 0), at(12, 0), "archived/2024/03/01/e_0.mp4", "2024/03/04/06/d_0.mp4", "2024/03/04/06/g_0.mp4")
+	if index.Generation() == generation {
+		t.Error("generation is not incremented by Refresh")
+	}
+	// the emptied directory is dropped
+	if len(index.dirs) != 1 || index.dirs[0].path != "2024/03/04/06" {
+		t.Errorf("directories after refresh = %v, want only 2024/03/04/06", index.dirs)
+	}
+	select {
+	case c := <-added:
+		if c.Path != "2024/03/04/06/g_0.mp4" {
+			t.Errorf("subscriber got %v", c.Path)
+		}
+	default:
+		t.Error("subscriber got nothing")
+	}
+	select {
+	case c := <-added:
+		t.Errorf("subscriber got %v, which was indexed already", c.Path)
+	default:
+	}
+	// nothing changed, clips with sidecar aren't loaded again
+	generation = index.Generation()
+	index.Refresh(at(6, 0), at(7, 0))
+	if index.Generation() != generation {
+		t.Error("generation is incremented without changes")
+	}
+	index.Rebuild()
+	checkClips(t, index, at(8, 0), at(9, 0), "2024/03/04/08/h_0.mp4")
+}
+
+func TestClipIndexPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	archive := testArchive()
+	index, err := OpenClipIndex(archive, time.UTC, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive["2024/03/04/07/f_0.mp4"] = &fstest.MapFile{}
+	archive["2024/03/04/07/f_0.mp4.json"] = sidecar("2024-03-04T07:10:00Z")
+	index.Add("2024/03/04/07/f_0.mp4")
+	index.Remove("2024/03/04/06/d_0.mp4")
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// answered from the file without walking the archive
+	index, err = OpenClipIndex(fstest.MapFS{}, time.UTC, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkClips(t, index, at(0, 0), at(12, 0), "2024/03/04/05/b_0.mp4", "archived/2024/03/01/e_0.mp4", "2024/03/04/05/a_0.mp4", "2024/03/04/07/f_0.mp4")
+	if c := index.Clips(at(7, 0), at(8, 0))[0]; c.Metadata == nil || c.EventName() != "chime" {
+		t.Errorf("stored clip = %+v, want its metadata", c)
+	}
+	if !index.stale {
+		t.Error("index loaded from the file is not rebuilt by Watch")
+	}
+	// the archive is empty now
+	index.Rebuild()
+	checkClips(t, index, at(0, 0), at(12, 0))
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err = OpenClipIndex(testArchive(), time.UTC, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if index.stale {
+		t.Error("empty file is not rebuilt from the archive at once")
+	}
+	checkClips(t, index, at(6, 0), at(7, 0), "2024/03/04/06/d_0.mp4")
+}
@@ -0,0 +1,90 @@
+package datasource
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket of the clips by path. Renamed when the stored format changes, so that old ones are rebuilt
+var indexBucket = []byte("clips.v1")
+
+// Clips of a ClipIndex persisted in a bbolt file, so that a restart doesn't walk the archive before answering. Methods
+// of nil stores are no-ops, for indexes kept only in memory
+type clipStore struct {
+	db *bolt.DB
+}
+
+type storedClip struct {
+	Time     time.Time             `json:"time"`
+	Metadata *storage.ClipMetadata `json:"metadata,omitempty"`
+}
+
+func openClipStore(path string) (*clipStore, error) {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(indexBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &clipStore{db: db}, nil
+}
+
+// Every stored clip
+func (s *clipStore) load() ([]clip, error) {
+	clips := []clip{}
+	if s == nil {
+		return clips, nil
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexBucket).ForEach(func(k, v []byte) error {
+			var stored storedClip
+			if err := json.Unmarshal(v, &stored); err != nil {
+				// reloaded from the archive by the next rebuild
+				return nil
+			}
+			clips = append(clips, clip{Path: string(k), Time: stored.Time, Metadata: stored.Metadata})
+			return nil
+		})
+	})
+	return clips, err
+}
+
+// Store put and delete removed in a transaction
+func (s *clipStore) update(put []clip, removed []string) error {
+	if s == nil || (len(put) == 0 && len(removed) == 0) {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(indexBucket)
+		for _, p := range removed {
+			if err := bucket.Delete([]byte(p)); err != nil {
+				return err
+			}
+		}
+		for _, c := range put {
+			v, err := json.Marshal(storedClip{Time: c.Time, Metadata: c.Metadata})
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(c.Path), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *clipStore) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,155 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Grafana JSON datasource contract (simpod-json-datasource, and the older SimpleJSON)
+// https://github.com/simPod/GrafanaJsonDatasource
+//   - GET /: health check
+//   - POST /metrics, /search: available targets
+//   - POST /query: clips in the range as a table
+//   - POST /annotations: events of the clips in the range, tagged by event type and device
+
+// Table of clips with the metadata sidecar
+const metricClips = "clips"
+
+type jsonQueryRequest struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Targets []struct {
+		Target string `json:"target"`
+		RefId  string `json:"refId"`
+	} `json:"targets"`
+}
+
+type jsonAnnotationRequest struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Annotation json.RawMessage `json:"annotation"` // echoed back for SimpleJSON
+}
+
+type jsonAnnotation struct {
+	Annotation json.RawMessage `json:"annotation,omitempty"`
+	Time       int64           `json:"time"` // unix millis
+	Title      string          `json:"title"`
+	Text       string          `json:"text"`
+	Tags       []string        `json:"tags"`
+}
+
+type jsonTableColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type jsonTable struct {
+	Type    string            `json:"type"` // always "table"
+	RefId   string            `json:"refId,omitempty"`
+	Columns []jsonTableColumn `json:"columns"`
+	Rows    [][]interface{}   `json:"rows"`
+}
+
+type jsonMetric struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+func registerJsonApi(mux *http.ServeMux, clips func(fromTs, toTs time.Time) []clip, location *time.Location) {
+	mux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("POST /metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, []jsonMetric{{Label: "Clips", Value: metricClips}})
+	})
+	mux.HandleFunc("POST /search", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, []string{metricClips})
+	})
+	mux.HandleFunc("POST /query", func(w http.ResponseWriter, r *http.Request) {
+		var query jsonQueryRequest
+		if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+			http.Error(w, "invalid query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		fromTs, toTs := query.Range.From.In(location), query.Range.To.In(location)
+		if !fromTs.Before(toTs) {
+			http.Error(w, "range.from should be less than range.to", http.StatusBadRequest)
+			return
+		}
+		result := []interface{}{}
+		for _, target := range query.Targets {
+			if len(target.Target) > 0 && target.Target != metricClips {
+				http.Error(w, "unknown target: "+target.Target, http.StatusBadRequest)
+				return
+			}
+			table := jsonTable{
+				Type:  "table",
+				RefId: target.RefId,
+				Columns: []jsonTableColumn{
+					{Text: "time", Type: "time"},
+					{Text: "path", Type: "string"},
+					{Text: "file", Type: "string"},
+					{Text: "eventType", Type: "string"},
+					{Text: "device", Type: "string"},
+				},
+				Rows: [][]interface{}{},
+			}
+			for _, c := range clips(fromTs, toTs) {
+				table.Rows = append(table.Rows, []interface{}{c.Time.UnixMilli(), c.Path, path.Join("/file", c.Path), c.EventName(), c.Device()})
+			}
+			result = append(result, table)
+		}
+		writeJson(w, result)
+	})
+	mux.HandleFunc("POST /annotations", func(w http.ResponseWriter, r *http.Request) {
+		var request jsonAnnotationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid annotation query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// "query" of the annotation is comma separated event names to show e.g. "chime,person". empty shows every event
+		var annotation struct {
+			Query string `json:"query"`
+		}
+		json.Unmarshal(request.Annotation, &annotation)
+		eventNames := map[string]bool{}
+		for _, name := range splitList(annotation.Query) {
+			eventNames[name] = true
+		}
+		fromTs, toTs := request.Range.From.In(location), request.Range.To.In(location)
+		if !fromTs.Before(toTs) {
+			http.Error(w, "range.from should be less than range.to", http.StatusBadRequest)
+			return
+		}
+		result := []jsonAnnotation{}
+		for _, c := range clips(fromTs, toTs) {
+			if c.Metadata == nil || (len(eventNames) > 0 && !eventNames[c.EventName()]) {
+				continue
+			}
+			device := sdmevents.DeviceId(c.Device())
+			result = append(result, jsonAnnotation{
+				Annotation: request.Annotation,
+				Time:       c.Time.UnixMilli(),
+				Title:      c.EventName() + " " + device,
+				Text:       fmt.Sprintf(`<a href="%v">%v</a>`, html.EscapeString(path.Join("/file", c.Path)), html.EscapeString(c.Path)),
+				Tags:       []string{c.EventName(), device},
+			})
+		}
+		writeJson(w, result)
+	})
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
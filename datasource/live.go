@@ -0,0 +1,101 @@
+package datasource
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// WebRTC live streams of the devices, which only the consumer can start since it has the SDM credentials
+type LiveStreams interface {
+	LiveDevices() []LiveDevice
+	GenerateWebRtcStream(device string, offerSdp string) (*sdmevents.GenerateWebRtcStreamResponse, error)
+	ExtendWebRtcStream(device string, mediaSessionId string) (*sdmevents.ExtendWebRtcStreamResponse, error)
+	StopWebRtcStream(device string, mediaSessionId string) error
+}
+
+// Device supporting WebRTC live streams
+type LiveDevice struct {
+	Name        string `json:"name"` // full name e.g. enterprises/<project>/devices/<device>
+	DisplayName string `json:"displayName"`
+}
+
+// Body of POST /live/*
+type liveRequest struct {
+	Device         string `json:"device"`
+	OfferSdp       string `json:"offerSdp,omitempty"`       // /live/stream
+	MediaSessionId string `json:"mediaSessionId,omitempty"` // /live/extend and /live/stop
+}
+
+// Signaling of live streams for the live view of /ui/. The browser sends its offer to POST /live/stream, gets the
+// answer of the device, and receives the media from Google directly. Streams expire in 5 minutes unless extended.
+//   - GET /live/devices: []LiveDevice
+//   - POST /live/stream {device, offerSdp}: {answerSdp, mediaSessionId, expiresAt}
+//   - POST /live/extend {device, mediaSessionId}: {mediaSessionId, expiresAt}
+//   - POST /live/stop {device, mediaSessionId}
+func registerLiveApi(mux *http.ServeMux, live LiveStreams) {
+	known := func(device string) bool {
+		for _, d := range live.LiveDevices() {
+			if d.Name == device {
+				return true
+			}
+		}
+		return false
+	}
+	// decode the request of a known device, or respond with an error
+	decode := func(w http.ResponseWriter, r *http.Request) (liveRequest, bool) {
+		var request liveRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return request, false
+		}
+		if !known(request.Device) {
+			http.Error(w, "unknown device: "+request.Device, http.StatusNotFound)
+			return request, false
+		}
+		return request, true
+	}
+	mux.HandleFunc("GET /live/devices", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, live.LiveDevices())
+	})
+	mux.HandleFunc("POST /live/stream", func(w http.ResponseWriter, r *http.Request) {
+		request, ok := decode(w, r)
+		if !ok {
+			return
+		}
+		if len(request.OfferSdp) == 0 {
+			http.Error(w, "offerSdp is required", http.StatusBadRequest)
+			return
+		}
+		stream, err := live.GenerateWebRtcStream(request.Device, request.OfferSdp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJson(w, stream)
+	})
+	mux.HandleFunc("POST /live/extend", func(w http.ResponseWriter, r *http.Request) {
+		request, ok := decode(w, r)
+		if !ok {
+			return
+		}
+		stream, err := live.ExtendWebRtcStream(request.Device, request.MediaSessionId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJson(w, stream)
+	})
+	mux.HandleFunc("POST /live/stop", func(w http.ResponseWriter, r *http.Request) {
+		request, ok := decode(w, r)
+		if !ok {
+			return
+		}
+		if err := live.StopWebRtcStream(request.Device, request.MediaSessionId); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
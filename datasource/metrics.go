@@ -0,0 +1,180 @@
+package datasource
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upper bounds of request duration buckets in seconds, the defaults of prometheus clients
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Route label of requests which didn't reach a handler of the mux e.g. rejected by authentication
+const unmatchedRoute = "unmatched"
+
+type requestKey struct {
+	route  string // pattern of the mux e.g. "GET /thumb/{path...}", which keeps the labels bounded
+	method string
+	code   int
+}
+
+type routeDurations struct {
+	buckets []uint64 // cumulative counts per durationBuckets
+	count   uint64
+	sum     float64
+}
+
+// Request counts, latencies and bytes served by the datasource, exposed on GET /metrics in prometheus text format
+type serverMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[string]*routeDurations
+	bytes     map[string]uint64 // by route
+	inFlight  int
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{requests: map[requestKey]uint64{}, durations: map[string]*routeDurations{}, bytes: map[string]uint64{}}
+}
+
+func (m *serverMetrics) observe(route string, method string, code int, duration time.Duration, bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{route, method, code}]++
+	d, ok := m.durations[route]
+	if !ok {
+		d = &routeDurations{buckets: make([]uint64, len(durationBuckets))}
+		m.durations[route] = d
+	}
+	for i, bound := range durationBuckets {
+		if duration.Seconds() <= bound {
+			d.buckets[i]++
+		}
+	}
+	d.count++
+	d.sum += duration.Seconds()
+	m.bytes[route] += uint64(bytes)
+}
+
+func (m *serverMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b requestKey) int {
+		if a.route != b.route {
+			return cmp.Compare(a.route, b.route)
+		}
+		if a.method != b.method {
+			return cmp.Compare(a.method, b.method)
+		}
+		return cmp.Compare(a.code, b.code)
+	})
+	fmt.Fprintln(w, "# HELP datasource_http_requests_total Number of requests by route, method and status code")
+	fmt.Fprintln(w, "# TYPE datasource_http_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "datasource_http_requests_total{route=%v,method=%v,code=\"%v\"} %v\n", strconv.Quote(key.route), strconv.Quote(key.method), key.code, m.requests[key])
+	}
+	routes := make([]string, 0, len(m.durations))
+	for route := range m.durations {
+		routes = append(routes, route)
+	}
+	slices.Sort(routes)
+	fmt.Fprintln(w, "# HELP datasource_http_request_duration_seconds Time to serve requests by route, until the end of the response")
+	fmt.Fprintln(w, "# TYPE datasource_http_request_duration_seconds histogram")
+	for _, route := range routes {
+		d := m.durations[route]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "datasource_http_request_duration_seconds_bucket{route=%v,le=\"%v\"} %v\n", strconv.Quote(route), bound, d.buckets[i])
+		}
+		fmt.Fprintf(w, "datasource_http_request_duration_seconds_bucket{route=%v,le=\"+Inf\"} %v\n", strconv.Quote(route), d.count)
+		fmt.Fprintf(w, "datasource_http_request_duration_seconds_sum{route=%v} %v\n", strconv.Quote(route), d.sum)
+		fmt.Fprintf(w, "datasource_http_request_duration_seconds_count{route=%v} %v\n", strconv.Quote(route), d.count)
+	}
+	fmt.Fprintln(w, "# HELP datasource_http_response_bytes_total Bytes of response bodies served by route, after compression")
+	fmt.Fprintln(w, "# TYPE datasource_http_response_bytes_total counter")
+	for _, route := range routes {
+		fmt.Fprintf(w, "datasource_http_response_bytes_total{route=%v} %v\n", strconv.Quote(route), m.bytes[route])
+	}
+	fmt.Fprintln(w, "# HELP datasource_http_requests_in_flight Requests being served, including open /stream connections")
+	fmt.Fprintln(w, "# TYPE datasource_http_requests_in_flight gauge")
+	// excluding this request
+	fmt.Fprintf(w, "datasource_http_requests_in_flight %v\n", m.inFlight-1)
+}
+
+// Count requests into metrics and log them to accessLog when it's not nil. The route is taken from the mux after the
+// request is served, so this must wrap the mux.
+func observeMiddleware(next http.Handler, metrics *serverMetrics, accessLog *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		metrics.mu.Lock()
+		metrics.inFlight++
+		metrics.mu.Unlock()
+		sw := &statusResponseWriter{ResponseWriter: w}
+		defer func() {
+			duration := time.Since(start)
+			route := r.Pattern
+			if len(route) == 0 {
+				route = unmatchedRoute
+			}
+			code := sw.status
+			if code == 0 {
+				code = http.StatusOK
+			}
+			metrics.mu.Lock()
+			metrics.inFlight--
+			metrics.mu.Unlock()
+			metrics.observe(route, r.Method, code, duration, sw.bytes)
+			if accessLog != nil {
+				// without the query, which may have ?token=
+				accessLog.LogAttrs(r.Context(), slog.LevelInfo, "request",
+					slog.String("method", r.Method),
+					slog.String("path", r.URL.Path),
+					slog.String("route", route),
+					slog.Int("status", code),
+					slog.Int64("bytes", sw.bytes),
+					slog.Duration("duration", duration),
+					slog.String("remote", r.RemoteAddr),
+					slog.String("userAgent", r.UserAgent()),
+				)
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// Remember the status and the size of the response
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// for http.ResponseController
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
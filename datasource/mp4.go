@@ -0,0 +1,95 @@
+package datasource
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// Duration of an mp4 (ISO BMFF) file read from moov/mvhd. Returns error for other containers.
+func mp4Duration(archive fs.FS, path string) (time.Duration, error) {
+	f, err := archive.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r, ok := f.(io.ReadSeeker)
+	if !ok {
+		return 0, fmt.Errorf("%v is not seekable", path)
+	}
+	// top level boxes, then boxes in moov
+	for _, want := range []string{"moov", "mvhd"} {
+		size, err := seekBox(r, want)
+		if err != nil {
+			return 0, err
+		}
+		if want == "mvhd" {
+			return readMvhdDuration(r, size)
+		}
+	}
+	return 0, fmt.Errorf("mvhd not found")
+}
+
+// Skip boxes until one of boxType, and return its payload size. r is positioned at the payload.
+func seekBox(r io.ReadSeeker, boxType string) (int64, error) {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return 0, fmt.Errorf("%v box not found: %v", boxType, err)
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		headerSize := int64(8)
+		if size == 1 {
+			large := make([]byte, 8)
+			if _, err := io.ReadFull(r, large); err != nil {
+				return 0, err
+			}
+			size = int64(binary.BigEndian.Uint64(large))
+			headerSize = 16
+		}
+		if size != 0 && size < headerSize {
+			return 0, fmt.Errorf("broken box size %v", size)
+		}
+		if string(header[4:]) == boxType {
+			return size - headerSize, nil
+		}
+		if size == 0 {
+			// extends to the end of the file
+			return 0, fmt.Errorf("%v box not found", boxType)
+		}
+		if _, err := r.Seek(size-headerSize, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func readMvhdDuration(r io.Reader, size int64) (time.Duration, error) {
+	if size < 20 {
+		return 0, fmt.Errorf("mvhd is too short")
+	}
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(r, b[:4]); err != nil {
+		return 0, err
+	}
+	var timescale, duration uint64
+	if b[0] == 1 {
+		// version 1: 64 bit times
+		if _, err := io.ReadFull(r, b[:28]); err != nil {
+			return 0, err
+		}
+		timescale = uint64(binary.BigEndian.Uint32(b[16:20]))
+		duration = binary.BigEndian.Uint64(b[20:28])
+	} else {
+		if _, err := io.ReadFull(r, b[:16]); err != nil {
+			return 0, err
+		}
+		timescale = uint64(binary.BigEndian.Uint32(b[8:12]))
+		duration = uint64(binary.BigEndian.Uint32(b[12:16]))
+	}
+	if timescale == 0 {
+		return 0, fmt.Errorf("mvhd timescale is 0")
+	}
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second)), nil
+}
@@ -0,0 +1,81 @@
+package datasource
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Buckets of /stats returned at most
+const maxStatsBuckets = 10000
+
+// Response of /stats. Buckets start at from and are interval long; the last one may end after to.
+type statsResponse struct {
+	From        int64          `json:"from"`              // unix millis
+	To          int64          `json:"to"`                // unix millis
+	IntervalSec float64        `json:"intervalSec"`       // length of each bucket
+	Buckets     []int64        `json:"buckets"`           // starts of buckets in unix millis
+	Series      []statsSeries  `json:"series"`            // sorted by event type and device
+	Devices     []DeviceHealth `json:"devices,omitempty"` // current state of the devices when served by the consumer
+}
+
+// Last known battery and Wi-Fi traits of a device. Fields the device doesn't report are omitted
+type DeviceHealth struct {
+	Device         string   `json:"device"` // device id
+	DeviceName     string   `json:"deviceName,omitempty"`
+	Online         *bool    `json:"online,omitempty"`
+	BatteryStatus  string   `json:"batteryStatus,omitempty"`  // e.g. NORMAL, LOW, CRITICAL
+	BatteryLevel   *float64 `json:"batteryLevel,omitempty"`   // percent
+	ChargingStatus string   `json:"chargingStatus,omitempty"` // e.g. CHARGING, NOT_CHARGING
+	WifiRssi       *float64 `json:"wifiRssi,omitempty"`       // dBm
+	UpdatedAt      int64    `json:"updatedAt"`                // unix millis
+}
+
+// Event counts of an event type and a device. Points have every bucket, including empty ones, so that Grafana can
+// draw them as a time series.
+type statsSeries struct {
+	EventType  string     `json:"eventType"`
+	Device     string     `json:"device"` // device id
+	DeviceName string     `json:"deviceName,omitempty"`
+	Total      int        `json:"total"`
+	Points     [][2]int64 `json:"points"` // [bucket start in unix millis, count]
+}
+
+// Count clips matching filter per interval from fromTs. Clips without metadata have no event and are not counted.
+func newStats(clips []clip, filter *clipFilter, fromTs time.Time, toTs time.Time, interval time.Duration) statsResponse {
+	stats := statsResponse{From: fromTs.UnixMilli(), To: toTs.UnixMilli(), IntervalSec: interval.Seconds(), Buckets: []int64{}, Series: []statsSeries{}}
+	for t := fromTs; t.Before(toTs); t = t.Add(interval) {
+		stats.Buckets = append(stats.Buckets, t.UnixMilli())
+	}
+	series := map[[2]string]*statsSeries{}
+	for _, c := range clips {
+		if c.Metadata == nil || !filter.Match(&c) || c.Time.Before(fromTs) || !c.Time.Before(toTs) {
+			continue
+		}
+		key := [2]string{c.EventName(), sdmevents.DeviceId(c.Device())}
+		s, ok := series[key]
+		if !ok {
+			s = &statsSeries{EventType: key[0], Device: key[1], Points: make([][2]int64, len(stats.Buckets))}
+			for i, bucket := range stats.Buckets {
+				s.Points[i][0] = bucket
+			}
+			series[key] = s
+		}
+		if len(c.Metadata.DeviceName) > 0 {
+			s.DeviceName = c.Metadata.DeviceName
+		}
+		s.Points[int(c.Time.Sub(fromTs)/interval)][1]++
+		s.Total++
+	}
+	for _, s := range series {
+		stats.Series = append(stats.Series, *s)
+	}
+	sort.Slice(stats.Series, func(i, j int) bool {
+		if stats.Series[i].EventType != stats.Series[j].EventType {
+			return stats.Series[i].EventType < stats.Series[j].EventType
+		}
+		return stats.Series[i].Device < stats.Series[j].Device
+	})
+	return stats
+}
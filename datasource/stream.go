@@ -0,0 +1,52 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Interval of comments keeping idle streams open through proxies
+const streamKeepAlive = 30 * time.Second
+
+// Server-Sent Events of clips as soon as they are indexed, so that a live dashboard can refresh without polling /list.
+// Each event is "event: clip" whose data is the /list entry of the clip. eventType and device filter them like /list.
+func streamHandler(index *ClipIndex, entry func(c *clip) listEntry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := newClipFilter(r.URL.Query())
+		rc := http.NewResponseController(w)
+		clips, unsubscribe := index.Subscribe()
+		defer unsubscribe()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// nginx buffers responses by default
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		keepAlive := time.NewTicker(streamKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case c := <-clips:
+				if !filter.Match(&c) {
+					continue
+				}
+				b, err := json.Marshal(entry(&c))
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "event: clip\ndata: %s\n\n", b)
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package datasource
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+// Width of generated thumbnails. The height keeps the aspect ratio
+const thumbnailWidth = 320
+
+// JPEG poster frames of clips generated by ffmpeg, cached in dir by the path, size and modification time of the clip
+type thumbnailer struct {
+	archive fs.FS
+	dir     string
+	ffmpeg  string
+	// one ffmpeg at a time, so that a grid of previews doesn't fork a process per clip on a Pi
+	mu sync.Mutex
+}
+
+func newThumbnailer(archive fs.FS, dir string) (*thumbnailer, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("thumbnails need ffmpeg: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &thumbnailer{archive: archive, dir: dir, ffmpeg: ffmpeg}, nil
+}
+
+// Path of the cached thumbnail of the clip, generated if missing
+func (t *thumbnailer) Thumbnail(ctx context.Context, p string) (string, error) {
+	key, err := clipCacheKey(t.archive, p)
+	if err != nil {
+		return "", err
+	}
+	thumbPath := filepath.Join(t.dir, key+".jpg")
+	if _, err := os.Stat(thumbPath); err == nil {
+		return thumbPath, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := os.Stat(thumbPath); err == nil {
+		// generated while waiting
+		return thumbPath, nil
+	}
+	input, err := copyClipToTemp(t.archive, t.dir, p)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(input)
+	tempPath := thumbPath + storage.TempFileExtension
+	cmd := exec.CommandContext(ctx, t.ffmpeg, "-loglevel", "error", "-i", input,
+		"-vf", "thumbnail,scale="+strconv.Itoa(thumbnailWidth)+":-2", "-frames:v", "1", "-q:v", "5", "-f", "image2", "-y", tempPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tempPath)
+		return "", fmt.Errorf("ffmpeg failed: %v: %s", err, out)
+	}
+	if err := os.Rename(tempPath, thumbPath); err != nil {
+		os.Remove(tempPath)
+		return "", err
+	}
+	return thumbPath, nil
+}
+
+// Name of the files generated from the clip, which changes when the clip is replaced
+func clipCacheKey(archive fs.FS, p string) (string, error) {
+	info, err := fs.Stat(archive, p)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%v is not a file", p)
+	}
+	key := sha256.Sum256([]byte(p + "\x00" + strconv.FormatInt(info.Size(), 10) + "\x00" + strconv.FormatInt(info.ModTime().UnixNano(), 10)))
+	return hex.EncodeToString(key[:]), nil
+}
+
+// Copy the clip into dir, since ffmpeg needs a seekable file to read mp4 whose moov is at the end and the archive may
+// not be a directory. The caller removes the copy.
+func copyClipToTemp(archive fs.FS, dir string, p string) (string, error) {
+	src, err := archive.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(dir, "clip-*"+path.Ext(p))
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+func (t *thumbnailer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(path.Clean("/"+r.PathValue("path")), "/")
+	if ext := path.Ext(p); len(p) == 0 || ext == ".json" || ext == storage.TempFileExtension {
+		http.NotFound(w, r)
+		return
+	}
+	if info, err := fs.Stat(t.archive, p); err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	thumbPath, err := t.Thumbnail(r.Context(), p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, thumbPath)
+}
@@ -0,0 +1,20 @@
+package datasource
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// Single page browser of the clips on /ui/, for those not running Grafana. It only uses the public endpoints (/meta,
+// /list, /thumb/, /file/, /hls/ and /stream), so it works behind the same authentication.
+func newUiHandler() http.Handler {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(files)))
+}
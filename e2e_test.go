@@ -0,0 +1,177 @@
+//go:build e2e
+
+// End-to-end test of the whole pipeline: canned SDM events are published to Pub/Sub, and the clips must land in the
+// output directory. Runs against the Pub/Sub emulator when PUBSUB_EMULATOR_HOST is set, an in-memory fake otherwise.
+// SDM API and clip previews are served by a local fake.
+//
+//	go test -tags e2e -v -run TestEndToEnd .
+package nestconsumer_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	nestconsumer "github.com/cormoran/NestDoorbellConsumer"
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+const e2eProjectId = "enterprises/e2e-project"
+
+// Send every request to the fake server regardless of its host
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Fake of SDM API with a doorbell, which also serves clip previews
+func newFakeSdm(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/"+e2eProjectId+"/devices", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"devices": [{"name": "%v/devices/doorbell", "type": "sdm.devices.types.DOORBELL", "traits": {"sdm.devices.traits.Info": {"customName": "Front door"}}}]}`, e2eProjectId)
+	})
+	mux.HandleFunc("/v1/"+e2eProjectId+"/structures", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"structures": []}`)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, ".mp4") {
+			t.Errorf("unexpected request %v", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		fmt.Fprint(w, "clip of "+r.URL.Path)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestEndToEnd(t *testing.T) {
+	t.Run("streaming pull", func(t *testing.T) { testEndToEnd(t, false) })
+	t.Run("pull mode", func(t *testing.T) { testEndToEnd(t, true) })
+}
+
+func testEndToEnd(t *testing.T, pullMode bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if len(os.Getenv("PUBSUB_EMULATOR_HOST")) == 0 {
+		server := pstest.NewServer()
+		defer server.Close()
+		t.Setenv("PUBSUB_EMULATOR_HOST", server.Addr)
+	}
+	pubsubClient, err := pubsub.NewClient(ctx, "e2e-project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubsubClient.Close()
+	id := fmt.Sprintf("e2e-%d", time.Now().UnixNano())
+	topic, err := pubsubClient.CreateTopic(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription, err := nestconsumer.EnsureSubscription(ctx, pubsubClient, id, nestconsumer.SubscriptionSettings{Topic: topic.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := nestconsumer.MessageSource(&nestconsumer.PubsubSource{Subscription: subscription})
+	if pullMode {
+		pullClient, err := nestconsumer.NewPullClient(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pullClient.Close()
+		source = &nestconsumer.PullSource{Client: pullClient, Subscription: subscription.String(), Interval: 100 * time.Millisecond}
+	}
+
+	sdm := newFakeSdm(t)
+	defer sdm.Close()
+	sdmUrl, _ := url.Parse(sdm.URL)
+	outputDir := t.TempDir()
+	consumer, err := nestconsumer.New(
+		nestconsumer.WithSmartDeviceManagement(e2eProjectId, &http.Client{Transport: &rewriteTransport{target: sdmUrl}}),
+		nestconsumer.WithMessageSource(source),
+		nestconsumer.WithStorage(outputDir, "2006/01/02/{eventType}_{eventSessionId}"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runErr := make(chan error, 1)
+	go func() { runErr <- consumer.Run(ctx) }()
+
+	events, err := filepath.Glob(filepath.Join("testdata", "e2e", "*.json"))
+	if err != nil || len(events) == 0 {
+		t.Fatalf("no canned events: %v", err)
+	}
+	for _, path := range events {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := topic.Publish(ctx, &pubsub.Message{Data: data}).Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range events {
+		data, _ := os.ReadFile(path)
+		var event struct {
+			Timestamp      string `json:"timestamp"`
+			ResourceUpdate struct {
+				Events map[string]struct {
+					EventSessionId string `json:"eventSessionId"`
+				} `json:"events"`
+			} `json:"resourceUpdate"`
+		}
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatalf("%v: %v", path, err)
+		}
+		timestamp, _ := time.Parse(time.RFC3339Nano, event.Timestamp)
+		sessionId := event.ResourceUpdate.Events["sdm.devices.events.CameraClipPreview.ClipPreview"].EventSessionId
+		eventName := strings.TrimSuffix(filepath.Base(path), ".json")
+		// the extension depends on the mime types of the system
+		clip := strings.TrimSuffix(waitForFile(ctx, t, filepath.Join(outputDir, timestamp.Local().Format("2006/01/02"), eventName+"_"+sessionId+"_0.*"+storage.ClipMetadataExtension)), storage.ClipMetadataExtension)
+		content, err := os.ReadFile(clip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "clip of /" + eventName + ".mp4"; string(content) != want {
+			t.Errorf("%v: got %q, want %q", clip, content, want)
+		}
+	}
+	cancel()
+	if err := <-runErr; err != nil && err != context.Canceled {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+// Wait for a file matching pattern and return its path. The metadata sidecar is written after the clip, so its
+// existence means the clip is complete.
+func waitForFile(ctx context.Context, t *testing.T, pattern string) string {
+	t.Helper()
+	for {
+		if matches, _ := filepath.Glob(pattern); len(matches) > 0 {
+			return matches[0]
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("%v was not written", pattern)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
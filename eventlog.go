@@ -0,0 +1,42 @@
+package nestconsumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Append-only JSONL file of raw event messages as received, one per line. Read back by OpenFileSource to replay
+// the events.
+type EventLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewEventLog(path string) *EventLog {
+	return &EventLog{path: path}
+}
+
+func (l *EventLog) Path() string {
+	return l.path
+}
+
+func (l *EventLog) Append(data []byte) error {
+	line := bytes.Buffer{}
+	if err := json.Compact(&line, data); err != nil {
+		return err
+	}
+	line.WriteByte('\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(line.Bytes())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -1,3 +0,0 @@
-module github.com/cormoran/grafana_image_datasource
-
-go 1.19
@@ -0,0 +1,54 @@
+package nestconsumer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+type RecentEvent struct {
+	Consumer   string                 `json:"consumer"` // Consumer.Name
+	ReceivedAt time.Time              `json:"receivedAt"`
+	Event      *sdmevents.DeviceEvent `json:"event"`
+}
+
+// Ring buffer of the last received events. Can be shared by consumers.
+type EventHistory struct {
+	mu     sync.Mutex
+	events []RecentEvent
+	next   int
+	size   int
+}
+
+func NewEventHistory(size int) *EventHistory {
+	return &EventHistory{events: make([]RecentEvent, size), size: size}
+}
+
+func (h *EventHistory) Add(consumer string, event *sdmevents.DeviceEvent, receivedAt time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.size == 0 {
+		return
+	}
+	h.events[h.next%h.size] = RecentEvent{Consumer: consumer, ReceivedAt: receivedAt, Event: event}
+	h.next++
+}
+
+// Up to limit events, newest first. limit <= 0 returns every kept event.
+func (h *EventHistory) Recent(limit int) []RecentEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.next
+	if n > h.size {
+		n = h.size
+	}
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	events := make([]RecentEvent, 0, n)
+	for i := 1; i <= n; i++ {
+		events = append(events, h.events[(h.next-i)%h.size])
+	}
+	return events
+}
@@ -0,0 +1,596 @@
+// Package nestconsumer embeds the whole doorbell pipeline: it receives SDM events from Pub/Sub, saves clip previews
+// and notifies the events.
+//
+//	consumer, err := nestconsumer.New(
+//		nestconsumer.WithSmartDeviceManagement("enterprises/<project_id>", client),
+//		nestconsumer.WithSubscription(subscription),
+//		nestconsumer.WithStorage("output", "2006/01/02/15/{eventSessionId}"),
+//		nestconsumer.WithNotifier(notifier),
+//	)
+//	err = consumer.Run(ctx)
+package nestconsumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/processor"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"github.com/cormoran/NestDoorbellConsumer/tracing"
+	"google.golang.org/api/option"
+	"google.golang.org/api/smartdevicemanagement/v1"
+)
+
+const DefaultOutputFileNameFormat = "2006/01/02/15/{eventSessionId}"
+
+// Pipeline of a Device Access project
+type Consumer struct {
+	name                  string
+	projectId             string
+	client                *http.Client
+	service               *smartdevicemanagement.Service
+	source                MessageSource
+	eventLog              *EventLog
+	history               *EventHistory
+	eventProcessor        processor.EventProcessor
+	devices               *processor.DeviceRegistry
+	deviceStates          *processor.DeviceStateTracker
+	pollInterval          time.Duration
+	refreshInterval       time.Duration
+	offlineAlertThreshold time.Duration
+	summaryPeriod         processor.SummaryPeriod // empty disables summaries
+	summaryAt             time.Duration
+	devicesLoaded         bool
+	commandQuotas         map[string]processor.CommandQuota // nil disables the limiter
+	commandQueueTimeout   time.Duration
+	commandLimiter        *processor.CommandLimiter
+	pauseMu               sync.Mutex
+	resumed               chan struct{} // closed on Resume. nil when not paused
+}
+
+type Option func(c *Consumer)
+
+// SDM project like "enterprises/<project_id>" and the client authorized for it e.g. by auth.NewClient
+func WithSmartDeviceManagement(projectId string, client *http.Client) Option {
+	return func(c *Consumer) {
+		c.projectId = projectId
+		c.client = client
+	}
+}
+
+// Pub/Sub subscription receiving the events of the project
+func WithSubscription(subscription *pubsub.Subscription) Option {
+	return WithMessageSource(&PubsubSource{Subscription: subscription})
+}
+
+// Receive events from source instead of Pub/Sub e.g. FileSource of recorded events
+func WithMessageSource(source MessageSource) Option {
+	return func(c *Consumer) {
+		c.source = source
+	}
+}
+
+// Directory to save clips and the file name format of them. See -output-file-path-format of cmd/consumer.
+func WithStorage(outputDir string, outputFileNameFormat string) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.OutputDir = outputDir
+		c.eventProcessor.OutputFileNameFormat = outputFileNameFormat
+	}
+}
+
+// Directory of the journals of pending and deferred downloads, which must be outside the output directory served by
+// the datasource
+func WithStateDir(stateDir string) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.StateDir = stateDir
+	}
+}
+
+// Can be given multiple times
+func WithNotifier(notifier notify.Notifier) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.Notifiers = append(c.eventProcessor.Notifiers, notifier)
+	}
+}
+
+// Rules applied to every notifier
+func WithNotificationRules(rules *notify.NotificationRules) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.NotificationRules = rules
+	}
+}
+
+// Process events only of devices accepted by filter. filter is given the device name
+// "enterprises/<project_id>/devices/<device_id>".
+func WithDeviceFilter(filter func(deviceName string) bool) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.DeviceFilter = filter
+	}
+}
+
+// Drop events by device and event type before downloading or notifying them
+func WithEventFilter(filter *processor.EventFilter) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.EventFilter = filter
+	}
+}
+
+// Run events through the stages of pipeline instead of downloading the clip then notifying. nil keeps the default
+func WithPipeline(pipeline *processor.Pipeline) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.Pipeline = pipeline
+	}
+}
+
+// Let plugin annotate or suppress notifications of events. Plugins run in the order of the options
+func WithPlugin(plugin *notify.Plugin) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.Plugins = append(c.eventProcessor.Plugins, plugin)
+	}
+}
+
+// Abort a download receiving no data for readTimeout, or larger than maxBytes. 0 disables each limit.
+// Connect timeouts are set on the transport of the client given to WithSmartDeviceManagement e.g. by
+// processor.NewHTTPTransport.
+func WithDownloadLimits(readTimeout time.Duration, maxBytes int64) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.ReadTimeout = readTimeout
+		c.eventProcessor.MaxDownloadBytes = maxBytes
+	}
+}
+
+func WithDownloadAttempts(attempts int) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.DownloadAttempts = attempts
+	}
+}
+
+// Time zone of output paths and metadata timestamps. Defaults to the local time zone.
+func WithLocation(location *time.Location) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.Location = location
+	}
+}
+
+func WithFilePathTimeSource(source processor.FilePathTimeSource) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.FilePathTimeSource = source
+	}
+}
+
+func WithLateArrivalThreshold(threshold time.Duration) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.LateArrivalThreshold = threshold
+	}
+}
+
+// Base URL of saved clips used in notifications
+func WithClipBaseUrl(url string) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.ClipBaseUrl = url
+	}
+}
+
+func WithDeferredDownloadPolicy(policy *processor.DeferredDownloadPolicy) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.DeferredDownloadPolicy = policy
+	}
+}
+
+// Poll device state every interval, and notify devices offline longer than offlineAlertThreshold (0 disables it)
+func WithPolling(interval time.Duration, offlineAlertThreshold time.Duration) Option {
+	return func(c *Consumer) {
+		c.pollInterval = interval
+		c.offlineAlertThreshold = offlineAlertThreshold
+	}
+}
+
+// Wait up to timeout for the clip of battery doorbell events before notifying them, or edit the notifications when it
+// arrives. See processor.ClipWait
+func WithClipWait(strategy processor.ClipWait, timeout time.Duration) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.ClipWait = strategy
+		c.eventProcessor.ClipWaitTimeout = timeout
+	}
+}
+
+// Limit SDM commands like GenerateImage per minute and day by client side quotas, see processor.ParseCommandQuotas.
+// Commands over the quota wait up to queueTimeout for it, or fail without reaching SDM
+func WithCommandQuotas(quotas map[string]processor.CommandQuota, queueTimeout time.Duration) Option {
+	return func(c *Consumer) {
+		c.commandQuotas = quotas
+		c.commandQueueTimeout = queueTimeout
+	}
+}
+
+// Reload devices, structures and rooms from SDM every interval in addition to relation update events, e.g. to pick
+// up renamed rooms which aren't notified. 0 disables it
+func WithDeviceRefresh(interval time.Duration) Option {
+	return func(c *Consumer) {
+		c.refreshInterval = interval
+	}
+}
+
+// Notify a summary of the saved clips every day or week at the time of the day
+func WithSummaryReport(period processor.SummaryPeriod, at time.Duration) Option {
+	return func(c *Consumer) {
+		c.summaryPeriod = period
+		c.summaryAt = at
+	}
+}
+
+// Notify "latency" when an event is notified later than budget after it happened, e.g. to learn that doorbell
+// notifications are too late to be useful. 0 only tracks latencies
+func WithLatencyBudget(budget time.Duration) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.Latency = processor.NewLatencyTracker(budget)
+	}
+}
+
+// Share the trait state tracker with other consumers e.g. to serve the state of every project at once
+func WithDeviceStateTracker(states *processor.DeviceStateTracker) Option {
+	return func(c *Consumer) {
+		c.deviceStates = states
+	}
+}
+
+// Append every received message to eventLog before processing it
+func WithEventLog(eventLog *EventLog) Option {
+	return func(c *Consumer) {
+		c.eventLog = eventLog
+	}
+}
+
+// Keep received events in history e.g. to show recent events on the admin API
+func WithEventHistory(history *EventHistory) Option {
+	return func(c *Consumer) {
+		c.history = history
+	}
+}
+
+// Call f with the path of every clip saved with its metadata sidecar e.g. to index it
+func WithClipSavedHook(f func(path string)) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.ClipSaved = f
+	}
+}
+
+// Label objects of saved clips by analyzer e.g. processor.NewHttpAnalyzer
+func WithAnalyzer(analyzer processor.Analyzer) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.Analyzer = analyzer
+	}
+}
+
+// Recognize faces of person clips by recognizer e.g. processor.NewHttpFaceRecognizer
+func WithFaceRecognizer(recognizer processor.FaceRecognizer) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.FaceRecognizer = recognizer
+	}
+}
+
+// Tag sounds of saved video clips by tagger e.g. processor.HeuristicAudioTagger
+func WithAudioTagger(tagger processor.AudioTagger) Option {
+	return func(c *Consumer) {
+		c.eventProcessor.AudioTagger = tagger
+	}
+}
+
+// Don't download clips of event sessions already saved, e.g. when replaying recorded events
+func WithSkipSavedClips() Option {
+	return func(c *Consumer) {
+		c.eventProcessor.SkipSavedClips = true
+	}
+}
+
+// Log decoded events and what would be done for them (downloads, output paths and notification payloads) without
+// writing files, appending to the event log or sending notifications
+func WithDryRun() Option {
+	return func(c *Consumer) {
+		c.eventProcessor.DryRun = true
+	}
+}
+
+// Name used in logs. Defaults to the project id.
+func WithName(name string) Option {
+	return func(c *Consumer) {
+		c.name = name
+	}
+}
+
+func New(opts ...Option) (*Consumer, error) {
+	c := &Consumer{}
+	c.eventProcessor.OutputDir = "output"
+	c.eventProcessor.StateDir = "state"
+	c.eventProcessor.OutputFileNameFormat = DefaultOutputFileNameFormat
+	c.eventProcessor.DownloadAttempts = 3
+	c.eventProcessor.FilePathTimeSource = processor.FilePathTimeSourceEvent
+	for _, opt := range opts {
+		opt(c)
+	}
+	if len(c.projectId) == 0 || c.client == nil {
+		return nil, fmt.Errorf("SDM project is required (WithSmartDeviceManagement)")
+	}
+	if c.source == nil {
+		return nil, fmt.Errorf("message source is required (WithSubscription or WithMessageSource)")
+	}
+	if len(c.name) == 0 {
+		c.name = c.projectId
+	}
+	if c.eventProcessor.DryRun {
+		for i, notifier := range c.eventProcessor.Notifiers {
+			c.eventProcessor.Notifiers[i] = notify.NewDryRunNotifier(notifier)
+		}
+	}
+	if c.commandQuotas != nil {
+		client := *c.client
+		c.commandLimiter = processor.NewCommandLimiter(client.Transport, c.commandQuotas, c.commandQueueTimeout)
+		client.Transport = c.commandLimiter
+		c.client = &client
+	}
+	service, err := smartdevicemanagement.NewService(context.Background(), option.WithHTTPClient(c.client))
+	if err != nil {
+		return nil, err
+	}
+	c.service = service
+	c.devices = processor.NewDeviceRegistry(service, c.projectId)
+	if c.deviceStates == nil {
+		c.deviceStates = processor.NewDeviceStateTracker()
+	}
+	if c.eventProcessor.Latency == nil {
+		c.eventProcessor.Latency = processor.NewLatencyTracker(0)
+	}
+	c.eventProcessor.Client = c.client
+	c.eventProcessor.DeviceAccessService = service
+	c.eventProcessor.Devices = c.devices
+	c.eventProcessor.DeviceStates = c.deviceStates
+	return c, nil
+}
+
+func (c *Consumer) Name() string {
+	return c.name
+}
+
+func (c *Consumer) ProjectId() string {
+	return c.projectId
+}
+
+func (c *Consumer) Service() *smartdevicemanagement.Service {
+	return c.service
+}
+
+// Current notifiers, see Reconfigure
+func (c *Consumer) Notifiers() []notify.Notifier {
+	notifiers, _ := c.eventProcessor.NotificationSettings()
+	return notifiers
+}
+
+// Limiter of SDM commands. nil without WithCommandQuotas
+func (c *Consumer) CommandLimiter() *processor.CommandLimiter {
+	return c.commandLimiter
+}
+
+// Source of the events e.g. *PubsubSource
+func (c *Consumer) Source() MessageSource {
+	return c.source
+}
+
+// Delays of the events of the project to milestones of the pipeline
+func (c *Consumer) Latency() *processor.LatencyTracker {
+	return c.eventProcessor.Latency
+}
+
+// Devices of the project. Loaded by LoadDevices or Run.
+func (c *Consumer) Devices() *processor.DeviceRegistry {
+	return c.devices
+}
+
+func (c *Consumer) DeviceStates() *processor.DeviceStateTracker {
+	return c.deviceStates
+}
+
+// Load devices of the project and their trait state
+func (c *Consumer) LoadDevices() error {
+	if err := c.devices.Refresh(context.Background()); err != nil {
+		return err
+	}
+	foundDoorbell := false
+	for _, device := range c.devices.Devices() {
+		var traits map[string]json.RawMessage
+		if err := json.Unmarshal(device.Traits, &traits); err == nil {
+			c.deviceStates.Update(device.Name, traits, time.Now())
+		}
+		if device.Type == sdmevents.DeviceTypeDoorbell {
+			foundDoorbell = true
+		}
+	}
+	if !foundDoorbell {
+		// keep running, doorbells added later are picked up by relation update events
+		log.Printf("[%v] Doorbell device not found in the account yet", c.name)
+	}
+	c.devicesLoaded = true
+	return nil
+}
+
+func (c *Consumer) refreshDevices(ctx context.Context) {
+	ticker := time.NewTicker(c.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.devices.Refresh(ctx); err != nil {
+				log.Printf("[%v] Failed to refresh devices: %v", c.name, err)
+				continue
+			}
+			for _, device := range c.devices.Devices() {
+				var traits map[string]json.RawMessage
+				if err := json.Unmarshal(device.Traits, &traits); err == nil {
+					c.deviceStates.Update(device.Name, traits, time.Now())
+				}
+			}
+		}
+	}
+}
+
+// Receive and process events until ctx is done, the source is exhausted or receiving fails. Devices are loaded first unless LoadDevices
+// was called.
+func (c *Consumer) Run(ctx context.Context) error {
+	if !c.devicesLoaded {
+		if err := c.LoadDevices(); err != nil {
+			return err
+		}
+	}
+	if err := c.eventProcessor.Init(); err != nil {
+		return err
+	}
+	if c.pollInterval > 0 {
+		poller := processor.DevicePoller{
+			Devices:               c.devices,
+			States:                c.deviceStates,
+			Interval:              c.pollInterval,
+			OfflineAlertThreshold: c.offlineAlertThreshold,
+			Notifications:         c.eventProcessor.NotificationSettings,
+		}
+		go poller.Run(ctx)
+	}
+	if c.refreshInterval > 0 {
+		go c.refreshDevices(ctx)
+	}
+	if len(c.summaryPeriod) > 0 {
+		location := c.eventProcessor.Location
+		if location == nil {
+			location = time.Local
+		}
+		reporter := processor.SummaryReporter{
+			OutputDir:     c.eventProcessor.OutputDir,
+			ClipBaseUrl:   c.eventProcessor.ClipBaseUrl,
+			Location:      location,
+			Period:        c.summaryPeriod,
+			At:            c.summaryAt,
+			Notifications: c.eventProcessor.NotificationSettings,
+		}
+		go reporter.Run(ctx)
+	}
+	return c.source.Receive(ctx, func(ctx context.Context, data []byte) {
+		receivedAt := time.Now()
+		ctx, span := tracing.StartAt(ctx, "message", receivedAt, tracing.String("project", c.name), tracing.Int("messaging.message.body.size", int64(len(data))))
+		defer span.End()
+		span.SetKind(tracing.SpanKindConsumer)
+		if !c.waitResumed(ctx) {
+			return
+		}
+		if c.eventLog != nil && !c.eventProcessor.DryRun {
+			if err := c.eventLog.Append(data); err != nil {
+				log.Printf("[%v] Failed to append message to %v: %v", c.name, c.eventLog.Path(), err)
+			}
+		}
+		var event = sdmevents.DeviceEvent{}
+		_, parseSpan := tracing.Start(ctx, "parse")
+		err := json.Unmarshal(data, &event)
+		parseSpan.RecordError(err)
+		parseSpan.End()
+		if err != nil {
+			span.RecordError(err)
+			log.Printf("[%v] Failed to unmarshal message: %v\n\t%v", c.name, err, data)
+			return
+		}
+		if t, err := time.Parse(time.RFC3339Nano, event.Timestamp); err == nil {
+			// how late SDM and Pub/Sub delivered the event
+			span.SetAttributes(tracing.String("sdm.event_timestamp", event.Timestamp), tracing.Float("sdm.delivery_delay_seconds", receivedAt.Sub(t).Seconds()))
+		}
+		if c.history != nil {
+			c.history.Add(c.name, &event, time.Now())
+		}
+		if c.eventProcessor.DryRun {
+			log.Printf("[%v] [dry-run] %v", c.name, event.Format())
+		}
+		if err := c.eventProcessor.ProcessContext(ctx, &event); err != nil {
+			span.RecordError(err)
+			log.Printf("[%v] Failed to process message: %v\n\t%v", c.name, err, data)
+			return
+		}
+	})
+}
+
+// nil if the message source is receiving, or can't tell
+func (c *Consumer) CheckHealth(ctx context.Context) error {
+	if checker, ok := c.source.(HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
+
+// Stop processing received events until Resume. Events received meanwhile are kept unacked, so Pub/Sub redelivers
+// them if the pause outlasts the ack deadline extension.
+func (c *Consumer) Pause() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+		log.Printf("[%v] Paused", c.name)
+	}
+}
+
+func (c *Consumer) Resume() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+		log.Printf("[%v] Resumed", c.name)
+	}
+}
+
+func (c *Consumer) Paused() bool {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	return c.resumed != nil
+}
+
+// Returns false if ctx is done while paused
+func (c *Consumer) waitResumed(ctx context.Context) bool {
+	c.pauseMu.Lock()
+	resumed := c.resumed
+	c.pauseMu.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Replace notifiers, notification rules and the event filter while running e.g. when the config is reloaded.
+// Notifiers given by WithNotifier are replaced as well.
+func (c *Consumer) Reconfigure(notifiers []notify.Notifier, rules *notify.NotificationRules, filter *processor.EventFilter) {
+	if c.eventProcessor.DryRun {
+		wrapped := make([]notify.Notifier, len(notifiers))
+		for i, notifier := range notifiers {
+			wrapped[i] = notify.NewDryRunNotifier(notifier)
+		}
+		notifiers = wrapped
+	}
+	c.eventProcessor.Reconfigure(notifiers, rules, filter)
+}
+
+// Record duration of the live stream of the device given by id, full name or custom name, and save it to the
+// storage. Returns the saved file. See processor.EventProcessor.Snapshot.
+func (c *Consumer) Snapshot(ctx context.Context, deviceQuery string, duration time.Duration) (string, error) {
+	device, err := sdmevents.FindDevice(c.devices.Devices(), deviceQuery)
+	if err != nil {
+		return "", err
+	}
+	return c.eventProcessor.Snapshot(ctx, device.Name, duration)
+}
@@ -0,0 +1,319 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// "circuitBreaker" of a notifier entry in the config file. Zero values mean the defaults
+type CircuitBreakerConfig struct {
+	Disabled      bool     `json:"disabled"`
+	Failures      int      `json:"failures"`      // consecutive failures opening the circuit. default 5
+	OpenFor       Duration `json:"openFor"`       // until a probe is let through the open circuit. default 1m
+	RetryBuffer   int      `json:"retryBuffer"`   // failed notifications kept to send again later. default 100, -1 keeps none
+	RetryMaxAge   Duration `json:"retryMaxAge"`   // failed notifications older than this are dropped. default 2 openFor
+	RetryAttempts int      `json:"retryAttempts"` // failed notifications are dropped after this many retries. default 3
+}
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half-open" // a probe is in flight
+)
+
+// Longest time a buffered notification is retried for
+const circuitRetryTimeout = time.Minute
+
+// State and counters of the circuit breaker of a notifier, for metrics
+type CircuitBreakerStats struct {
+	Notifier       string // NotifierId
+	State          CircuitState
+	Opens          int64 // times the circuit opened
+	ShortCircuited int64 // notifications not sent since the circuit was open
+	Buffered       int   // failed notifications waiting for retry
+	Retried        int64 // buffered notifications sent later
+	Dropped        int64 // buffered notifications dropped since the buffer was full, they got too old or kept failing
+}
+
+// Stop sending to a notification service after consecutive failures, so that events don't wait for a service which
+// is down. After openFor one notification probes the service (half-open), closing the circuit when it succeeds.
+// Failed and short circuited notifications are kept in a bounded buffer and sent again once the service is back.
+type circuitBreakerNotifier struct {
+	next       Notifier
+	config     CircuitBreakerConfig
+	mu         sync.Mutex
+	stats      CircuitBreakerStats
+	failures   int // consecutive
+	openedAt   time.Time
+	buffer     []bufferedNotification // oldest first
+	retrying   bool
+	retryTimer *time.Timer // nil unless a retry is scheduled
+	closed     bool
+	now        func() time.Time // replaced by tests
+}
+
+type bufferedNotification struct {
+	notification *Notification
+	at           time.Time // when it first failed
+	attempts     int       // failed retries
+}
+
+func newCircuitBreakerNotifier(next Notifier, config CircuitBreakerConfig) *circuitBreakerNotifier {
+	if config.Failures < 1 {
+		config.Failures = 5
+	}
+	if config.OpenFor <= 0 {
+		config.OpenFor = Duration(time.Minute)
+	}
+	if config.RetryBuffer == 0 {
+		config.RetryBuffer = 100
+	}
+	if config.RetryMaxAge <= 0 {
+		// retried at least once, as retries are openFor apart
+		config.RetryMaxAge = 2 * config.OpenFor
+	}
+	if config.RetryAttempts < 1 {
+		config.RetryAttempts = 3
+	}
+	return &circuitBreakerNotifier{next: next, config: config, stats: CircuitBreakerStats{State: CircuitClosed}, now: time.Now}
+}
+
+// Wrap notifier by a circuit breaker unless config disables it
+func NewCircuitBreakerNotifier(notifier Notifier, config CircuitBreakerConfig) Notifier {
+	if config.Disabled {
+		return notifier
+	}
+	return newCircuitBreakerNotifier(notifier, config)
+}
+
+func (b *circuitBreakerNotifier) Name() string {
+	return b.next.Name()
+}
+
+func (b *circuitBreakerNotifier) Notify(ctx context.Context, notification *Notification) error {
+	if !b.allow() {
+		b.mu.Lock()
+		b.stats.ShortCircuited++
+		b.enqueue(notification)
+		b.mu.Unlock()
+		if b.config.RetryBuffer < 0 {
+			return fmt.Errorf("circuit open since %v failures", b.config.Failures)
+		}
+		return fmt.Errorf("circuit open since %v failures, queued for retry", b.config.Failures)
+	}
+	err := b.next.Notify(ctx, notification)
+	if err != nil && ctx.Err() != nil {
+		// canceled by the caller e.g. on shutdown, not a failure of the service. The next one probes again
+		b.mu.Lock()
+		if b.stats.State == CircuitHalfOpen {
+			b.stats.State = CircuitOpen
+		}
+		b.mu.Unlock()
+		return err
+	}
+	b.done(err)
+	if err != nil {
+		b.mu.Lock()
+		b.enqueue(notification)
+		b.mu.Unlock()
+		return err
+	}
+	b.retryBuffered()
+	return nil
+}
+
+// Returns false while the circuit is open. Lets one probe through after openFor
+func (b *circuitBreakerNotifier) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.stats.State {
+	case CircuitOpen:
+		if b.now().Sub(b.openedAt) < time.Duration(b.config.OpenFor) {
+			return false
+		}
+		b.stats.State = CircuitHalfOpen
+		return true
+	case CircuitHalfOpen:
+		return false
+	}
+	return true
+}
+
+// Record the result of a notification let through by allow
+func (b *circuitBreakerNotifier) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.stats.State != CircuitClosed {
+			log.Printf("Notifier %v recovered, circuit closed", b.next.Name())
+		}
+		b.stats.State = CircuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.stats.State == CircuitHalfOpen || b.failures >= b.config.Failures {
+		if b.stats.State == CircuitClosed {
+			log.Printf("Notifier %v failed %v times in a row, circuit open for %v: %v", b.next.Name(), b.failures, time.Duration(b.config.OpenFor), err)
+			b.stats.Opens++
+		}
+		b.stats.State = CircuitOpen
+		b.openedAt = b.now()
+		b.scheduleRetry()
+	}
+}
+
+// Keep a failed notification to send again. Called with mu held
+func (b *circuitBreakerNotifier) enqueue(notification *Notification) {
+	if b.closed || b.config.RetryBuffer < 0 {
+		return
+	}
+	if len(b.buffer) >= b.config.RetryBuffer {
+		log.Printf("Retry buffer of notifier %v is full, dropped %v notification of %v", b.next.Name(), b.buffer[0].notification.EventName(), b.buffer[0].notification.Timestamp)
+		b.buffer = b.buffer[1:]
+		b.stats.Dropped++
+	}
+	b.buffer = append(b.buffer, bufferedNotification{notification: notification, at: b.now()})
+	b.scheduleRetry()
+}
+
+// Retry the buffer after openFor unless it's already scheduled. Called with mu held
+func (b *circuitBreakerNotifier) scheduleRetry() {
+	if b.closed || b.retryTimer != nil || len(b.buffer) == 0 {
+		return
+	}
+	b.retryTimer = time.AfterFunc(time.Duration(b.config.OpenFor), func() {
+		b.mu.Lock()
+		b.retryTimer = nil
+		b.mu.Unlock()
+		b.retryBuffered()
+	})
+}
+
+// Send the buffered notifications, oldest first, in the background until one fails or the circuit opens
+func (b *circuitBreakerNotifier) retryBuffered() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || b.retrying || len(b.buffer) == 0 {
+		return
+	}
+	b.retrying = true
+	go b.retry()
+}
+
+func (b *circuitBreakerNotifier) retry() {
+	for {
+		b.mu.Lock()
+		for len(b.buffer) > 0 && b.now().Sub(b.buffer[0].at) > time.Duration(b.config.RetryMaxAge) {
+			log.Printf("Dropped %v notification of %v via %v, failing for longer than %v", b.buffer[0].notification.EventName(), b.buffer[0].notification.Timestamp, b.next.Name(), time.Duration(b.config.RetryMaxAge))
+			b.buffer = b.buffer[1:]
+			b.stats.Dropped++
+		}
+		if b.closed || len(b.buffer) == 0 {
+			b.retrying = false
+			b.mu.Unlock()
+			return
+		}
+		buffered := b.buffer[0]
+		b.mu.Unlock()
+		if !b.allow() {
+			break
+		}
+		notification := *buffered.notification
+		if len(notification.ClipFile) > 0 {
+			if _, err := os.Stat(notification.ClipFile); err != nil {
+				// e.g. the temp image of -clip-wait snapshot
+				notification.ClipFile = ""
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), circuitRetryTimeout)
+		err := b.next.Notify(ctx, &notification)
+		cancel()
+		b.done(err)
+		if err != nil {
+			log.Printf("Failed to retry %v notification via %v: %v", notification.EventName(), b.next.Name(), err)
+			// one which always fails e.g. for its payload mustn't hold back the ones after it
+			b.mu.Lock()
+			if len(b.buffer) > 0 && b.buffer[0].notification == buffered.notification {
+				if b.buffer[0].attempts++; b.buffer[0].attempts >= b.config.RetryAttempts {
+					log.Printf("Dropped %v notification of %v via %v after %v failed retries", notification.EventName(), notification.Timestamp, b.next.Name(), b.buffer[0].attempts)
+					b.buffer = b.buffer[1:]
+					b.stats.Dropped++
+				}
+			}
+			b.mu.Unlock()
+			break
+		}
+		log.Printf("Retried %v notification of %v via %v", notification.EventName(), notification.Timestamp, b.next.Name())
+		b.mu.Lock()
+		if len(b.buffer) > 0 && b.buffer[0].notification == buffered.notification {
+			b.buffer = b.buffer[1:]
+		}
+		b.stats.Retried++
+		b.mu.Unlock()
+	}
+	b.mu.Lock()
+	b.retrying = false
+	b.scheduleRetry()
+	b.mu.Unlock()
+}
+
+// Stop the scheduled retry and drop the buffered notifications, for notifiers discarded e.g. on config reload. A retry
+// in flight finishes, and later notifications are still sent but not buffered
+func (b *circuitBreakerNotifier) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	if b.retryTimer != nil {
+		b.retryTimer.Stop()
+		b.retryTimer = nil
+	}
+	if len(b.buffer) > 0 {
+		log.Printf("Dropped %v buffered notifications of closed notifier %v", len(b.buffer), b.next.Name())
+		b.stats.Dropped += int64(len(b.buffer))
+		b.buffer = nil
+	}
+}
+
+// Circuit breaker stats of notifiers having one
+func CircuitBreakers(notifiers []Notifier) []CircuitBreakerStats {
+	stats := []CircuitBreakerStats{}
+	for _, notifier := range notifiers {
+		for n := notifier; n != nil; n = unwrapNotifier(n) {
+			if b, ok := n.(*circuitBreakerNotifier); ok {
+				b.mu.Lock()
+				s := b.stats
+				s.Buffered = len(b.buffer)
+				b.mu.Unlock()
+				s.Notifier = NotifierId(notifier)
+				stats = append(stats, s)
+				break
+			}
+		}
+	}
+	return stats
+}
+
+// Notifier wrapped by filters of the config or the circuit breaker, nil if n wraps nothing
+func unwrapNotifier(n Notifier) Notifier {
+	switch n := n.(type) {
+	case *namedNotifier:
+		return n.Notifier
+	case *eventFilterNotifier:
+		return n.next
+	case *rulesNotifier:
+		return n.next
+	case *circuitBreakerNotifier:
+		return n.next
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Notifier failing while fail is set or for notifications of timestamp poison, recording the timestamps of the
+// notifications it got
+type fakeNotifier struct {
+	mu     sync.Mutex
+	fail   bool
+	poison string
+	sent   []string
+	got    int
+}
+
+func (n *fakeNotifier) Name() string {
+	return "fake"
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, notification *Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.got++
+	if n.fail || (len(n.poison) > 0 && notification.Timestamp == n.poison) {
+		return errors.New("service is down")
+	}
+	n.sent = append(n.sent, notification.Timestamp)
+	return nil
+}
+
+func (n *fakeNotifier) setFail(fail bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.fail = fail
+}
+
+func (n *fakeNotifier) calls() (int, []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.got, append([]string{}, n.sent...)
+}
+
+func breakerStats(b *circuitBreakerNotifier) CircuitBreakerStats {
+	return CircuitBreakers([]Notifier{b})[0]
+}
+
+// Clock of breakers moved by tests, so that openFor passes without the retry timers firing
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestClock(b *circuitBreakerNotifier) *testClock {
+	c := &testClock{now: time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)}
+	b.now = c.Now
+	return c
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Run the retry of the buffer and wait for it to end
+func retryNow(t *testing.T, b *circuitBreakerNotifier) {
+	t.Helper()
+	b.retryBuffered()
+	eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return !b.retrying
+	})
+}
+
+// Wait until cond holds, for the retries running in the background
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal("condition not met in 5s")
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	next := &fakeNotifier{fail: true}
+	// the retry timers of an hour don't fire during the test, which retries by itself
+	openFor := time.Hour
+	b := newCircuitBreakerNotifier(next, CircuitBreakerConfig{Failures: 3, OpenFor: Duration(openFor), RetryBuffer: 10, RetryMaxAge: Duration(10 * openFor)})
+	defer b.Close()
+	clock := newTestClock(b)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if state := breakerStats(b).State; state != CircuitClosed {
+			t.Fatalf("state after %v failures = %v, want closed", i, state)
+		}
+		if err := b.Notify(ctx, &Notification{Timestamp: "fail"}); err == nil {
+			t.Fatal("failure of the service is not returned")
+		}
+	}
+	if stats := breakerStats(b); stats.State != CircuitOpen || stats.Opens != 1 {
+		t.Fatalf("stats after 3 failures = %+v, want open once", stats)
+	}
+	// short circuited without reaching the service
+	if err := b.Notify(ctx, &Notification{Timestamp: "short"}); err == nil {
+		t.Fatal("short circuited notification succeeded")
+	}
+	if got, _ := next.calls(); got != 3 {
+		t.Fatalf("service got %v notifications, want 3", got)
+	}
+	if stats := breakerStats(b); stats.ShortCircuited != 1 || stats.Buffered != 4 {
+		t.Fatalf("stats = %+v, want 1 short circuited and 4 buffered", stats)
+	}
+	if b.allow() {
+		t.Fatal("allowed before openFor")
+	}
+	// after openFor, only one probe is let through (half-open) and it fails, opening the circuit again
+	clock.advance(openFor)
+	if !b.allow() {
+		t.Fatal("probe after openFor is not allowed")
+	}
+	if state := breakerStats(b).State; state != CircuitHalfOpen {
+		t.Fatalf("state while probing = %v, want half-open", state)
+	}
+	if b.allow() {
+		t.Fatal("second notification is allowed while probing")
+	}
+	b.done(errors.New("still down"))
+	if stats := breakerStats(b); stats.State != CircuitOpen || stats.Opens != 1 {
+		t.Fatalf("stats after the failed probe = %+v, want open and not counted again", stats)
+	}
+	// the service is back. The retry after openFor probes it, closes the circuit and sends the buffer in order
+	next.setFail(false)
+	retryNow(t, b)
+	if stats := breakerStats(b); stats.Buffered != 4 || stats.Retried != 0 {
+		t.Fatalf("stats after a retry before openFor = %+v, want nothing retried", stats)
+	}
+	clock.advance(openFor)
+	retryNow(t, b)
+	if stats := breakerStats(b); stats.State != CircuitClosed || stats.Retried != 4 {
+		t.Fatalf("stats after recovery = %+v, want closed and 4 retried", stats)
+	}
+	if _, sent := next.calls(); len(sent) != 4 || sent[3] != "short" {
+		t.Fatalf("sent %v, want the buffered notifications in order", sent)
+	}
+	if err := b.Notify(ctx, &Notification{Timestamp: "ok"}); err != nil {
+		t.Fatalf("notification after recovery: %v", err)
+	}
+}
+
+// A success in the closed state resets the count of consecutive failures
+func TestCircuitBreakerCountsConsecutiveFailures(t *testing.T) {
+	next := &fakeNotifier{}
+	b := newCircuitBreakerNotifier(next, CircuitBreakerConfig{Failures: 2, OpenFor: Duration(time.Hour)})
+	defer b.Close()
+	for _, fail := range []bool{true, false, true, false, true} {
+		next.setFail(fail)
+		b.Notify(context.Background(), &Notification{})
+	}
+	if state := breakerStats(b).State; state != CircuitClosed {
+		t.Errorf("state = %v, want closed", state)
+	}
+}
+
+// Canceled notifications aren't failures of the service
+func TestCircuitBreakerIgnoresCanceled(t *testing.T) {
+	next := &fakeNotifier{fail: true}
+	b := newCircuitBreakerNotifier(next, CircuitBreakerConfig{Failures: 1, OpenFor: Duration(time.Hour)})
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Notify(ctx, &Notification{})
+	if stats := breakerStats(b); stats.State != CircuitClosed || stats.Buffered != 0 {
+		t.Errorf("stats = %+v, want closed without buffered notifications", stats)
+	}
+}
+
+func TestCircuitBreakerRetryBufferOverflow(t *testing.T) {
+	next := &fakeNotifier{fail: true}
+	b := newCircuitBreakerNotifier(next, CircuitBreakerConfig{Failures: 1, OpenFor: Duration(time.Hour), RetryBuffer: 3})
+	defer b.Close()
+	for _, timestamp := range []string{"1", "2", "3", "4", "5"} {
+		b.Notify(context.Background(), &Notification{Timestamp: timestamp})
+	}
+	if stats := breakerStats(b); stats.Buffered != 3 || stats.Dropped != 2 || stats.ShortCircuited != 4 {
+		t.Fatalf("stats = %+v, want 3 buffered, 2 dropped and 4 short circuited", stats)
+	}
+	// oldest dropped first
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, want := range []string{"3", "4", "5"} {
+		if got := b.buffer[i].notification.Timestamp; got != want {
+			t.Errorf("buffer[%v] = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// A notification which keeps failing is dropped after retryAttempts, letting the ones after it through
+func TestCircuitBreakerRetryAttempts(t *testing.T) {
+	next := &fakeNotifier{poison: "bad"}
+	openFor := time.Hour
+	b := newCircuitBreakerNotifier(next, CircuitBreakerConfig{Failures: 1, OpenFor: Duration(openFor), RetryMaxAge: Duration(10 * openFor), RetryAttempts: 2})
+	defer b.Close()
+	clock := newTestClock(b)
+	b.Notify(context.Background(), &Notification{Timestamp: "bad"})
+	b.Notify(context.Background(), &Notification{Timestamp: "good"})
+	for i, want := range []CircuitBreakerStats{
+		{Notifier: "fake", State: CircuitOpen, Opens: 1, ShortCircuited: 1, Buffered: 2},
+		{Notifier: "fake", State: CircuitOpen, Opens: 1, ShortCircuited: 1, Buffered: 1, Dropped: 1},
+		{Notifier: "fake", State: CircuitClosed, Opens: 1, ShortCircuited: 1, Retried: 1, Dropped: 1},
+	} {
+		clock.advance(openFor)
+		retryNow(t, b)
+		if stats := breakerStats(b); stats != want {
+			t.Fatalf("stats after retry %v = %+v, want %+v", i+1, stats, want)
+		}
+	}
+	if got, sent := next.calls(); got != 4 || len(sent) != 1 || sent[0] != "good" {
+		t.Errorf("service got %v notifications and sent %v, want the bad one 3 times and the good one", got, sent)
+	}
+}
+
+// Notifiers which mustn't act late, exec by default, keep no failed notifications
+func TestCircuitBreakerWithoutRetryBuffer(t *testing.T) {
+	next := &fakeNotifier{fail: true}
+	b := newCircuitBreakerNotifier(next, CircuitBreakerConfig{Failures: 1, OpenFor: Duration(time.Hour), RetryBuffer: -1})
+	defer b.Close()
+	b.Notify(context.Background(), &Notification{})
+	if err := b.Notify(context.Background(), &Notification{}); err == nil || strings.Contains(err.Error(), "queued") {
+		t.Errorf("error = %v, want short circuited and not queued", err)
+	}
+	if stats := breakerStats(b); stats.Buffered != 0 || stats.ShortCircuited != 1 {
+		t.Errorf("stats = %+v, want nothing buffered", stats)
+	}
+	exec, err := newExecNotifierFromConfig(json.RawMessage(`{"command":["true"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		notifier Notifier
+		header   NotifierConfigHeader
+		want     int
+	}{
+		{exec, NotifierConfigHeader{Type: "exec"}, -1},
+		{exec, NotifierConfigHeader{Type: "exec", CircuitBreaker: CircuitBreakerConfig{RetryBuffer: 5}}, 5},
+		{&fakeNotifier{}, NotifierConfigHeader{Type: "fake"}, 100},
+	} {
+		wrapped, err := WrapNotifier(c.notifier, c.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := unwrapNotifier(wrapped).(*circuitBreakerNotifier)
+		if b.config.RetryBuffer != c.want {
+			t.Errorf("retryBuffer of %v with %+v = %v, want %v", c.notifier.Name(), c.header.CircuitBreaker, b.config.RetryBuffer, c.want)
+		}
+	}
+}
+
+func TestCircuitBreakerDefaults(t *testing.T) {
+	b := newCircuitBreakerNotifier(&fakeNotifier{}, CircuitBreakerConfig{OpenFor: Duration(30 * time.Second)})
+	if want := (CircuitBreakerConfig{Failures: 5, OpenFor: Duration(30 * time.Second), RetryBuffer: 100, RetryMaxAge: Duration(time.Minute), RetryAttempts: 3}); b.config != want {
+		t.Errorf("config = %+v, want %+v", b.config, want)
+	}
+}
+
+func TestCircuitBreakerRetryMaxAge(t *testing.T) {
+	next := &fakeNotifier{fail: true}
+	b := newCircuitBreakerNotifier(next, CircuitBreakerConfig{Failures: 1, OpenFor: Duration(time.Hour), RetryMaxAge: Duration(time.Minute)})
+	defer b.Close()
+	b.Notify(context.Background(), &Notification{Timestamp: "old"})
+	b.mu.Lock()
+	b.buffer[0].at = time.Now().Add(-2 * time.Minute)
+	b.stats.State = CircuitClosed
+	b.mu.Unlock()
+	next.setFail(false)
+	b.retryBuffered()
+	eventually(t, func() bool { return breakerStats(b).Buffered == 0 })
+	if _, sent := next.calls(); len(sent) != 0 {
+		t.Errorf("sent %v, want the old notification dropped", sent)
+	}
+	if stats := breakerStats(b); stats.Dropped != 1 || stats.Retried != 0 {
+		t.Errorf("stats = %+v, want 1 dropped", stats)
+	}
+}
+
+func TestCircuitBreakerClose(t *testing.T) {
+	next := &fakeNotifier{fail: true}
+	openFor := 20 * time.Millisecond
+	b := newCircuitBreakerNotifier(next, CircuitBreakerConfig{Failures: 1, OpenFor: Duration(openFor)})
+	b.Notify(context.Background(), &Notification{})
+	b.Notify(context.Background(), &Notification{})
+	CloseNotifiers([]Notifier{&namedNotifier{Notifier: b, id: "fake"}})
+	if stats := breakerStats(b); stats.Buffered != 0 || stats.Dropped != 2 {
+		t.Fatalf("stats after Close = %+v, want the buffer drained", stats)
+	}
+	b.mu.Lock()
+	timer := b.retryTimer
+	b.mu.Unlock()
+	if timer != nil {
+		t.Fatal("retry is still scheduled after Close")
+	}
+	// nothing is retried or buffered against the discarded service anymore
+	next.setFail(false)
+	time.Sleep(3 * openFor)
+	if got, _ := next.calls(); got != 1 {
+		t.Errorf("service got %v notifications after Close, want only the first one", got)
+	}
+	next.setFail(true)
+	time.Sleep(openFor)
+	b.Notify(context.Background(), &Notification{})
+	if stats := breakerStats(b); stats.Buffered != 0 {
+		t.Errorf("stats = %+v, want nothing buffered after Close", stats)
+	}
+}
@@ -0,0 +1,113 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+)
+
+// Fields shared by every entry of "notifiers" in the config file
+type NotifierConfigHeader struct {
+	Name   string                   `json:"name"` // id used by `test notify -sink`. defaults to type
+	Type   string                   `json:"type"`
+	Events []string                 `json:"events"` // chime, motion, person, sound. empty means every event
+	Rules  *NotificationRulesConfig `json:"rules"`  // applied to this notifier only
+	// stops sending to the service while it's failing. enabled with the defaults when omitted
+	CircuitBreaker CircuitBreakerConfig `json:"circuitBreaker"`
+}
+
+// Create notifier from its config entry
+type notifierFactory func(raw json.RawMessage) (Notifier, error)
+
+var notifierFactories = map[string]notifierFactory{
+	"webhook":       newWebhookNotifierFromConfig,
+	"slack":         newSlackNotifierFromConfig,
+	"discord":       newDiscordNotifierFromConfig,
+	"telegram":      newTelegramNotifierFromConfig,
+	"email":         newEmailNotifierFromConfig,
+	"ntfy":          newNtfyNotifierFromConfig,
+	"gotify":        newGotifyNotifierFromConfig,
+	"pushover":      newPushoverNotifierFromConfig,
+	"pushbullet":    newPushbulletNotifierFromConfig,
+	"exec":          newExecNotifierFromConfig,
+	"homeassistant": newHomeAssistantNotifierFromConfig,
+	"ifttt":         newIftttNotifierFromConfig,
+	"nats":          newNatsNotifierFromConfig,
+	"kafka":         newKafkaNotifierFromConfig,
+	"influxdb":      newInfluxDbNotifierFromConfig,
+	"remotewrite":   newRemoteWriteNotifierFromConfig,
+}
+
+// Create notifiers from entries of "notifiers" in the config file
+func CreateNotifiers(configs []json.RawMessage) ([]Notifier, error) {
+	notifiers := []Notifier{}
+	for i, raw := range configs {
+		var header NotifierConfigHeader
+		if err := json.Unmarshal(raw, &header); err != nil {
+			return nil, fmt.Errorf("notifiers[%v]: %v", i, err)
+		}
+		factory, ok := notifierFactories[header.Type]
+		if !ok {
+			return nil, fmt.Errorf("notifiers[%v]: unknown notifier type %v", i, header.Type)
+		}
+		notifier, err := factory(raw)
+		if err != nil {
+			return nil, fmt.Errorf("notifiers[%v]: %v", i, err)
+		}
+		notifier, err = WrapNotifier(notifier, header)
+		if err != nil {
+			return nil, fmt.Errorf("notifiers[%v]: %v", i, err)
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	return notifiers, nil
+}
+
+// Wrap notifier by the circuit breaker, event filter and rules of header, and name it by header.Name (or Type).
+// Notifiers given by flags are wrapped by it too with only the name, to get the default circuit breaker
+func WrapNotifier(notifier Notifier, header NotifierConfigHeader) (Notifier, error) {
+	if _, ok := notifier.(*ExecNotifier); ok && header.CircuitBreaker.RetryBuffer == 0 {
+		// hooks run later would act on events which are over
+		header.CircuitBreaker.RetryBuffer = -1
+	}
+	notifier = NewCircuitBreakerNotifier(notifier, header.CircuitBreaker)
+	if len(header.Events) > 0 {
+		var err error
+		notifier, err = newEventFilterNotifier(notifier, header.Events)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if header.Rules != nil {
+		rules, err := NewNotificationRules(header.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("rules: %v", err)
+		}
+		notifier = &rulesNotifier{next: notifier, rules: rules}
+	}
+	id := header.Name
+	if len(id) == 0 {
+		id = header.Type
+	}
+	if len(id) == 0 {
+		id = notifier.Name()
+	}
+	return &namedNotifier{Notifier: notifier, id: id}, nil
+}
+
+// Stop the retries of the circuit breakers of notifiers which are no longer used e.g. on config reload, and close the
+// notifiers holding connections (io.Closer) after the notification in progress
+func CloseNotifiers(notifiers []Notifier) {
+	for _, notifier := range notifiers {
+		for n := notifier; n != nil; n = unwrapNotifier(n) {
+			if b, ok := n.(*circuitBreakerNotifier); ok {
+				b.Close()
+			} else if closer, ok := n.(io.Closer); ok {
+				if err := closer.Close(); err != nil {
+					log.Printf("Failed to close notifier %v: %v", n.Name(), err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// Post message to Discord webhook. The saved snapshot/clip is uploaded as attachment when attachImage is true.
+// Messages can be edited e.g. to attach the clip saved later.
+type DiscordNotifier struct {
+	url         string
+	template    *template.Template
+	attachImage bool
+	attempts    int
+}
+
+type DiscordNotifierConfig struct {
+	Url         string `json:"url"`      // https://discord.com/api/webhooks/...
+	Template    string `json:"template"` // go text/template of message content
+	AttachImage bool   `json:"attachImage"`
+	Attempts    int    `json:"attempts"`
+}
+
+func newDiscordNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := DiscordNotifierConfig{Attempts: 3}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Url) == 0 {
+		return nil, fmt.Errorf("url is required")
+	}
+	t, err := parseMessageTemplate(config.Template)
+	if err != nil {
+		return nil, err
+	}
+	return &DiscordNotifier{url: config.Url, template: t, attachImage: config.AttachImage, attempts: config.Attempts}, nil
+}
+
+func (n *DiscordNotifier) Name() string {
+	return "discord"
+}
+
+// https://discord.com/developers/docs/resources/webhook#execute-webhook
+type discordMessage struct {
+	Id      string `json:"id,omitempty"` // of responses
+	Content string `json:"content"`
+}
+
+func (n *DiscordNotifier) Notify(ctx context.Context, notification *Notification) error {
+	contentType, body, err := n.body(notification)
+	if err != nil {
+		return err
+	}
+	if !recordingSentMessages(ctx) {
+		return postWithRetry(ctx, http.DefaultClient, n.attempts, n.url, contentType, body)
+	}
+	// wait=true answers the created message
+	u, err := url.Parse(n.url)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("wait", "true")
+	u.RawQuery = query.Encode()
+	response, err := sendWithRetry(ctx, http.DefaultClient, n.attempts, http.MethodPost, u.String(), contentType, body)
+	if err != nil {
+		return err
+	}
+	var message discordMessage
+	if err := json.Unmarshal(response, &message); err != nil || len(message.Id) == 0 {
+		return fmt.Errorf("no message id in the response: %s", response)
+	}
+	recordSentMessage(ctx, n, message.Id)
+	return nil
+}
+
+// https://discord.com/developers/docs/resources/webhook#edit-webhook-message
+func (n *DiscordNotifier) EditMessage(ctx context.Context, id string, notification *Notification) error {
+	contentType, body, err := n.body(notification)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(n.url)
+	if err != nil {
+		return err
+	}
+	u.Path += "/messages/" + id
+	_, err = sendWithRetry(ctx, http.DefaultClient, n.attempts, http.MethodPatch, u.String(), contentType, body)
+	return err
+}
+
+// JSON of the message, or multipart with the clip attached
+func (n *DiscordNotifier) body(notification *Notification) (string, []byte, error) {
+	content, err := renderMessage(n.template, notification)
+	if err != nil {
+		return "", nil, err
+	}
+	payload, err := json.Marshal(discordMessage{Content: content})
+	if err != nil {
+		return "", nil, err
+	}
+	if !n.attachImage || len(notification.ClipFile) == 0 {
+		return "application/json", payload, nil
+	}
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if err := writer.WriteField("payload_json", string(payload)); err != nil {
+		return "", nil, err
+	}
+	part, err := writer.CreateFormFile("files[0]", filepath.Base(notification.ClipFile))
+	if err != nil {
+		return "", nil, err
+	}
+	file, err := os.Open(notification.ClipFile)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	if _, err := io.Copy(part, file); err != nil {
+		return "", nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return "", nil, err
+	}
+	return writer.FormDataContentType(), body.Bytes(), nil
+}
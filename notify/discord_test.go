@@ -0,0 +1,97 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newTestDiscordNotifier(t *testing.T, url string, attachImage bool) *DiscordNotifier {
+	raw, _ := json.Marshal(DiscordNotifierConfig{Url: url, Template: "ring {{.Timestamp}}", AttachImage: attachImage, Attempts: 1})
+	n, err := newDiscordNotifierFromConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n.(*DiscordNotifier)
+}
+
+func TestDiscordNotify(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusNoContent, ""))
+	n := newTestDiscordNotifier(t, server.URL+"/api/webhooks/1/token", true)
+
+	// JSON without a clip
+	if err := n.Notify(context.Background(), &Notification{Timestamp: "10:00"}); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.take()
+	if len(requests) != 1 || requests[0].Method != http.MethodPost || requests[0].Path != "/api/webhooks/1/token" || len(requests[0].Query) != 0 {
+		t.Fatalf("requests = %+v, want POST of the webhook", requests)
+	}
+	if string(requests[0].Body) != `{"content":"ring 10:00"}` {
+		t.Errorf("body = %s, want the content", requests[0].Body)
+	}
+
+	// multipart with the clip attached
+	if err := n.Notify(context.Background(), &Notification{Timestamp: "10:00", ClipFile: writeTestClip(t, "clip.mp4")}); err != nil {
+		t.Fatal(err)
+	}
+	requests = server.take()
+	if len(requests) != 1 {
+		t.Fatalf("%v requests, want 1", len(requests))
+	}
+	fields, files := requests[0].form(t)
+	if fields["payload_json"] != `{"content":"ring 10:00"}` || files["files[0]"] != [2]string{"clip.mp4", "clip of clip.mp4"} {
+		t.Errorf("fields = %v, files = %v, want payload_json and the clip", fields, files)
+	}
+}
+
+func TestDiscordEditMessage(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusOK, `{"id":"1001","content":"ring 10:00"}`))
+	n := newTestDiscordNotifier(t, server.URL+"/api/webhooks/1/token", true)
+
+	// recorded messages wait for the created message to learn its id
+	sent := &SentMessages{}
+	if err := n.Notify(RecordSentMessages(context.Background(), sent), &Notification{Timestamp: "10:00"}); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.take()
+	if len(requests) != 1 || requests[0].Query.Get("wait") != "true" {
+		t.Fatalf("requests = %+v, want wait=true", requests)
+	}
+	if len(sent.messages) != 1 || sent.messages[0].id != "1001" {
+		t.Fatalf("recorded %+v, want 1001", sent.messages)
+	}
+
+	if err := n.EditMessage(context.Background(), "1001", &Notification{Timestamp: "10:01", ClipFile: writeTestClip(t, "clip.mp4")}); err != nil {
+		t.Fatal(err)
+	}
+	requests = server.take()
+	if len(requests) != 1 || requests[0].Method != http.MethodPatch || requests[0].Path != "/api/webhooks/1/token/messages/1001" {
+		t.Fatalf("requests = %+v, want PATCH of the message", requests)
+	}
+	if fields, files := requests[0].form(t); fields["payload_json"] != `{"content":"ring 10:01"}` || files["files[0]"][0] != "clip.mp4" {
+		t.Errorf("fields = %v, files = %v, want the new content and the clip", fields, files)
+	}
+}
+
+func TestDiscordErrors(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusNotFound, `{"message":"Unknown Webhook","code":10015}`))
+	n := newTestDiscordNotifier(t, server.URL, false)
+	if err := n.Notify(context.Background(), &Notification{}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Notify answered 404 = %v, want the status", err)
+	}
+	if err := n.EditMessage(context.Background(), "1001", &Notification{}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("EditMessage answered 404 = %v, want the status", err)
+	}
+	// recording needs the id of the message
+	server.answer(http.StatusNoContent, "")
+	sent := &SentMessages{}
+	if err := n.Notify(RecordSentMessages(context.Background(), sent), &Notification{}); err == nil || sent.Len() != 0 {
+		t.Errorf("Notify answered without a message = %v, recorded %v, want an error", err, sent.Len())
+	}
+	if _, err := newDiscordNotifierFromConfig(json.RawMessage(`{}`)); err == nil {
+		t.Error("config without url succeeded, want error")
+	}
+}
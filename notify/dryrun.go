@@ -0,0 +1,43 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+)
+
+// Log notifications instead of sending them
+type dryRunNotifier struct {
+	name string
+}
+
+func (n *dryRunNotifier) Name() string {
+	return n.name
+}
+
+func (n *dryRunNotifier) Notify(ctx context.Context, notification *Notification) error {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	log.Printf("[dry-run] Would notify %v via %v: %s", notification.EventName(), n.name, payload)
+	return nil
+}
+
+// Replace the notification service behind notifier with a logger. Event filters and rules of the notifier still apply,
+// so the log shows exactly the notifications which would be sent.
+func NewDryRunNotifier(notifier Notifier) Notifier {
+	switch n := notifier.(type) {
+	case *namedNotifier:
+		return &namedNotifier{Notifier: NewDryRunNotifier(n.Notifier), id: n.id}
+	case *eventFilterNotifier:
+		return &eventFilterNotifier{next: NewDryRunNotifier(n.next), events: n.events}
+	case *rulesNotifier:
+		return &rulesNotifier{next: NewDryRunNotifier(n.next), rules: n.rules}
+	case *circuitBreakerNotifier:
+		return NewDryRunNotifier(n.next)
+	case *dryRunNotifier:
+		return n
+	}
+	return &dryRunNotifier{name: notifier.Name()}
+}
@@ -0,0 +1,86 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/cormoran/NestDoorbellConsumer/tracing"
+)
+
+// Notifier which can edit the messages it sent, e.g. to attach the clip which was saved after the notification
+type MessageEditor interface {
+	Notifier
+	EditMessage(ctx context.Context, id string, notification *Notification) error
+}
+
+// Messages sent by MessageEditors with the context of RecordSentMessages
+type SentMessages struct {
+	mu       sync.Mutex
+	messages []sentMessage
+}
+
+type sentMessage struct {
+	editor MessageEditor
+	id     string // given by the editor
+}
+
+type sentMessagesKey struct{}
+
+// Context recording the messages which MessageEditors send with it into sent
+func RecordSentMessages(ctx context.Context, sent *SentMessages) context.Context {
+	return context.WithValue(ctx, sentMessagesKey{}, sent)
+}
+
+// Whether messages sent with ctx are recorded, so that the notifier should learn the id of the message
+func recordingSentMessages(ctx context.Context) bool {
+	_, ok := ctx.Value(sentMessagesKey{}).(*SentMessages)
+	return ok
+}
+
+func recordSentMessage(ctx context.Context, editor MessageEditor, id string) {
+	if sent, ok := ctx.Value(sentMessagesKey{}).(*SentMessages); ok {
+		sent.mu.Lock()
+		defer sent.mu.Unlock()
+		sent.messages = append(sent.messages, sentMessage{editor: editor, id: id})
+	}
+}
+
+func (s *SentMessages) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+// Edit every recorded message into notification in parallel like NotifyAll
+func (s *SentMessages) EditAll(ctx context.Context, notification *Notification) error {
+	s.mu.Lock()
+	messages := append([]sentMessage{}, s.messages...)
+	s.mu.Unlock()
+	ctx, span := tracing.Start(ctx, "edit", tracing.Int("notify.messages", int64(len(messages))))
+	defer span.End()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := []string{}
+	for _, message := range messages {
+		wg.Add(1)
+		go func(message sentMessage) {
+			defer wg.Done()
+			if err := message.editor.EditMessage(ctx, message.id, notification); err != nil {
+				log.Printf("Failed to edit %v notification via %v: %v", notification.EventName(), message.editor.Name(), err)
+				mu.Lock()
+				failed = append(failed, message.editor.Name())
+				mu.Unlock()
+			}
+		}(message)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		err := fmt.Errorf("failed to edit notifications via %v", strings.Join(failed, ", "))
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
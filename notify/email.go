@@ -0,0 +1,224 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Send mail via SMTP. The saved snapshot is attached inline when attachImage is true.
+type EmailNotifier struct {
+	config   EmailNotifierConfig
+	subject  *template.Template
+	template *template.Template
+}
+
+const (
+	EmailSecurityStartTLS = "starttls" // plain connection upgraded by STARTTLS (port 587)
+	EmailSecurityTLS      = "tls"      // implicit TLS (port 465)
+	EmailSecurityNone     = "none"     // no encryption. only for local relay
+)
+
+type EmailNotifierConfig struct {
+	Host        string   `json:"host"`
+	Port        int      `json:"port"`
+	Security    string   `json:"security"` // starttls (default), tls or none
+	Username    string   `json:"username"`
+	Password    string   `json:"password"`
+	From        string   `json:"from"`
+	To          []string `json:"to"`
+	Subject     string   `json:"subject"`  // go text/template of subject
+	Template    string   `json:"template"` // go text/template of body
+	AttachImage bool     `json:"attachImage"`
+	Attempts    int      `json:"attempts"`
+}
+
+const defaultEmailSubjectTemplate = `{{if .Summary}}Doorbell {{.Summary.Period}} summary{{else if .LatencyAlert}}Doorbell notifications are late{{else}}Doorbell {{.EventName}} at {{.DeviceLabel}}{{end}}`
+
+func newEmailNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := EmailNotifierConfig{Security: EmailSecurityStartTLS, Attempts: 3}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Host) == 0 || len(config.From) == 0 || len(config.To) == 0 {
+		return nil, fmt.Errorf("host, from and to are required")
+	}
+	switch config.Security {
+	case EmailSecurityStartTLS, EmailSecurityNone:
+		if config.Port == 0 {
+			config.Port = 587
+		}
+	case EmailSecurityTLS:
+		if config.Port == 0 {
+			config.Port = 465
+		}
+	default:
+		return nil, fmt.Errorf("unknown security %v", config.Security)
+	}
+	if len(config.Subject) == 0 {
+		config.Subject = defaultEmailSubjectTemplate
+	}
+	subject, err := template.New("subject").Funcs(webhookTemplateFuncs).Parse(config.Subject)
+	if err != nil {
+		return nil, err
+	}
+	body, err := parseMessageTemplate(config.Template)
+	if err != nil {
+		return nil, err
+	}
+	return &EmailNotifier{config: config, subject: subject, template: body}, nil
+}
+
+func (n *EmailNotifier) Name() string {
+	return "email(" + strings.Join(n.config.To, ",") + ")"
+}
+
+func (n *EmailNotifier) Notify(ctx context.Context, notification *Notification) error {
+	subject, err := renderMessage(n.subject, notification)
+	if err != nil {
+		return err
+	}
+	body, err := renderMessage(n.template, notification)
+	if err != nil {
+		return err
+	}
+	var image string
+	if n.config.AttachImage && notification.HasImage() {
+		image = notification.ClipFile
+	}
+	message, err := n.buildMessage(subject, body, image)
+	if err != nil {
+		return err
+	}
+	return retryWithBackoff(ctx, n.config.Attempts, func() error {
+		return n.send(message)
+	})
+}
+
+// Build RFC 5322 message. imagePath is attached inline when not empty.
+func (n *EmailNotifier) buildMessage(subject, body, imagePath string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(n.config.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	if len(imagePath) == 0 {
+		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: base64\r\n\r\n")
+		writeBase64Lines(&buf, []byte(body))
+		return buf.Bytes(), nil
+	}
+	image, err := os.ReadFile(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	writer := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+	text, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64Lines(text, []byte(body))
+	fileName := filepath.Base(imagePath)
+	attachment, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.TypeByExtension(filepath.Ext(imagePath))},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("inline", map[string]string{"filename": fileName})},
+		"Content-Id":                {"<snapshot>"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64Lines(attachment, image)
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Write base64 encoded data wrapped at 76 characters as required by RFC 2045
+func writeBase64Lines(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
+
+func (n *EmailNotifier) send(message []byte) error {
+	addr := net.JoinHostPort(n.config.Host, strconv.Itoa(n.config.Port))
+	tlsConfig := &tls.Config{ServerName: n.config.Host}
+	var client *smtp.Client
+	if n.config.Security == EmailSecurityTLS {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		client, err = smtp.NewClient(conn, n.config.Host)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+		if err != nil {
+			return err
+		}
+		client, err = smtp.NewClient(conn, n.config.Host)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		if n.config.Security == EmailSecurityStartTLS {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				client.Close()
+				return err
+			}
+		}
+	}
+	defer client.Close()
+	if len(n.config.Username) > 0 {
+		if err := client.Auth(smtp.PlainAuth("", n.config.Username, n.config.Password, n.config.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(n.config.From); err != nil {
+		return err
+	}
+	for _, to := range n.config.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,191 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// SMTP server recording the session of a single client at a time. rcptReply answers RCPT TO
+type smtpServer struct {
+	net.Listener
+	rcptReply string
+	mu        sync.Mutex
+	commands  []string
+	data      string
+}
+
+func newSmtpServer(t *testing.T, rcptReply string) *smtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{Listener: listener, rcptReply: rcptReply}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "220 localhost ESMTP\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+		switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+		case "EHLO":
+			io.WriteString(conn, "250-localhost\r\n250 AUTH PLAIN\r\n")
+		case "AUTH":
+			io.WriteString(conn, "235 2.7.0 Authentication successful\r\n")
+		case "RCPT":
+			io.WriteString(conn, s.rcptReply+"\r\n")
+		case "DATA":
+			io.WriteString(conn, "354 End data with <CR><LF>.<CR><LF>\r\n")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.mu.Lock()
+			s.data = data.String()
+			s.mu.Unlock()
+			io.WriteString(conn, "250 OK\r\n")
+		case "QUIT":
+			io.WriteString(conn, "221 Bye\r\n")
+			return
+		default:
+			io.WriteString(conn, "250 OK\r\n")
+		}
+	}
+}
+
+// Commands and the message received so far, cleared
+func (s *smtpServer) take() ([]string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	commands, data := s.commands, s.data
+	s.commands, s.data = nil, ""
+	return commands, data
+}
+
+func newTestEmailNotifier(t *testing.T, server *smtpServer, attachImage bool) Notifier {
+	port := server.Addr().(*net.TCPAddr).Port
+	raw, _ := json.Marshal(EmailNotifierConfig{Host: "127.0.0.1", Port: port, Security: EmailSecurityNone, Username: "user", Password: "pass", From: "nest@example.com", To: []string{"a@example.com", "b@example.com"}, Template: "ring {{.Timestamp}}", AttachImage: attachImage, Attempts: 1})
+	n, err := newEmailNotifierFromConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestEmailNotify(t *testing.T) {
+	server := newSmtpServer(t, "250 OK")
+	n := newTestEmailNotifier(t, server, false)
+	if err := n.Notify(context.Background(), &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Device: "enterprises/p/devices/front", DeviceName: "Front door", Timestamp: "10:00"}); err != nil {
+		t.Fatal(err)
+	}
+	commands, data := server.take()
+	auth := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00pass"))
+	want := []string{"EHLO localhost", auth, "MAIL FROM:<nest@example.com>", "RCPT TO:<a@example.com>", "RCPT TO:<b@example.com>", "DATA", "QUIT"}
+	if strings.Join(commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands = %q, want %q", commands, want)
+	}
+	message, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid message %q: %v", data, err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if message.Header.Get("From") != "nest@example.com" || message.Header.Get("To") != "a@example.com, b@example.com" || subject != "Doorbell chime at Front door" {
+		t.Errorf("header = %v, want from, to and subject", message.Header)
+	}
+	body, _ := io.ReadAll(base64.NewDecoder(base64.StdEncoding, message.Body))
+	if message.Header.Get("Content-Type") != "text/plain; charset=utf-8" || string(body) != "ring 10:00" {
+		t.Errorf("body = %q of %v, want the text", body, message.Header.Get("Content-Type"))
+	}
+}
+
+func TestEmailNotifyWithImage(t *testing.T) {
+	server := newSmtpServer(t, "250 OK")
+	n := newTestEmailNotifier(t, server, true)
+	if err := n.Notify(context.Background(), &Notification{Timestamp: "10:00", ClipFile: writeTestClip(t, "snapshot.jpg")}); err != nil {
+		t.Fatal(err)
+	}
+	_, data := server.take()
+	message, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid message %q: %v", data, err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("content type = %v, want multipart/mixed", mediaType)
+	}
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	var parts []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+		parts = append(parts, part.Header.Get("Content-Type")+" "+part.FileName()+" "+string(b))
+	}
+	want := []string{"text/plain; charset=utf-8  ring 10:00", "image/jpeg snapshot.jpg clip of snapshot.jpg"}
+	if strings.Join(parts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("parts = %q, want %q", parts, want)
+	}
+}
+
+func TestEmailErrors(t *testing.T) {
+	server := newSmtpServer(t, "550 5.1.1 No such user")
+	n := newTestEmailNotifier(t, server, false)
+	if err := n.Notify(context.Background(), &Notification{}); err == nil || !strings.Contains(err.Error(), "No such user") {
+		t.Errorf("Notify rejected by the server = %v, want the reply", err)
+	}
+	if _, data := server.take(); len(data) > 0 {
+		t.Errorf("sent %q to a rejected recipient", data)
+	}
+	n = newTestEmailNotifier(t, server, true)
+	if err := n.Notify(context.Background(), &Notification{ClipFile: "/nonexistent/snapshot.jpg"}); err == nil {
+		t.Error("Notify of a missing snapshot succeeded, want error")
+	}
+	for _, config := range []string{`{"from":"a@example.com","to":["b@example.com"]}`, `{"host":"localhost","to":["b@example.com"]}`, `{"host":"localhost","from":"a@example.com"}`, `{"host":"localhost","from":"a@example.com","to":["b@example.com"],"security":"ssl"}`, `{"host":"localhost","from":"a@example.com","to":["b@example.com"],"subject":"{{"}`} {
+		if _, err := newEmailNotifierFromConfig(json.RawMessage(config)); err == nil {
+			t.Errorf("config %v succeeded, want error", config)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Run a user specified command for each event. Event details are passed as NEST_* environment variables.
+type ExecNotifier struct {
+	command []string
+	timeout time.Duration
+	slots   chan struct{} // limits number of commands running at once
+}
+
+type ExecNotifierConfig struct {
+	Command     []string `json:"command"` // program and its arguments. not run through shell
+	Timeout     Duration `json:"timeout"` // default 30s
+	Concurrency int      `json:"concurrency"`
+}
+
+func newExecNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := ExecNotifierConfig{Timeout: Duration(30 * time.Second), Concurrency: 1}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Command) == 0 {
+		return nil, fmt.Errorf("command is required")
+	}
+	if config.Concurrency < 1 {
+		return nil, fmt.Errorf("concurrency must be positive")
+	}
+	return &ExecNotifier{
+		command: config.Command,
+		timeout: time.Duration(config.Timeout),
+		slots:   make(chan struct{}, config.Concurrency),
+	}, nil
+}
+
+func (n *ExecNotifier) Name() string {
+	return "exec(" + n.command[0] + ")"
+}
+
+func execNotifierEnv(notification *Notification) ([]string, error) {
+	event, err := json.Marshal(notification.Event)
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"NEST_EVENT_TYPE=" + notification.EventName(),
+		"NEST_SDM_EVENT_TYPE=" + string(notification.EventType),
+		"NEST_DEVICE=" + notification.Device,
+		"NEST_DEVICE_ID=" + sdmevents.DeviceId(notification.Device),
+		"NEST_DEVICE_NAME=" + notification.DeviceName,
+		"NEST_ROOM=" + notification.Room,
+		"NEST_STRUCTURE=" + notification.Structure,
+		"NEST_EVENT_ID=" + notification.Event.EventId,
+		"NEST_EVENT_SESSION_ID=" + notification.EventSessionId,
+		"NEST_TIMESTAMP=" + notification.Timestamp,
+		"NEST_CLIP_PATH=" + notification.ClipFile,
+		"NEST_CLIP_URL=" + notification.ClipUrl,
+		"NEST_FAMILIAR_FACE=" + notification.FamiliarFace,
+		"NEST_EVENT_JSON=" + string(event),
+	}, nil
+}
+
+func (n *ExecNotifier) Notify(ctx context.Context, notification *Notification) error {
+	ctx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+	select {
+	case n.slots <- struct{}{}:
+		defer func() { <-n.slots }()
+	case <-ctx.Done():
+		return fmt.Errorf("too many commands running: %v", ctx.Err())
+	}
+	env, err := execNotifierEnv(notification)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, n.command[0], n.command[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, output.String())
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+func newTestExecNotifier(t *testing.T, timeout string, command ...string) Notifier {
+	raw, _ := json.Marshal(map[string]any{"command": command, "timeout": timeout})
+	n, err := newExecNotifierFromConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestExecNotify(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "env")
+	n := newTestExecNotifier(t, "10s", "sh", "-c", `printf '%s\n' "$NEST_EVENT_TYPE" "$NEST_DEVICE_ID" "$NEST_DEVICE_NAME" "$NEST_EVENT_ID" "$NEST_CLIP_PATH" "$NEST_CLIP_URL" "$NEST_EVENT_JSON" "$1" > "$0"`, output, "arg; not a shell")
+	notification := &Notification{
+		EventType:  sdmevents.ResourceUpdateEventTypeDoorbellChime,
+		Event:      &sdmevents.DeviceEvent{EventId: "e1", Timestamp: "2024-01-02T10:00:00Z"},
+		Device:     "enterprises/p/devices/front",
+		DeviceName: "Front door",
+		ClipFile:   "/data/clip.mp4",
+		ClipUrl:    "https://nest.example.com/clip.mp4",
+	}
+	if err := n.Notify(context.Background(), notification); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, _ := json.Marshal(notification.Event)
+	want := strings.Join([]string{"chime", "front", "Front door", "e1", "/data/clip.mp4", "https://nest.example.com/clip.mp4", string(event), "arg; not a shell"}, "\n") + "\n"
+	if string(b) != want {
+		t.Errorf("environment = %q, want %q", b, want)
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	notification := &Notification{Event: &sdmevents.DeviceEvent{}}
+	// the output of failed commands is in the error
+	n := newTestExecNotifier(t, "10s", "sh", "-c", "echo broken >&2; exit 3")
+	if err := n.Notify(context.Background(), notification); err == nil || !strings.Contains(err.Error(), "exit status 3") || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("Notify of a failing command = %v, want the status and the output", err)
+	}
+	n = newTestExecNotifier(t, "50ms", "sleep", "10")
+	start := time.Now()
+	if err := n.Notify(context.Background(), notification); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("Notify of a hanging command = %v after %v, want killed at the timeout", err, time.Since(start))
+	}
+	for _, config := range []string{`{}`, `{"command":[]}`, `{"command":["true"],"concurrency":0}`} {
+		if _, err := newExecNotifierFromConfig(json.RawMessage(config)); err == nil {
+			t.Errorf("config %v succeeded, want error", config)
+		}
+	}
+}
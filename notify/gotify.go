@@ -0,0 +1,98 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// Push message to Gotify server. Gotify can't store attachments, so image is embedded by URL as markdown when attachImage is true.
+type GotifyNotifier struct {
+	config   GotifyNotifierConfig
+	template *template.Template
+}
+
+type GotifyNotifierConfig struct {
+	Server      string         `json:"server"` // e.g. https://gotify.example.com
+	Token       string         `json:"token"`  // application token
+	Priorities  map[string]int `json:"priorities"`
+	Template    string         `json:"template"` // go text/template of message
+	AttachImage bool           `json:"attachImage"`
+	Attempts    int            `json:"attempts"`
+}
+
+var defaultGotifyPriorities = map[string]int{
+	"chime":  8,
+	"person": 8,
+	"motion": 5,
+}
+
+func newGotifyNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := GotifyNotifierConfig{Attempts: 3}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Server) == 0 || len(config.Token) == 0 {
+		return nil, fmt.Errorf("server and token are required")
+	}
+	t, err := parseMessageTemplate(config.Template)
+	if err != nil {
+		return nil, err
+	}
+	return &GotifyNotifier{config: config, template: t}, nil
+}
+
+func (n *GotifyNotifier) Name() string {
+	return "gotify"
+}
+
+func (n *GotifyNotifier) priority(eventName string) int {
+	if p, ok := n.config.Priorities[eventName]; ok {
+		return p
+	}
+	if p, ok := defaultGotifyPriorities[eventName]; ok {
+		return p
+	}
+	return 5
+}
+
+// https://gotify.net/api-docs#/message/createMessage
+type gotifyMessage struct {
+	Title    string                 `json:"title"`
+	Message  string                 `json:"message"`
+	Priority int                    `json:"priority"`
+	Extras   map[string]interface{} `json:"extras,omitempty"`
+}
+
+func (n *GotifyNotifier) Notify(ctx context.Context, notification *Notification) error {
+	text, err := renderMessage(n.template, notification)
+	if err != nil {
+		return err
+	}
+	message := gotifyMessage{
+		Title:    "Doorbell " + notification.EventName(),
+		Message:  text,
+		Priority: n.priority(notification.EventName()),
+		Extras:   map[string]interface{}{},
+	}
+	if len(notification.ClipUrl) > 0 {
+		// https://gotify.net/docs/msgextras
+		message.Extras["client::notification"] = map[string]interface{}{
+			"click": map[string]string{"url": notification.ClipUrl},
+		}
+		if n.config.AttachImage && notification.HasImage() {
+			message.Message += "\n\n![snapshot](" + notification.ClipUrl + ")"
+			message.Extras["client::display"] = map[string]string{"contentType": "text/markdown"}
+		}
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	endpoint := strings.TrimSuffix(n.config.Server, "/") + "/message?token=" + url.QueryEscape(n.config.Token)
+	return postWithRetry(ctx, http.DefaultClient, n.config.Attempts, endpoint, "application/json", payload)
+}
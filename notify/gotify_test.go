@@ -0,0 +1,62 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+func newTestGotifyNotifier(t *testing.T, server string, attachImage bool) Notifier {
+	raw, _ := json.Marshal(GotifyNotifierConfig{Server: server, Token: "A&secret", Priorities: map[string]int{"chime": 10}, Template: "ring {{.Timestamp}}", AttachImage: attachImage, Attempts: 1})
+	n, err := newGotifyNotifierFromConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestGotifyNotify(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusOK, `{"id":1}`))
+	n := newTestGotifyNotifier(t, server.URL+"/", true)
+
+	if err := n.Notify(context.Background(), &Notification{EventType: sdmevents.ResourceUpdateEventTypeCameraMotion, Timestamp: "10:00"}); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.take()
+	if len(requests) != 1 || requests[0].Method != http.MethodPost || requests[0].Path != "/message" || requests[0].Query.Get("token") != "A&secret" {
+		t.Fatalf("requests = %+v, want POST of /message with the token", requests)
+	}
+	if string(requests[0].Body) != `{"title":"Doorbell motion","message":"ring 10:00","priority":5}` {
+		t.Errorf("body = %s, want the message", requests[0].Body)
+	}
+
+	// the clip URL is opened on click, and snapshots are embedded as markdown
+	if err := n.Notify(context.Background(), &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Timestamp: "10:00", ClipFile: "/data/snapshot.jpg", ClipUrl: "https://nest.example.com/snapshot.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+	requests = server.take()
+	if len(requests) != 1 {
+		t.Fatalf("%v requests, want 1", len(requests))
+	}
+	want := `{"title":"Doorbell chime","message":"ring 10:00\n\n![snapshot](https://nest.example.com/snapshot.jpg)","priority":10,"extras":{"client::display":{"contentType":"text/markdown"},"client::notification":{"click":{"url":"https://nest.example.com/snapshot.jpg"}}}}`
+	if string(requests[0].Body) != want {
+		t.Errorf("body = %s, want %s", requests[0].Body, want)
+	}
+}
+
+func TestGotifyErrors(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusUnauthorized, `{"error":"Unauthorized"}`))
+	n := newTestGotifyNotifier(t, server.URL, false)
+	if err := n.Notify(context.Background(), &Notification{}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Notify answered 401 = %v, want the status", err)
+	}
+	for _, config := range []string{`{"server":"http://localhost"}`, `{"token":"t"}`, `{"server":"http://localhost","token":"t","template":"{{"}`} {
+		if _, err := newGotifyNotifierFromConfig(json.RawMessage(config)); err == nil {
+			t.Errorf("config %v succeeded, want error", config)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package notify
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Notifications queued per subscriber. Notifications are dropped while the subscriber is behind
+const grpcSubscriberBuffer = 64
+
+// Stream notifications to the subscribers of the gRPC service nestconsumer.v1.Events (events.proto), so that other
+// services can consume events without Pub/Sub or MQTT. Messages are google.protobuf.Struct of the notification JSON
+// (same as webhooks) with eventName, so clients need no generated code of this repository.
+type GrpcNotifier struct {
+	server *grpc.Server
+	token  string // required as "authorization: Bearer <token>" metadata unless empty
+
+	mu          sync.Mutex
+	subscribers map[chan *structpb.Struct]bool
+}
+
+var grpcEventsServiceDesc = grpc.ServiceDesc{
+	ServiceName: "nestconsumer.v1.Events",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Subscribe",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			var request emptypb.Empty
+			if err := stream.RecvMsg(&request); err != nil {
+				return err
+			}
+			return srv.(*GrpcNotifier).subscribe(stream)
+		},
+	}},
+	Metadata: "notify/events.proto",
+}
+
+// Serve the service on addr e.g. ":9090" in the background
+func NewGrpcNotifier(addr string, token string) (*GrpcNotifier, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	n := &GrpcNotifier{token: token, subscribers: map[chan *structpb.Struct]bool{}}
+	n.server = grpc.NewServer(grpc.StreamInterceptor(n.authenticate))
+	n.server.RegisterService(&grpcEventsServiceDesc, n)
+	go func() {
+		log.Printf("Serving gRPC events on %v", listener.Addr())
+		if err := n.server.Serve(listener); err != nil {
+			log.Printf("gRPC server stopped: %v", err)
+		}
+	}()
+	return n, nil
+}
+
+func (n *GrpcNotifier) Name() string {
+	return "grpc"
+}
+
+func (n *GrpcNotifier) authenticate(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if len(n.token) > 0 {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		given := ""
+		if values := md.Get("authorization"); len(values) > 0 {
+			given = strings.TrimPrefix(values[0], "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(n.token)) != 1 {
+			return status.Error(codes.Unauthenticated, "invalid token")
+		}
+	}
+	return handler(srv, stream)
+}
+
+// Send notifications to the stream until the client goes away
+func (n *GrpcNotifier) subscribe(stream grpc.ServerStream) error {
+	ch := make(chan *structpb.Struct, grpcSubscriberBuffer)
+	n.mu.Lock()
+	n.subscribers[ch] = true
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.subscribers, ch)
+		n.mu.Unlock()
+	}()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case message := <-ch:
+			if err := stream.SendMsg(message); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (n *GrpcNotifier) Notify(ctx context.Context, notification *Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.subscribers) == 0 {
+		return nil
+	}
+	message, err := notificationStruct(notification)
+	if err != nil {
+		return err
+	}
+	for ch := range n.subscribers {
+		select {
+		case ch <- message:
+		default:
+			log.Printf("Dropped %v event for a slow gRPC subscriber", notification.EventName())
+		}
+	}
+	return nil
+}
+
+func notificationStruct(notification *Notification) (*structpb.Struct, error) {
+	b, err := json.Marshal(notification)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	fields["eventName"] = notification.EventName()
+	return structpb.NewStruct(fields)
+}
@@ -0,0 +1,133 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Fire events on Home Assistant event bus and update input entities via its REST API (long-lived access token),
+// for users without MQTT broker.
+type HomeAssistantNotifier struct {
+	config HomeAssistantNotifierConfig
+}
+
+type HomeAssistantNotifierConfig struct {
+	Url       string              `json:"url"`       // e.g. http://homeassistant.local:8123
+	Token     string              `json:"token"`     // long-lived access token
+	EventType string              `json:"eventType"` // event fired on the bus. default nest_doorbell_event
+	Entities  map[string][]string `json:"entities"`  // event name => entity ids to update (input_datetime, input_text, input_boolean or counter)
+	Attempts  int                 `json:"attempts"`
+}
+
+func newHomeAssistantNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := HomeAssistantNotifierConfig{EventType: "nest_doorbell_event", Attempts: 3}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Url) == 0 || len(config.Token) == 0 {
+		return nil, fmt.Errorf("url and token are required")
+	}
+	for _, entities := range config.Entities {
+		for _, entity := range entities {
+			if _, _, err := homeAssistantEntityService(entity, &Notification{}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &HomeAssistantNotifier{config: config}, nil
+}
+
+func (n *HomeAssistantNotifier) Name() string {
+	return "homeassistant"
+}
+
+// Service and its data to update entity for notification
+func homeAssistantEntityService(entity string, notification *Notification) (string, map[string]interface{}, error) {
+	domain := strings.SplitN(entity, ".", 2)[0]
+	data := map[string]interface{}{"entity_id": entity}
+	switch domain {
+	case "input_datetime":
+		timestamp := time.Now()
+		if t, err := time.Parse(time.RFC3339Nano, notification.Timestamp); err == nil {
+			timestamp = t
+		}
+		data["timestamp"] = timestamp.Unix()
+		return "input_datetime/set_datetime", data, nil
+	case "input_text":
+		value := notification.ClipUrl
+		if len(value) == 0 {
+			value = notification.EventName() + " " + notification.Timestamp
+		}
+		// input_text accepts at most 255 characters
+		if len(value) > 255 {
+			value = value[:255]
+		}
+		data["value"] = value
+		return "input_text/set_value", data, nil
+	case "input_boolean":
+		return "input_boolean/turn_on", data, nil
+	case "counter":
+		return "counter/increment", data, nil
+	}
+	return "", nil, fmt.Errorf("unsupported entity %v", entity)
+}
+
+func (n *HomeAssistantNotifier) post(ctx context.Context, path string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return retryWithBackoff(ctx, n.config.Attempts, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(n.config.Url, "/")+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+n.config.Token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status code %v from %v", resp.Status, path)
+		}
+		return nil
+	})
+}
+
+// https://developers.home-assistant.io/docs/api/rest/
+func (n *HomeAssistantNotifier) Notify(ctx context.Context, notification *Notification) error {
+	eventData := map[string]interface{}{
+		"type":             notification.EventName(),
+		"device":           notification.Device,
+		"device_id":        sdmevents.DeviceId(notification.Device),
+		"event_session_id": notification.EventSessionId,
+		"timestamp":        notification.Timestamp,
+		"clip_path":        notification.ClipPath,
+		"clip_url":         notification.ClipUrl,
+		"familiar_face":    notification.FamiliarFace,
+	}
+	if err := n.post(ctx, "/api/events/"+n.config.EventType, eventData); err != nil {
+		return err
+	}
+	for _, entity := range n.config.Entities[notification.EventName()] {
+		service, data, err := homeAssistantEntityService(entity, notification)
+		if err != nil {
+			return err
+		}
+		if err := n.post(ctx, "/api/services/"+service, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
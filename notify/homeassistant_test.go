@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+func newTestHomeAssistantNotifier(t *testing.T, url string, entities map[string][]string) Notifier {
+	// without eventType, which would replace the default
+	raw, _ := json.Marshal(map[string]any{"url": url, "token": "long-lived", "entities": entities, "attempts": 1})
+	n, err := newHomeAssistantNotifierFromConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestHomeAssistantNotify(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusOK, `[]`))
+	n := newTestHomeAssistantNotifier(t, server.URL+"/", map[string][]string{
+		"chime":  {"input_datetime.last_ring", "input_text.last_clip", "input_boolean.ringing", "counter.rings"},
+		"motion": {"counter.motions"},
+	})
+	notification := &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Device: "enterprises/p/devices/front", EventSessionId: "s1", Timestamp: "2024-01-02T10:00:00Z", ClipPath: "2024/01/02/10/chime.mp4"}
+	if err := n.Notify(context.Background(), notification); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.take()
+	want := []struct {
+		path string
+		body string
+	}{
+		{"/api/events/nest_doorbell_event", `{"clip_path":"2024/01/02/10/chime.mp4","clip_url":"","device":"enterprises/p/devices/front","device_id":"front","event_session_id":"s1","familiar_face":"","timestamp":"2024-01-02T10:00:00Z","type":"chime"}`},
+		{"/api/services/input_datetime/set_datetime", `{"entity_id":"input_datetime.last_ring","timestamp":1704189600}`},
+		// input_text gets the clip URL, or the event without one
+		{"/api/services/input_text/set_value", `{"entity_id":"input_text.last_clip","value":"chime 2024-01-02T10:00:00Z"}`},
+		{"/api/services/input_boolean/turn_on", `{"entity_id":"input_boolean.ringing"}`},
+		{"/api/services/counter/increment", `{"entity_id":"counter.rings"}`},
+	}
+	if len(requests) != len(want) {
+		t.Fatalf("requests = %+v, want %v", requests, len(want))
+	}
+	for i, r := range requests {
+		if r.Method != http.MethodPost || r.Path != want[i].path || string(r.Body) != want[i].body {
+			t.Errorf("request %v = %v %v %s, want %v %s", i, r.Method, r.Path, r.Body, want[i].path, want[i].body)
+		}
+		if r.Header.Get("Authorization") != "Bearer long-lived" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("headers of %v = %v, want the token", r.Path, r.Header)
+		}
+	}
+
+	// input_text is cut to 255 characters
+	n = newTestHomeAssistantNotifier(t, server.URL, map[string][]string{"chime": {"input_text.last_clip"}})
+	notification.ClipUrl = "https://nest.example.com/" + strings.Repeat("x", 300)
+	if err := n.Notify(context.Background(), notification); err != nil {
+		t.Fatal(err)
+	}
+	requests = server.take()
+	if len(requests) != 2 || requests[1].json(t)["value"] != notification.ClipUrl[:255] {
+		t.Errorf("requests = %+v, want the clip URL cut to 255 characters", requests)
+	}
+}
+
+func TestHomeAssistantErrors(t *testing.T) {
+	server := newRecordingServer(t, func(r recordedRequest) (int, string) {
+		if strings.HasPrefix(r.Path, "/api/services/") {
+			return http.StatusBadRequest, `{"message":"Entity not found"}`
+		}
+		return http.StatusOK, `{"message":"Event fired."}`
+	})
+	n := newTestHomeAssistantNotifier(t, server.URL, map[string][]string{"chime": {"counter.rings", "input_boolean.ringing"}})
+	err := n.Notify(context.Background(), &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime})
+	if err == nil || !strings.Contains(err.Error(), "400") || !strings.Contains(err.Error(), "/api/services/counter/increment") {
+		t.Errorf("Notify answered 400 = %v, want the status and the path", err)
+	}
+	// the failed service stops the later ones
+	if requests := server.take(); len(requests) != 2 {
+		t.Errorf("%v requests, want the event and the failed service", len(requests))
+	}
+	server.answer(http.StatusUnauthorized, "401: Unauthorized")
+	if err := n.Notify(context.Background(), &Notification{}); err == nil || !strings.Contains(err.Error(), "/api/events/") {
+		t.Errorf("Notify answered 401 = %v, want the path of the event", err)
+	}
+	for _, config := range []string{`{"url":"http://localhost"}`, `{"token":"t"}`, `{"url":"http://localhost","token":"t","entities":{"chime":["light.porch"]}}`} {
+		if _, err := newHomeAssistantNotifierFromConfig(json.RawMessage(config)); err == nil {
+			t.Errorf("config %v succeeded, want error", config)
+		}
+	}
+}
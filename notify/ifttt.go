@@ -0,0 +1,96 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"text/template"
+)
+
+// Trigger IFTTT Webhooks (and compatible "maker" services) with value1/value2/value3 rendered from the event
+type IftttNotifier struct {
+	config IftttNotifierConfig
+	event  *template.Template
+	values [3]*template.Template
+}
+
+type IftttNotifierConfig struct {
+	Url      string `json:"url"`   // default https://maker.ifttt.com/trigger/{event}/with/key/{key}
+	Key      string `json:"key"`   // webhooks key
+	Event    string `json:"event"` // go text/template of IFTTT event name. default nest_doorbell_{{.EventName}}
+	Value1   string `json:"value1"`
+	Value2   string `json:"value2"`
+	Value3   string `json:"value3"`
+	Attempts int    `json:"attempts"`
+}
+
+const (
+	iftttDefaultUrl    = "https://maker.ifttt.com/trigger/{event}/with/key/{key}"
+	iftttDefaultEvent  = "nest_doorbell_{{.EventName}}"
+	iftttDefaultValue1 = "{{.EventName}}"
+	iftttDefaultValue2 = "{{.DeviceLabel}}"
+	iftttDefaultValue3 = "{{.ClipUrl}}"
+)
+
+func newIftttNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := IftttNotifierConfig{
+		Url:      iftttDefaultUrl,
+		Event:    iftttDefaultEvent,
+		Value1:   iftttDefaultValue1,
+		Value2:   iftttDefaultValue2,
+		Value3:   iftttDefaultValue3,
+		Attempts: 3,
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Key) == 0 {
+		return nil, fmt.Errorf("key is required")
+	}
+	n := &IftttNotifier{config: config}
+	var err error
+	if n.event, err = template.New("event").Funcs(webhookTemplateFuncs).Parse(config.Event); err != nil {
+		return nil, err
+	}
+	for i, text := range []string{config.Value1, config.Value2, config.Value3} {
+		if n.values[i], err = template.New(fmt.Sprintf("value%v", i+1)).Funcs(webhookTemplateFuncs).Parse(text); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (n *IftttNotifier) Name() string {
+	return "ifttt"
+}
+
+// https://ifttt.com/maker_webhooks
+type iftttPayload struct {
+	Value1 string `json:"value1"`
+	Value2 string `json:"value2"`
+	Value3 string `json:"value3"`
+}
+
+func (n *IftttNotifier) Notify(ctx context.Context, notification *Notification) error {
+	event, err := renderMessage(n.event, notification)
+	if err != nil {
+		return err
+	}
+	var values [3]string
+	for i, t := range n.values {
+		if values[i], err = renderMessage(t, notification); err != nil {
+			return err
+		}
+	}
+	payload, err := json.Marshal(iftttPayload{Value1: values[0], Value2: values[1], Value3: values[2]})
+	if err != nil {
+		return err
+	}
+	endpoint := ReplacePlaceholders(n.config.Url, map[string]string{
+		"{event}": url.PathEscape(event),
+		"{key}":   url.PathEscape(n.config.Key),
+	})
+	return postWithRetry(ctx, http.DefaultClient, n.config.Attempts, endpoint, "application/json", payload)
+}
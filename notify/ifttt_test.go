@@ -0,0 +1,60 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+func TestIftttNotify(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusOK, "Congratulations!"))
+	notification := &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Device: "enterprises/p/devices/front", DeviceName: "Front door", Timestamp: "10:00", ClipUrl: "https://nest.example.com/clip.mp4"}
+	for _, c := range []struct {
+		config string
+		path   string
+		body   string
+	}{
+		{`{"key":"k/ey"}`, "/trigger/nest_doorbell_chime/with/key/k/ey", `{"value1":"chime","value2":"Front door","value3":"https://nest.example.com/clip.mp4"}`},
+		{`{"key":"key","event":"ring {{.DeviceName}}","value1":"{{.Timestamp}}","value2":"","value3":"x"}`, "/trigger/ring Front door/with/key/key", `{"value1":"10:00","value2":"","value3":"x"}`},
+	} {
+		config := map[string]any{}
+		json.Unmarshal([]byte(c.config), &config)
+		config["url"], config["attempts"] = server.URL+"/trigger/{event}/with/key/{key}", 1
+		raw, _ := json.Marshal(config)
+		n, err := newIftttNotifierFromConfig(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Notify(context.Background(), notification); err != nil {
+			t.Fatal(err)
+		}
+		requests := server.take()
+		if len(requests) != 1 || requests[0].Method != http.MethodPost {
+			t.Fatalf("requests = %+v, want a POST", requests)
+		}
+		if requests[0].Path != c.path || string(requests[0].Body) != c.body {
+			t.Errorf("config %v posted %s to %v, want %s to %v", c.config, requests[0].Body, requests[0].Path, c.body, c.path)
+		}
+	}
+}
+
+func TestIftttErrors(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusUnauthorized, `{"errors":[{"message":"You sent an invalid key."}]}`))
+	raw, _ := json.Marshal(IftttNotifierConfig{Url: server.URL + "/{event}/{key}", Key: "key", Event: "e", Attempts: 1})
+	n, err := newIftttNotifierFromConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), &Notification{}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Notify answered 401 = %v, want the status", err)
+	}
+	for _, config := range []string{`{}`, `{"key":"k","event":"{{"}`, `{"key":"k","value3":"{{.X"}`} {
+		if _, err := newIftttNotifierFromConfig(json.RawMessage(config)); err == nil {
+			t.Errorf("config %v succeeded, want error", config)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Write a point per event to InfluxDB, so that doorbell activity can be charted over years without scraping the
+// consumer. Points are written in line protocol, e.g.
+//
+//	nest_doorbell_event,device=<device id>,event=chime clip=true,clip_bytes=123456i,latency_seconds=4.2 <event time>
+type InfluxDbNotifier struct {
+	config InfluxDbNotifierConfig
+	client *http.Client
+}
+
+type InfluxDbNotifierConfig struct {
+	Url         string `json:"url"`         // e.g. http://influxdb:8086
+	Org         string `json:"org"`         // InfluxDB 2 /api/v2/write
+	Bucket      string `json:"bucket"`      // InfluxDB 2 /api/v2/write
+	Token       string `json:"token"`       // InfluxDB 2 API token
+	Database    string `json:"database"`    // InfluxDB 1 /write, used unless bucket is given
+	Username    string `json:"username"`    // InfluxDB 1
+	Password    string `json:"password"`    // InfluxDB 1
+	Measurement string `json:"measurement"` // default nest_doorbell_event
+	Attempts    int    `json:"attempts"`
+}
+
+func newInfluxDbNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := InfluxDbNotifierConfig{Measurement: "nest_doorbell_event", Attempts: 3}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Url) == 0 {
+		return nil, fmt.Errorf("url is required")
+	}
+	if len(config.Bucket) == 0 && len(config.Database) == 0 {
+		return nil, fmt.Errorf("bucket (InfluxDB 2) or database (InfluxDB 1) is required")
+	}
+	return &InfluxDbNotifier{config: config, client: http.DefaultClient}, nil
+}
+
+func (n *InfluxDbNotifier) Name() string {
+	if len(n.config.Bucket) > 0 {
+		return "influxdb(" + n.config.Bucket + ")"
+	}
+	return "influxdb(" + n.config.Database + ")"
+}
+
+func (n *InfluxDbNotifier) writeUrl() string {
+	base := strings.TrimSuffix(n.config.Url, "/")
+	if len(n.config.Bucket) > 0 {
+		return base + "/api/v2/write?" + url.Values{"org": {n.config.Org}, "bucket": {n.config.Bucket}, "precision": {"ms"}}.Encode()
+	}
+	return base + "/write?" + url.Values{"db": {n.config.Database}, "precision": {"ms"}}.Encode()
+}
+
+func (n *InfluxDbNotifier) Notify(ctx context.Context, notification *Notification) error {
+	line := influxDbLine(n.config.Measurement, newEventPoint(notification))
+	return retryWithBackoff(ctx, n.config.Attempts, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.writeUrl(), strings.NewReader(line))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if len(n.config.Token) > 0 {
+			req.Header.Set("Authorization", "Token "+n.config.Token)
+		} else if len(n.config.Username) > 0 {
+			req.SetBasicAuth(n.config.Username, n.config.Password)
+		}
+		resp, err := n.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status code %v: %s", resp.Status, bytes.TrimSpace(body))
+		}
+		return nil
+	})
+}
+
+// Line protocol of the point with millisecond precision
+func influxDbLine(measurement string, point eventPoint) string {
+	escape := strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	var line strings.Builder
+	line.WriteString(strings.NewReplacer(",", `\,`, " ", `\ `).Replace(measurement))
+	// tags in key order, without empty values which line protocol doesn't allow
+	for _, tag := range [][2]string{{"device", point.Device}, {"event", point.Event}} {
+		if len(tag[1]) > 0 {
+			line.WriteString("," + tag[0] + "=" + escape.Replace(tag[1]))
+		}
+	}
+	line.WriteString(" clip=" + strconv.FormatBool(point.Clip))
+	line.WriteString(",clip_bytes=" + strconv.FormatInt(point.ClipBytes, 10) + "i")
+	if point.Latency > 0 {
+		line.WriteString(",latency_seconds=" + strconv.FormatFloat(point.Latency.Seconds(), 'f', -1, 64))
+	}
+	line.WriteString(" " + strconv.FormatInt(point.Time.UnixMilli(), 10) + "\n")
+	return line.String()
+}
@@ -0,0 +1,65 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+func newTestInfluxDbNotifier(t *testing.T, config string) Notifier {
+	n, err := newInfluxDbNotifierFromConfig(json.RawMessage(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestInfluxDbNotify(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusNoContent, ""))
+	notification := &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Device: "enterprises/p/devices/front door", Timestamp: "2024-01-02T10:00:00.123Z", ClipFile: writeTestClip(t, "clip.mp4")}
+	for _, c := range []struct {
+		config        string
+		path          string
+		query         string
+		authorization string
+	}{
+		{`{"url":"` + server.URL + `/","org":"home","bucket":"nest","token":"influx-token","attempts":1}`, "/api/v2/write", "bucket=nest&org=home&precision=ms", "Token influx-token"},
+		{`{"url":"` + server.URL + `","database":"nest","username":"user","password":"pass","attempts":1}`, "/write", "db=nest&precision=ms", "Basic dXNlcjpwYXNz"},
+		{`{"url":"` + server.URL + `","database":"nest","attempts":1}`, "/write", "db=nest&precision=ms", ""},
+	} {
+		if err := newTestInfluxDbNotifier(t, c.config).Notify(context.Background(), notification); err != nil {
+			t.Fatal(err)
+		}
+		requests := server.take()
+		if len(requests) != 1 || requests[0].Method != http.MethodPost {
+			t.Fatalf("requests = %+v, want a POST", requests)
+		}
+		r := requests[0]
+		if r.Path != c.path || r.Query.Encode() != c.query || r.Header.Get("Authorization") != c.authorization {
+			t.Errorf("config %v wrote to %v?%v with Authorization %q, want %v?%v with %q", c.config, r.Path, r.Query.Encode(), r.Header.Get("Authorization"), c.path, c.query, c.authorization)
+		}
+		// the latency depends on the time of the test
+		line := string(r.Body)
+		prefix, suffix := `nest_doorbell_event,device=front\ door,event=chime clip=true,clip_bytes=16i,latency_seconds=`, " 1704189600123\n"
+		if !strings.HasPrefix(line, prefix) || !strings.HasSuffix(line, suffix) {
+			t.Errorf("line = %q, want %q...%q", line, prefix, suffix)
+		}
+	}
+}
+
+func TestInfluxDbErrors(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusBadRequest, `{"code":"invalid","message":"unable to parse line"}`+"\n"))
+	n := newTestInfluxDbNotifier(t, `{"url":"`+server.URL+`","bucket":"nest","attempts":1}`)
+	if err := n.Notify(context.Background(), &Notification{}); err == nil || !strings.Contains(err.Error(), "400") || !strings.Contains(err.Error(), "unable to parse line") {
+		t.Errorf("Notify answered 400 = %v, want the status and the message", err)
+	}
+	for _, config := range []string{`{"bucket":"nest"}`, `{"url":"http://localhost"}`} {
+		if _, err := newInfluxDbNotifierFromConfig(json.RawMessage(config)); err == nil {
+			t.Errorf("config %v succeeded, want error", config)
+		}
+	}
+}
@@ -0,0 +1,735 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Produce events to a Kafka topic for data pipelines. Records are the notification JSON (same as MQTT and NATS),
+// which refers the saved media by clipPath and clipUrl, keyed by the device so that the events of a device stay in
+// order on one partition.
+//
+// Speaks the Kafka protocol (https://kafka.apache.org/protocol) directly, since producing a record at a time is all it
+// needs. The version of each request is negotiated with each broker through ApiVersions among kafkaClientVersions, so
+// that it works with Kafka 0.11 and later (1.0 and later with SASL), including 4.x which removed old versions
+// (KIP-896). A broker which drops all of the versions here gets an error naming the API rather than garbage.
+type KafkaNotifier struct {
+	config KafkaNotifierConfig
+	key    *template.Template
+	dial   func(ctx context.Context, network, address string) (net.Conn, error) // replaced by tests
+
+	mu      sync.Mutex           // serializes produces
+	brokers map[int32]string     // address of brokers by node id, from the metadata
+	leaders []int32              // leader node of each partition of the topic. nil until the metadata is fetched
+	conns   map[int32]*kafkaConn // connections by node id
+	next    int                  // partition of the next record without key
+	closed  bool
+}
+
+type KafkaNotifierConfig struct {
+	Brokers  []string         `json:"brokers"` // bootstrap brokers host:port
+	Topic    string           `json:"topic"`
+	Key      string           `json:"key"`  // go text/template of record keys. default {{.Device}}. records are spread over partitions if it renders empty
+	Acks     int              `json:"acks"` // -1 (all in-sync replicas, default) or 1 (leader)
+	Tls      bool             `json:"tls"`
+	Sasl     *KafkaSaslConfig `json:"sasl"`
+	Attempts int              `json:"attempts"`
+}
+
+type KafkaSaslConfig struct {
+	Mechanism string `json:"mechanism"` // PLAIN (default), SCRAM-SHA-256 or SCRAM-SHA-512
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+}
+
+const (
+	kafkaTimeout  = 10 * time.Second
+	kafkaClientId = "nest-doorbell-consumer"
+
+	kafkaApiProduce          = 0
+	kafkaApiMetadata         = 3
+	kafkaApiSaslHandshake    = 17
+	kafkaApiApiVersions      = 18
+	kafkaApiSaslAuthenticate = 36
+
+	// bound of responses, much more than the metadata of a topic takes
+	kafkaMaxResponseSize = 16 << 20
+)
+
+// Versions of the APIs implemented here, oldest and newest. Later versions are flexible ones (KIP-482) of another
+// encoding
+var kafkaClientVersions = map[int16][2]int16{
+	kafkaApiProduce:          {3, 8},
+	kafkaApiMetadata:         {1, 8},
+	kafkaApiSaslHandshake:    {1, 1},
+	kafkaApiSaslAuthenticate: {0, 1},
+}
+
+func newKafkaNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := KafkaNotifierConfig{Key: "{{.Device}}", Acks: -1, Attempts: 3}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Brokers) == 0 || len(config.Topic) == 0 {
+		return nil, fmt.Errorf("brokers and topic are required")
+	}
+	if config.Acks != -1 && config.Acks != 1 {
+		return nil, fmt.Errorf("acks must be -1 or 1")
+	}
+	if config.Sasl != nil {
+		if len(config.Sasl.Mechanism) == 0 {
+			config.Sasl.Mechanism = "PLAIN"
+		}
+		if _, ok := kafkaScramHashes[config.Sasl.Mechanism]; !ok && config.Sasl.Mechanism != "PLAIN" {
+			return nil, fmt.Errorf("unsupported sasl mechanism %v", config.Sasl.Mechanism)
+		}
+	}
+	key, err := template.New("key").Funcs(webhookTemplateFuncs).Parse(config.Key)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: kafkaTimeout}
+	return &KafkaNotifier{config: config, key: key, dial: dialer.DialContext, conns: map[int32]*kafkaConn{}}, nil
+}
+
+func (n *KafkaNotifier) Name() string {
+	return "kafka(" + n.config.Topic + ")"
+}
+
+func (n *KafkaNotifier) Notify(ctx context.Context, notification *Notification) error {
+	value, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	key, err := renderMessage(n.key, notification)
+	if err != nil {
+		return err
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, notification.Timestamp)
+	if err != nil {
+		timestamp = time.Now()
+	}
+	batch := kafkaRecordBatch([]byte(key), value, timestamp)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return retryWithBackoff(ctx, n.config.Attempts, func() error {
+		err := n.produce(ctx, key, batch)
+		if err != nil {
+			// the leader may have moved
+			n.reset()
+		}
+		return err
+	})
+}
+
+// Forget the metadata and connections. n.mu must be held
+func (n *KafkaNotifier) reset() {
+	for _, conn := range n.conns {
+		conn.Close()
+	}
+	n.conns = map[int32]*kafkaConn{}
+	n.leaders = nil
+}
+
+// Close the connections after the produce in progress, for notifiers discarded e.g. on config reload
+func (n *KafkaNotifier) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	n.reset()
+	return nil
+}
+
+// Produce the batch to the leader of the partition of key. n.mu must be held
+func (n *KafkaNotifier) produce(ctx context.Context, key string, batch []byte) error {
+	if n.closed {
+		return fmt.Errorf("%v is closed", n.Name())
+	}
+	if n.leaders == nil {
+		if err := n.fetchMetadata(ctx); err != nil {
+			return err
+		}
+	}
+	var partition int
+	if len(key) > 0 {
+		// same partition as Kafka's default partitioner of Java clients
+		partition = int(kafkaMurmur2([]byte(key))&0x7fffffff) % len(n.leaders)
+	} else {
+		partition = n.next % len(n.leaders)
+		n.next++
+	}
+	leader := n.leaders[partition]
+	conn, ok := n.conns[leader]
+	if !ok {
+		address, ok := n.brokers[leader]
+		if !ok {
+			return fmt.Errorf("no leader of partition %v of %v", partition, n.config.Topic)
+		}
+		var err error
+		if conn, err = n.dialBroker(ctx, address); err != nil {
+			return err
+		}
+		n.conns[leader] = conn
+	}
+	version, err := conn.version(kafkaApiProduce)
+	if err != nil {
+		return err
+	}
+	// same request from v3 to v8
+	var body kafkaWriter
+	body.nullableString(nil) // transactional_id
+	body.int16(int16(n.config.Acks))
+	body.int32(int32(kafkaTimeout / time.Millisecond))
+	body.int32(1)
+	body.string(n.config.Topic)
+	body.int32(1)
+	body.int32(int32(partition))
+	body.bytes(batch)
+	response, err := conn.roundTrip(ctx, kafkaApiProduce, version, body.Bytes())
+	if err != nil {
+		return err
+	}
+	for topics := response.int32(); topics > 0 && response.err == nil; topics-- {
+		response.string()
+		for partitions := response.int32(); partitions > 0 && response.err == nil; partitions-- {
+			response.int32()
+			code := response.int16()
+			response.int64() // base_offset
+			response.int64() // log_append_time_ms
+			if version >= 5 {
+				response.int64() // log_start_offset
+			}
+			var message string
+			if version >= 8 {
+				for count := response.int32(); count > 0 && response.err == nil; count-- {
+					response.int32()          // batch_index
+					response.nullableString() // batch_index_error_message
+				}
+				message = response.nullableString()
+			}
+			if code != 0 && len(message) > 0 {
+				return fmt.Errorf("kafka refused the record to %v/%v: error code %v: %v", n.config.Topic, partition, code, message)
+			} else if code != 0 {
+				return fmt.Errorf("kafka refused the record to %v/%v: error code %v", n.config.Topic, partition, code)
+			}
+		}
+	}
+	return response.err
+}
+
+// Fetch the partitions of the topic and their leaders from one of the bootstrap brokers. n.mu must be held
+func (n *KafkaNotifier) fetchMetadata(ctx context.Context) error {
+	var errs []string
+	for _, address := range n.config.Brokers {
+		conn, err := n.dialBroker(ctx, address)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		version, err := conn.version(kafkaApiMetadata)
+		if err != nil {
+			conn.Close()
+			errs = append(errs, err.Error())
+			continue
+		}
+		var body kafkaWriter
+		body.int32(1)
+		body.string(n.config.Topic)
+		if version >= 4 {
+			body.int8(1) // allow_auto_topic_creation, as the brokers are configured
+		}
+		if version >= 8 {
+			body.int8(0) // include_cluster_authorized_operations
+			body.int8(0) // include_topic_authorized_operations
+		}
+		response, err := conn.roundTrip(ctx, kafkaApiMetadata, version, body.Bytes())
+		conn.Close()
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if version >= 3 {
+			response.int32() // throttle_time_ms
+		}
+		brokers := map[int32]string{}
+		for count := response.int32(); count > 0 && response.err == nil; count-- {
+			node := response.int32()
+			host := response.string()
+			port := response.int32()
+			response.nullableString() // rack
+			brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+		if version >= 2 {
+			response.nullableString() // cluster_id
+		}
+		response.int32() // controller_id
+		var leaders []int32
+		for count := response.int32(); count > 0 && response.err == nil; count-- {
+			code := response.int16()
+			name := response.string()
+			response.int8() // is_internal
+			if code != 0 {
+				// e.g. 3 UNKNOWN_TOPIC_OR_PARTITION, or 5 LEADER_NOT_AVAILABLE while the topic is auto-created
+				return fmt.Errorf("no metadata of topic %v: error code %v", name, code)
+			}
+			partitions := response.int32()
+			if partitions < 0 || int(partitions) > len(response.b) {
+				return fmt.Errorf("invalid metadata of topic %v", name)
+			}
+			leaders = make([]int32, partitions)
+			for ; partitions > 0 && response.err == nil; partitions-- {
+				response.int16() // error_code
+				index := response.int32()
+				leader := response.int32()
+				if version >= 7 {
+					response.int32() // leader_epoch
+				}
+				response.skipInt32s() // replica_nodes
+				response.skipInt32s() // isr_nodes
+				if version >= 5 {
+					response.skipInt32s() // offline_replicas
+				}
+				if index >= 0 && int(index) < len(leaders) {
+					leaders[index] = leader
+				}
+			}
+			if version >= 8 {
+				response.int32() // topic_authorized_operations
+			}
+		}
+		if response.err != nil {
+			return response.err
+		}
+		if len(leaders) == 0 {
+			return fmt.Errorf("topic %v has no partitions", n.config.Topic)
+		}
+		n.brokers, n.leaders = brokers, leaders
+		return nil
+	}
+	return fmt.Errorf("no kafka broker is reachable: %v", strings.Join(errs, "; "))
+}
+
+type kafkaConn struct {
+	conn        net.Conn
+	address     string
+	correlation int32
+	versions    map[int16]int16 // version of each API of kafkaClientVersions to request, if the broker has one of them
+}
+
+// Connect and authenticate to a broker
+func (n *KafkaNotifier) dialBroker(ctx context.Context, address string) (*kafkaConn, error) {
+	config := &n.config
+	conn, err := n.dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if config.Tls {
+		host, _, _ := net.SplitHostPort(address)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	c := &kafkaConn{conn: conn, address: address}
+	// ApiVersions is allowed before authentication
+	if err := c.negotiate(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("no api versions of %v: %v", address, err)
+	}
+	if config.Sasl != nil {
+		if err := c.authenticate(ctx, config.Sasl); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("sasl authentication to %v failed: %v", address, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *kafkaConn) Close() {
+	c.conn.Close()
+}
+
+// Pick the newest version of each API which both the broker and kafkaClientVersions have
+func (c *kafkaConn) negotiate(ctx context.Context) error {
+	// v0 has no body, and brokers answer it in v0 even if they dropped it
+	response, err := c.roundTrip(ctx, kafkaApiApiVersions, 0, nil)
+	if err != nil {
+		return err
+	}
+	if code := response.int16(); code != 0 {
+		return fmt.Errorf("error code %v", code)
+	}
+	c.versions = map[int16]int16{}
+	for count := response.int32(); count > 0 && response.err == nil; count-- {
+		apiKey, min, max := response.int16(), response.int16(), response.int16()
+		if versions, ok := kafkaClientVersions[apiKey]; ok && min <= versions[1] && max >= versions[0] {
+			c.versions[apiKey] = versions[1]
+			if max < versions[1] {
+				c.versions[apiKey] = max
+			}
+		}
+	}
+	return response.err
+}
+
+// Version of an API to request
+func (c *kafkaConn) version(apiKey int16) (int16, error) {
+	version, ok := c.versions[apiKey]
+	if !ok {
+		versions := kafkaClientVersions[apiKey]
+		return 0, fmt.Errorf("kafka broker %v has none of versions %v to %v of api %v", c.address, versions[0], versions[1], apiKey)
+	}
+	return version, nil
+}
+
+// Send a request and read its response
+func (c *kafkaConn) roundTrip(ctx context.Context, apiKey int16, apiVersion int16, body []byte) (*kafkaReader, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > kafkaTimeout {
+		deadline = time.Now().Add(kafkaTimeout)
+	}
+	c.conn.SetDeadline(deadline)
+	c.correlation++
+	var request kafkaWriter
+	request.int32(0) // size, filled below
+	request.int16(apiKey)
+	request.int16(apiVersion)
+	request.int32(c.correlation)
+	request.string(kafkaClientId)
+	request.Write(body)
+	b := request.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	if _, err := c.conn.Write(b); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(size[:])
+	if length > kafkaMaxResponseSize {
+		return nil, fmt.Errorf("kafka response of %v bytes is over %v", length, kafkaMaxResponseSize)
+	}
+	response := make([]byte, length)
+	if _, err := io.ReadFull(c.conn, response); err != nil {
+		return nil, err
+	}
+	r := &kafkaReader{b: response}
+	correlation := r.int32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if correlation != c.correlation {
+		return nil, fmt.Errorf("unexpected kafka response %v to request %v", correlation, c.correlation)
+	}
+	return r, nil
+}
+
+// Exchange one SASL message
+func (c *kafkaConn) saslAuthenticate(ctx context.Context, message []byte) ([]byte, error) {
+	version, err := c.version(kafkaApiSaslAuthenticate)
+	if err != nil {
+		return nil, err
+	}
+	// v1 only adds session_lifetime_ms to the response
+	var body kafkaWriter
+	body.bytes(message)
+	response, err := c.roundTrip(ctx, kafkaApiSaslAuthenticate, version, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	code := response.int16()
+	errorMessage := response.nullableString()
+	reply := response.bytesField()
+	if code != 0 {
+		return nil, fmt.Errorf("error code %v: %v", code, errorMessage)
+	}
+	return reply, response.err
+}
+
+func (c *kafkaConn) authenticate(ctx context.Context, config *KafkaSaslConfig) error {
+	version, err := c.version(kafkaApiSaslHandshake)
+	if err != nil {
+		return err
+	}
+	var body kafkaWriter
+	body.string(config.Mechanism)
+	response, err := c.roundTrip(ctx, kafkaApiSaslHandshake, version, body.Bytes())
+	if err != nil {
+		return err
+	}
+	if code := response.int16(); code != 0 {
+		var mechanisms []string
+		for count := response.int32(); count > 0 && response.err == nil; count-- {
+			mechanisms = append(mechanisms, response.string())
+		}
+		return fmt.Errorf("%v is not enabled (error code %v), enabled: %v", config.Mechanism, code, mechanisms)
+	}
+	if config.Mechanism == "PLAIN" {
+		_, err := c.saslAuthenticate(ctx, []byte("\x00"+config.Username+"\x00"+config.Password))
+		return err
+	}
+	nonce := make([]byte, 18)
+	rand.Read(nonce)
+	return c.scram(ctx, config, kafkaScramHashes[config.Mechanism], base64.StdEncoding.EncodeToString(nonce))
+}
+
+var kafkaScramHashes = map[string]func() hash.Hash{
+	"SCRAM-SHA-256": sha256.New,
+	"SCRAM-SHA-512": sha512.New,
+}
+
+// SCRAM authentication of RFC 5802
+func (c *kafkaConn) scram(ctx context.Context, config *KafkaSaslConfig, h func() hash.Hash, clientNonce string) error {
+	username := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(config.Username)
+	clientFirst := "n=" + username + ",r=" + clientNonce
+	serverFirst, err := c.saslAuthenticate(ctx, []byte("n,,"+clientFirst))
+	if err != nil {
+		return err
+	}
+	attributes := map[string]string{}
+	for _, attribute := range strings.Split(string(serverFirst), ",") {
+		if k, v, ok := strings.Cut(attribute, "="); ok {
+			attributes[k] = v
+		}
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	iterations, _ := strconv.Atoi(attributes["i"])
+	if err != nil || iterations <= 0 || !strings.HasPrefix(attributes["r"], clientNonce) {
+		return fmt.Errorf("invalid server-first-message %q", serverFirst)
+	}
+	saltedPassword, err := pbkdf2.Key(h, config.Password, salt, iterations, h().Size())
+	if err != nil {
+		return err
+	}
+	mac := func(key []byte, message string) []byte {
+		m := hmac.New(h, key)
+		m.Write([]byte(message))
+		return m.Sum(nil)
+	}
+	clientFinal := "c=biws,r=" + attributes["r"]
+	authMessage := clientFirst + "," + string(serverFirst) + "," + clientFinal
+	clientKey := mac(saltedPassword, "Client Key")
+	storedKey := h()
+	storedKey.Write(clientKey)
+	proof := mac(storedKey.Sum(nil), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	serverFinal, err := c.saslAuthenticate(ctx, []byte(clientFinal+",p="+base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	signature := base64.StdEncoding.EncodeToString(mac(mac(saltedPassword, "Server Key"), authMessage))
+	if string(serverFinal) != "v="+signature {
+		return fmt.Errorf("invalid server-final-message %q", serverFinal)
+	}
+	return nil
+}
+
+// A record batch (magic 2) of one record
+func kafkaRecordBatch(key []byte, value []byte, timestamp time.Time) []byte {
+	var record kafkaWriter
+	record.int8(0)     // attributes
+	record.varint(0)   // timestamp_delta
+	record.varint(0)   // offset_delta
+	if len(key) == 0 { // null key
+		record.varint(-1)
+	} else {
+		record.varint(int64(len(key)))
+		record.Write(key)
+	}
+	record.varint(int64(len(value)))
+	record.Write(value)
+	record.varint(0) // headers
+
+	// fields covered by the CRC
+	var batch kafkaWriter
+	batch.int16(0) // attributes: no compression, CreateTime
+	batch.int32(0) // last_offset_delta
+	batch.int64(timestamp.UnixMilli())
+	batch.int64(timestamp.UnixMilli())
+	batch.int64(-1) // producer_id
+	batch.int16(-1) // producer_epoch
+	batch.int32(-1) // base_sequence
+	batch.int32(1)  // records
+	batch.varint(int64(record.Len()))
+	batch.Write(record.Bytes())
+	crc := crc32.Checksum(batch.Bytes(), crc32.MakeTable(crc32.Castagnoli))
+
+	var header kafkaWriter
+	header.int64(0)                              // base_offset
+	header.int32(int32(4 + 1 + 4 + batch.Len())) // batch_length
+	header.int32(-1)                             // partition_leader_epoch
+	header.int8(2)                               // magic
+	header.int32(int32(crc))
+	header.Write(batch.Bytes())
+	return header.Bytes()
+}
+
+// murmur2 of Kafka's default partitioner
+func kafkaMurmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+	i := 0
+	for ; i+4 <= len(data); i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch len(data) - i {
+	case 3:
+		h ^= uint32(data[i+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[i+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[i])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// Big endian encoding of the Kafka protocol
+type kafkaWriter struct {
+	bytes.Buffer
+}
+
+func (w *kafkaWriter) int8(v int8) {
+	w.WriteByte(byte(v))
+}
+
+func (w *kafkaWriter) int16(v int16) {
+	w.Buffer.Write(binary.BigEndian.AppendUint16(nil, uint16(v)))
+}
+
+func (w *kafkaWriter) int32(v int32) {
+	w.Buffer.Write(binary.BigEndian.AppendUint32(nil, uint32(v)))
+}
+
+func (w *kafkaWriter) int64(v int64) {
+	w.Buffer.Write(binary.BigEndian.AppendUint64(nil, uint64(v)))
+}
+
+func (w *kafkaWriter) varint(v int64) {
+	w.Buffer.Write(binary.AppendVarint(nil, v))
+}
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *kafkaWriter) nullableString(s *string) {
+	if s == nil {
+		w.int16(-1)
+		return
+	}
+	w.string(*s)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	w.Buffer.Write(b)
+}
+
+// Decoding of responses. The first error sticks to err, and later reads return zero values
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = fmt.Errorf("truncated kafka response")
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.read(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.read(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.read(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.read(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) string() string {
+	return string(r.read(int(r.int16())))
+}
+
+func (r *kafkaReader) nullableString() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.read(int(n)))
+}
+
+func (r *kafkaReader) bytesField() []byte {
+	n := r.int32()
+	if n < 0 {
+		return nil
+	}
+	return r.read(int(n))
+}
+
+func (r *kafkaReader) skipInt32s() {
+	if n := r.int32(); n > 0 {
+		r.read(int(n) * 4)
+	}
+}
@@ -0,0 +1,755 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Broker answering ApiVersions by versions, and other requests of connections on net.Pipe by handle, which gets the
+// dialed address, the api key, its version and the request body, and returns the response body. A nil response hangs
+// up, as brokers without ApiVersions do
+type fakeKafkaBroker struct {
+	t        *testing.T
+	versions map[int16][2]int16 // default kafkaVersions40
+	handle   func(address string, apiKey, version int16, body *kafkaReader) []byte
+}
+
+// API versions of Kafka releases
+var (
+	kafkaVersions011 = map[int16][2]int16{
+		kafkaApiProduce:       {0, 3},
+		kafkaApiMetadata:      {0, 4},
+		kafkaApiSaslHandshake: {0, 1},
+		kafkaApiApiVersions:   {0, 1},
+	}
+	kafkaVersions10 = map[int16][2]int16{
+		kafkaApiProduce:          {0, 5},
+		kafkaApiMetadata:         {0, 5},
+		kafkaApiSaslHandshake:    {0, 1},
+		kafkaApiApiVersions:      {0, 1},
+		kafkaApiSaslAuthenticate: {0, 0},
+	}
+	kafkaVersions40 = map[int16][2]int16{
+		kafkaApiProduce:          {3, 12},
+		kafkaApiMetadata:         {4, 13},
+		kafkaApiSaslHandshake:    {1, 1},
+		kafkaApiApiVersions:      {0, 4},
+		kafkaApiSaslAuthenticate: {0, 2},
+	}
+)
+
+func (b *fakeKafkaBroker) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if strings.HasPrefix(address, "unreachable") {
+		return nil, fmt.Errorf("dial %v: connection refused", address)
+	}
+	client, server := net.Pipe()
+	go b.serve(address, server)
+	return client, nil
+}
+
+func (b *fakeKafkaBroker) serve(address string, conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		versions := b.versions
+		if versions == nil {
+			versions = kafkaVersions40
+		}
+		r := &kafkaReader{b: request}
+		apiKey, version := r.int16(), r.int16()
+		correlation := r.int32()
+		if clientId := r.string(); clientId != kafkaClientId {
+			b.t.Errorf("client id %q, want %q", clientId, kafkaClientId)
+		}
+		var body []byte
+		if supported, ok := versions[apiKey]; !ok {
+			// brokers before ApiVersions hang up on unknown requests
+		} else if apiKey == kafkaApiApiVersions {
+			body = kafkaApiVersionsResponse(versions)
+		} else if version < supported[0] || version > supported[1] {
+			b.t.Errorf("api %v version %v, want %v to %v", apiKey, version, supported[0], supported[1])
+		} else {
+			body = b.handle(address, apiKey, version, r)
+		}
+		if body == nil {
+			return
+		}
+		var response kafkaWriter
+		response.int32(int32(4 + len(body)))
+		response.int32(correlation)
+		response.Write(body)
+		if _, err := conn.Write(response.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// ApiVersions v0 response
+func kafkaApiVersionsResponse(versions map[int16][2]int16) []byte {
+	var w kafkaWriter
+	w.int16(0)
+	w.int32(int32(len(versions)))
+	for apiKey, v := range versions {
+		w.int16(apiKey)
+		w.int16(v[0])
+		w.int16(v[1])
+	}
+	return w.Bytes()
+}
+
+// Metadata response of brokers 1 and 2 at broker1:9092 and broker2:9092, and topic of partitions led by leaders
+func kafkaMetadataResponse(version int16, topic string, code int16, leaders ...int32) []byte {
+	var w kafkaWriter
+	if version >= 3 {
+		w.int32(0) // throttle_time_ms
+	}
+	w.int32(2)
+	for _, node := range []int32{1, 2} {
+		w.int32(node)
+		w.string(fmt.Sprintf("broker%v", node))
+		w.int32(9092)
+		w.nullableString(nil) // rack
+	}
+	if version >= 2 {
+		clusterId := "cluster"
+		w.nullableString(&clusterId)
+	}
+	w.int32(1) // controller_id
+	w.int32(1)
+	w.int16(code)
+	w.string(topic)
+	w.int8(0) // is_internal
+	w.int32(int32(len(leaders)))
+	for i, leader := range leaders {
+		w.int16(0)
+		w.int32(int32(i))
+		w.int32(leader)
+		if version >= 7 {
+			w.int32(5) // leader_epoch
+		}
+		w.int32(1) // replica_nodes
+		w.int32(leader)
+		w.int32(1) // isr_nodes
+		w.int32(leader)
+		if version >= 5 {
+			w.int32(1) // offline_replicas
+			w.int32(3)
+		}
+	}
+	if version >= 8 {
+		w.int32(-2147483648) // topic_authorized_operations
+		w.int32(-2147483648) // cluster_authorized_operations
+	}
+	return w.Bytes()
+}
+
+// Produce response of a partition
+func kafkaProduceResponse(version int16, topic string, partition int32, code int16, message string) []byte {
+	var w kafkaWriter
+	w.int32(1)
+	w.string(topic)
+	w.int32(1)
+	w.int32(partition)
+	w.int16(code)
+	w.int64(42) // base_offset
+	w.int64(-1) // log_append_time_ms
+	if version >= 5 {
+		w.int64(0) // log_start_offset
+	}
+	if version >= 8 {
+		w.int32(1) // record_errors
+		w.int32(0)
+		w.nullableString(nil)
+		if len(message) > 0 {
+			w.nullableString(&message)
+		} else {
+			w.nullableString(nil)
+		}
+	}
+	w.int32(0) // throttle_time_ms
+	return w.Bytes()
+}
+
+// SaslHandshake v1 response
+func kafkaHandshakeResponse(code int16, mechanisms ...string) []byte {
+	var w kafkaWriter
+	w.int16(code)
+	w.int32(int32(len(mechanisms)))
+	for _, mechanism := range mechanisms {
+		w.string(mechanism)
+	}
+	return w.Bytes()
+}
+
+// SaslAuthenticate response
+func kafkaSaslResponse(version int16, code int16, message string, reply []byte) []byte {
+	var w kafkaWriter
+	w.int16(code)
+	if len(message) > 0 {
+		w.nullableString(&message)
+	} else {
+		w.nullableString(nil)
+	}
+	w.bytes(reply)
+	if version >= 1 {
+		w.int64(0) // session_lifetime_ms
+	}
+	return w.Bytes()
+}
+
+// Connection to broker, negotiated like the ones of dialBroker
+func dialTestKafkaConn(t *testing.T, broker *fakeKafkaBroker) *kafkaConn {
+	t.Helper()
+	conn, _ := broker.dial(context.Background(), "tcp", "broker1:9092")
+	t.Cleanup(func() { conn.Close() })
+	c := &kafkaConn{conn: conn, address: "broker1:9092"}
+	if err := c.negotiate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+type kafkaTestRecord struct {
+	key       []byte // nil for null keys
+	value     []byte
+	timestamp int64
+}
+
+// Decode a record batch of one record, checking every field of the batch header and its CRC
+func decodeKafkaBatch(t *testing.T, b []byte) kafkaTestRecord {
+	t.Helper()
+	r := &kafkaReader{b: b}
+	if offset := r.int64(); offset != 0 {
+		t.Errorf("base_offset = %v", offset)
+	}
+	if length := r.int32(); int(length) != len(b)-12 {
+		t.Errorf("batch_length = %v, want %v", length, len(b)-12)
+	}
+	if epoch := r.int32(); epoch != -1 {
+		t.Errorf("partition_leader_epoch = %v", epoch)
+	}
+	if magic := r.int8(); magic != 2 {
+		t.Errorf("magic = %v", magic)
+	}
+	if crc := uint32(r.int32()); crc != crc32.Checksum(r.b, crc32.MakeTable(crc32.Castagnoli)) {
+		t.Errorf("crc = %x, want CRC-32C of the rest %x", crc, crc32.Checksum(r.b, crc32.MakeTable(crc32.Castagnoli)))
+	}
+	if attributes := r.int16(); attributes != 0 {
+		t.Errorf("attributes = %v", attributes)
+	}
+	if delta := r.int32(); delta != 0 {
+		t.Errorf("last_offset_delta = %v", delta)
+	}
+	var record kafkaTestRecord
+	record.timestamp = r.int64()
+	if max := r.int64(); max != record.timestamp {
+		t.Errorf("max_timestamp = %v, want %v", max, record.timestamp)
+	}
+	if producer, epoch, sequence := r.int64(), r.int16(), r.int32(); producer != -1 || epoch != -1 || sequence != -1 {
+		t.Errorf("producer_id, producer_epoch, base_sequence = %v, %v, %v, want -1", producer, epoch, sequence)
+	}
+	if count := r.int32(); count != 1 {
+		t.Errorf("records = %v", count)
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	varint := func() int64 {
+		v, n := binary.Varint(r.b)
+		if n <= 0 {
+			t.Fatal("invalid varint")
+		}
+		r.b = r.b[n:]
+		return v
+	}
+	if length := varint(); int(length) != len(r.b) {
+		t.Errorf("record length = %v, want the rest %v", length, len(r.b))
+	}
+	if attributes := r.int8(); attributes != 0 {
+		t.Errorf("record attributes = %v", attributes)
+	}
+	if timestampDelta, offsetDelta := varint(), varint(); timestampDelta != 0 || offsetDelta != 0 {
+		t.Errorf("timestamp_delta, offset_delta = %v, %v", timestampDelta, offsetDelta)
+	}
+	if length := varint(); length >= 0 {
+		record.key = r.read(int(length))
+	}
+	record.value = r.read(int(varint()))
+	if headers := varint(); headers != 0 {
+		t.Errorf("headers = %v", headers)
+	}
+	if r.err != nil || len(r.b) > 0 {
+		t.Errorf("batch ends with %v bytes left: %v", len(r.b), r.err)
+	}
+	return record
+}
+
+func TestKafkaRecordBatch(t *testing.T) {
+	timestamp := time.Date(2026, 10, 15, 10, 0, 0, 123e6, time.UTC)
+	for _, c := range []struct {
+		key   []byte
+		value []byte
+	}{
+		{[]byte("enterprises/p/devices/d"), []byte(`{"eventType":"chime"}`)},
+		{nil, []byte(`{}`)},
+		// lengths over a byte of varint
+		{bytes.Repeat([]byte("k"), 200), bytes.Repeat([]byte("v"), 70000)},
+	} {
+		got := decodeKafkaBatch(t, kafkaRecordBatch(c.key, c.value, timestamp))
+		if !bytes.Equal(got.key, c.key) || (got.key == nil) != (c.key == nil) || !bytes.Equal(got.value, c.value) || got.timestamp != timestamp.UnixMilli() {
+			t.Errorf("record = %q, %.20q at %v, want %q, %.20q at %v", got.key, got.value, got.timestamp, c.key, c.value, timestamp.UnixMilli())
+		}
+	}
+}
+
+// Vectors of Utils.murmur2 of the Java client, so that records go to the same partitions
+func TestKafkaMurmur2(t *testing.T) {
+	for _, c := range []struct {
+		data string
+		want int32
+	}{
+		{"21", -973932308},
+		{"foobar", -790332482},
+		{"a-little-bit-long-string", -985981536},
+		{"a-little-bit-longer-string", -1486304829},
+		{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+		{"abc", 479470107},
+	} {
+		if got := kafkaMurmur2([]byte(c.data)); got != c.want {
+			t.Errorf("kafkaMurmur2(%q) = %v, want %v", c.data, got, c.want)
+		}
+	}
+}
+
+// Broker answering SaslAuthenticate by a scripted conversation
+func scriptedSasl(t *testing.T, script [][2]string) *fakeKafkaBroker {
+	var mu sync.Mutex
+	step := 0
+	return &fakeKafkaBroker{t: t, handle: func(address string, apiKey, version int16, body *kafkaReader) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		message := string(body.bytesField())
+		if apiKey != kafkaApiSaslAuthenticate || step >= len(script) || message != script[step][0] {
+			return kafkaSaslResponse(version, 58, fmt.Sprintf("unexpected message %q", message), nil)
+		}
+		step++
+		return kafkaSaslResponse(version, 0, "", []byte(script[step-1][1]))
+	}}
+}
+
+// Exchanges of RFC 5802 (SCRAM-SHA-1) and RFC 7677 (SCRAM-SHA-256)
+func TestKafkaScramVectors(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		h      func() hash.Hash
+		nonce  string
+		script [][2]string
+	}{
+		{"RFC 5802", sha1.New, "fyko+d2lbbFgONRv9qkxdawL", [][2]string{
+			{"n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL", "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096"},
+			{"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=", "v=rmF9pqV8S7suAoZWja4dJRkFsKQ="},
+		}},
+		{"RFC 7677", sha256.New, "rOprNGfwEbeRWgbNEkqO", [][2]string{
+			{"n,,n=user,r=rOprNGfwEbeRWgbNEkqO", "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"},
+			{"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="},
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conn := dialTestKafkaConn(t, scriptedSasl(t, c.script))
+			err := conn.scram(context.Background(), &KafkaSaslConfig{Username: "user", Password: "pencil"}, c.h, c.nonce)
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Broker verifying the client proof of SCRAM like RFC 5802 section 3, with a username to escape
+func TestKafkaScramSha512(t *testing.T) {
+	const username, password, nonce = "a=b,c", "pencil", "clientnonce"
+	salt := []byte("salt of the server")
+	saltedPassword, _ := pbkdf2.Key(sha512.New, password, salt, 4096, sha512.Size)
+	mac := func(key []byte, message string) []byte {
+		m := hmac.New(sha512.New, key)
+		m.Write([]byte(message))
+		return m.Sum(nil)
+	}
+	clientKey := mac(saltedPassword, "Client Key")
+	storedKey := sha512.Sum512(clientKey)
+	serverFirst := "r=" + nonce + "servernonce,s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+	var clientFirst string
+	broker := &fakeKafkaBroker{t: t, versions: kafkaVersions10, handle: func(address string, apiKey, version int16, body *kafkaReader) []byte {
+		message := string(body.bytesField())
+		if len(clientFirst) == 0 {
+			if message != "n,,n=a=3Db=2Cc,r="+nonce {
+				return kafkaSaslResponse(version, 58, "bad client-first-message "+message, nil)
+			}
+			clientFirst = strings.TrimPrefix(message, "n,,")
+			return kafkaSaslResponse(version, 0, "", []byte(serverFirst))
+		}
+		withoutProof, proof, _ := strings.Cut(message, ",p=")
+		authMessage := clientFirst + "," + serverFirst + "," + withoutProof
+		p, _ := base64.StdEncoding.DecodeString(proof)
+		signature := mac(storedKey[:], authMessage)
+		if len(p) != len(signature) {
+			return kafkaSaslResponse(version, 58, "bad proof", nil)
+		}
+		for i := range p {
+			p[i] ^= signature[i]
+		}
+		if sha512.Sum512(p) != storedKey {
+			return kafkaSaslResponse(version, 58, "bad proof", nil)
+		}
+		return kafkaSaslResponse(version, 0, "", []byte("v="+base64.StdEncoding.EncodeToString(mac(mac(saltedPassword, "Server Key"), authMessage))))
+	}}
+	if err := dialTestKafkaConn(t, broker).scram(context.Background(), &KafkaSaslConfig{Username: username, Password: password}, sha512.New, nonce); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKafkaScramErrors(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		script [][2]string
+		want   string
+	}{
+		{"refused", nil, "error code 58: unexpected message"},
+		{"nonce not of the client", [][2]string{{"n,,n=user,r=nonce", "r=other,s=c2FsdA==,i=4096"}}, "invalid server-first-message"},
+		{"no iterations", [][2]string{{"n,,n=user,r=nonce", "r=nonce1,s=c2FsdA=="}}, "invalid server-first-message"},
+		{"invalid salt", [][2]string{{"n,,n=user,r=nonce", "r=nonce1,s=!,i=1"}}, "invalid server-first-message"},
+		{"wrong server signature", [][2]string{
+			{"n,,n=user,r=nonce", "r=nonce1,s=c2FsdA==,i=1"},
+			{"c=biws,r=nonce1,p=3fRAdX1+sAKeMA+5fqgSpreOTDwaT4kojyQ7mTEe6z4=", "v=c2lnbmF0dXJl"},
+		}, "invalid server-final-message"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conn := dialTestKafkaConn(t, scriptedSasl(t, c.script))
+			err := conn.scram(context.Background(), &KafkaSaslConfig{Username: "user", Password: "pencil"}, sha256.New, "nonce")
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %v, want containing %q", err, c.want)
+			}
+		})
+	}
+}
+
+// Cluster of brokers 1 and 2 of versions leading partitions of topic "events" by leaders. Records produced by broker
+// address
+type fakeKafkaCluster struct {
+	mu          sync.Mutex
+	versions    map[int16][2]int16 // default kafkaVersions40
+	leaders     []int32
+	metadataErr int16   // error code of the topic in metadata
+	produceErrs []int16 // error codes of the next produce requests
+	mechanisms  []string
+	requests    map[int16]int
+	used        map[int16]int16              // version of requests by api
+	produced    map[string][]kafkaTestRecord // by broker address and partition e.g. broker1:9092/0
+}
+
+func newFakeKafkaNotifier(t *testing.T, cluster *fakeKafkaCluster, config string) *KafkaNotifier {
+	t.Helper()
+	notifier, err := newKafkaNotifierFromConfig(json.RawMessage(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := notifier.(*KafkaNotifier)
+	cluster.requests, cluster.used, cluster.produced = map[int16]int{}, map[int16]int16{}, map[string][]kafkaTestRecord{}
+	broker := &fakeKafkaBroker{t: t, versions: cluster.versions, handle: func(address string, apiKey, version int16, body *kafkaReader) []byte {
+		cluster.mu.Lock()
+		defer cluster.mu.Unlock()
+		cluster.requests[apiKey]++
+		cluster.used[apiKey] = version
+		switch apiKey {
+		case kafkaApiSaslHandshake:
+			mechanism := body.string()
+			for _, m := range cluster.mechanisms {
+				if m == mechanism {
+					return kafkaHandshakeResponse(0, cluster.mechanisms...)
+				}
+			}
+			return kafkaHandshakeResponse(33, cluster.mechanisms...) // UNSUPPORTED_SASL_MECHANISM
+		case kafkaApiSaslAuthenticate:
+			if message := string(body.bytesField()); message != "\x00user\x00secret" {
+				return kafkaSaslResponse(version, 58, "Authentication failed: Invalid username or password", nil)
+			}
+			return kafkaSaslResponse(version, 0, "", nil)
+		case kafkaApiMetadata:
+			if topics, topic := body.int32(), body.string(); topics != 1 || topic != "events" {
+				t.Errorf("metadata of %v topics %v, want events", topics, topic)
+			}
+			if version >= 4 && body.int8() != 1 {
+				t.Error("auto topic creation not allowed")
+			}
+			if version >= 8 && (body.int8() != 0 || body.int8() != 0) {
+				t.Error("authorized operations included")
+			}
+			if body.err != nil || len(body.b) > 0 {
+				t.Errorf("metadata v%v request ends with %v bytes left: %v", version, len(body.b), body.err)
+			}
+			return kafkaMetadataResponse(version, "events", cluster.metadataErr, cluster.leaders...)
+		case kafkaApiProduce:
+			body.nullableString() // transactional_id
+			acks, timeout := body.int16(), body.int32()
+			if acks != int16(n.config.Acks) || timeout != int32(kafkaTimeout/time.Millisecond) {
+				t.Errorf("acks, timeout = %v, %v", acks, timeout)
+			}
+			body.int32()
+			topic := body.string()
+			body.int32()
+			partition := body.int32()
+			batch := body.bytesField()
+			if body.err != nil || topic != "events" {
+				t.Errorf("produce to %v: %v", topic, body.err)
+				return nil
+			}
+			code := int16(0)
+			if len(cluster.produceErrs) > 0 {
+				code, cluster.produceErrs = cluster.produceErrs[0], cluster.produceErrs[1:]
+			}
+			if code == 0 {
+				key := fmt.Sprintf("%v/%v", address, partition)
+				cluster.produced[key] = append(cluster.produced[key], decodeKafkaBatch(t, batch))
+			}
+			message := ""
+			if code != 0 {
+				message = fmt.Sprintf("test error %v", code)
+			}
+			return kafkaProduceResponse(version, topic, partition, code, message)
+		}
+		t.Errorf("unexpected api %v", apiKey)
+		return nil
+	}}
+	n.dial = broker.dial
+	return n
+}
+
+func testKafkaNotification(device string) *Notification {
+	return &Notification{Device: device, EventSessionId: "session", Timestamp: "2026-10-15T10:00:00.123Z"}
+}
+
+// Versions are negotiated with brokers before and after KIP-896
+func TestKafkaNotify(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		versions map[int16][2]int16
+		sasl     bool
+		want     map[int16]int16
+	}{
+		{"kafka 4.0", kafkaVersions40, true, map[int16]int16{kafkaApiProduce: 8, kafkaApiMetadata: 8, kafkaApiSaslHandshake: 1, kafkaApiSaslAuthenticate: 1}},
+		{"kafka 1.0", kafkaVersions10, true, map[int16]int16{kafkaApiProduce: 5, kafkaApiMetadata: 5, kafkaApiSaslHandshake: 1, kafkaApiSaslAuthenticate: 0}},
+		{"kafka 0.11", kafkaVersions011, false, map[int16]int16{kafkaApiProduce: 3, kafkaApiMetadata: 4}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cluster := &fakeKafkaCluster{versions: c.versions, leaders: []int32{1, 2}, mechanisms: []string{"PLAIN", "SCRAM-SHA-512"}}
+			config := `{"brokers":["bootstrap:9092"],"topic":"events"}`
+			if c.sasl {
+				config = `{"brokers":["bootstrap:9092"],"topic":"events","sasl":{"username":"user","password":"secret"}}`
+			}
+			n := newFakeKafkaNotifier(t, cluster, config)
+			defer n.reset()
+			devices := []string{"enterprises/p/devices/front", "enterprises/p/devices/back", "enterprises/p/devices/front"}
+			for _, device := range devices {
+				if err := n.Notify(context.Background(), testKafkaNotification(device)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := map[string][]kafkaTestRecord{}
+			for _, device := range devices {
+				partition := int(kafkaMurmur2([]byte(device))&0x7fffffff) % 2
+				key := fmt.Sprintf("broker%v:9092/%v", cluster.leaders[partition], partition)
+				value, _ := json.Marshal(testKafkaNotification(device))
+				want[key] = append(want[key], kafkaTestRecord{key: []byte(device), value: value, timestamp: time.Date(2026, 10, 15, 10, 0, 0, 123e6, time.UTC).UnixMilli()})
+			}
+			cluster.mu.Lock()
+			defer cluster.mu.Unlock()
+			if fmt.Sprint(cluster.produced) != fmt.Sprint(want) {
+				t.Errorf("produced %q, want %q", cluster.produced, want)
+			}
+			if fmt.Sprint(cluster.used) != fmt.Sprint(c.want) {
+				t.Errorf("versions %v, want %v", cluster.used, c.want)
+			}
+			// a connection to the bootstrap broker and each leader, authenticated if sasl, and metadata fetched once
+			connections, authentications := len(want)+1, 0
+			if c.sasl {
+				authentications = connections
+			}
+			if cluster.requests[kafkaApiMetadata] != 1 || cluster.requests[kafkaApiSaslHandshake] != authentications || cluster.requests[kafkaApiSaslAuthenticate] != authentications {
+				t.Errorf("requests %v, want metadata once and authentication of %v connections", cluster.requests, authentications)
+			}
+		})
+	}
+}
+
+// Records without key are spread over the partitions
+func TestKafkaNotifyWithoutKey(t *testing.T) {
+	cluster := &fakeKafkaCluster{leaders: []int32{1, 1, 2}}
+	n := newFakeKafkaNotifier(t, cluster, `{"brokers":["bootstrap:9092"],"topic":"events","key":"","acks":1}`)
+	defer n.reset()
+	for i := 0; i < 4; i++ {
+		if err := n.Notify(context.Background(), testKafkaNotification("enterprises/p/devices/front")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	counts := map[string]int{}
+	for partition, records := range cluster.produced {
+		counts[partition] = len(records)
+		if records[0].key != nil {
+			t.Errorf("key %q, want null", records[0].key)
+		}
+	}
+	if want := map[string]int{"broker1:9092/0": 2, "broker1:9092/1": 1, "broker2:9092/2": 1}; fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("records by partition %v, want %v", counts, want)
+	}
+}
+
+// A produce refused by a broker which isn't the leader anymore is retried after fetching the metadata again
+func TestKafkaNotifyLeaderMoved(t *testing.T) {
+	cluster := &fakeKafkaCluster{leaders: []int32{1}, produceErrs: []int16{6}} // NOT_LEADER_OR_FOLLOWER
+	n := newFakeKafkaNotifier(t, cluster, `{"brokers":["bootstrap:9092"],"topic":"events","attempts":2}`)
+	defer n.reset()
+	if err := n.Notify(context.Background(), testKafkaNotification("enterprises/p/devices/front")); err != nil {
+		t.Fatal(err)
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	if cluster.requests[kafkaApiMetadata] != 2 || cluster.requests[kafkaApiProduce] != 2 || len(cluster.produced["broker1:9092/0"]) != 1 {
+		t.Errorf("requests %v and produced %v, want the record produced by the second attempt", cluster.requests, cluster.produced)
+	}
+}
+
+func TestKafkaNotifyErrors(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		cluster *fakeKafkaCluster
+		config  string
+		want    string
+	}{
+		{"unknown topic", &fakeKafkaCluster{metadataErr: 3}, `{"brokers":["bootstrap:9092"],"topic":"events"}`, "no metadata of topic events: error code 3"},
+		{"no partitions", &fakeKafkaCluster{}, `{"brokers":["bootstrap:9092"],"topic":"events"}`, "has no partitions"},
+		{"refused record", &fakeKafkaCluster{leaders: []int32{1}, produceErrs: []int16{10}}, `{"brokers":["bootstrap:9092"],"topic":"events"}`, "kafka refused the record to events/0: error code 10: test error 10"},
+		{"refused record before error messages", &fakeKafkaCluster{versions: kafkaVersions10, leaders: []int32{1}, produceErrs: []int16{10}}, `{"brokers":["bootstrap:9092"],"topic":"events"}`, "kafka refused the record to events/0: error code 10"},
+		{"unreachable", &fakeKafkaCluster{}, `{"brokers":["unreachable1:9092","unreachable2:9092"],"topic":"events"}`, "no kafka broker is reachable: dial unreachable1:9092: connection refused; dial unreachable2:9092"},
+		{"mechanism not enabled", &fakeKafkaCluster{mechanisms: []string{"SCRAM-SHA-512"}}, `{"brokers":["bootstrap:9092"],"topic":"events","sasl":{"username":"user","password":"secret"}}`, "PLAIN is not enabled (error code 33), enabled: [SCRAM-SHA-512]"},
+		{"wrong password", &fakeKafkaCluster{mechanisms: []string{"PLAIN"}}, `{"brokers":["bootstrap:9092"],"topic":"events","sasl":{"username":"user","password":"wrong"}}`, "error code 58: Authentication failed"},
+		{"no ApiVersions", &fakeKafkaCluster{versions: map[int16][2]int16{kafkaApiProduce: {0, 2}, kafkaApiMetadata: {0, 1}}}, `{"brokers":["bootstrap:9092"],"topic":"events"}`, "no api versions of bootstrap:9092: EOF"},
+		{"no common metadata version", &fakeKafkaCluster{versions: map[int16][2]int16{kafkaApiApiVersions: {0, 0}, kafkaApiProduce: {0, 2}, kafkaApiMetadata: {9, 13}}}, `{"brokers":["bootstrap:9092"],"topic":"events"}`, "kafka broker bootstrap:9092 has none of versions 1 to 8 of api 3"},
+		{"no SaslAuthenticate", &fakeKafkaCluster{versions: kafkaVersions011, mechanisms: []string{"PLAIN"}}, `{"brokers":["bootstrap:9092"],"topic":"events","sasl":{"username":"user","password":"secret"}}`, "has none of versions 0 to 1 of api 36"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.config = strings.TrimSuffix(c.config, "}") + `,"attempts":1}`
+			n := newFakeKafkaNotifier(t, c.cluster, c.config)
+			defer n.reset()
+			err := n.Notify(context.Background(), testKafkaNotification("enterprises/p/devices/front"))
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %v, want containing %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestKafkaRoundTripErrors(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		response func(correlation int32) []byte // whole response including size
+		want     string
+	}{
+		{"truncated", func(correlation int32) []byte {
+			return []byte{0, 0, 0, 2, 0, 0}
+		}, "truncated kafka response"},
+		{"other correlation", func(correlation int32) []byte {
+			return binary.BigEndian.AppendUint32([]byte{0, 0, 0, 4}, uint32(correlation+1))
+		}, "unexpected kafka response 2 to request 1"},
+		{"hang up", nil, "EOF"},
+		{"too large", func(correlation int32) []byte {
+			return []byte{0x7f, 0xff, 0xff, 0xff}
+		}, "kafka response of 2147483647 bytes is over 16777216"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				var size [4]byte
+				io.ReadFull(server, size[:])
+				request := make([]byte, binary.BigEndian.Uint32(size[:]))
+				io.ReadFull(server, request)
+				if c.response != nil {
+					server.Write(c.response(int32(binary.BigEndian.Uint32(request[4:]))))
+				}
+			}()
+			_, err := (&kafkaConn{conn: client}).roundTrip(context.Background(), kafkaApiMetadata, 1, nil)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error = %v, want containing %q", err, c.want)
+			}
+		})
+	}
+}
+
+// Notifiers replaced on config reload hang up and don't connect again
+func TestKafkaClose(t *testing.T) {
+	cluster := &fakeKafkaCluster{leaders: []int32{1}}
+	n := newFakeKafkaNotifier(t, cluster, `{"brokers":["bootstrap:9092"],"topic":"events","attempts":1}`)
+	wrapped, err := WrapNotifier(n, NotifierConfigHeader{Type: "kafka"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wrapped.Notify(context.Background(), testKafkaNotification("enterprises/p/devices/front")); err != nil {
+		t.Fatal(err)
+	}
+	conn := n.conns[1]
+	CloseNotifiers([]Notifier{wrapped})
+	if len(n.conns) != 0 {
+		t.Errorf("connections %v left after Close", n.conns)
+	}
+	if _, err := conn.conn.Write([]byte{0}); err == nil {
+		t.Error("connection to the leader still open")
+	}
+	if err := n.Notify(context.Background(), testKafkaNotification("enterprises/p/devices/front")); err == nil || !strings.Contains(err.Error(), "is closed") {
+		t.Errorf("error after Close = %v, want closed", err)
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	if cluster.requests[kafkaApiMetadata] != 1 || cluster.requests[kafkaApiProduce] != 1 {
+		t.Errorf("requests %v, want none after Close", cluster.requests)
+	}
+}
+
+func TestNewKafkaNotifierErrors(t *testing.T) {
+	for _, config := range []string{
+		`{"topic":"events"}`,
+		`{"brokers":["b:9092"]}`,
+		`{"brokers":["b:9092"],"topic":"events","acks":0}`,
+		`{"brokers":["b:9092"],"topic":"events","sasl":{"mechanism":"GSSAPI"}}`,
+		`{"brokers":["b:9092"],"topic":"events","key":"{{.Device"}`,
+	} {
+		if _, err := newKafkaNotifierFromConfig(json.RawMessage(config)); err == nil {
+			t.Errorf("config %v succeeded, want error", config)
+		}
+	}
+}
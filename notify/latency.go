@@ -0,0 +1,26 @@
+package notify
+
+import (
+	"fmt"
+	"time"
+)
+
+// Event notified later after it happened than the latency budget, sent as "latency" notification
+type LatencyAlert struct {
+	Event          string  `json:"event"`  // e.g. chime
+	Device         string  `json:"device"` // custom name or device id
+	LatencySeconds float64 `json:"latencySeconds"`
+	BudgetSeconds  float64 `json:"budgetSeconds"`
+	P95Seconds     float64 `json:"p95Seconds"` // of recent notifications, including this one
+}
+
+// Plain text of the alert used by the default message template, e.g.
+//
+//	Doorbell chime at Front door was notified 1m12s after the event, over the latency budget of 30s (p95 of recent events: 8s)
+func (a *LatencyAlert) Text() string {
+	seconds := func(s float64) time.Duration {
+		return time.Duration(s * float64(time.Second)).Round(time.Second)
+	}
+	return fmt.Sprintf("Doorbell %v at %v was notified %v after the event, over the latency budget of %v (p95 of recent events: %v)",
+		a.Event, a.Device, seconds(a.LatencySeconds), seconds(a.BudgetSeconds), seconds(a.P95Seconds))
+}
@@ -0,0 +1,187 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Publish events to MQTT broker under <topicPrefix>/<device id>/<event name>.
+// When discoveryPrefix is not empty, Home Assistant MQTT Discovery configs are published for each device so that
+// chime/motion/person show up as binary sensors and the latest snapshot as a camera entity.
+type MqttNotifier struct {
+	client          mqtt.Client
+	topicPrefix     string // e.g. "nest"
+	discoveryPrefix string // e.g. "homeassistant"
+	discoveredMu    sync.Mutex
+	discovered      map[string]bool // device id => discovery config published
+}
+
+// Seconds until binary sensors go back to OFF in Home Assistant
+const mqttBinarySensorOffDelay = 30
+
+func NewMqttNotifier(broker, clientId, username, password, topicPrefix, discoveryPrefix string) (*MqttNotifier, error) {
+	n := &MqttNotifier{
+		topicPrefix:     strings.TrimSuffix(topicPrefix, "/"),
+		discoveryPrefix: strings.TrimSuffix(discoveryPrefix, "/"),
+		discovered:      map[string]bool{},
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientId).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			log.Printf("MQTT connection lost: %v", err)
+		}).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			// republish discovery configs in case broker lost retained messages
+			n.discoveredMu.Lock()
+			n.discovered = map[string]bool{}
+			n.discoveredMu.Unlock()
+		})
+	n.client = mqtt.NewClient(opts)
+	token := n.client.Connect()
+	if !token.WaitTimeout(30 * time.Second) {
+		return nil, fmt.Errorf("timeout to connect MQTT broker %v", broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *MqttNotifier) Name() string {
+	return "mqtt"
+}
+
+func (n *MqttNotifier) publish(ctx context.Context, topic string, retained bool, payload interface{}) error {
+	token := n.client.Publish(topic, 1, retained, payload)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (n *MqttNotifier) Notify(ctx context.Context, notification *Notification) error {
+	deviceId := sdmevents.DeviceId(notification.Device)
+	if err := n.publishDiscovery(ctx, deviceId); err != nil {
+		log.Printf("Failed to publish Home Assistant discovery config for %v: %v", deviceId, err)
+	}
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	eventTopic := n.topicPrefix + "/" + deviceId + "/" + notification.EventName()
+	if err := n.publish(ctx, eventTopic, false, payload); err != nil {
+		return err
+	}
+	if err := n.publish(ctx, eventTopic+"/state", false, "ON"); err != nil {
+		return err
+	}
+	// camera entity only accepts images
+	if notification.HasImage() {
+		image, err := os.ReadFile(notification.ClipFile)
+		if err != nil {
+			return err
+		}
+		if err := n.publish(ctx, n.topicPrefix+"/"+deviceId+"/snapshot", true, image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type mqttDiscoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+// https://www.home-assistant.io/integrations/binary_sensor.mqtt/
+type mqttBinarySensorConfig struct {
+	Name        string              `json:"name"`
+	UniqueId    string              `json:"unique_id"`
+	StateTopic  string              `json:"state_topic"`
+	DeviceClass string              `json:"device_class,omitempty"`
+	OffDelay    int                 `json:"off_delay"`
+	Device      mqttDiscoveryDevice `json:"device"`
+}
+
+// https://www.home-assistant.io/integrations/camera.mqtt/
+type mqttCameraConfig struct {
+	Name     string              `json:"name"`
+	UniqueId string              `json:"unique_id"`
+	Topic    string              `json:"topic"`
+	Device   mqttDiscoveryDevice `json:"device"`
+}
+
+func (n *MqttNotifier) publishDiscovery(ctx context.Context, deviceId string) error {
+	if len(n.discoveryPrefix) == 0 {
+		return nil
+	}
+	n.discoveredMu.Lock()
+	defer n.discoveredMu.Unlock()
+	if n.discovered[deviceId] {
+		return nil
+	}
+	device := mqttDiscoveryDevice{
+		Identifiers:  []string{"nest_" + deviceId},
+		Name:         "Nest " + deviceId,
+		Manufacturer: "Google Nest",
+	}
+	sensors := []struct {
+		event       string
+		name        string
+		deviceClass string
+	}{
+		{"chime", "Ding", "occupancy"},
+		{"motion", "Motion", "motion"},
+		{"person", "Person", "occupancy"},
+		{"sound", "Sound", "sound"},
+	}
+	for _, sensor := range sensors {
+		uniqueId := "nest_" + deviceId + "_" + sensor.event
+		config, err := json.Marshal(mqttBinarySensorConfig{
+			Name:        sensor.name,
+			UniqueId:    uniqueId,
+			StateTopic:  n.topicPrefix + "/" + deviceId + "/" + sensor.event + "/state",
+			DeviceClass: sensor.deviceClass,
+			OffDelay:    mqttBinarySensorOffDelay,
+			Device:      device,
+		})
+		if err != nil {
+			return err
+		}
+		if err := n.publish(ctx, n.discoveryPrefix+"/binary_sensor/"+uniqueId+"/config", true, config); err != nil {
+			return err
+		}
+	}
+	uniqueId := "nest_" + deviceId + "_snapshot"
+	config, err := json.Marshal(mqttCameraConfig{
+		Name:     "Snapshot",
+		UniqueId: uniqueId,
+		Topic:    n.topicPrefix + "/" + deviceId + "/snapshot",
+		Device:   device,
+	})
+	if err != nil {
+		return err
+	}
+	if err := n.publish(ctx, n.discoveryPrefix+"/camera/"+uniqueId+"/config", true, config); err != nil {
+		return err
+	}
+	n.discovered[deviceId] = true
+	return nil
+}
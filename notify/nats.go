@@ -0,0 +1,328 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publish events to NATS subjects <subjectPrefix>.<event name> e.g. nest.doorbell.chime. The payload is the
+// notification JSON like MQTT. JetStream streams capture the subjects as they are; with jetStream, publishes wait
+// for the ack of the stream so that events aren't lost silently.
+//
+// Speaks the text protocol of NATS directly (https://docs.nats.io/reference/reference-protocols/nats-protocol), since
+// publishing is all it needs.
+type NatsNotifier struct {
+	config NatsNotifierConfig
+	dial   func(ctx context.Context, network, address string) (net.Conn, error) // replaced by tests
+
+	mu     sync.Mutex // serializes publishes
+	conn   *natsConn  // nil until connected, or after it failed
+	closed bool
+}
+
+type NatsNotifierConfig struct {
+	Url           string `json:"url"`           // nats://host:4222, or tls://host:4222
+	SubjectPrefix string `json:"subjectPrefix"` // default nest.doorbell
+	User          string `json:"user"`          // optional
+	Password      string `json:"password"`
+	Token         string `json:"token"`     // optional
+	JetStream     bool   `json:"jetStream"` // wait for the PubAck of the stream capturing the subjects
+	Attempts      int    `json:"attempts"`
+}
+
+// Time to wait for the server's PONG or PubAck
+const natsTimeout = 10 * time.Second
+
+// max_payload of servers which don't tell theirs, the default of nats-server
+const natsDefaultMaxPayload = 1 << 20
+
+func newNatsNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := NatsNotifierConfig{SubjectPrefix: "nest.doorbell", Attempts: 3}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Url) == 0 {
+		return nil, fmt.Errorf("url is required")
+	}
+	if _, err := url.Parse(config.Url); err != nil {
+		return nil, fmt.Errorf("invalid url: %v", err)
+	}
+	config.SubjectPrefix = strings.TrimSuffix(config.SubjectPrefix, ".")
+	dialer := &net.Dialer{Timeout: natsTimeout}
+	return &NatsNotifier{config: config, dial: dialer.DialContext}, nil
+}
+
+func (n *NatsNotifier) Name() string {
+	return "nats(" + n.config.SubjectPrefix + ")"
+}
+
+func (n *NatsNotifier) Notify(ctx context.Context, notification *Notification) error {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	subject := n.config.SubjectPrefix + "." + notification.EventName()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return retryWithBackoff(ctx, n.config.Attempts, func() error {
+		return n.publish(ctx, subject, payload)
+	})
+}
+
+// Publish on the connection, reconnecting if needed. n.mu must be held
+func (n *NatsNotifier) publish(ctx context.Context, subject string, payload []byte) error {
+	if n.closed {
+		return fmt.Errorf("%v is closed", n.Name())
+	}
+	if n.conn == nil {
+		conn, err := n.connect(ctx)
+		if err != nil {
+			return err
+		}
+		n.conn = conn
+	}
+	if err := n.conn.Publish(ctx, subject, payload, n.config.JetStream); err != nil {
+		n.conn.Close()
+		n.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close the connection after the publish in progress, for notifiers discarded e.g. on config reload
+func (n *NatsNotifier) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+	return nil
+}
+
+type natsConn struct {
+	conn     net.Conn
+	inbox    string // prefix of reply subjects of PubAcks
+	writeMu  sync.Mutex
+	sequence int
+	replies  chan natsMessage // PubAck waited for, or an error of the server
+	maxSize  int              // max_payload of the server, which bounds MSGs
+	mu       sync.Mutex
+	awaiting string // reply subject of the PubAck waited for
+	closed   chan struct{}
+}
+
+type natsMessage struct {
+	subject string
+	payload []byte
+	err     error
+}
+
+func (n *NatsNotifier) connect(ctx context.Context) (*natsConn, error) {
+	config := &n.config
+	u, err := url.Parse(config.Url)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if len(u.Port()) == 0 {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	conn, err := n.dial(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	// INFO comes first, also before the TLS handshake
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting of %v: %q %v", host, line, err)
+	}
+	var info struct {
+		MaxPayload int `json:"max_payload"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("invalid INFO of %v: %v", host, err)
+	}
+	if info.MaxPayload <= 0 {
+		info.MaxPayload = natsDefaultMaxPayload
+	}
+	if u.Scheme == "tls" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(conn)
+	}
+	user, password := config.User, config.Password
+	if u.User != nil && len(user) == 0 {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "lang": "go", "version": "1", "protocol": 1, "name": "nest-doorbell-consumer"}
+	if len(user) > 0 {
+		options["user"], options["pass"] = user, password
+	}
+	if len(config.Token) > 0 {
+		options["auth_token"] = config.Token
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	c := &natsConn{conn: conn, inbox: "_INBOX." + hex.EncodeToString(id), replies: make(chan natsMessage, 1), maxSize: info.MaxPayload, closed: make(chan struct{})}
+	// PONG confirms CONNECT was accepted, otherwise -ERR comes
+	fmt.Fprintf(conn, "CONNECT %s\r\nSUB %v.* 1\r\nPING\r\n", connect, c.inbox)
+	for {
+		if line, err = reader.ReadString('\n'); err != nil || strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, fmt.Errorf("NATS server %v refused the connection: %v %v", host, strings.TrimSpace(line), err)
+		}
+		if line = strings.TrimSpace(line); line == "PONG" {
+			break
+		} else if line == "PING" {
+			io.WriteString(conn, "PONG\r\n")
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	go c.read(reader)
+	return c, nil
+}
+
+// Answer PINGs of the server and deliver MSGs to the inbox until the connection is closed
+func (c *natsConn) read(reader *bufio.Reader) {
+	defer close(c.closed)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			c.reply(natsMessage{err: err})
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PING":
+			c.write("PONG\r\n")
+		case strings.HasPrefix(line, "-ERR"):
+			// e.g. permission violations of a PUB, which has no reply without jetStream
+			log.Printf("NATS server error: %v", strings.TrimPrefix(line, "-ERR "))
+			c.reply(natsMessage{err: fmt.Errorf("NATS server error: %v", strings.TrimPrefix(line, "-ERR "))})
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line)
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || len(fields) < 4 || size < 0 {
+				c.reply(natsMessage{err: fmt.Errorf("invalid NATS message %q", line)})
+				return
+			}
+			if size > c.maxSize {
+				c.reply(natsMessage{err: fmt.Errorf("NATS message of %v bytes exceeds max_payload %v", size, c.maxSize)})
+				return
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				c.reply(natsMessage{err: err})
+				return
+			}
+			c.mu.Lock()
+			awaited := fields[1] == c.awaiting
+			c.mu.Unlock()
+			if awaited {
+				// others are late acks of publishes which timed out, which mustn't take the place of this one
+				c.reply(natsMessage{subject: fields[1], payload: payload[:size]})
+			}
+		}
+	}
+}
+
+// Drop replies nobody waits for e.g. after a timeout
+func (c *natsConn) reply(message natsMessage) {
+	select {
+	case c.replies <- message:
+	default:
+	}
+}
+
+func (c *natsConn) write(s string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+	_, err := io.WriteString(c.conn, s)
+	return err
+}
+
+// Publish payload to subject. With ack, wait for the PubAck of JetStream
+func (c *natsConn) Publish(ctx context.Context, subject string, payload []byte, ack bool) error {
+	if !ack {
+		return c.write(fmt.Sprintf("PUB %v %v\r\n%s\r\n", subject, len(payload), payload))
+	}
+	c.sequence++
+	reply := c.inbox + "." + strconv.Itoa(c.sequence)
+	c.mu.Lock()
+	c.awaiting = reply
+	c.mu.Unlock()
+	// stale replies of timed out publishes
+	select {
+	case <-c.replies:
+	default:
+	}
+	if err := c.write(fmt.Sprintf("PUB %v %v %v\r\n%s\r\n", subject, reply, len(payload), payload)); err != nil {
+		return err
+	}
+	timeout := time.NewTimer(natsTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return fmt.Errorf("no JetStream ack for %v. Is a stream capturing %v?", subject, subject)
+		case message := <-c.replies:
+			if message.err != nil {
+				return message.err
+			}
+			if message.subject != reply {
+				continue
+			}
+			var pubAck struct {
+				Stream string `json:"stream"`
+				Error  *struct {
+					Description string `json:"description"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(message.payload, &pubAck); err != nil {
+				return fmt.Errorf("invalid JetStream ack %q: %v", message.payload, err)
+			}
+			if pubAck.Error != nil {
+				return fmt.Errorf("JetStream refused %v: %v", subject, pubAck.Error.Description)
+			}
+			return nil
+		}
+	}
+}
+
+func (c *natsConn) Close() {
+	c.conn.Close()
+	<-c.closed
+}
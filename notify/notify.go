@@ -0,0 +1,234 @@
+// Package notify sends processed doorbell events to notification services.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+	"github.com/cormoran/NestDoorbellConsumer/tracing"
+)
+
+// Notification sent to notifiers when a doorbell event is processed
+type Notification struct {
+	EventType      sdmevents.ResourceUpdateEventType `json:"eventType"`
+	Event          *sdmevents.DeviceEvent            `json:"event"`
+	Device         string                            `json:"device"`               // "enterprises/project-id/devices/device-id"
+	DeviceName     string                            `json:"deviceName,omitempty"` // custom name of the device e.g. "Front door"
+	Room           string                            `json:"room,omitempty"`       // custom name of the room of the device e.g. "Porch"
+	Structure      string                            `json:"structure,omitempty"`  // custom name of the structure of the device e.g. "Home"
+	EventSessionId string                            `json:"eventSessionId"`
+	Timestamp      string                            `json:"timestamp"`              // DeviceEvent.Timestamp
+	ClipPath       string                            `json:"clipPath"`               // path of the saved clip relative to output dir. empty if no clip was saved
+	ClipUrl        string                            `json:"clipUrl"`                // URL of the saved clip. empty if no clip was saved or -clip-base-url is not given
+	ClipFile       string                            `json:"-"`                      // local path of the saved clip. empty if no clip was saved
+	FamiliarFace   string                            `json:"familiarFace,omitempty"` // name of recognized person in person events
+	Detections     []storage.Detection               `json:"detections,omitempty"`   // objects in the saved clip found by the analyzer, most confident first
+	Faces          []storage.Face                    `json:"faces,omitempty"`        // faces in the saved clip of person events found by the face recognizer
+	Frame          *storage.FrameSize                `json:"frame,omitempty"`        // size of the frame of Detections and Faces
+	Sounds         []string                          `json:"sounds,omitempty"`       // sounds heard in the saved clip by the audio tagger. nil if the audio wasn't analyzed
+	Summary        *Summary                          `json:"summary,omitempty"`      // digest of summary notifications
+	LatencyAlert   *LatencyAlert                     `json:"latencyAlert,omitempty"` // late event of latency notifications
+	Annotations    map[string]string                 `json:"annotations,omitempty"`  // added by plugins
+}
+
+// Short event name used in notifications and templates e.g. "chime"
+func (n *Notification) EventName() string {
+	return sdmevents.EventName(n.EventType)
+}
+
+// Custom name of the device with its room e.g. "Front door (Porch)", or Device if the name is unknown
+func (n *Notification) DeviceLabel() string {
+	if len(n.DeviceName) == 0 {
+		return n.Device
+	}
+	if len(n.Room) > 0 && n.Room != n.DeviceName {
+		return n.DeviceName + " (" + n.Room + ")"
+	}
+	return n.DeviceName
+}
+
+// Distinct labels of the detections e.g. "person, car"
+func (n *Notification) DetectedLabels() string {
+	labels := []string{}
+	for _, detection := range n.Detections {
+		if !slices.Contains(labels, detection.Label) {
+			labels = append(labels, detection.Label)
+		}
+	}
+	return strings.Join(labels, ", ")
+}
+
+// Sounds e.g. "knock, bark"
+func (n *Notification) HeardSounds() string {
+	return strings.Join(n.Sounds, ", ")
+}
+
+// Recognized faces e.g. "known: Alice", "unknown" or "known: Alice, unknown"
+func (n *Notification) FaceSummary() string {
+	known, unknown := []string{}, false
+	for _, face := range n.Faces {
+		if len(face.Name) == 0 {
+			unknown = true
+		} else if !slices.Contains(known, face.Name) {
+			known = append(known, face.Name)
+		}
+	}
+	summary := []string{}
+	if len(known) > 0 {
+		summary = append(summary, "known: "+strings.Join(known, ", "))
+	}
+	if unknown {
+		summary = append(summary, "unknown")
+	}
+	return strings.Join(summary, ", ")
+}
+
+type Notifier interface {
+	// Name used in logs
+	Name() string
+	Notify(ctx context.Context, notification *Notification) error
+}
+
+// Notifier with an id to select it by `test notify -sink <id>`
+type namedNotifier struct {
+	Notifier
+	id string
+}
+
+func NewNamedNotifier(notifier Notifier, id string) Notifier {
+	return &namedNotifier{Notifier: notifier, id: id}
+}
+
+// Id of notifier given by NewNamedNotifier, or its name
+func NotifierId(n Notifier) string {
+	if named, ok := n.(*namedNotifier); ok {
+		return named.id
+	}
+	return n.Name()
+}
+
+// Pass only notifications of listed event types to the wrapped notifier
+type eventFilterNotifier struct {
+	next   Notifier
+	events map[sdmevents.ResourceUpdateEventType]bool
+}
+
+func newEventFilterNotifier(next Notifier, eventNames []string) (*eventFilterNotifier, error) {
+	n := &eventFilterNotifier{next: next, events: map[sdmevents.ResourceUpdateEventType]bool{}}
+	for _, name := range eventNames {
+		eventType, ok := sdmevents.EventTypeByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown event type: %v", name)
+		}
+		n.events[eventType] = true
+	}
+	return n, nil
+}
+
+func (n *eventFilterNotifier) Name() string {
+	return n.next.Name()
+}
+
+func (n *eventFilterNotifier) Notify(ctx context.Context, notification *Notification) error {
+	if !n.events[notification.EventType] {
+		return nil
+	}
+	return n.next.Notify(ctx, notification)
+}
+
+// Default text of chat/push notifications
+const defaultMessageTemplate = `{{if .Summary}}{{.Summary.Text}}{{else if .LatencyAlert}}{{.LatencyAlert.Text}}{{else}}Doorbell {{.EventName}}{{if .FamiliarFace}} ({{.FamiliarFace}}){{end}}{{if .Faces}} ({{.FaceSummary}}){{end}}{{if .Detections}} [{{.DetectedLabels}}]{{end}}{{if .Sounds}} ({{.HeardSounds}} heard){{end}} at {{.DeviceLabel}} ({{.Timestamp}}){{if .ClipUrl}}
+{{.ClipUrl}}{{end}}{{end}}`
+
+// Parse message template given in the config. Empty text means defaultMessageTemplate.
+func parseMessageTemplate(text string) (*template.Template, error) {
+	if len(text) == 0 {
+		text = defaultMessageTemplate
+	}
+	return template.New("message").Funcs(webhookTemplateFuncs).Parse(text)
+}
+
+func renderMessage(t *template.Template, notification *Notification) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, notification); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Replace each key of values in s with its value
+func ReplacePlaceholders(s string, values map[string]string) string {
+	for key, value := range values {
+		s = strings.ReplaceAll(s, key, value)
+	}
+	return s
+}
+
+// Returns true if the saved clip is an image (snapshot) rather than a video
+func (n *Notification) HasImage() bool {
+	return len(n.ClipFile) > 0 && strings.HasPrefix(mime.TypeByExtension(filepath.Ext(n.ClipFile)), "image/")
+}
+
+// Send notification to all notifiers in parallel. Failures are logged and don't stop other notifiers. Returns an
+// error naming the failed notifiers, if any.
+func NotifyAll(ctx context.Context, notifiers []Notifier, notification *Notification) error {
+	ctx, span := tracing.Start(ctx, "notify", tracing.Int("notify.notifiers", int64(len(notifiers))))
+	defer span.End()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := []string{}
+	for _, notifier := range notifiers {
+		wg.Add(1)
+		go func(notifier Notifier) {
+			defer wg.Done()
+			ctx, span := tracing.Start(ctx, "notifier", tracing.String("notifier.name", notifier.Name()))
+			defer span.End()
+			if err := notifier.Notify(ctx, notification); err != nil {
+				span.RecordError(err)
+				log.Printf("Failed to notify %v via %v: %v", notification.EventName(), notifier.Name(), err)
+				mu.Lock()
+				failed = append(failed, notifier.Name())
+				mu.Unlock()
+			}
+		}(notifier)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		err := fmt.Errorf("failed to notify via %v", strings.Join(failed, ", "))
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// Call f up to attempts times with exponential backoff starting from 1 second.
+func retryWithBackoff(ctx context.Context, attempts int, f func() error) error {
+	var err error
+	backoff := time.Second
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		if attempt == attempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// Request received by a recordingServer
+type recordedRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// JSON body decoded into a map
+func (r recordedRequest) json(t *testing.T) map[string]any {
+	t.Helper()
+	var body map[string]any
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		t.Fatalf("invalid JSON body of %v %q: %v", r.Path, r.Body, err)
+	}
+	return body
+}
+
+// Fields and files (field => file name and content) of a multipart/form-data body
+func (r recordedRequest) form(t *testing.T) (map[string]string, map[string][2]string) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		t.Fatalf("content type of %v = %q, want multipart/form-data", r.Path, r.Header.Get("Content-Type"))
+	}
+	fields, files := map[string]string{}, map[string][2]string{}
+	reader := multipart.NewReader(bytes.NewReader(r.Body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return fields, files
+		}
+		if err != nil {
+			t.Fatalf("invalid multipart body of %v: %v", r.Path, err)
+		}
+		b, _ := io.ReadAll(part)
+		if len(part.FileName()) > 0 {
+			files[part.FormName()] = [2]string{part.FileName(), string(b)}
+		} else {
+			fields[part.FormName()] = string(b)
+		}
+	}
+}
+
+// HTTP server recording the requests of notifiers, answering them by respond
+type recordingServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []recordedRequest
+	respond  func(r recordedRequest) (int, string) // status and body
+}
+
+func newRecordingServer(t *testing.T, respond func(r recordedRequest) (int, string)) *recordingServer {
+	s := &recordingServer{respond: respond}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request := recordedRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Header: r.Header.Clone(), Body: body}
+		s.mu.Lock()
+		s.requests = append(s.requests, request)
+		respond := s.respond
+		s.mu.Unlock()
+		status, answer := respond(request)
+		w.WriteHeader(status)
+		io.WriteString(w, answer)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Respond to every request with status and body
+func answering(status int, body string) func(recordedRequest) (int, string) {
+	return func(recordedRequest) (int, string) { return status, body }
+}
+
+// Answer every later request with status and body
+func (s *recordingServer) answer(status int, body string) {
+	s.respondBy(answering(status, body))
+}
+
+// Answer every later request by respond
+func (s *recordingServer) respondBy(respond func(r recordedRequest) (int, string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.respond = respond
+}
+
+// Requests received so far, cleared
+func (s *recordingServer) take() []recordedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := s.requests
+	s.requests = nil
+	return requests
+}
@@ -0,0 +1,118 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Publish to ntfy (https://ntfy.sh or self-hosted). The saved snapshot/clip is uploaded as attachment when attachImage is true.
+type NtfyNotifier struct {
+	config   NtfyNotifierConfig
+	template *template.Template
+}
+
+type NtfyNotifierConfig struct {
+	Server      string            `json:"server"` // default https://ntfy.sh
+	Topic       string            `json:"topic"`
+	Token       string            `json:"token"`      // access token. optional
+	Priorities  map[string]string `json:"priorities"` // event name => min, low, default, high or urgent
+	Template    string            `json:"template"`   // go text/template of message
+	AttachImage bool              `json:"attachImage"`
+	Attempts    int               `json:"attempts"`
+}
+
+var defaultNtfyPriorities = map[string]string{
+	"chime":  "high",
+	"person": "high",
+	"motion": "default",
+}
+
+func newNtfyNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := NtfyNotifierConfig{Server: "https://ntfy.sh", Attempts: 3}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Topic) == 0 {
+		return nil, fmt.Errorf("topic is required")
+	}
+	t, err := parseMessageTemplate(config.Template)
+	if err != nil {
+		return nil, err
+	}
+	return &NtfyNotifier{config: config, template: t}, nil
+}
+
+func (n *NtfyNotifier) Name() string {
+	return "ntfy(" + n.config.Topic + ")"
+}
+
+func (n *NtfyNotifier) priority(eventName string) string {
+	if p, ok := n.config.Priorities[eventName]; ok {
+		return p
+	}
+	if p, ok := defaultNtfyPriorities[eventName]; ok {
+		return p
+	}
+	return "default"
+}
+
+// https://docs.ntfy.sh/publish/
+func (n *NtfyNotifier) Notify(ctx context.Context, notification *Notification) error {
+	message, err := renderMessage(n.template, notification)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(n.config.Server, "/") + "/" + n.config.Topic
+	var attachment []byte
+	if n.config.AttachImage && len(notification.ClipFile) > 0 {
+		attachment, err = os.ReadFile(notification.ClipFile)
+		if err != nil {
+			return err
+		}
+	}
+	return retryWithBackoff(ctx, n.config.Attempts, func() error {
+		var req *http.Request
+		var err error
+		if attachment != nil {
+			// attachment is sent as body, so message goes to header
+			req, err = http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(attachment))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Filename", filepath.Base(notification.ClipFile))
+			req.Header.Set("Message", strings.ReplaceAll(message, "\n", "\\n"))
+		} else {
+			req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(message))
+			if err != nil {
+				return err
+			}
+		}
+		req.Header.Set("Title", "Doorbell "+notification.EventName())
+		req.Header.Set("Priority", n.priority(notification.EventName()))
+		req.Header.Set("Tags", notification.EventName())
+		if len(notification.ClipUrl) > 0 {
+			req.Header.Set("Click", notification.ClipUrl)
+		}
+		if len(n.config.Token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+n.config.Token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status code %v", resp.Status)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,95 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+func newTestNtfyNotifier(t *testing.T, config NtfyNotifierConfig) Notifier {
+	config.Topic, config.Template, config.Attempts = "doorbell", "ring {{.Timestamp}}\nat the door", 1
+	raw, _ := json.Marshal(config)
+	n, err := newNtfyNotifierFromConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestNtfyNotify(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusOK, `{"id":"x"}`))
+	n := newTestNtfyNotifier(t, NtfyNotifierConfig{Server: server.URL + "/", Token: "tk_secret", Priorities: map[string]string{"motion": "low"}})
+	for _, c := range []struct {
+		eventType sdmevents.ResourceUpdateEventType
+		priority  string
+	}{
+		{sdmevents.ResourceUpdateEventTypeDoorbellChime, "high"},
+		{sdmevents.ResourceUpdateEventTypeCameraMotion, "low"},
+		{sdmevents.ResourceUpdateEventTypeCameraSound, "default"},
+	} {
+		notification := &Notification{EventType: c.eventType, Timestamp: "10:00", ClipUrl: "https://nest.example.com/clip.mp4"}
+		if err := n.Notify(context.Background(), notification); err != nil {
+			t.Fatal(err)
+		}
+		requests := server.take()
+		if len(requests) != 1 || requests[0].Method != http.MethodPost || requests[0].Path != "/doorbell" {
+			t.Fatalf("requests = %+v, want POST to the topic", requests)
+		}
+		r := requests[0]
+		if string(r.Body) != "ring 10:00\nat the door" {
+			t.Errorf("body = %q, want the message", r.Body)
+		}
+		name := notification.EventName()
+		if r.Header.Get("Title") != "Doorbell "+name || r.Header.Get("Priority") != c.priority || r.Header.Get("Tags") != name || r.Header.Get("Click") != notification.ClipUrl {
+			t.Errorf("headers of %v = %v, want priority %v", name, r.Header, c.priority)
+		}
+		if r.Header.Get("Authorization") != "Bearer tk_secret" {
+			t.Errorf("Authorization = %q, want the token", r.Header.Get("Authorization"))
+		}
+	}
+}
+
+func TestNtfyNotifyWithClip(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusOK, `{"id":"x"}`))
+	n := newTestNtfyNotifier(t, NtfyNotifierConfig{Server: server.URL, AttachImage: true})
+	if err := n.Notify(context.Background(), &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Timestamp: "10:00", ClipFile: writeTestClip(t, "snapshot.jpg")}); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.take()
+	if len(requests) != 1 || requests[0].Method != http.MethodPut || requests[0].Path != "/doorbell" {
+		t.Fatalf("requests = %+v, want PUT to the topic", requests)
+	}
+	// the clip is the body, so the message moves to a header with escaped new lines
+	r := requests[0]
+	if string(r.Body) != "clip of snapshot.jpg" || r.Header.Get("Filename") != "snapshot.jpg" || r.Header.Get("Message") != `ring 10:00\nat the door` {
+		t.Errorf("body = %q, headers = %v, want the clip with the message header", r.Body, r.Header)
+	}
+	if len(r.Header.Get("Authorization")) > 0 || len(r.Header.Get("Click")) > 0 {
+		t.Errorf("headers = %v, want no Authorization and Click", r.Header)
+	}
+}
+
+func TestNtfyErrors(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusUnauthorized, `{"code":40101,"error":"unauthorized"}`))
+	n := newTestNtfyNotifier(t, NtfyNotifierConfig{Server: server.URL})
+	if err := n.Notify(context.Background(), &Notification{}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Notify answered 401 = %v, want the status", err)
+	}
+	server.take()
+	n = newTestNtfyNotifier(t, NtfyNotifierConfig{Server: server.URL, AttachImage: true})
+	if err := n.Notify(context.Background(), &Notification{ClipFile: "/nonexistent/clip.mp4"}); err == nil {
+		t.Error("Notify of a missing clip succeeded, want error")
+	}
+	if requests := server.take(); len(requests) != 0 {
+		t.Errorf("%v requests, want none for the missing clip", len(requests))
+	}
+	for _, config := range []string{`{}`, `{"topic":"doorbell","template":"{{"}`} {
+		if _, err := newNtfyNotifierFromConfig(json.RawMessage(config)); err == nil {
+			t.Errorf("config %v succeeded, want error", config)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Version of the plugin protocol sent in every request. Incremented only on incompatible changes
+const PluginProtocolVersion = 1
+
+// Don't restart a plugin which exited more often than this
+const pluginRestartInterval = 10 * time.Second
+
+// Long running executable which gets each notification as a JSON line on stdin before it's sent, and answers a JSON
+// line on stdout to forward or suppress it, optionally with annotations or changed fields. Lines on stderr go to the log.
+//
+//	> {"protocol":1,"id":"1","notification":{"eventType":"...","device":"...",...},"clipFile":"/output/.../x.mp4"}
+//	< {"id":"1","action":"suppress","reason":"a cat","annotations":{"animal":"cat"}}
+//
+// The plugin is started on the first notification and restarted when it exits. Notifications are forwarded as they
+// are when it fails or doesn't answer in time, so a broken plugin never drops events.
+type Plugin struct {
+	name    string
+	command []string
+	events  map[sdmevents.ResourceUpdateEventType]bool // nil means every event
+	timeout time.Duration
+
+	mu        sync.Mutex // one request at a time
+	cmd       *exec.Cmd  // nil if not running
+	stdin     io.WriteCloser
+	responses chan PluginResponse
+	exited    chan struct{}
+	startedAt time.Time
+	nextId    int64
+}
+
+type PluginConfig struct {
+	Name    string   `json:"name"`    // used in logs. defaults to the program
+	Command []string `json:"command"` // program and its arguments. not run through shell
+	Events  []string `json:"events"`  // event types passed to the plugin. empty means every event
+	Timeout Duration `json:"timeout"` // wait for the answer to each notification. default 5s
+}
+
+type pluginRequest struct {
+	Protocol     int           `json:"protocol"`
+	Id           string        `json:"id"`
+	Notification *Notification `json:"notification"`
+	ClipFile     string        `json:"clipFile,omitempty"` // local path of the saved clip
+}
+
+// Answer of a plugin to a request
+type PluginResponse struct {
+	Id           string            `json:"id"`           // of the request
+	Action       string            `json:"action"`       // forward (default) or suppress
+	Reason       string            `json:"reason"`       // logged when suppressed
+	Annotations  map[string]string `json:"annotations"`  // merged into Notification.Annotations
+	Notification json.RawMessage   `json:"notification"` // fields to change, e.g. {"familiarFace":"Alice"}
+}
+
+func NewPlugin(config PluginConfig) (*Plugin, error) {
+	if len(config.Command) == 0 {
+		return nil, fmt.Errorf("command is required")
+	}
+	p := &Plugin{name: config.Name, command: config.Command, timeout: time.Duration(config.Timeout)}
+	if len(p.name) == 0 {
+		p.name = config.Command[0]
+	}
+	if p.timeout <= 0 {
+		p.timeout = 5 * time.Second
+	}
+	if len(config.Events) > 0 {
+		p.events = map[sdmevents.ResourceUpdateEventType]bool{}
+		for _, name := range config.Events {
+			eventType, ok := sdmevents.EventTypeByName(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown event type: %v", name)
+			}
+			p.events[eventType] = true
+		}
+	}
+	return p, nil
+}
+
+// Create plugins from entries of "plugins" in the config file
+func CreatePlugins(configs []PluginConfig) ([]*Plugin, error) {
+	plugins := []*Plugin{}
+	for i, config := range configs {
+		plugin, err := NewPlugin(config)
+		if err != nil {
+			return nil, fmt.Errorf("plugins[%v]: %v", i, err)
+		}
+		plugins = append(plugins, plugin)
+	}
+	return plugins, nil
+}
+
+func (p *Plugin) Name() string {
+	return p.name
+}
+
+// Pass notification to the plugin and add its annotations. Returns the reason if the plugin suppresses it, or an
+// error if the plugin can't answer, in which case the notification should be forwarded.
+func (p *Plugin) Process(ctx context.Context, notification *Notification) (string, error) {
+	if p.events != nil && !p.events[notification.EventType] {
+		return "", nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// e.g. canceled while waiting for the previous request
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := p.start(); err != nil {
+		return "", err
+	}
+	p.nextId++
+	id := strconv.FormatInt(p.nextId, 10)
+	line, err := json.Marshal(pluginRequest{Protocol: PluginProtocolVersion, Id: id, Notification: notification, ClipFile: notification.ClipFile})
+	if err != nil {
+		return "", err
+	}
+	if _, err := p.stdin.Write(append(line, '\n')); err != nil {
+		p.stop()
+		return "", err
+	}
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case response := <-p.responses:
+			if response.Id != id {
+				// late answer of a request which timed out
+				continue
+			}
+			return response.Apply(notification)
+		case <-p.exited:
+			p.stop()
+			return "", fmt.Errorf("exited")
+		case <-timer.C:
+			return "", fmt.Errorf("no answer in %v", p.timeout)
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// Change notification by the response, which can be applied to any notification of the event. Returns the reason if
+// it's suppressed
+func (r *PluginResponse) Apply(notification *Notification) (string, error) {
+	if r.Action != "" && r.Action != "forward" && r.Action != "suppress" {
+		return "", fmt.Errorf("unknown action %q", r.Action)
+	}
+	if len(r.Notification) > 0 {
+		// on a deep copy, as events and maps may be shared with other notifications
+		b, err := json.Marshal(notification)
+		if err != nil {
+			return "", err
+		}
+		changed := Notification{ClipFile: notification.ClipFile}
+		if err := json.Unmarshal(b, &changed); err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal(r.Notification, &changed); err != nil {
+			return "", fmt.Errorf("invalid notification: %v", err)
+		}
+		*notification = changed
+	}
+	if len(r.Annotations) > 0 {
+		annotations := maps.Clone(notification.Annotations)
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		maps.Copy(annotations, r.Annotations)
+		notification.Annotations = annotations
+	}
+	if r.Action == "suppress" {
+		if len(r.Reason) == 0 {
+			return "suppressed", nil
+		}
+		return r.Reason, nil
+	}
+	return "", nil
+}
+
+// Start the process unless it's running. Called with mu held
+func (p *Plugin) start() error {
+	if p.cmd != nil {
+		return nil
+	}
+	if since := time.Since(p.startedAt); since < pluginRestartInterval {
+		return fmt.Errorf("not running, restarting in %v", (pluginRestartInterval - since).Round(time.Second))
+	}
+	p.startedAt = time.Now()
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("Started plugin %v (pid %v)", p.name, cmd.Process.Pid)
+	responses := make(chan PluginResponse, 16)
+	exited := make(chan struct{})
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Printf("[plugin %v] %v", p.name, scanner.Text())
+		}
+	}()
+	go func() {
+		defer close(exited)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var response PluginResponse
+			if err := json.Unmarshal(scanner.Bytes(), &response); err != nil {
+				log.Printf("Ignored invalid answer of plugin %v: %v", p.name, err)
+				continue
+			}
+			select {
+			case responses <- response:
+			default:
+				// nobody waits for it
+			}
+		}
+		<-stderrDone
+		log.Printf("Plugin %v exited: %v", p.name, cmd.Wait())
+	}()
+	p.cmd, p.stdin, p.responses, p.exited = cmd, stdin, responses, exited
+	return nil
+}
+
+// Kill the process. Called with mu held
+func (p *Plugin) stop() {
+	if p.cmd == nil {
+		return
+	}
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	p.cmd = nil
+}
+
+// Close stdin of the plugin so that it can exit
+func (p *Plugin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == nil {
+		return nil
+	}
+	err := p.stdin.Close()
+	p.cmd = nil
+	return err
+}
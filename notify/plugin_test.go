@@ -0,0 +1,233 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Not a test: the plugin started by the tests below, run as "<test binary> -test.run=TestPluginHelperProcess -- <mode>"
+//
+//	echo            answer each request with annotations of what it got, suppress notifications of device "cat"
+//	slow            answer request 1 late, after the next request arrived
+//	crash-once f    exit without answering the first request unless file f exists, which it creates, then echo
+//	garbage         print an invalid line before each answer
+func TestPluginHelperProcess(t *testing.T) {
+	if os.Getenv("NEST_PLUGIN_HELPER") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	mode := args[1]
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, 1<<20)
+	if mode == "crash-once" {
+		if _, err := os.Stat(args[2]); err != nil {
+			// after the request was written, so that the plugin sees the exit rather than a broken pipe
+			scanner.Scan()
+			os.WriteFile(args[2], nil, 0666)
+			fmt.Fprintln(os.Stderr, "crashing")
+			os.Exit(1)
+		}
+		mode = "echo"
+	}
+	for scanner.Scan() {
+		var request pluginRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		response := PluginResponse{Id: request.Id, Annotations: map[string]string{
+			"protocol": fmt.Sprint(request.Protocol),
+			"id":       request.Id,
+			"device":   request.Notification.Device,
+			"clipFile": request.ClipFile,
+		}}
+		if request.Notification.Device == "cat" {
+			response.Action, response.Reason = "suppress", "a cat"
+		}
+		switch {
+		case mode == "slow" && request.Id == "1":
+			// answered with the next one
+			continue
+		case mode == "slow" && request.Id == "2":
+			b, _ := json.Marshal(PluginResponse{Id: "1", Action: "suppress", Reason: "late"})
+			fmt.Println(string(b))
+		case mode == "garbage":
+			fmt.Println("not json")
+		}
+		b, _ := json.Marshal(response)
+		fmt.Println(string(b))
+	}
+	os.Exit(0)
+}
+
+func newHelperPlugin(t *testing.T, config PluginConfig, mode ...string) *Plugin {
+	t.Helper()
+	t.Setenv("NEST_PLUGIN_HELPER", "1")
+	config.Command = append([]string{os.Args[0], "-test.run=^TestPluginHelperProcess$", "--"}, mode...)
+	p, err := NewPlugin(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.mu.Lock()
+		p.stop()
+		p.mu.Unlock()
+	})
+	return p
+}
+
+func testPluginNotification(device string) *Notification {
+	return &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Device: device, ClipFile: "/output/clip.mp4"}
+}
+
+func TestPluginProcess(t *testing.T) {
+	p := newHelperPlugin(t, PluginConfig{Name: "echo"}, "echo")
+	for i, c := range []struct {
+		device string
+		reason string
+	}{
+		{"front", ""},
+		{"cat", "a cat"},
+		{"back", ""},
+	} {
+		n := testPluginNotification(c.device)
+		reason, err := p.Process(context.Background(), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"protocol": "1", "id": fmt.Sprint(i + 1), "device": c.device, "clipFile": "/output/clip.mp4"}
+		if reason != c.reason || !reflect.DeepEqual(n.Annotations, want) {
+			t.Errorf("Process(%v) = %q with annotations %v, want %q with %v", c.device, reason, n.Annotations, c.reason, want)
+		}
+	}
+}
+
+func TestPluginEvents(t *testing.T) {
+	p := newHelperPlugin(t, PluginConfig{Events: []string{"motion"}}, "echo")
+	n := testPluginNotification("front")
+	if reason, err := p.Process(context.Background(), n); reason != "" || err != nil || n.Annotations != nil {
+		t.Errorf("Process(chime) = %q, %v with annotations %v, want it passed as it is", reason, err, n.Annotations)
+	}
+	if p.cmd != nil {
+		t.Error("plugin started for an event it doesn't get")
+	}
+	if _, err := NewPlugin(PluginConfig{Command: []string{"true"}, Events: []string{"doorknock"}}); err == nil {
+		t.Error("unknown event type should fail")
+	}
+	if _, err := NewPlugin(PluginConfig{}); err == nil {
+		t.Error("plugin without command should fail")
+	}
+}
+
+// A request answered after its timeout doesn't answer the next one
+func TestPluginTimeout(t *testing.T) {
+	p := newHelperPlugin(t, PluginConfig{Timeout: Duration(200 * time.Millisecond)}, "slow")
+	if _, err := p.Process(context.Background(), testPluginNotification("front")); err == nil || !strings.Contains(err.Error(), "no answer in 200ms") {
+		t.Fatalf("error = %v, want no answer", err)
+	}
+	n := testPluginNotification("back")
+	reason, err := p.Process(context.Background(), n)
+	if err != nil || reason != "" || n.Annotations["id"] != "2" {
+		t.Errorf("Process() = %q, %v with annotations %v, want the answer of request 2", reason, err, n.Annotations)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.Process(ctx, testPluginNotification("front")); err != context.Canceled {
+		t.Errorf("error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestPluginRestart(t *testing.T) {
+	p := newHelperPlugin(t, PluginConfig{}, "crash-once", filepath.Join(t.TempDir(), "crashed"))
+	if _, err := p.Process(context.Background(), testPluginNotification("front")); err == nil || err.Error() != "exited" {
+		t.Fatalf("error = %v, want exited", err)
+	}
+	if _, err := p.Process(context.Background(), testPluginNotification("front")); err == nil || !strings.Contains(err.Error(), "restarting in") {
+		t.Fatalf("error = %v, want not restarted yet", err)
+	}
+	p.mu.Lock()
+	p.startedAt = time.Now().Add(-pluginRestartInterval)
+	p.mu.Unlock()
+	n := testPluginNotification("front")
+	if reason, err := p.Process(context.Background(), n); reason != "" || err != nil || n.Annotations["device"] != "front" {
+		t.Errorf("Process() after restart = %q, %v with annotations %v", reason, err, n.Annotations)
+	}
+}
+
+func TestPluginInvalidAnswers(t *testing.T) {
+	p := newHelperPlugin(t, PluginConfig{}, "garbage")
+	n := testPluginNotification("cat")
+	if reason, err := p.Process(context.Background(), n); reason != "a cat" || err != nil {
+		t.Errorf("Process() = %q, %v, want the answer after the invalid line", reason, err)
+	}
+	missing := &Plugin{name: "missing", command: []string{filepath.Join(t.TempDir(), "missing")}, timeout: time.Second}
+	if _, err := missing.Process(context.Background(), testPluginNotification("front")); err == nil {
+		t.Error("missing program should fail")
+	}
+}
+
+// Closing stdin lets the plugin exit
+func TestPluginClose(t *testing.T) {
+	p := newHelperPlugin(t, PluginConfig{}, "echo")
+	if _, err := p.Process(context.Background(), testPluginNotification("front")); err != nil {
+		t.Fatal(err)
+	}
+	exited := p.exited
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Error("plugin didn't exit after Close")
+	}
+}
+
+func TestPluginResponseApply(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		response PluginResponse
+		reason   string
+		err      string
+		want     Notification
+	}{
+		{"forward", PluginResponse{}, "", "", Notification{DeviceName: "Front", Annotations: map[string]string{"a": "1"}}},
+		{"forward explicitly", PluginResponse{Action: "forward"}, "", "", Notification{DeviceName: "Front", Annotations: map[string]string{"a": "1"}}},
+		{"suppress", PluginResponse{Action: "suppress"}, "suppressed", "", Notification{DeviceName: "Front", Annotations: map[string]string{"a": "1"}}},
+		{"suppress with reason", PluginResponse{Action: "suppress", Reason: "a cat"}, "a cat", "", Notification{DeviceName: "Front", Annotations: map[string]string{"a": "1"}}},
+		{"annotate", PluginResponse{Annotations: map[string]string{"a": "2", "b": "3"}}, "", "", Notification{DeviceName: "Front", Annotations: map[string]string{"a": "2", "b": "3"}}},
+		{"change fields", PluginResponse{Notification: json.RawMessage(`{"familiarFace":"Alice","deviceName":"Porch"}`)}, "", "", Notification{DeviceName: "Porch", FamiliarFace: "Alice", Annotations: map[string]string{"a": "1"}}},
+		{"unknown action", PluginResponse{Action: "drop"}, "", `unknown action "drop"`, Notification{}},
+		{"invalid notification", PluginResponse{Notification: json.RawMessage(`{"deviceName":1}`)}, "", "invalid notification", Notification{}},
+	} {
+		annotations := map[string]string{"a": "1"}
+		n := Notification{DeviceName: "Front", ClipFile: "/output/clip.mp4", Annotations: annotations}
+		reason, err := c.response.Apply(&n)
+		if len(c.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%v: error = %v, want %q", c.name, err, c.err)
+			}
+			continue
+		}
+		c.want.ClipFile = "/output/clip.mp4"
+		if err != nil || reason != c.reason || !reflect.DeepEqual(n, c.want) {
+			t.Errorf("%v: Apply() = %q, %v with %+v, want %q with %+v", c.name, reason, err, n, c.reason, c.want)
+		}
+		if annotations["a"] != "1" || len(annotations) != 1 {
+			t.Errorf("%v: changed the annotations of the notification it was applied to: %v", c.name, annotations)
+		}
+	}
+}
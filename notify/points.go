@@ -0,0 +1,33 @@
+package notify
+
+import (
+	"os"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Data point of an event for time series databases (influxdb and remotewrite notifiers)
+type eventPoint struct {
+	Event     string // chime, motion, person, sound
+	Device    string // device id
+	Time      time.Time
+	Clip      bool
+	ClipBytes int64         // size of the saved clip
+	Latency   time.Duration // from the event to its notification, including the clip download. 0 if unknown
+}
+
+func newEventPoint(notification *Notification) eventPoint {
+	point := eventPoint{Event: notification.EventName(), Device: sdmevents.DeviceId(notification.Device), Time: time.Now()}
+	if t, err := time.Parse(time.RFC3339Nano, notification.Timestamp); err == nil {
+		point.Latency = point.Time.Sub(t)
+		point.Time = t
+	}
+	if len(notification.ClipFile) > 0 {
+		if info, err := os.Stat(notification.ClipFile); err == nil {
+			point.Clip = true
+			point.ClipBytes = info.Size()
+		}
+	}
+	return point
+}
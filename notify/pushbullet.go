@@ -0,0 +1,97 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"text/template"
+)
+
+// Push note (or link to the saved clip when its URL is known) via Pushbullet
+type PushbulletNotifier struct {
+	config   PushbulletNotifierConfig
+	template *template.Template
+	apiUrl   string // replaced by tests
+}
+
+type PushbulletNotifierConfig struct {
+	Token      string `json:"token"`       // access token
+	DeviceIden string `json:"device_iden"` // push to the device only. optional
+	ChannelTag string `json:"channel_tag"` // push to channel subscribers. optional
+	Template   string `json:"template"`    // go text/template of body
+	Attempts   int    `json:"attempts"`
+}
+
+const pushbulletApiUrl = "https://api.pushbullet.com/v2/pushes"
+
+func newPushbulletNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := PushbulletNotifierConfig{Attempts: 3}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Token) == 0 {
+		return nil, fmt.Errorf("token is required")
+	}
+	t, err := parseMessageTemplate(config.Template)
+	if err != nil {
+		return nil, err
+	}
+	return &PushbulletNotifier{config: config, template: t, apiUrl: pushbulletApiUrl}, nil
+}
+
+func (n *PushbulletNotifier) Name() string {
+	return "pushbullet"
+}
+
+// https://docs.pushbullet.com/#create-push
+type pushbulletPush struct {
+	Type       string `json:"type"` // note or link
+	Title      string `json:"title"`
+	Body       string `json:"body"`
+	Url        string `json:"url,omitempty"`
+	DeviceIden string `json:"device_iden,omitempty"`
+	ChannelTag string `json:"channel_tag,omitempty"`
+}
+
+func (n *PushbulletNotifier) Notify(ctx context.Context, notification *Notification) error {
+	body, err := renderMessage(n.template, notification)
+	if err != nil {
+		return err
+	}
+	push := pushbulletPush{
+		Type:       "note",
+		Title:      "Doorbell " + notification.EventName(),
+		Body:       body,
+		DeviceIden: n.config.DeviceIden,
+		ChannelTag: n.config.ChannelTag,
+	}
+	if len(notification.ClipUrl) > 0 {
+		push.Type = "link"
+		push.Url = notification.ClipUrl
+	}
+	payload, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+	return retryWithBackoff(ctx, n.config.Attempts, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.apiUrl, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Access-Token", n.config.Token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status code %v", resp.Status)
+		}
+		return nil
+	})
+}
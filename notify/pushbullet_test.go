@@ -0,0 +1,62 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+func newTestPushbulletNotifier(t *testing.T, server *recordingServer, config PushbulletNotifierConfig) *PushbulletNotifier {
+	config.Token, config.Template, config.Attempts = "o.secret", "ring {{.Timestamp}}", 1
+	raw, _ := json.Marshal(config)
+	n, err := newPushbulletNotifierFromConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.(*PushbulletNotifier).apiUrl = server.URL + "/v2/pushes"
+	return n.(*PushbulletNotifier)
+}
+
+func TestPushbulletNotify(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusOK, `{"active":true}`))
+	n := newTestPushbulletNotifier(t, server, PushbulletNotifierConfig{DeviceIden: "phone"})
+	for _, c := range []struct {
+		notification *Notification
+		want         string
+	}{
+		{&Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Timestamp: "10:00"}, `{"type":"note","title":"Doorbell chime","body":"ring 10:00","device_iden":"phone"}`},
+		// links to the saved clip when its URL is known
+		{&Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Timestamp: "10:00", ClipUrl: "https://nest.example.com/clip.mp4"}, `{"type":"link","title":"Doorbell chime","body":"ring 10:00","url":"https://nest.example.com/clip.mp4","device_iden":"phone"}`},
+	} {
+		if err := n.Notify(context.Background(), c.notification); err != nil {
+			t.Fatal(err)
+		}
+		requests := server.take()
+		if len(requests) != 1 || requests[0].Method != http.MethodPost || requests[0].Path != "/v2/pushes" {
+			t.Fatalf("requests = %+v, want POST of pushes", requests)
+		}
+		if r := requests[0]; r.Header.Get("Access-Token") != "o.secret" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("headers = %v, want the access token", r.Header)
+		}
+		if string(requests[0].Body) != c.want {
+			t.Errorf("body = %s, want %s", requests[0].Body, c.want)
+		}
+	}
+}
+
+func TestPushbulletErrors(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusUnauthorized, `{"error":{"code":"invalid_access_token"}}`))
+	n := newTestPushbulletNotifier(t, server, PushbulletNotifierConfig{})
+	if err := n.Notify(context.Background(), &Notification{}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Notify answered 401 = %v, want the status", err)
+	}
+	for _, config := range []string{`{}`, `{"token":"t","template":"{{"}`} {
+		if _, err := newPushbulletNotifierFromConfig(json.RawMessage(config)); err == nil {
+			t.Errorf("config %v succeeded, want error", config)
+		}
+	}
+}
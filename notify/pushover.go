@@ -0,0 +1,114 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+)
+
+// Send message via Pushover. The saved snapshot is attached with Pushover's image attachment API when attachImage is true.
+type PushoverNotifier struct {
+	config   PushoverNotifierConfig
+	template *template.Template
+	apiUrl   string // replaced by tests
+}
+
+type PushoverNotifierConfig struct {
+	Token       string         `json:"token"` // application API token
+	User        string         `json:"user"`  // user or group key
+	Device      string         `json:"device"`
+	Priorities  map[string]int `json:"priorities"` // event name => -2..2
+	Template    string         `json:"template"`   // go text/template of message
+	AttachImage bool           `json:"attachImage"`
+	Attempts    int            `json:"attempts"`
+}
+
+const pushoverApiUrl = "https://api.pushover.net/1/messages.json"
+
+// Pushover rejects attachments larger than this
+const pushoverMaxAttachmentBytes = 2621440
+
+var defaultPushoverPriorities = map[string]int{
+	"chime":  1,
+	"person": 0,
+	"motion": -1,
+}
+
+func newPushoverNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := PushoverNotifierConfig{Attempts: 3}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Token) == 0 || len(config.User) == 0 {
+		return nil, fmt.Errorf("token and user are required")
+	}
+	t, err := parseMessageTemplate(config.Template)
+	if err != nil {
+		return nil, err
+	}
+	return &PushoverNotifier{config: config, template: t, apiUrl: pushoverApiUrl}, nil
+}
+
+func (n *PushoverNotifier) Name() string {
+	return "pushover"
+}
+
+// https://pushover.net/api
+func (n *PushoverNotifier) Notify(ctx context.Context, notification *Notification) error {
+	message, err := renderMessage(n.template, notification)
+	if err != nil {
+		return err
+	}
+	priority, ok := n.config.Priorities[notification.EventName()]
+	if !ok {
+		priority = defaultPushoverPriorities[notification.EventName()]
+	}
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	fields := map[string]string{
+		"token":    n.config.Token,
+		"user":     n.config.User,
+		"title":    "Doorbell " + notification.EventName(),
+		"message":  message,
+		"priority": strconv.Itoa(priority),
+	}
+	if len(n.config.Device) > 0 {
+		fields["device"] = n.config.Device
+	}
+	if len(notification.ClipUrl) > 0 {
+		fields["url"] = notification.ClipUrl
+	}
+	for key, value := range fields {
+		if err := writer.WriteField(key, value); err != nil {
+			return err
+		}
+	}
+	if n.config.AttachImage && notification.HasImage() {
+		if stat, err := os.Stat(notification.ClipFile); err == nil && stat.Size() <= pushoverMaxAttachmentBytes {
+			part, err := writer.CreateFormFile("attachment", filepath.Base(notification.ClipFile))
+			if err != nil {
+				return err
+			}
+			file, err := os.Open(notification.ClipFile)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			if _, err := io.Copy(part, file); err != nil {
+				return err
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return postWithRetry(ctx, http.DefaultClient, n.config.Attempts, n.apiUrl, writer.FormDataContentType(), body.Bytes())
+}
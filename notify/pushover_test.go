@@ -0,0 +1,97 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+func newTestPushoverNotifier(t *testing.T, server *recordingServer, config PushoverNotifierConfig) *PushoverNotifier {
+	config.Token, config.User, config.Template, config.Attempts = "app-token", "user-key", "ring {{.Timestamp}}", 1
+	raw, _ := json.Marshal(config)
+	n, err := newPushoverNotifierFromConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.(*PushoverNotifier).apiUrl = server.URL + "/1/messages.json"
+	return n.(*PushoverNotifier)
+}
+
+func TestPushoverNotify(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusOK, `{"status":1}`))
+	n := newTestPushoverNotifier(t, server, PushoverNotifierConfig{Device: "phone", Priorities: map[string]int{"motion": -2}})
+	for _, c := range []struct {
+		eventType sdmevents.ResourceUpdateEventType
+		priority  string
+	}{
+		{sdmevents.ResourceUpdateEventTypeDoorbellChime, "1"},
+		{sdmevents.ResourceUpdateEventTypeCameraMotion, "-2"},
+		{sdmevents.ResourceUpdateEventTypeCameraSound, "0"},
+	} {
+		notification := &Notification{EventType: c.eventType, Timestamp: "10:00", ClipUrl: "https://nest.example.com/clip.mp4"}
+		if err := n.Notify(context.Background(), notification); err != nil {
+			t.Fatal(err)
+		}
+		requests := server.take()
+		if len(requests) != 1 || requests[0].Method != http.MethodPost || requests[0].Path != "/1/messages.json" {
+			t.Fatalf("requests = %+v, want POST of messages.json", requests)
+		}
+		fields, files := requests[0].form(t)
+		want := map[string]string{"token": "app-token", "user": "user-key", "device": "phone", "title": "Doorbell " + notification.EventName(), "message": "ring 10:00", "priority": c.priority, "url": notification.ClipUrl}
+		for key, value := range want {
+			if fields[key] != value {
+				t.Errorf("%v of %v = %q, want %q", key, notification.EventName(), fields[key], value)
+			}
+		}
+		if len(files) != 0 {
+			t.Errorf("files = %v, want none", files)
+		}
+	}
+}
+
+func TestPushoverNotifyWithImage(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusOK, `{"status":1}`))
+	n := newTestPushoverNotifier(t, server, PushoverNotifierConfig{AttachImage: true})
+	large := writeTestClip(t, "large.jpg")
+	if err := os.Truncate(large, pushoverMaxAttachmentBytes+1); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		clip string
+		want [2]string
+	}{
+		{writeTestClip(t, "snapshot.jpg"), [2]string{"snapshot.jpg", "clip of snapshot.jpg"}},
+		// videos and images Pushover would reject aren't attached
+		{writeTestClip(t, "clip.mp4"), [2]string{}},
+		{large, [2]string{}},
+	} {
+		if err := n.Notify(context.Background(), &Notification{Timestamp: "10:00", ClipFile: c.clip}); err != nil {
+			t.Fatal(err)
+		}
+		requests := server.take()
+		if len(requests) != 1 {
+			t.Fatalf("%v requests, want 1", len(requests))
+		}
+		if fields, files := requests[0].form(t); files["attachment"] != c.want || fields["message"] != "ring 10:00" {
+			t.Errorf("attachment of %v = %v, want %v", c.clip, files["attachment"], c.want)
+		}
+	}
+}
+
+func TestPushoverErrors(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusBadRequest, `{"user":"invalid","errors":["user identifier is invalid"],"status":0}`))
+	n := newTestPushoverNotifier(t, server, PushoverNotifierConfig{})
+	if err := n.Notify(context.Background(), &Notification{}); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("Notify answered 400 = %v, want the status", err)
+	}
+	for _, config := range []string{`{"token":"t"}`, `{"user":"u"}`, `{"token":"t","user":"u","template":"{{"}`} {
+		if _, err := newPushoverNotifierFromConfig(json.RawMessage(config)); err == nil {
+			t.Errorf("config %v succeeded, want error", config)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Push samples of each event via Prometheus remote write (Prometheus with --web.enable-remote-write-receiver, Mimir,
+// VictoriaMetrics, Grafana Cloud etc.) at the time of the event, so that doorbell activity can be charted over years
+// without scraping the consumer:
+//   - nest_doorbell_event{event, device} 1
+//   - nest_doorbell_event_clip_bytes{event, device}: size of the saved clip, 0 without clip
+//   - nest_doorbell_event_latency_seconds{event, device}: from the event to its notification, including the clip download
+//
+// e.g. sum by (event) (count_over_time(nest_doorbell_event[1d])) charts events per day.
+type RemoteWriteNotifier struct {
+	config RemoteWriteNotifierConfig
+	client *http.Client
+}
+
+type RemoteWriteNotifierConfig struct {
+	Url         string            `json:"url"` // e.g. http://prometheus:9090/api/v1/write
+	Username    string            `json:"username"`
+	Password    string            `json:"password"`
+	BearerToken string            `json:"bearerToken"`
+	Headers     map[string]string `json:"headers"` // e.g. X-Scope-OrgID of Mimir
+	Labels      map[string]string `json:"labels"`  // added to every series e.g. {"instance": "home"}
+	Attempts    int               `json:"attempts"`
+}
+
+func newRemoteWriteNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := RemoteWriteNotifierConfig{Attempts: 3}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Url) == 0 {
+		return nil, fmt.Errorf("url is required")
+	}
+	return &RemoteWriteNotifier{config: config, client: http.DefaultClient}, nil
+}
+
+func (n *RemoteWriteNotifier) Name() string {
+	return "remotewrite(" + n.config.Url + ")"
+}
+
+func (n *RemoteWriteNotifier) Notify(ctx context.Context, notification *Notification) error {
+	point := newEventPoint(notification)
+	labels := map[string]string{"event": point.Event, "device": point.Device}
+	for k, v := range n.config.Labels {
+		labels[k] = v
+	}
+	samples := map[string]float64{
+		"nest_doorbell_event":            1,
+		"nest_doorbell_event_clip_bytes": float64(point.ClipBytes),
+	}
+	if point.Latency > 0 {
+		samples["nest_doorbell_event_latency_seconds"] = point.Latency.Seconds()
+	}
+	body := snappyEncode(remoteWriteRequest(samples, labels, point.Time.UnixMilli()))
+	return retryWithBackoff(ctx, n.config.Attempts, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.config.Url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		for k, v := range n.config.Headers {
+			req.Header.Set(k, v)
+		}
+		if len(n.config.BearerToken) > 0 {
+			req.Header.Set("Authorization", "Bearer "+n.config.BearerToken)
+		} else if len(n.config.Username) > 0 {
+			req.SetBasicAuth(n.config.Username, n.config.Password)
+		}
+		resp, err := n.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status code %v: %s", resp.Status, bytes.TrimSpace(b))
+		}
+		return nil
+	})
+}
+
+// prometheus.WriteRequest of a sample per metric name, encoded by hand since it's the only message
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label { string name = 1; string value = 2; }
+//	Sample { double value = 1; int64 timestamp = 2; }
+func remoteWriteRequest(samples map[string]float64, labels map[string]string, timestamp int64) []byte {
+	names := make([]string, 0, len(samples))
+	for name := range samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var request []byte
+	for _, name := range names {
+		// labels sorted by name, which puts __name__ first
+		seriesLabels := map[string]string{"__name__": name}
+		for k, v := range labels {
+			if len(v) > 0 {
+				seriesLabels[k] = v
+			}
+		}
+		keys := make([]string, 0, len(seriesLabels))
+		for k := range seriesLabels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var series []byte
+		for _, k := range keys {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, k)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, seriesLabels[k])
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(samples[name]))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(timestamp))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, series)
+	}
+	return request
+}
+
+// Snappy block format of only literals. Requests are small, so compression isn't worth a dependency
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		n := min(len(src), 1<<16)
+		// literal of n bytes with the length in the 2 bytes after the tag
+		dst = append(dst, 61<<2, byte(n-1), byte((n-1)>>8))
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
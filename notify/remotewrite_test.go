@@ -0,0 +1,141 @@
+package notify
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Sample of a decoded remote write request
+type remoteWriteSample struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// Decode the snappy literals of snappyEncode and the WriteRequest in them, keyed by __name__
+func decodeRemoteWrite(t *testing.T, body []byte) map[string]remoteWriteSample {
+	t.Helper()
+	size, n := binary.Uvarint(body)
+	var request []byte
+	for body = body[n:]; len(body) >= 3 && body[0] == 61<<2; {
+		length := int(body[1]) | int(body[2])<<8 + 1
+		request = append(request, body[3:3+length]...)
+		body = body[3+length:]
+	}
+	if len(body) > 0 || uint64(len(request)) != size {
+		t.Fatalf("invalid snappy body, %v bytes left", len(body))
+	}
+	// each field is length delimited but the fixed64 value and varint timestamp of samples
+	fields := func(b []byte, f func(num protowire.Number, value []byte, varint uint64)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatal("invalid protobuf")
+			}
+			b = b[n:]
+			var value []byte
+			var varint uint64
+			switch typ {
+			case protowire.BytesType:
+				value, n = protowire.ConsumeBytes(b)
+			case protowire.Fixed64Type:
+				varint, n = protowire.ConsumeFixed64(b)
+			case protowire.VarintType:
+				varint, n = protowire.ConsumeVarint(b)
+			default:
+				t.Fatalf("unexpected wire type %v", typ)
+			}
+			if n < 0 {
+				t.Fatal("invalid protobuf")
+			}
+			f(num, value, varint)
+			b = b[n:]
+		}
+	}
+	samples := map[string]remoteWriteSample{}
+	fields(request, func(_ protowire.Number, series []byte, _ uint64) {
+		sample := remoteWriteSample{labels: map[string]string{}}
+		fields(series, func(num protowire.Number, value []byte, _ uint64) {
+			if num == 1 {
+				var label [2]string
+				fields(value, func(num protowire.Number, value []byte, _ uint64) { label[num-1] = string(value) })
+				sample.labels[label[0]] = label[1]
+				return
+			}
+			fields(value, func(num protowire.Number, _ []byte, v uint64) {
+				if num == 1 {
+					sample.value = math.Float64frombits(v)
+				} else {
+					sample.timestamp = int64(v)
+				}
+			})
+		})
+		samples[sample.labels["__name__"]] = sample
+	})
+	return samples
+}
+
+func TestRemoteWriteNotify(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusNoContent, ""))
+	raw, _ := json.Marshal(RemoteWriteNotifierConfig{Url: server.URL + "/api/v1/write", BearerToken: "bearer", Headers: map[string]string{"X-Scope-OrgID": "home"}, Labels: map[string]string{"instance": "pi"}, Attempts: 1})
+	n, err := newRemoteWriteNotifierFromConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification := &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Device: "enterprises/p/devices/front", Timestamp: "2024-01-02T10:00:00.123Z", ClipFile: writeTestClip(t, "clip.mp4")}
+	if err := n.Notify(context.Background(), notification); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.take()
+	if len(requests) != 1 || requests[0].Method != http.MethodPost || requests[0].Path != "/api/v1/write" {
+		t.Fatalf("requests = %+v, want POST of /api/v1/write", requests)
+	}
+	r := requests[0]
+	for key, value := range map[string]string{"Content-Type": "application/x-protobuf", "Content-Encoding": "snappy", "X-Prometheus-Remote-Write-Version": "0.1.0", "Authorization": "Bearer bearer", "X-Scope-OrgID": "home"} {
+		if r.Header.Get(key) != value {
+			t.Errorf("%v = %q, want %q", key, r.Header.Get(key), value)
+		}
+	}
+	samples := decodeRemoteWrite(t, r.Body)
+	for name, value := range map[string]float64{"nest_doorbell_event": 1, "nest_doorbell_event_clip_bytes": 16, "nest_doorbell_event_latency_seconds": -1} {
+		sample, ok := samples[name]
+		if !ok {
+			t.Errorf("no %v in %v", name, samples)
+			continue
+		}
+		// the latency depends on the time of the test
+		if (value >= 0 && sample.value != value) || sample.value <= 0 || sample.timestamp != 1704189600123 {
+			t.Errorf("%v = %v at %v, want %v at 1704189600123", name, sample.value, sample.timestamp, value)
+		}
+		if len(sample.labels) != 4 || sample.labels["event"] != "chime" || sample.labels["device"] != "front" || sample.labels["instance"] != "pi" {
+			t.Errorf("labels of %v = %v", name, sample.labels)
+		}
+	}
+}
+
+func TestRemoteWriteErrors(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusBadRequest, "out of order sample\n"))
+	raw, _ := json.Marshal(RemoteWriteNotifierConfig{Url: server.URL, Username: "user", Password: "pass", Attempts: 1})
+	n, err := newRemoteWriteNotifierFromConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), &Notification{}); err == nil || !strings.Contains(err.Error(), "400") || !strings.Contains(err.Error(), "out of order sample") {
+		t.Errorf("Notify answered 400 = %v, want the status and the message", err)
+	}
+	if requests := server.take(); len(requests) != 1 || requests[0].Header.Get("Authorization") != "Basic dXNlcjpwYXNz" {
+		t.Errorf("requests = %+v, want basic auth", requests)
+	}
+	if _, err := newRemoteWriteNotifierFromConfig(json.RawMessage(`{}`)); err == nil {
+		t.Error("config without url succeeded, want error")
+	}
+}
@@ -0,0 +1,212 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+// Duration in config file written as go duration string e.g. "5m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type QuietHoursConfig struct {
+	Window string   `json:"window"` // HH:MM-HH:MM
+	Events []string `json:"events"` // events suppressed in the window. empty means every event
+}
+
+// Declarative notification rules given in the config file, globally ("rules") or per notifier ("rules" in notifier entry)
+type NotificationRulesConfig struct {
+	Events         []string            `json:"events"`         // notify only these events. empty means every event
+	Devices        []string            `json:"devices"`        // notify only events from these devices (id or full name). empty means every device
+	ExcludeDevices []string            `json:"excludeDevices"` // never notify events from these devices
+	QuietHours     []QuietHoursConfig  `json:"quietHours"`
+	Cooldowns      map[string]Duration `json:"cooldowns"`   // event name => minimum interval between notifications per device
+	Faces          []string            `json:"faces"`       // notify only events with these faces: known, unknown or names of the gallery. events without recognized faces pass
+	Sounds         []string            `json:"sounds"`      // notify only events with these sounds e.g. knock. events whose audio wasn't analyzed pass
+	MotionZones    map[string][]Zone   `json:"motionZones"` // device (id or full name) => zones. motion events with detections only outside the zones are suppressed
+}
+
+type quietHours struct {
+	window DailyWindow
+	events map[sdmevents.ResourceUpdateEventType]bool // empty means every event
+}
+
+type NotificationRules struct {
+	events         map[sdmevents.ResourceUpdateEventType]bool
+	devices        map[string]bool
+	excludeDevices map[string]bool
+	quietHours     []quietHours
+	cooldowns      map[sdmevents.ResourceUpdateEventType]time.Duration
+	faces          map[string]bool
+	sounds         map[string]bool
+	motionZones    map[string][]Zone
+	lastNotifiedMu sync.Mutex
+	lastNotified   map[string]time.Time // device + event type => last notification time
+}
+
+func parseEventNames(names []string) (map[sdmevents.ResourceUpdateEventType]bool, error) {
+	eventTypes := map[sdmevents.ResourceUpdateEventType]bool{}
+	for _, name := range names {
+		eventType, ok := sdmevents.EventTypeByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown event type: %v", name)
+		}
+		eventTypes[eventType] = true
+	}
+	return eventTypes, nil
+}
+
+func NewNotificationRules(config *NotificationRulesConfig) (*NotificationRules, error) {
+	events, err := parseEventNames(config.Events)
+	if err != nil {
+		return nil, err
+	}
+	rules := &NotificationRules{
+		events:         events,
+		devices:        map[string]bool{},
+		excludeDevices: map[string]bool{},
+		cooldowns:      map[sdmevents.ResourceUpdateEventType]time.Duration{},
+		faces:          map[string]bool{},
+		sounds:         map[string]bool{},
+		motionZones:    map[string][]Zone{},
+		lastNotified:   map[string]time.Time{},
+	}
+	for _, sound := range config.Sounds {
+		rules.sounds[sound] = true
+	}
+	for device, zones := range config.MotionZones {
+		for _, zone := range zones {
+			if err := zone.validate(); err != nil {
+				return nil, fmt.Errorf("motion zones of %v: %v", device, err)
+			}
+		}
+		rules.motionZones[device] = zones
+	}
+	for _, face := range config.Faces {
+		rules.faces[face] = true
+	}
+	for _, device := range config.Devices {
+		rules.devices[device] = true
+	}
+	for _, device := range config.ExcludeDevices {
+		rules.excludeDevices[device] = true
+	}
+	for _, q := range config.QuietHours {
+		window, err := ParseDailyWindow(q.Window)
+		if err != nil {
+			return nil, err
+		}
+		events, err := parseEventNames(q.Events)
+		if err != nil {
+			return nil, err
+		}
+		rules.quietHours = append(rules.quietHours, quietHours{window: window, events: events})
+	}
+	for name, cooldown := range config.Cooldowns {
+		eventType, ok := sdmevents.EventTypeByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown event type: %v", name)
+		}
+		rules.cooldowns[eventType] = time.Duration(cooldown)
+	}
+	return rules, nil
+}
+
+func (r *NotificationRules) matchesDevice(devices map[string]bool, device string) bool {
+	return devices[device] || devices[sdmevents.DeviceId(device)]
+}
+
+func (r *NotificationRules) matchesFaces(faces []storage.Face) bool {
+	for _, face := range faces {
+		if (len(face.Name) == 0 && r.faces["unknown"]) || (len(face.Name) > 0 && (r.faces["known"] || r.faces[face.Name])) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns empty string if notification is allowed at now, otherwise the reason of suppression.
+// Allowed notifications start the cooldown.
+func (r *NotificationRules) Check(notification *Notification, now time.Time) string {
+	if r == nil {
+		return ""
+	}
+	if len(r.events) > 0 && !r.events[notification.EventType] {
+		return "event filter"
+	}
+	// summaries are of every device
+	if len(r.devices) > 0 && len(notification.Device) > 0 && !r.matchesDevice(r.devices, notification.Device) {
+		return "device filter"
+	}
+	if r.matchesDevice(r.excludeDevices, notification.Device) {
+		return "excluded device"
+	}
+	if len(r.faces) > 0 && len(notification.Faces) > 0 && !r.matchesFaces(notification.Faces) {
+		return "face filter"
+	}
+	if len(r.sounds) > 0 && notification.Sounds != nil && !slices.ContainsFunc(notification.Sounds, func(sound string) bool { return r.sounds[sound] }) {
+		return "sound filter"
+	}
+	if notification.EventType == sdmevents.ResourceUpdateEventTypeCameraMotion {
+		zones, ok := r.motionZones[notification.Device]
+		if !ok {
+			zones, ok = r.motionZones[sdmevents.DeviceId(notification.Device)]
+		}
+		if ok && !notification.detectedInZones(zones) {
+			return "outside motion zones"
+		}
+	}
+	for _, q := range r.quietHours {
+		if (len(q.events) == 0 || q.events[notification.EventType]) && q.window.Contains(now) {
+			return "quiet hours"
+		}
+	}
+	if cooldown, ok := r.cooldowns[notification.EventType]; ok {
+		key := notification.Device + "/" + string(notification.EventType)
+		r.lastNotifiedMu.Lock()
+		defer r.lastNotifiedMu.Unlock()
+		if last, ok := r.lastNotified[key]; ok && now.Sub(last) < cooldown {
+			return "cooldown"
+		}
+		r.lastNotified[key] = now
+	}
+	return ""
+}
+
+// Apply per notifier rules
+type rulesNotifier struct {
+	next  Notifier
+	rules *NotificationRules
+}
+
+func (n *rulesNotifier) Name() string {
+	return n.next.Name()
+}
+
+func (n *rulesNotifier) Notify(ctx context.Context, notification *Notification) error {
+	if reason := n.rules.Check(notification, time.Now()); len(reason) > 0 {
+		log.Printf("Suppressed %v notification via %v: %v", notification.EventName(), n.next.Name(), reason)
+		return nil
+	}
+	return n.next.Notify(ctx, notification)
+}
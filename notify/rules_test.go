@@ -0,0 +1,146 @@
+package notify
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+const (
+	frontDoor = "enterprises/project/devices/front"
+	backDoor  = "enterprises/project/devices/back"
+)
+
+func mustRules(t *testing.T, config *NotificationRulesConfig) *NotificationRules {
+	t.Helper()
+	rules, err := NewNotificationRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestNewNotificationRulesErrors(t *testing.T) {
+	for name, config := range map[string]*NotificationRulesConfig{
+		"event":             {Events: []string{"doorknock"}},
+		"quiet hours":       {QuietHours: []QuietHoursConfig{{Window: "22:00"}}},
+		"quiet hours event": {QuietHours: []QuietHoursConfig{{Window: "22:00-06:00", Events: []string{"doorknock"}}}},
+		"cooldown":          {Cooldowns: map[string]Duration{"doorknock": Duration(time.Minute)}},
+		"motion zone":       {MotionZones: map[string][]Zone{"front": {{{0, 0}, {1, 1}}}}},
+	} {
+		if _, err := NewNotificationRules(config); err == nil {
+			t.Errorf("invalid %v is accepted", name)
+		}
+	}
+}
+
+func TestNotificationRulesCheck(t *testing.T) {
+	night := time.Date(2024, 3, 4, 23, 0, 0, 0, time.UTC)
+	day := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	chime := &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Device: frontDoor}
+	motion := &Notification{EventType: sdmevents.ResourceUpdateEventTypeCameraMotion, Device: frontDoor}
+	// a car in the bottom right quarter of the frame
+	detectedMotion := &Notification{
+		EventType:  sdmevents.ResourceUpdateEventTypeCameraMotion,
+		Device:     frontDoor,
+		Frame:      &storage.FrameSize{Width: 100, Height: 100},
+		Detections: []storage.Detection{{Label: "car", XMin: 60, YMin: 60, XMax: 90, YMax: 90}},
+	}
+	topLeft := []Zone{{{0, 0}, {0.5, 0}, {0.5, 0.5}, {0, 0.5}}}
+	for _, c := range []struct {
+		name         string
+		config       *NotificationRulesConfig
+		notification *Notification
+		now          time.Time
+		want         string
+	}{
+		{"no rules", &NotificationRulesConfig{}, chime, night, ""},
+		{"event", &NotificationRulesConfig{Events: []string{"person"}}, chime, day, "event filter"},
+		{"event listed", &NotificationRulesConfig{Events: []string{"chime"}}, chime, day, ""},
+		{"device by id", &NotificationRulesConfig{Devices: []string{"back"}}, chime, day, "device filter"},
+		{"device by name", &NotificationRulesConfig{Devices: []string{frontDoor}}, chime, day, ""},
+		// summaries have no device
+		{"device of summary", &NotificationRulesConfig{Devices: []string{"back"}}, &Notification{EventType: sdmevents.ResourceUpdateEventTypeSummary}, day, ""},
+		{"excluded device", &NotificationRulesConfig{ExcludeDevices: []string{"front"}}, chime, day, "excluded device"},
+		{"unknown face", &NotificationRulesConfig{Faces: []string{"known"}}, &Notification{Faces: []storage.Face{{}}}, day, "face filter"},
+		{"known face", &NotificationRulesConfig{Faces: []string{"Alice"}}, &Notification{Faces: []storage.Face{{}, {Name: "Alice"}}}, day, ""},
+		{"no face", &NotificationRulesConfig{Faces: []string{"known"}}, chime, day, ""},
+		{"sound", &NotificationRulesConfig{Sounds: []string{"knock"}}, &Notification{Sounds: []string{"bark"}}, day, "sound filter"},
+		{"no sound heard", &NotificationRulesConfig{Sounds: []string{"knock"}}, &Notification{Sounds: []string{}}, day, "sound filter"},
+		{"audio not analyzed", &NotificationRulesConfig{Sounds: []string{"knock"}}, chime, day, ""},
+		{"quiet hours", &NotificationRulesConfig{QuietHours: []QuietHoursConfig{{Window: "22:00-06:00"}}}, chime, night, "quiet hours"},
+		{"out of quiet hours", &NotificationRulesConfig{QuietHours: []QuietHoursConfig{{Window: "22:00-06:00"}}}, chime, day, ""},
+		{"quiet hours of other events", &NotificationRulesConfig{QuietHours: []QuietHoursConfig{{Window: "22:00-06:00", Events: []string{"motion"}}}}, chime, night, ""},
+		{"quiet hours of the event", &NotificationRulesConfig{QuietHours: []QuietHoursConfig{{Window: "22:00-06:00", Events: []string{"motion"}}}}, motion, night, "quiet hours"},
+		{"motion outside zones", &NotificationRulesConfig{MotionZones: map[string][]Zone{"front": topLeft}}, detectedMotion, day, "outside motion zones"},
+		{"motion without detections", &NotificationRulesConfig{MotionZones: map[string][]Zone{"front": topLeft}}, motion, day, ""},
+		{"zones of other device", &NotificationRulesConfig{MotionZones: map[string][]Zone{"back": topLeft}}, detectedMotion, day, ""},
+	} {
+		if got := mustRules(t, c.config).Check(c.notification, c.now); got != c.want {
+			t.Errorf("%v: Check = %q, want %q", c.name, got, c.want)
+		}
+	}
+	var none *NotificationRules
+	if got := none.Check(chime, night); got != "" {
+		t.Errorf("nil rules: Check = %q, want allowed", got)
+	}
+}
+
+// Filters are checked in order and the first one suppressing the notification is the reason. Cooldown comes last,
+// so that suppressed notifications don't start it
+func TestNotificationRulesOrder(t *testing.T) {
+	config := &NotificationRulesConfig{
+		Events:         []string{"chime", "motion"},
+		Devices:        []string{"front"},
+		ExcludeDevices: []string{"back"},
+		QuietHours:     []QuietHoursConfig{{Window: "22:00-06:00"}},
+		Cooldowns:      map[string]Duration{"chime": Duration(time.Minute)},
+	}
+	night := time.Date(2024, 3, 4, 23, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		notification *Notification
+		want         string
+	}{
+		{&Notification{EventType: sdmevents.ResourceUpdateEventTypeCameraPerson, Device: backDoor}, "event filter"},
+		{&Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Device: backDoor}, "device filter"},
+		{&Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Device: frontDoor}, "quiet hours"},
+	} {
+		if got := mustRules(t, config).Check(c.notification, night); got != c.want {
+			t.Errorf("Check(%v of %v) = %q, want %q", c.notification.EventName(), c.notification.Device, got, c.want)
+		}
+	}
+
+	rules := mustRules(t, config)
+	chime := &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Device: frontDoor}
+	if got := rules.Check(chime, night); got != "quiet hours" {
+		t.Fatalf("Check in quiet hours = %q", got)
+	}
+	morning := time.Date(2024, 3, 5, 6, 0, 0, 0, time.UTC)
+	if got := rules.Check(chime, morning); got != "" {
+		t.Fatalf("first chime after quiet hours = %q, want allowed without cooldown", got)
+	}
+	if got := rules.Check(chime, morning.Add(30*time.Second)); got != "cooldown" {
+		t.Errorf("chime in cooldown = %q, want cooldown", got)
+	}
+	// per device
+	if got := rules.Check(&Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Device: "enterprises/project/devices/front2"}, morning); got != "device filter" {
+		t.Errorf("chime of other device = %q", got)
+	}
+	// the suppressed chime didn't restart the cooldown
+	if got := rules.Check(chime, morning.Add(time.Minute)); got != "" {
+		t.Errorf("chime after cooldown = %q, want allowed", got)
+	}
+}
+
+func TestRulesNotifier(t *testing.T) {
+	next := &fakeNotifier{}
+	n := &rulesNotifier{next: next, rules: mustRules(t, &NotificationRulesConfig{Events: []string{"chime"}})}
+	n.Notify(context.Background(), &Notification{EventType: sdmevents.ResourceUpdateEventTypeCameraMotion, Timestamp: "motion"})
+	n.Notify(context.Background(), &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Timestamp: "chime"})
+	if _, sent := next.calls(); len(sent) != 1 || sent[0] != "chime" {
+		t.Errorf("sent %v, want only chime", sent)
+	}
+}
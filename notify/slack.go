@@ -0,0 +1,85 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+)
+
+// Post message to Slack incoming webhook.
+// Incoming webhooks can't upload files, so an image is attached as image block only when its public URL (ClipUrl) is known.
+type SlackNotifier struct {
+	url         string
+	template    *template.Template
+	attachImage bool
+	attempts    int
+}
+
+type SlackNotifierConfig struct {
+	Url         string `json:"url"`      // https://hooks.slack.com/services/...
+	Template    string `json:"template"` // go text/template of message text
+	AttachImage bool   `json:"attachImage"`
+	Attempts    int    `json:"attempts"`
+}
+
+func newSlackNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := SlackNotifierConfig{Attempts: 3}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Url) == 0 {
+		return nil, fmt.Errorf("url is required")
+	}
+	t, err := parseMessageTemplate(config.Template)
+	if err != nil {
+		return nil, err
+	}
+	return &SlackNotifier{url: config.Url, template: t, attachImage: config.AttachImage, attempts: config.Attempts}, nil
+}
+
+func (n *SlackNotifier) Name() string {
+	return "slack"
+}
+
+// https://api.slack.com/messaging/webhooks
+type slackMessage struct {
+	Text   string        `json:"text"`
+	Blocks []interface{} `json:"blocks,omitempty"`
+}
+
+type slackTextObject struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackSectionBlock struct {
+	Type string          `json:"type"`
+	Text slackTextObject `json:"text"`
+}
+
+type slackImageBlock struct {
+	Type     string `json:"type"`
+	ImageUrl string `json:"image_url"`
+	AltText  string `json:"alt_text"`
+}
+
+func (n *SlackNotifier) Notify(ctx context.Context, notification *Notification) error {
+	text, err := renderMessage(n.template, notification)
+	if err != nil {
+		return err
+	}
+	message := slackMessage{Text: text}
+	if n.attachImage && notification.HasImage() && len(notification.ClipUrl) > 0 {
+		message.Blocks = []interface{}{
+			slackSectionBlock{Type: "section", Text: slackTextObject{Type: "mrkdwn", Text: text}},
+			slackImageBlock{Type: "image", ImageUrl: notification.ClipUrl, AltText: notification.EventName()},
+		}
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return postWithRetry(ctx, http.DefaultClient, n.attempts, n.url, "application/json", payload)
+}
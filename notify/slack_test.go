@@ -0,0 +1,59 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newTestSlackNotifier(t *testing.T, url string, attachImage bool) Notifier {
+	raw, _ := json.Marshal(SlackNotifierConfig{Url: url, Template: "ring {{.Timestamp}}", AttachImage: attachImage, Attempts: 1})
+	n, err := newSlackNotifierFromConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSlackNotify(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusOK, "ok"))
+	snapshot := &Notification{Timestamp: "10:00", ClipFile: "/data/snapshot.jpg", ClipUrl: "https://nest.example.com/snapshot.jpg"}
+	for _, c := range []struct {
+		attachImage  bool
+		notification *Notification
+		want         string
+	}{
+		{false, snapshot, `{"text":"ring 10:00"}`},
+		{true, snapshot, `{"text":"ring 10:00","blocks":[{"type":"section","text":{"type":"mrkdwn","text":"ring 10:00"}},{"type":"image","image_url":"https://nest.example.com/snapshot.jpg","alt_text":""}]}`},
+		// webhooks can't upload, so images without a public URL and videos are sent as text
+		{true, &Notification{Timestamp: "10:00", ClipFile: "/data/snapshot.jpg"}, `{"text":"ring 10:00"}`},
+		{true, &Notification{Timestamp: "10:00", ClipFile: "/data/clip.mp4", ClipUrl: "https://nest.example.com/clip.mp4"}, `{"text":"ring 10:00"}`},
+	} {
+		n := newTestSlackNotifier(t, server.URL+"/services/T/B/X", c.attachImage)
+		if err := n.Notify(context.Background(), c.notification); err != nil {
+			t.Fatal(err)
+		}
+		requests := server.take()
+		if len(requests) != 1 || requests[0].Method != http.MethodPost || requests[0].Path != "/services/T/B/X" || requests[0].Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("requests = %+v, want a JSON POST to the webhook", requests)
+		}
+		if string(requests[0].Body) != c.want {
+			t.Errorf("body of %+v (attachImage %v) = %s, want %s", c.notification, c.attachImage, requests[0].Body, c.want)
+		}
+	}
+}
+
+func TestSlackErrors(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusForbidden, "invalid_token"))
+	n := newTestSlackNotifier(t, server.URL, false)
+	if err := n.Notify(context.Background(), &Notification{}); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Notify answered 403 = %v, want the status", err)
+	}
+	for _, config := range []string{`{}`, `{"url":"http://localhost","template":"{{"}`} {
+		if _, err := newSlackNotifierFromConfig(json.RawMessage(config)); err == nil {
+			t.Errorf("config %v succeeded, want error", config)
+		}
+	}
+}
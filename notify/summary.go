@@ -0,0 +1,110 @@
+package notify
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Digest of the events of a day or a week, sent as "summary" notification
+type Summary struct {
+	Period       string         `json:"period"` // daily or weekly
+	From         time.Time      `json:"from"`
+	To           time.Time      `json:"to"`     // exclusive
+	Events       map[string]int `json:"events"` // event name => number of saved clips
+	BusiestHours []SummaryHour  `json:"busiestHours"`
+	ClipBytes    int64          `json:"clipBytes"`    // size of the clips saved in the period
+	StorageBytes int64          `json:"storageBytes"` // size of the whole output directory
+	Notable      []NotableEvent `json:"notable"`      // chimes, packages and people, oldest first
+}
+
+// Hour of the day and the number of events in it
+type SummaryHour struct {
+	Hour   int `json:"hour"`
+	Events int `json:"events"`
+}
+
+type NotableEvent struct {
+	Event       string    `json:"event"` // e.g. chime
+	Device      string    `json:"device"`
+	Time        time.Time `json:"time"`
+	Description string    `json:"description,omitempty"` // e.g. familiar face or detected objects
+	ClipPath    string    `json:"clipPath"`
+	ClipUrl     string    `json:"clipUrl,omitempty"`
+}
+
+// Plain text of the summary used by the default message template, e.g.
+//
+//	Doorbell daily summary of 2024-03-04
+//	chime: 3, person: 12, motion: 40
+//	Busiest hours: 08:00 (12), 17:00 (9)
+//	Saved 55 clips (120.5 MB), 3.2 GB in total
+//	- 08:12 chime at Front door http://...
+func (s *Summary) Text() string {
+	var b strings.Builder
+	last := s.To.Add(-time.Nanosecond)
+	if s.Period == "weekly" {
+		fmt.Fprintf(&b, "Doorbell weekly summary of %v - %v\n", s.From.Format(time.DateOnly), last.Format(time.DateOnly))
+	} else {
+		fmt.Fprintf(&b, "Doorbell daily summary of %v\n", s.From.Format(time.DateOnly))
+	}
+	names := make([]string, 0, len(s.Events))
+	clips := 0
+	for name, count := range s.Events {
+		names = append(names, name)
+		clips += count
+	}
+	if clips == 0 {
+		b.WriteString("No events\n")
+	} else {
+		// most frequent first
+		sort.Slice(names, func(i, j int) bool {
+			if s.Events[names[i]] != s.Events[names[j]] {
+				return s.Events[names[i]] > s.Events[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		counts := []string{}
+		for _, name := range names {
+			counts = append(counts, fmt.Sprintf("%v: %v", name, s.Events[name]))
+		}
+		b.WriteString(strings.Join(counts, ", ") + "\n")
+		hours := []string{}
+		for _, hour := range s.BusiestHours {
+			hours = append(hours, fmt.Sprintf("%02d:00 (%v)", hour.Hour, hour.Events))
+		}
+		fmt.Fprintf(&b, "Busiest hours: %v\n", strings.Join(hours, ", "))
+	}
+	fmt.Fprintf(&b, "Saved %v clips (%v), %v in total\n", clips, formatBytes(s.ClipBytes), formatBytes(s.StorageBytes))
+	for _, event := range s.Notable {
+		layout := "15:04"
+		if s.Period == "weekly" {
+			layout = "Mon 15:04"
+		}
+		fmt.Fprintf(&b, "- %v %v", event.Time.Format(layout), event.Event)
+		if len(event.Description) > 0 {
+			fmt.Fprintf(&b, " (%v)", event.Description)
+		}
+		fmt.Fprintf(&b, " at %v", event.Device)
+		if len(event.ClipUrl) > 0 {
+			fmt.Fprintf(&b, " %v", event.ClipUrl)
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// e.g. 120.5 MB
+func formatBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	v, i := float64(n), 0
+	for v >= 1000 && i < len(units)-1 {
+		v /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%v B", n)
+	}
+	return fmt.Sprintf("%.1f %v", v, units[i])
+}
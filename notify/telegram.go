@@ -0,0 +1,198 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const telegramDefaultApiUrl = "https://api.telegram.org"
+
+// Send message to a Telegram chat by a bot. The saved snapshot/clip is sent with the message as caption when
+// attachImage is true. Messages can be edited e.g. to add the clip saved later: the media of the message is replaced,
+// or the clip is sent as a reply to text messages since Telegram can't turn them into media.
+type TelegramNotifier struct {
+	config   TelegramNotifierConfig
+	template *template.Template
+}
+
+type TelegramNotifierConfig struct {
+	Token       string `json:"token"`    // of the bot from @BotFather
+	ChatId      string `json:"chatId"`   // e.g. "123456789" or "@channel"
+	Template    string `json:"template"` // go text/template of message text
+	AttachImage bool   `json:"attachImage"`
+	Attempts    int    `json:"attempts"`
+	ApiUrl      string `json:"apiUrl"` // default https://api.telegram.org e.g. for a local Bot API server
+}
+
+func newTelegramNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := TelegramNotifierConfig{Attempts: 3, ApiUrl: telegramDefaultApiUrl}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Token) == 0 || len(config.ChatId) == 0 {
+		return nil, fmt.Errorf("token and chatId are required")
+	}
+	t, err := parseMessageTemplate(config.Template)
+	if err != nil {
+		return nil, err
+	}
+	config.ApiUrl = strings.TrimSuffix(config.ApiUrl, "/")
+	return &TelegramNotifier{config: config, template: t}, nil
+}
+
+func (n *TelegramNotifier) Name() string {
+	return "telegram"
+}
+
+// https://core.telegram.org/bots/api#making-requests
+type telegramResponse struct {
+	Ok          bool   `json:"ok"`
+	Description string `json:"description"`
+	Result      struct {
+		MessageId int64 `json:"message_id"`
+	} `json:"result"`
+}
+
+func (n *TelegramNotifier) Notify(ctx context.Context, notification *Notification) error {
+	text, err := renderMessage(n.template, notification)
+	if err != nil {
+		return err
+	}
+	var response *telegramResponse
+	kind := "text"
+	if n.config.AttachImage && len(notification.ClipFile) > 0 {
+		kind = "media"
+		response, err = n.sendMedia(ctx, notification.ClipFile, map[string]string{"caption": text})
+	} else {
+		response, err = n.call(ctx, "sendMessage", map[string]any{"chat_id": n.config.ChatId, "text": text})
+	}
+	if err != nil {
+		return err
+	}
+	recordSentMessage(ctx, n, kind+"/"+strconv.FormatInt(response.Result.MessageId, 10))
+	return nil
+}
+
+// Replace the text or caption of the message. The clip is sent as a reply if the message had none
+func (n *TelegramNotifier) EditMessage(ctx context.Context, id string, notification *Notification) error {
+	kind, messageId, _ := strings.Cut(id, "/")
+	text, err := renderMessage(n.template, notification)
+	if err != nil {
+		return err
+	}
+	if kind == "media" {
+		if !n.config.AttachImage || len(notification.ClipFile) == 0 {
+			_, err = n.call(ctx, "editMessageCaption", map[string]any{"chat_id": n.config.ChatId, "message_id": messageId, "caption": text})
+			return err
+		}
+		// https://core.telegram.org/bots/api#editmessagemedia
+		_, field := telegramMediaType(notification.ClipFile)
+		media, err := json.Marshal(map[string]string{"type": field, "media": "attach://clip", "caption": text})
+		if err != nil {
+			return err
+		}
+		_, err = n.upload(ctx, "editMessageMedia", map[string]string{"message_id": messageId, "media": string(media)}, "clip", notification.ClipFile)
+		return err
+	}
+	if _, err := n.call(ctx, "editMessageText", map[string]any{"chat_id": n.config.ChatId, "message_id": messageId, "text": text}); err != nil {
+		return err
+	}
+	if n.config.AttachImage && len(notification.ClipFile) > 0 {
+		_, err = n.sendMedia(ctx, notification.ClipFile, map[string]string{"reply_parameters": `{"message_id":` + messageId + `}`})
+	}
+	return err
+}
+
+// Method and field sending the file: images as photo, mp4 as video and anything else e.g. raw H.264 as document
+func telegramMediaType(path string) (string, string) {
+	if (&Notification{ClipFile: path}).HasImage() {
+		return "sendPhoto", "photo"
+	} else if strings.EqualFold(filepath.Ext(path), ".mp4") {
+		return "sendVideo", "video"
+	}
+	return "sendDocument", "document"
+}
+
+func (n *TelegramNotifier) sendMedia(ctx context.Context, path string, fields map[string]string) (*telegramResponse, error) {
+	method, field := telegramMediaType(path)
+	return n.upload(ctx, method, fields, field, path)
+}
+
+// Call method with fields and the file at path as field
+func (n *TelegramNotifier) upload(ctx context.Context, method string, fields map[string]string, field string, path string) (*telegramResponse, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	fields["chat_id"] = n.config.ChatId
+	for key, value := range fields {
+		if err := writer.WriteField(key, value); err != nil {
+			return nil, err
+		}
+	}
+	part, err := writer.CreateFormFile(field, filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := io.Copy(part, file); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return n.do(ctx, method, writer.FormDataContentType(), body.Bytes())
+}
+
+func (n *TelegramNotifier) call(ctx context.Context, method string, params map[string]any) (*telegramResponse, error) {
+	payload, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	return n.do(ctx, method, "application/json", payload)
+}
+
+func (n *TelegramNotifier) do(ctx context.Context, method string, contentType string, body []byte) (*telegramResponse, error) {
+	response := &telegramResponse{}
+	err := retryWithBackoff(ctx, n.config.Attempts, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.config.ApiUrl+"/bot"+n.config.Token+"/"+method, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if e, ok := err.(*url.Error); ok {
+			// without the URL, which has the token
+			return fmt.Errorf("%v: %v", method, e.Err)
+		} else if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		*response = telegramResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			return fmt.Errorf("%v: unexpected status code %v", method, resp.Status)
+		}
+		if !response.Ok {
+			if strings.Contains(response.Description, "message is not modified") {
+				// the template doesn't have anything which changed
+				return nil
+			}
+			return fmt.Errorf("%v: %v", method, response.Description)
+		}
+		return nil
+	})
+	return response, err
+}
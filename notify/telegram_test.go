@@ -0,0 +1,163 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestTelegramNotifier(t *testing.T, server *recordingServer, attachImage bool) *TelegramNotifier {
+	config, _ := json.Marshal(TelegramNotifierConfig{Token: "123:secret", ChatId: "@doorbell", Template: "ring {{.Timestamp}}", AttachImage: attachImage, Attempts: 1, ApiUrl: server.URL + "/"})
+	notifier, err := newTelegramNotifierFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return notifier.(*TelegramNotifier)
+}
+
+func writeTestClip(t *testing.T, name string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("clip of "+name), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func telegramOk(messageId string) func(recordedRequest) (int, string) {
+	return func(recordedRequest) (int, string) {
+		return http.StatusOK, `{"ok":true,"result":{"message_id":` + messageId + `}}`
+	}
+}
+
+func TestTelegramNotify(t *testing.T) {
+	server := newRecordingServer(t, telegramOk("42"))
+	n := newTestTelegramNotifier(t, server, false)
+	sent := &SentMessages{}
+	if err := n.Notify(RecordSentMessages(context.Background(), sent), &Notification{Timestamp: "10:00"}); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.take()
+	if len(requests) != 1 || requests[0].Method != http.MethodPost || requests[0].Path != "/bot123:secret/sendMessage" {
+		t.Fatalf("requests = %+v, want POST of sendMessage", requests)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(requests[0].Body, &body); err != nil || body["chat_id"] != "@doorbell" || body["text"] != "ring 10:00" {
+		t.Errorf("body = %s, want chat_id and text", requests[0].Body)
+	}
+	if len(sent.messages) != 1 || sent.messages[0].id != "text/42" {
+		t.Errorf("recorded %+v, want text/42", sent.messages)
+	}
+}
+
+func TestTelegramNotifyWithClip(t *testing.T) {
+	server := newRecordingServer(t, telegramOk("7"))
+	n := newTestTelegramNotifier(t, server, true)
+	for _, c := range []struct {
+		file, method, field string
+	}{
+		{"snapshot.jpg", "sendPhoto", "photo"},
+		{"clip.mp4", "sendVideo", "video"},
+		{"clip.h264", "sendDocument", "document"},
+	} {
+		sent := &SentMessages{}
+		if err := n.Notify(RecordSentMessages(context.Background(), sent), &Notification{Timestamp: "10:00", ClipFile: writeTestClip(t, c.file)}); err != nil {
+			t.Fatal(err)
+		}
+		requests := server.take()
+		if len(requests) != 1 || requests[0].Path != "/bot123:secret/"+c.method {
+			t.Fatalf("requests of %v = %+v, want %v", c.file, requests, c.method)
+		}
+		fields, files := requests[0].form(t)
+		if fields["chat_id"] != "@doorbell" || fields["caption"] != "ring 10:00" {
+			t.Errorf("fields of %v = %v, want chat_id and caption", c.file, fields)
+		}
+		if files[c.field] != [2]string{c.file, "clip of " + c.file} {
+			t.Errorf("files of %v = %v, want it as %v", c.file, files, c.field)
+		}
+		if len(sent.messages) != 1 || sent.messages[0].id != "media/7" {
+			t.Errorf("recorded %+v, want media/7", sent.messages)
+		}
+	}
+}
+
+func TestTelegramEditMessage(t *testing.T) {
+	server := newRecordingServer(t, telegramOk("8"))
+	n := newTestTelegramNotifier(t, server, true)
+	clip := writeTestClip(t, "clip.mp4")
+
+	// text messages get the new text, and the clip as a reply
+	if err := n.EditMessage(context.Background(), "text/42", &Notification{Timestamp: "10:01", ClipFile: clip}); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.take()
+	if len(requests) != 2 || requests[0].Path != "/bot123:secret/editMessageText" || requests[1].Path != "/bot123:secret/sendVideo" {
+		t.Fatalf("requests = %+v, want editMessageText and sendVideo", requests)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(requests[0].Body, &body); err != nil || body["message_id"] != "42" || body["text"] != "ring 10:01" {
+		t.Errorf("editMessageText body = %s", requests[0].Body)
+	}
+	if fields, _ := requests[1].form(t); fields["reply_parameters"] != `{"message_id":42}` {
+		t.Errorf("reply fields = %v, want reply_parameters of message 42", fields)
+	}
+
+	// media messages get the clip in place of the snapshot
+	if err := n.EditMessage(context.Background(), "media/7", &Notification{Timestamp: "10:01", ClipFile: clip}); err != nil {
+		t.Fatal(err)
+	}
+	requests = server.take()
+	if len(requests) != 1 || requests[0].Path != "/bot123:secret/editMessageMedia" {
+		t.Fatalf("requests = %+v, want editMessageMedia", requests)
+	}
+	fields, files := requests[0].form(t)
+	var media map[string]string
+	if err := json.Unmarshal([]byte(fields["media"]), &media); err != nil || media["type"] != "video" || media["media"] != "attach://clip" || media["caption"] != "ring 10:01" {
+		t.Errorf("media = %v, want the video attached as clip", fields["media"])
+	}
+	if fields["message_id"] != "7" || files["clip"][0] != "clip.mp4" {
+		t.Errorf("fields = %v, files = %v", fields, files)
+	}
+
+	// without a clip only the caption changes
+	if err := n.EditMessage(context.Background(), "media/7", &Notification{Timestamp: "10:02"}); err != nil {
+		t.Fatal(err)
+	}
+	if requests = server.take(); len(requests) != 1 || requests[0].Path != "/bot123:secret/editMessageCaption" {
+		t.Errorf("requests = %+v, want editMessageCaption", requests)
+	}
+}
+
+func TestTelegramErrors(t *testing.T) {
+	server := newRecordingServer(t, telegramOk("1"))
+	n := newTestTelegramNotifier(t, server, false)
+	notification := &Notification{Timestamp: "10:00"}
+
+	server.answer(http.StatusBadRequest, `{"ok":false,"description":"Bad Request: chat not found"}`)
+	if err := n.Notify(context.Background(), notification); err == nil || !strings.Contains(err.Error(), "chat not found") {
+		t.Errorf("Notify answered not ok = %v, want the description", err)
+	}
+	server.answer(http.StatusBadGateway, `<html>bad gateway</html>`)
+	if err := n.Notify(context.Background(), notification); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("Notify answered 502 = %v, want the status", err)
+	}
+	// edits which don't change the text aren't errors
+	server.answer(http.StatusBadRequest, `{"ok":false,"description":"Bad Request: message is not modified"}`)
+	if err := n.EditMessage(context.Background(), "text/1", notification); err != nil {
+		t.Errorf("EditMessage not modified = %v, want nil", err)
+	}
+	// errors don't have the URL, which has the token
+	server.Close()
+	if err := n.Notify(context.Background(), notification); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("Notify of a closed server = %v, want an error without the token", err)
+	}
+
+	for _, config := range []string{`{"chatId":"1"}`, `{"token":"t"}`, `{"token":"t","chatId":"1","template":"{{"}`} {
+		if _, err := newTelegramNotifierFromConfig(json.RawMessage(config)); err == nil {
+			t.Errorf("config %v succeeded, want error", config)
+		}
+	}
+}
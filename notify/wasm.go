@@ -0,0 +1,227 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// Memory of each instance, 16MiB
+const wasmMemoryPages = 256
+
+// WebAssembly module run in-process by wazero for each notification, with the protocol of Plugin: it gets the request
+// and answers the response, by the "nest" host API or by a line on stdin and stdout. It's sandboxed, so it can't touch
+// files or the network, and runs within a timeout and 16MiB of memory.
+//
+// Host API imported from "nest":
+//
+//	input_len() i32                 length of the request JSON
+//	input_read(ptr i32)             copy the request JSON to memory at ptr
+//	output(ptr i32, len i32)        set the response JSON
+//	log(ptr i32, len i32)           write a line to the log
+//
+// The module exports "transform" (after "_initialize" if any), or runs "_start" like WASI commands.
+type WasmPlugin struct {
+	name      string
+	runtime   wazero.Runtime
+	module    wazero.CompiledModule
+	transform bool // exports transform, otherwise _start
+	timeout   time.Duration
+}
+
+type WasmPluginConfig struct {
+	Name    string        // used in logs. defaults to the file name
+	Module  string        // path of the .wasm file
+	Timeout time.Duration // of each notification. default 1s
+}
+
+// Request and answer of the running instance, for the host API
+type wasmCall struct {
+	request []byte
+	output  []byte
+}
+
+type wasmCallKey struct{}
+
+func NewWasmPlugin(config WasmPluginConfig) (*WasmPlugin, error) {
+	if len(config.Module) == 0 {
+		return nil, fmt.Errorf("module is required")
+	}
+	b, err := os.ReadFile(config.Module)
+	if err != nil {
+		return nil, err
+	}
+	p := &WasmPlugin{name: config.Name, timeout: config.Timeout}
+	if len(p.name) == 0 {
+		p.name = strings.TrimSuffix(filepath.Base(config.Module), ".wasm")
+	}
+	if p.timeout == 0 {
+		p.timeout = time.Second
+	}
+	if err := p.compile(b); err != nil {
+		return nil, fmt.Errorf("%v: %v", config.Module, err)
+	}
+	return p, nil
+}
+
+func (p *WasmPlugin) compile(b []byte) error {
+	ctx := context.Background()
+	p.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(wasmMemoryPages).
+		WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, p.runtime); err != nil {
+		p.runtime.Close(ctx)
+		return err
+	}
+	if _, err := p.runtime.NewHostModuleBuilder("nest").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context) uint32 {
+		return uint32(len(ctx.Value(wasmCallKey{}).(*wasmCall).request))
+	}).Export("input_len").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, ptr uint32) {
+		if !m.Memory().Write(ptr, ctx.Value(wasmCallKey{}).(*wasmCall).request) {
+			panic(fmt.Errorf("input_read out of bounds"))
+		}
+	}).Export("input_read").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, ptr, size uint32) {
+		b, ok := m.Memory().Read(ptr, size)
+		if !ok {
+			panic(fmt.Errorf("output out of bounds"))
+		}
+		ctx.Value(wasmCallKey{}).(*wasmCall).output = bytes.Clone(b)
+	}).Export("output").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, ptr, size uint32) {
+		b, ok := m.Memory().Read(ptr, size)
+		if !ok {
+			panic(fmt.Errorf("log out of bounds"))
+		}
+		log.Printf("[wasm %v] %s", p.name, b)
+	}).Export("log").
+		Instantiate(ctx); err != nil {
+		p.runtime.Close(ctx)
+		return err
+	}
+	module, err := p.runtime.CompileModule(ctx, b)
+	if err != nil {
+		p.runtime.Close(ctx)
+		return err
+	}
+	// resolve the imports and allocate the memory now rather than failing at each event
+	instance, err := p.runtime.InstantiateModule(ctx, module, wazero.NewModuleConfig().WithName("").WithStartFunctions())
+	if err != nil {
+		p.runtime.Close(ctx)
+		return err
+	}
+	instance.Close(ctx)
+	p.module = module
+	_, p.transform = module.ExportedFunctions()["transform"]
+	if _, ok := module.ExportedFunctions()["_start"]; !ok && !p.transform {
+		p.runtime.Close(ctx)
+		return fmt.Errorf("exports neither transform nor _start")
+	}
+	return nil
+}
+
+func (p *WasmPlugin) Name() string {
+	return p.name
+}
+
+// Run the module for notification in a new instance, so that nothing carries over between notifications. Returns an
+// error if it traps, times out or answers garbage
+func (p *WasmPlugin) Run(ctx context.Context, notification *Notification) (*PluginResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	request, err := json.Marshal(pluginRequest{Protocol: PluginProtocolVersion, Notification: notification, ClipFile: notification.ClipFile})
+	if err != nil {
+		return nil, err
+	}
+	call := &wasmCall{request: request}
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, wasmCallKey{}, call), p.timeout)
+	defer cancel()
+	var stdout bytes.Buffer
+	stderr := &lineLogger{prefix: fmt.Sprintf("[wasm %v] ", p.name)}
+	defer stderr.flush()
+	config := wazero.NewModuleConfig().
+		WithName(""). // instances of concurrent events don't collide
+		WithArgs(p.name).
+		WithStdin(bytes.NewReader(append(request, '\n'))).
+		WithStdout(&stdout).
+		WithStderr(stderr)
+	if p.transform {
+		config = config.WithStartFunctions("_initialize")
+	} else {
+		config = config.WithStartFunctions("_start")
+	}
+	instance, err := p.runtime.InstantiateModule(ctx, p.module, config)
+	if err == nil {
+		defer instance.Close(ctx)
+		if p.transform {
+			_, err = instance.ExportedFunction("transform").Call(ctx)
+		}
+	}
+	if exit := (*sys.ExitError)(nil); errors.As(err, &exit) && exit.ExitCode() == 0 {
+		err = nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out after %v: %w", p.timeout, ctx.Err())
+		}
+		return nil, err
+	}
+	output := call.output
+	if output == nil {
+		output, _, _ = bytes.Cut(stdout.Bytes(), []byte("\n"))
+	}
+	response := &PluginResponse{}
+	if len(bytes.TrimSpace(output)) == 0 {
+		// no answer means forward
+		return response, nil
+	}
+	if err := json.Unmarshal(output, response); err != nil {
+		return nil, fmt.Errorf("invalid answer: %v", err)
+	}
+	return response, nil
+}
+
+// Release the compiled module
+func (p *WasmPlugin) Close() error {
+	return p.runtime.Close(context.Background())
+}
+
+// Writer logging each line
+type lineLogger struct {
+	prefix string
+	line   []byte
+}
+
+func (l *lineLogger) Write(b []byte) (int, error) {
+	l.line = append(l.line, b...)
+	for {
+		line, rest, ok := bytes.Cut(l.line, []byte("\n"))
+		if !ok {
+			break
+		}
+		log.Printf("%v%s", l.prefix, line)
+		l.line = rest
+	}
+	return len(b), nil
+}
+
+func (l *lineLogger) flush() {
+	if len(l.line) > 0 {
+		log.Printf("%v%s", l.prefix, l.line)
+		l.line = nil
+	}
+}
@@ -0,0 +1,386 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Minimal encoder of the WebAssembly binary format for the modules of the tests
+
+const (
+	wasmI32 = 0x7f
+
+	opUnreachable = 0x00
+	opLoop        = 0x03
+	opIf          = 0x04
+	opEnd         = 0x0b
+	opBr          = 0x0c
+	opCall        = 0x10
+	opDrop        = 0x1a
+	opGlobalGet   = 0x23
+	opGlobalSet   = 0x24
+	opMemoryGrow  = 0x40
+	opI32Const    = 0x41
+	opI32Ne       = 0x47
+	opI32Add      = 0x6a
+	blockVoid     = 0x40
+)
+
+func uleb(n uint32) []byte {
+	b := []byte{}
+	for {
+		c := byte(n & 0x7f)
+		if n >>= 7; n != 0 {
+			b = append(b, c|0x80)
+			continue
+		}
+		return append(b, c)
+	}
+}
+
+func sleb(n int32) []byte {
+	b := []byte{}
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if (n == 0 && c&0x40 == 0) || (n == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func i32Const(n int32) []byte {
+	return append([]byte{opI32Const}, sleb(n)...)
+}
+
+func wasmName(s string) []byte {
+	return append(uleb(uint32(len(s))), s...)
+}
+
+func wasmVec(items ...[]byte) []byte {
+	b := uleb(uint32(len(items)))
+	for _, item := range items {
+		b = append(b, item...)
+	}
+	return b
+}
+
+func wasmSection(id byte, items ...[]byte) []byte {
+	content := wasmVec(items...)
+	return append(append([]byte{id}, uleb(uint32(len(content)))...), content...)
+}
+
+func wasmModule(sections ...[]byte) []byte {
+	b := []byte("\x00asm\x01\x00\x00\x00")
+	for _, section := range sections {
+		b = append(b, section...)
+	}
+	return b
+}
+
+func wasmTypes(types ...[]byte) []byte { return wasmSection(1, types...) }
+
+func wasmFuncType(params, results []byte) []byte {
+	return append(append([]byte{0x60}, wasmName(string(params))...), wasmName(string(results))...)
+}
+
+func wasmImports(imports ...[]byte) []byte { return wasmSection(2, imports...) }
+
+func wasmImport(module, name string, typeIndex uint32) []byte {
+	return append(append(append(wasmName(module), wasmName(name)...), 0x00), uleb(typeIndex)...)
+}
+
+func wasmFuncs(typeIndexes ...uint32) []byte {
+	items := [][]byte{}
+	for _, i := range typeIndexes {
+		items = append(items, uleb(i))
+	}
+	return wasmSection(3, items...)
+}
+
+func wasmMemory(pages uint32) []byte { return wasmSection(5, append([]byte{0x00}, uleb(pages)...)) }
+
+// Mutable i32 global initialized to 0
+func wasmGlobal() []byte {
+	return wasmSection(6, append([]byte{wasmI32, 0x01}, append(i32Const(0), opEnd)...))
+}
+
+func wasmExports(exports ...[]byte) []byte { return wasmSection(7, exports...) }
+
+func wasmExportFunc(name string, index uint32) []byte {
+	return append(append(wasmName(name), 0x00), uleb(index)...)
+}
+
+func wasmExportMemory() []byte { return append(wasmName("memory"), 0x02, 0x00) }
+
+func wasmCodes(bodies ...[]byte) []byte { return wasmSection(10, bodies...) }
+
+// Body of a function without locals
+func wasmCode(instructions ...[]byte) []byte {
+	body := []byte{0x00}
+	for _, instruction := range instructions {
+		body = append(body, instruction...)
+	}
+	body = append(body, opEnd)
+	return append(uleb(uint32(len(body))), body...)
+}
+
+func wasmData(offset int32, b []byte) []byte {
+	return wasmSection(11, append(append(append([]byte{0x00}, i32Const(offset)...), opEnd), wasmName(string(b))...))
+}
+
+// Module exporting transform with body, and memory of a page holding data at 16. Functions of nest are imported as
+// 0 input_len, 1 input_read, 2 output and 3 log, transform is 4
+func nestModule(data string, body ...[]byte) []byte {
+	return wasmModule(
+		wasmTypes(
+			wasmFuncType(nil, []byte{wasmI32}),
+			wasmFuncType([]byte{wasmI32}, nil),
+			wasmFuncType([]byte{wasmI32, wasmI32}, nil),
+			wasmFuncType(nil, nil),
+		),
+		wasmImports(
+			wasmImport("nest", "input_len", 0),
+			wasmImport("nest", "input_read", 1),
+			wasmImport("nest", "output", 2),
+			wasmImport("nest", "log", 2),
+		),
+		wasmFuncs(3),
+		wasmMemory(1),
+		wasmExports(wasmExportFunc("transform", 4), wasmExportMemory()),
+		wasmCodes(wasmCode(body...)),
+		wasmData(16, []byte(data)),
+	)
+}
+
+// Call of output with the data of nestModule
+func outputData(data string) [][]byte {
+	return [][]byte{i32Const(16), i32Const(int32(len(data))), {opCall, 2}}
+}
+
+// WASI command printing data on stdout from _start
+func wasiModule(data string) []byte {
+	// iovec of data at 0, the number of written bytes at 8
+	iovec := []byte{16, 0, 0, 0, byte(len(data)), 0, 0, 0}
+	return wasmModule(
+		wasmTypes(
+			wasmFuncType([]byte{wasmI32, wasmI32, wasmI32, wasmI32}, []byte{wasmI32}),
+			wasmFuncType(nil, nil),
+		),
+		wasmImports(wasmImport("wasi_snapshot_preview1", "fd_write", 0)),
+		wasmFuncs(1),
+		wasmMemory(1),
+		wasmExports(wasmExportFunc("_start", 1), wasmExportMemory()),
+		wasmCodes(wasmCode(i32Const(1), i32Const(0), i32Const(1), i32Const(8), []byte{opCall, 0, opDrop})),
+		wasmSection(11,
+			append(append(append([]byte{0x00}, i32Const(0)...), opEnd), wasmName(string(iovec))...),
+			append(append(append([]byte{0x00}, i32Const(16)...), opEnd), wasmName(data)...),
+		),
+	)
+}
+
+func newTestWasmPlugin(t *testing.T, module []byte, timeout time.Duration) (*WasmPlugin, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.wasm")
+	if err := os.WriteFile(path, module, 0666); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewWasmPlugin(WasmPluginConfig{Module: path, Timeout: timeout})
+	if err == nil {
+		t.Cleanup(func() { p.Close() })
+	}
+	return p, err
+}
+
+func testWasmNotification() *Notification {
+	return &Notification{
+		EventType:      sdmevents.ResourceUpdateEventType("sdm.devices.events.DoorbellChime.Chime"),
+		Device:         "enterprises/p/devices/d",
+		DeviceName:     "Front door",
+		EventSessionId: "session",
+		Timestamp:      "2026-10-15T10:00:00Z",
+		Annotations:    map[string]string{"zone": "porch"},
+	}
+}
+
+func TestNewWasmPluginErrors(t *testing.T) {
+	valid := nestModule("")
+	for _, tt := range []struct {
+		name   string
+		module []byte
+		want   string
+	}{
+		{"not wasm", []byte("#!/bin/sh\necho hello\n"), "magic"},
+		{"empty", []byte{}, "magic"},
+		{"truncated header", valid[:6], "version"},
+		{"truncated section", valid[:len(valid)-5], "section"},
+		{"section longer than module", wasmModule([]byte{1, 100, 1}), "section"},
+		{"unknown opcode", wasmModule(wasmTypes(wasmFuncType(nil, nil)), wasmFuncs(0), wasmExports(wasmExportFunc("transform", 0)), wasmCodes(wasmCode([]byte{0xff}))), "invalid"},
+		{"unknown import", wasmModule(wasmTypes(wasmFuncType(nil, nil)), wasmImports(wasmImport("env", "f", 0)), wasmExports(wasmExportFunc("_start", 0))), "env"},
+		{"no entry point", wasmModule(wasmTypes(wasmFuncType(nil, nil)), wasmFuncs(0), wasmExports(wasmExportFunc("main", 0)), wasmCodes(wasmCode())), "neither transform nor _start"},
+		{"memory over the limit", wasmModule(wasmTypes(wasmFuncType(nil, nil)), wasmFuncs(0), wasmMemory(wasmMemoryPages+1), wasmExports(wasmExportFunc("transform", 0)), wasmCodes(wasmCode())), "memory"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTestWasmPlugin(t, tt.module, 0)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+	if _, err := NewWasmPlugin(WasmPluginConfig{Module: filepath.Join(t.TempDir(), "missing.wasm")}); err == nil {
+		t.Error("missing module should fail")
+	}
+}
+
+func TestWasmPluginRun(t *testing.T) {
+	answer := `{"action":"suppress","reason":"cat","annotations":{"animal":"cat"}}`
+	for _, tt := range []struct {
+		name   string
+		module []byte
+		want   PluginResponse
+	}{
+		{
+			name: "echo the request",
+			// input_read(0), output(0, input_len())
+			module: nestModule("", i32Const(0), []byte{opCall, 1}, i32Const(0), []byte{opCall, 0}, []byte{opCall, 2}),
+			want:   PluginResponse{Notification: json.RawMessage(mustMarshal(t, testWasmNotification()))},
+		},
+		{
+			name:   "answer by output",
+			module: nestModule(answer, outputData(answer)...),
+			want:   PluginResponse{Action: "suppress", Reason: "cat", Annotations: map[string]string{"animal": "cat"}},
+		},
+		{
+			name:   "log and answer",
+			module: nestModule(answer, append([][]byte{i32Const(16), i32Const(5), {opCall, 3}}, outputData(answer)...)...),
+			want:   PluginResponse{Action: "suppress", Reason: "cat", Annotations: map[string]string{"animal": "cat"}},
+		},
+		{
+			name:   "no answer forwards",
+			module: nestModule(""),
+			want:   PluginResponse{},
+		},
+		{
+			name:   "answer by stdout",
+			module: wasiModule(answer + "\nignored\n"),
+			want:   PluginResponse{Action: "suppress", Reason: "cat", Annotations: map[string]string{"animal": "cat"}},
+		},
+		{
+			name: "memory can't grow over the limit",
+			// unreachable unless memory.grow(wasmMemoryPages) fails
+			module: nestModule("", i32Const(wasmMemoryPages), []byte{opMemoryGrow, 0x00}, i32Const(-1), []byte{opI32Ne, opIf, blockVoid, opUnreachable, opEnd}),
+			want:   PluginResponse{},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newTestWasmPlugin(t, tt.module, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := p.Run(context.Background(), testWasmNotification())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*response, tt.want) {
+				t.Errorf("response = %+v, want %+v", *response, tt.want)
+			}
+		})
+	}
+}
+
+func TestWasmPluginRunErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		module  []byte
+		timeout time.Duration
+		want    string
+	}{
+		{"trap", nestModule("", []byte{opUnreachable}), 0, "unreachable"},
+		{"output out of bounds", nestModule("", i32Const(65536-4), i32Const(8), []byte{opCall, 2}), 0, "out of bounds"},
+		{"input out of bounds", nestModule("", i32Const(65536-4), []byte{opCall, 1}), 0, "out of bounds"},
+		{"invalid answer", nestModule("{", outputData("{")...), 0, "invalid answer"},
+		{"endless loop", nestModule("", []byte{opLoop, blockVoid, opBr, 0, opEnd}), 100 * time.Millisecond, "timed out"},
+		// transform (4) calls itself until the stack runs out, which takes a while by growing the stack
+		{"endless recursion", nestModule("", []byte{opCall, 4}), time.Minute, "stack overflow"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newTestWasmPlugin(t, tt.module, tt.timeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = p.Run(context.Background(), testWasmNotification())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// The instance of each notification starts over, also when notifications run at once
+func TestWasmPluginFreshInstances(t *testing.T) {
+	// global 0 += 1, unreachable unless it became 1
+	module := wasmModule(
+		wasmTypes(wasmFuncType(nil, nil)),
+		wasmFuncs(0),
+		wasmGlobal(),
+		wasmExports(wasmExportFunc("transform", 0)),
+		wasmCodes(wasmCode(
+			[]byte{opGlobalGet, 0}, i32Const(1), []byte{opI32Add, opGlobalSet, 0},
+			[]byte{opGlobalGet, 0}, i32Const(1), []byte{opI32Ne, opIf, blockVoid, opUnreachable, opEnd},
+		)),
+	)
+	p, err := newTestWasmPlugin(t, module, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Run(context.Background(), testWasmNotification()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// The answer of the echo module applies to the same notification
+func TestWasmPluginApplyEcho(t *testing.T) {
+	p, err := newTestWasmPlugin(t, nestModule("", i32Const(0), []byte{opCall, 1}, i32Const(0), []byte{opCall, 0}, []byte{opCall, 2}), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := testWasmNotification()
+	response, err := p.Run(context.Background(), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := *n
+	if reason, err := response.Apply(&changed); err != nil || reason != "" {
+		t.Fatalf("Apply() = %q, %v", reason, err)
+	}
+	if !reflect.DeepEqual(changed, *n) {
+		t.Errorf("notification = %+v, want %+v", changed, *n)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,126 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/template"
+)
+
+// POST JSON payload to an URL. Payload is the Notification marshaled as JSON unless template is given.
+type WebhookNotifier struct {
+	url      string
+	template *template.Template // executed with *Notification
+	attempts int
+	client   *http.Client
+}
+
+// template may be nil to send the notification marshaled as JSON
+func NewWebhookNotifier(url string, template *template.Template, attempts int) *WebhookNotifier {
+	return &WebhookNotifier{url: url, template: template, attempts: attempts}
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	// encode value as JSON so that it can be embedded into JSON payload safely
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Load webhook payload template. Empty path means default payload.
+func LoadWebhookTemplate(path string) (*template.Template, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(path).Funcs(webhookTemplateFuncs).Parse(string(b))
+}
+
+type WebhookNotifierConfig struct {
+	Url      string `json:"url"`
+	Template string `json:"template"` // go text/template rendering JSON payload. empty means the notification marshaled as JSON
+	Attempts int    `json:"attempts"`
+}
+
+func newWebhookNotifierFromConfig(raw json.RawMessage) (Notifier, error) {
+	config := WebhookNotifierConfig{Attempts: 3}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Url) == 0 {
+		return nil, fmt.Errorf("url is required")
+	}
+	n := &WebhookNotifier{url: config.Url, attempts: config.Attempts}
+	if len(config.Template) > 0 {
+		t, err := template.New("webhook").Funcs(webhookTemplateFuncs).Parse(config.Template)
+		if err != nil {
+			return nil, err
+		}
+		n.template = t
+	}
+	return n, nil
+}
+
+func (n *WebhookNotifier) Name() string {
+	return "webhook(" + n.url + ")"
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, notification *Notification) error {
+	var payload []byte
+	if n.template == nil {
+		b, err := json.Marshal(notification)
+		if err != nil {
+			return err
+		}
+		payload = b
+	} else {
+		var buf bytes.Buffer
+		if err := n.template.Execute(&buf, notification); err != nil {
+			return err
+		}
+		payload = buf.Bytes()
+	}
+	client := n.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return postWithRetry(ctx, client, n.attempts, n.url, "application/json", payload)
+}
+
+// POST body to url, retrying on errors and non 2xx responses
+func postWithRetry(ctx context.Context, client *http.Client, attempts int, url string, contentType string, body []byte) error {
+	_, err := sendWithRetry(ctx, client, attempts, http.MethodPost, url, contentType, body)
+	return err
+}
+
+// Send body to url by method like postWithRetry. Returns the body of the successful response
+func sendWithRetry(ctx context.Context, client *http.Client, attempts int, method string, url string, contentType string, body []byte) ([]byte, error) {
+	var response []byte
+	err := retryWithBackoff(ctx, attempts, func() error {
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status code %v", resp.Status)
+		}
+		response = b
+		return err
+	})
+	return response, err
+}
@@ -0,0 +1,84 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+func newTestWebhookNotifier(t *testing.T, config WebhookNotifierConfig) Notifier {
+	raw, _ := json.Marshal(config)
+	n, err := newWebhookNotifierFromConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestWebhookNotify(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusNoContent, ""))
+	notification := &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Device: "enterprises/p/devices/d", Timestamp: "10:00", ClipPath: "2024/01/02/10/chime.mp4", ClipFile: "/data/2024/01/02/10/chime.mp4"}
+
+	// the notification marshaled as JSON by default
+	n := newTestWebhookNotifier(t, WebhookNotifierConfig{Url: server.URL + "/hook", Attempts: 1})
+	if err := n.Notify(context.Background(), notification); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.take()
+	if len(requests) != 1 || requests[0].Method != http.MethodPost || requests[0].Path != "/hook" || requests[0].Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("requests = %+v, want a JSON POST to /hook", requests)
+	}
+	body := requests[0].json(t)
+	if body["eventType"] != string(sdmevents.ResourceUpdateEventTypeDoorbellChime) || body["device"] != "enterprises/p/devices/d" || body["clipPath"] != "2024/01/02/10/chime.mp4" {
+		t.Errorf("body = %s, want the notification", requests[0].Body)
+	}
+	if strings.Contains(string(requests[0].Body), "/data/") {
+		t.Errorf("body = %s has the local path of the clip", requests[0].Body)
+	}
+
+	// the template renders the payload, json escapes values
+	n = newTestWebhookNotifier(t, WebhookNotifierConfig{Url: server.URL + "/hook", Template: `{"text":{{json .EventName}},"at":{{json .Timestamp}}}`, Attempts: 1})
+	if err := n.Notify(context.Background(), &Notification{EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime, Timestamp: `10:00 "UTC"`}); err != nil {
+		t.Fatal(err)
+	}
+	requests = server.take()
+	if len(requests) != 1 || string(requests[0].Body) != `{"text":"chime","at":"10:00 \"UTC\""}` {
+		t.Errorf("requests = %+v, want the rendered template", requests)
+	}
+}
+
+func TestWebhookErrors(t *testing.T) {
+	server := newRecordingServer(t, answering(http.StatusInternalServerError, "down"))
+	n := newTestWebhookNotifier(t, WebhookNotifierConfig{Url: server.URL, Attempts: 1})
+	if err := n.Notify(context.Background(), &Notification{}); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Notify answered 500 = %v, want the status", err)
+	}
+
+	// non 2xx responses are retried
+	failures := 1
+	server.respondBy(func(recordedRequest) (int, string) {
+		if failures > 0 {
+			failures--
+			return http.StatusServiceUnavailable, ""
+		}
+		return http.StatusOK, ""
+	})
+	server.take()
+	n = newTestWebhookNotifier(t, WebhookNotifierConfig{Url: server.URL, Attempts: 2})
+	if err := n.Notify(context.Background(), &Notification{}); err != nil {
+		t.Errorf("Notify answered 503 once = %v, want nil after a retry", err)
+	}
+	if requests := server.take(); len(requests) != 2 {
+		t.Errorf("%v requests, want 2", len(requests))
+	}
+
+	for _, config := range []string{`{}`, `{"url":"http://localhost","template":"{{"}`} {
+		if _, err := newWebhookNotifierFromConfig(json.RawMessage(config)); err == nil {
+			t.Errorf("config %v succeeded, want error", config)
+		}
+	}
+}
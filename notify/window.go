@@ -0,0 +1,47 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Daily time window like "01:00-06:00". End may be smaller than start to cross midnight, and equal to start for the
+// whole day. Used for download windows and quiet hours.
+type DailyWindow struct {
+	start time.Duration // since midnight
+	end   time.Duration
+}
+
+func ParseDailyWindow(s string) (DailyWindow, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return DailyWindow{}, fmt.Errorf("time window must be HH:MM-HH:MM: %v", s)
+	}
+	var window DailyWindow
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return DailyWindow{}, fmt.Errorf("time window must be HH:MM-HH:MM: %v", s)
+		}
+		d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			window.start = d
+		} else {
+			window.end = d
+		}
+	}
+	return window, nil
+}
+
+// Whether t is in [start, end) of its day, by the location of t
+func (w DailyWindow) Contains(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start == w.end {
+		return true
+	}
+	if w.start < w.end {
+		return w.start <= d && d < w.end
+	}
+	return w.start <= d || d < w.end
+}
@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDailyWindow(t *testing.T) {
+	for _, c := range []struct {
+		s          string
+		start, end time.Duration
+	}{
+		{"01:00-06:00", time.Hour, 6 * time.Hour},
+		{"22:00-06:00", 22 * time.Hour, 6 * time.Hour},
+		{" 07:30 - 08:15 ", 7*time.Hour + 30*time.Minute, 8*time.Hour + 15*time.Minute},
+		{"00:00-00:00", 0, 0},
+		{"23:59-00:00", 23*time.Hour + 59*time.Minute, 0},
+	} {
+		w, err := ParseDailyWindow(c.s)
+		if err != nil {
+			t.Errorf("ParseDailyWindow(%q): %v", c.s, err)
+			continue
+		}
+		if w.start != c.start || w.end != c.end {
+			t.Errorf("ParseDailyWindow(%q) = %v-%v, want %v-%v", c.s, w.start, w.end, c.start, c.end)
+		}
+	}
+	for _, s := range []string{"", "01:00", "01:00-06:00-07:00", "1-6", "24:00-06:00", "01:00-06:60", "a-b"} {
+		if _, err := ParseDailyWindow(s); err == nil {
+			t.Errorf("ParseDailyWindow(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestDailyWindowContains(t *testing.T) {
+	at := func(hour, minute, second int) time.Time {
+		return time.Date(2024, 3, 4, hour, minute, second, 0, time.UTC)
+	}
+	for _, c := range []struct {
+		window string
+		t      time.Time
+		want   bool
+	}{
+		{"01:00-06:00", at(0, 59, 59), false},
+		{"01:00-06:00", at(1, 0, 0), true}, // start is included
+		{"01:00-06:00", at(3, 0, 0), true},
+		{"01:00-06:00", at(5, 59, 59), true},
+		{"01:00-06:00", at(6, 0, 0), false}, // end is excluded
+		{"01:00-06:00", at(23, 0, 0), false},
+		// crossing midnight
+		{"22:00-06:00", at(21, 59, 59), false},
+		{"22:00-06:00", at(22, 0, 0), true},
+		{"22:00-06:00", at(23, 59, 59), true},
+		{"22:00-06:00", at(0, 0, 0), true},
+		{"22:00-06:00", at(5, 59, 59), true},
+		{"22:00-06:00", at(6, 0, 0), false},
+		{"22:00-06:00", at(12, 0, 0), false},
+		{"23:59-00:00", at(23, 59, 30), true},
+		{"23:59-00:00", at(0, 0, 0), false},
+		// equal start and end is the whole day
+		{"00:00-00:00", at(0, 0, 0), true},
+		{"00:00-00:00", at(23, 59, 59), true},
+		{"12:00-12:00", at(11, 59, 59), true},
+		{"12:00-12:00", at(12, 0, 0), true},
+	} {
+		w, err := ParseDailyWindow(c.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Contains(c.t); got != c.want {
+			t.Errorf("%v contains %v = %v, want %v", c.window, c.t.Format("15:04:05"), got, c.want)
+		}
+	}
+}
+
+// The window is in the location of the time e.g. -timezone
+func TestDailyWindowContainsLocation(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := ParseDailyWindow("22:00-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 23:00 in Tokyo is 14:00 UTC
+	now := time.Date(2024, 3, 4, 14, 0, 0, 0, time.UTC)
+	if w.Contains(now) {
+		t.Errorf("14:00 UTC is in the window")
+	}
+	if !w.Contains(now.In(tokyo)) {
+		t.Errorf("23:00 in Tokyo is not in the window")
+	}
+}
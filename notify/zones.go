@@ -0,0 +1,80 @@
+package notify
+
+import (
+	"fmt"
+)
+
+// Polygon in the frame of a device as [x, y] points relative to the frame size, i.e. [0, 0] is top left and [1, 1]
+// is bottom right
+type Zone [][2]float64
+
+func (z Zone) validate() error {
+	if len(z) < 3 {
+		return fmt.Errorf("zone needs at least 3 points: %v", z)
+	}
+	for _, p := range z {
+		if p[0] < 0 || p[0] > 1 || p[1] < 0 || p[1] > 1 {
+			return fmt.Errorf("zone points must be in [0, 1]: %v", p)
+		}
+	}
+	return nil
+}
+
+// Ray casting
+func (z Zone) contains(x, y float64) bool {
+	inside := false
+	for i, j := 0, len(z)-1; i < len(z); j, i = i, i+1 {
+		if (z[i][1] > y) != (z[j][1] > y) && x < (z[j][0]-z[i][0])*(y-z[i][1])/(z[j][1]-z[i][1])+z[i][0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Whether the box overlaps the zone
+func (z Zone) intersectsBox(xMin, yMin, xMax, yMax float64) bool {
+	corners := [][2]float64{{xMin, yMin}, {xMax, yMin}, {xMax, yMax}, {xMin, yMax}}
+	for _, c := range corners {
+		if z.contains(c[0], c[1]) {
+			return true
+		}
+	}
+	for i, p := range z {
+		if xMin <= p[0] && p[0] <= xMax && yMin <= p[1] && p[1] <= yMax {
+			return true
+		}
+		q := z[(i+1)%len(z)]
+		for j, c := range corners {
+			if segmentsIntersect(p, q, c, corners[(j+1)%len(corners)]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func segmentsIntersect(a, b, c, d [2]float64) bool {
+	cross := func(o, p, q [2]float64) float64 {
+		return (p[0]-o[0])*(q[1]-o[1]) - (p[1]-o[1])*(q[0]-o[0])
+	}
+	d1, d2 := cross(c, d, a), cross(c, d, b)
+	d3, d4 := cross(a, b, c), cross(a, b, d)
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
+
+// Whether a detection of the notification overlaps one of the zones. Notifications without detections or the frame
+// size can't be told, so they are inside
+func (n *Notification) detectedInZones(zones []Zone) bool {
+	if n.Frame == nil || n.Frame.Width <= 0 || n.Frame.Height <= 0 || len(n.Detections) == 0 {
+		return true
+	}
+	w, h := float64(n.Frame.Width), float64(n.Frame.Height)
+	for _, detection := range n.Detections {
+		for _, zone := range zones {
+			if zone.intersectsBox(float64(detection.XMin)/w, float64(detection.YMin)/h, float64(detection.XMax)/w, float64(detection.YMax)/h) {
+				return true
+			}
+		}
+	}
+	return false
+}
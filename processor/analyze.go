@@ -0,0 +1,211 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+	"github.com/cormoran/NestDoorbellConsumer/tracing"
+)
+
+// Labels objects in a JPEG frame of a saved clip e.g. by an external inference server
+type Analyzer interface {
+	Analyze(ctx context.Context, frame []byte) ([]storage.Detection, error)
+}
+
+type AnalyzerApi string
+
+const (
+	AnalyzerApiDeepStack = AnalyzerApi("deepstack") // multipart form with "image", also served by CodeProject.AI
+	AnalyzerApiRaw       = AnalyzerApi("raw")       // image/jpeg body, answered like DeepStack e.g. by a bridge to Frigate
+)
+
+// Analyzer POSTing frames to the object detection API of DeepStack or CodeProject.AI
+// e.g. http://deepstack:5000/v1/vision/detection
+type HttpAnalyzer struct {
+	url           string
+	api           AnalyzerApi
+	minConfidence float64 // detections below are dropped
+	client        *http.Client
+}
+
+func NewHttpAnalyzer(url string, api AnalyzerApi, minConfidence float64, client *http.Client) (*HttpAnalyzer, error) {
+	if api != AnalyzerApiDeepStack && api != AnalyzerApiRaw {
+		return nil, fmt.Errorf("unknown analyzer api: %v", api)
+	}
+	return &HttpAnalyzer{url: url, api: api, minConfidence: minConfidence, client: client}, nil
+}
+
+// Response of /v1/vision/detection
+type deepStackResponse struct {
+	Predictions []struct {
+		Label      string  `json:"label"`
+		Confidence float64 `json:"confidence"`
+		XMin       int     `json:"x_min"`
+		YMin       int     `json:"y_min"`
+		XMax       int     `json:"x_max"`
+		YMax       int     `json:"y_max"`
+	} `json:"predictions"`
+}
+
+// Detections in the frame, most confident first
+func (a *HttpAnalyzer) Analyze(ctx context.Context, frame []byte) ([]storage.Detection, error) {
+	var result deepStackResponse
+	if a.api == AnalyzerApiDeepStack {
+		fields := map[string]string{"min_confidence": strconv.FormatFloat(a.minConfidence, 'f', -1, 64)}
+		if err := postDeepStack(ctx, a.client, a.url, fields, [][]byte{frame}, &result); err != nil {
+			return nil, err
+		}
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(frame))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "image/jpeg")
+		if err := doDeepStack(a.client, req, &result); err != nil {
+			return nil, err
+		}
+	}
+	detections := []storage.Detection{}
+	for _, p := range result.Predictions {
+		if p.Confidence >= a.minConfidence {
+			detections = append(detections, storage.Detection{Label: p.Label, Confidence: p.Confidence, XMin: p.XMin, YMin: p.YMin, XMax: p.XMax, YMax: p.YMax})
+		}
+	}
+	sort.SliceStable(detections, func(i, j int) bool { return detections[i].Confidence > detections[j].Confidence })
+	return detections, nil
+}
+
+// POST a multipart form of fields and images ("image" for one, otherwise "image1", "image2", ...) to the DeepStack
+// API at url, and decode the response into result
+func postDeepStack(ctx context.Context, client *http.Client, url string, fields map[string]string, images [][]byte, result interface{}) error {
+	var form bytes.Buffer
+	w := multipart.NewWriter(&form)
+	for i, image := range images {
+		name := "image"
+		if len(images) > 1 {
+			name += strconv.Itoa(i + 1)
+		}
+		part, err := w.CreateFormFile(name, name+".jpg")
+		if err != nil {
+			return err
+		}
+		part.Write(image)
+	}
+	for k, v := range fields {
+		w.WriteField(k, v)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &form)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return doDeepStack(client, req, result)
+}
+
+// Send the request and decode the response into result. DeepStack responds {"success": false, "error": ...} on errors
+func doDeepStack(client *http.Client, req *http.Request, result interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var status struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	json.Unmarshal(b, &status)
+	if len(status.Error) > 0 {
+		return fmt.Errorf("%v failed: %v", req.URL.Path, status.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %v: %s", resp.Status, bytes.TrimSpace(b[:min(len(b), 1024)]))
+	}
+	return json.Unmarshal(b, result)
+}
+
+// JPEG frame of the saved clip: the image itself, or a representative frame of videos picked by ffmpeg
+func clipFrame(ctx context.Context, fileName string, contentType string) ([]byte, error) {
+	if strings.HasPrefix(contentType, "image/") {
+		return os.ReadFile(fileName)
+	}
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("analyzing videos needs ffmpeg: %v", err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, "-loglevel", "error", "-i", fileName, "-vf", "thumbnail", "-frames:v", "1", "-f", "image2pipe", "-c:v", "mjpeg", "-")
+	cmd.Stderr = &stderr
+	frame, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %v: %s", err, stderr.Bytes())
+	}
+	return frame, nil
+}
+
+// Fill the detections of the analyzer, the faces of person events and the sounds into the metadata of the saved clip.
+// Failures are logged, and the clip is saved without them
+func (p *EventProcessor) analyzeClip(ctx context.Context, fileName string, metadata *storage.ClipMetadata) {
+	if p.AudioTagger == nil && p.Analyzer == nil && p.FaceRecognizer == nil {
+		return
+	}
+	ctx, span := tracing.Start(ctx, "analyze")
+	defer span.End()
+	if p.AudioTagger != nil {
+		if samples, err := clipAudio(ctx, fileName, metadata.Download.ContentType); err != nil {
+			log.Printf("Failed to extract the audio of %v to analyze: %v", fileName, err)
+		} else if samples != nil {
+			metadata.Sounds = p.AudioTagger.TagSounds(samples, audioSampleRate)
+			log.Printf("Analyzed the audio of %v: %v", fileName, metadata.Sounds)
+		}
+	}
+	recognizeFaces := p.FaceRecognizer != nil && metadata.EventType == sdmevents.ResourceUpdateEventTypeCameraPerson
+	if p.Analyzer == nil && !recognizeFaces {
+		return
+	}
+	frame, err := clipFrame(ctx, fileName, metadata.Download.ContentType)
+	if err != nil {
+		log.Printf("Failed to extract a frame of %v to analyze: %v", fileName, err)
+		return
+	}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(frame)); err == nil {
+		metadata.Frame = &storage.FrameSize{Width: config.Width, Height: config.Height}
+	}
+	if p.Analyzer != nil {
+		if metadata.Detections, err = p.Analyzer.Analyze(ctx, frame); err != nil {
+			log.Printf("Failed to analyze %v: %v", fileName, err)
+		} else {
+			log.Printf("Analyzed %v: %v objects", fileName, len(metadata.Detections))
+		}
+	}
+	if recognizeFaces {
+		if metadata.Faces, err = p.FaceRecognizer.RecognizeFaces(ctx, frame); err != nil {
+			log.Printf("Failed to recognize faces in %v: %v", fileName, err)
+		} else {
+			log.Printf("Recognized %v faces in %v", len(metadata.Faces), fileName)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Sample rate of the mono audio decoded from clips for AudioTagger
+const audioSampleRate = 16000
+
+// Tags sounds heard in the audio of a saved clip e.g. "knock", "bark"
+type AudioTagger interface {
+	TagSounds(samples []float64, sampleRate int) []string
+}
+
+// AudioTagger of simple energy and pitch heuristics, cheap enough to run on every clip without a model. It tells
+//   - knock: a series of short, sharp bursts a beat apart
+//   - bark: loud, high pitched voiced bursts, which human speech rarely is
+//
+// Loud TVs or children may be tagged too, so use the tags to route notifications rather than to drop them.
+type HeuristicAudioTagger struct{}
+
+// Run of consecutive loud frames
+type audioBurst struct {
+	start, end int // frame index, end exclusive
+	peak       float64
+	sharp      bool // reached the peak in its first frame
+}
+
+const audioFrameSeconds = 0.01
+
+func (HeuristicAudioTagger) TagSounds(samples []float64, sampleRate int) []string {
+	frameSize := int(float64(sampleRate) * audioFrameSeconds)
+	if frameSize == 0 || len(samples) < frameSize {
+		return []string{}
+	}
+	rms := make([]float64, len(samples)/frameSize)
+	for i := range rms {
+		var sum float64
+		for _, s := range samples[i*frameSize : (i+1)*frameSize] {
+			sum += s * s
+		}
+		rms[i] = math.Sqrt(sum / float64(frameSize))
+	}
+	// loud is 18dB above the noise floor, taken as the quietest fifth of the clip
+	sorted := append([]float64{}, rms...)
+	sort.Float64s(sorted)
+	threshold := max(sorted[len(sorted)/5]*8, 0.02)
+
+	bursts := []audioBurst{}
+	for i := 0; i < len(rms); i++ {
+		if rms[i] < threshold {
+			continue
+		}
+		burst := audioBurst{start: i}
+		// allow a frame of gap inside a burst
+		for i < len(rms) && (rms[i] >= threshold || (i+1 < len(rms) && rms[i+1] >= threshold)) {
+			burst.peak = max(burst.peak, rms[i])
+			i++
+		}
+		burst.end = i
+		burst.sharp = rms[burst.start] >= burst.peak*0.5
+		bursts = append(bursts, burst)
+	}
+
+	tags := []string{}
+	if isKnocking(bursts) {
+		tags = append(tags, "knock")
+	}
+	for _, burst := range bursts {
+		frames := burst.end - burst.start
+		if frames < 10 || frames > 60 {
+			continue
+		}
+		if pitch := audioPitch(samples[burst.start*frameSize:burst.end*frameSize], sampleRate); pitch >= 300 && pitch <= 1200 {
+			tags = append(tags, "bark")
+			break
+		}
+	}
+	return tags
+}
+
+// At least 2 sharp bursts up to 80ms long with 100-700ms between them
+func isKnocking(bursts []audioBurst) bool {
+	series, last := 0, -1
+	for _, burst := range bursts {
+		if !burst.sharp || burst.end-burst.start > 8 {
+			continue
+		}
+		if gap := burst.start - last; last >= 0 && gap >= 10 && gap <= 70 {
+			series++
+		} else {
+			series = 1
+		}
+		if series >= 2 {
+			return true
+		}
+		last = burst.start
+	}
+	return false
+}
+
+// Fundamental frequency of the loudest 40ms of samples by autocorrelation, 0 if it isn't voiced
+func audioPitch(samples []float64, sampleRate int) float64 {
+	window := sampleRate * 40 / 1000
+	if len(samples) < window {
+		return 0
+	}
+	best, bestEnergy := 0, 0.0
+	for i := 0; i+window <= len(samples); i += window / 2 {
+		var energy float64
+		for _, s := range samples[i : i+window] {
+			energy += s * s
+		}
+		if energy > bestEnergy {
+			best, bestEnergy = i, energy
+		}
+	}
+	x := samples[best : best+window]
+	bestLag, bestCorrelation := 0, 0.0
+	// pitches of 200-2000Hz
+	for lag := sampleRate / 2000; lag <= sampleRate/200; lag++ {
+		var correlation float64
+		for i := 0; i+lag < len(x); i++ {
+			correlation += x[i] * x[i+lag]
+		}
+		if correlation /= bestEnergy; correlation > bestCorrelation {
+			bestLag, bestCorrelation = lag, correlation
+		}
+	}
+	if bestLag == 0 || bestCorrelation < 0.5 {
+		return 0
+	}
+	return float64(sampleRate) / float64(bestLag)
+}
+
+// Mono audio of the saved clip decoded by ffmpeg as samples in [-1, 1]. Empty for images and videos without audio
+func clipAudio(ctx context.Context, fileName string, contentType string) ([]float64, error) {
+	if strings.HasPrefix(contentType, "image/") {
+		return nil, nil
+	}
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("analyzing audio needs ffmpeg: %v", err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, "-loglevel", "error", "-i", fileName, "-map", "0:a:0?", "-ac", "1", "-ar", fmt.Sprint(audioSampleRate), "-f", "s16le", "-")
+	cmd.Stderr = &stderr
+	pcm, err := cmd.Output()
+	if err != nil {
+		if strings.Contains(stderr.String(), "does not contain any stream") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("ffmpeg failed: %v: %s", err, stderr.Bytes())
+	}
+	samples := make([]float64, len(pcm)/2)
+	for i := range samples {
+		samples[i] = float64(int16(binary.LittleEndian.Uint16(pcm[i*2:]))) / 32768
+	}
+	return samples, nil
+}
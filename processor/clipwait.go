@@ -0,0 +1,196 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"github.com/golang/groupcache/lru"
+)
+
+// How notifications of battery doorbells get the clip, which arrives with the ENDED message of the event thread up
+// to a minute after the event
+type ClipWait string
+
+const (
+	ClipWaitNone  = ClipWait("")      // notify on the first message of the thread without the clip
+	ClipWaitDefer = ClipWait("defer") // notify when the clip is saved, or without it after ClipWaitTimeout
+	ClipWaitEdit  = ClipWait("edit")  // notify on the first message, then edit the sent messages to add the clip where notifiers can (Discord, Telegram)
+	// like ClipWaitEdit, but the first notification has the image of CameraEventImage.GenerateImage, also for events
+	// with the clip in the same message
+	ClipWaitSnapshot = ClipWait("snapshot")
+)
+
+// GenerateImage of an event works only within 30 seconds after it
+const eventImageTimeout = 10 * time.Second
+
+const DefaultClipWaitTimeout = 90 * time.Second
+
+// Notifications of event threads waiting for their clip. Keys are <eventThreadId or eventSessionId>/<event type>
+type clipWaits struct {
+	mu       sync.Mutex
+	deferred map[string]*time.Timer // notifies without the clip when it fires
+	sent     *lru.Cache             // *notify.SentMessages to edit
+}
+
+func newClipWaits() *clipWaits {
+	return &clipWaits{deferred: map[string]*time.Timer{}, sent: lru.New(100)}
+}
+
+// Call notify after timeout unless takeDeferred is called before
+func (c *clipWaits) deferNotification(key string, timeout time.Duration, notify func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.deferred[key]; ok {
+		return
+	}
+	c.deferred[key] = time.AfterFunc(timeout, func() {
+		if c.takeDeferred(key) {
+			notify()
+		}
+	})
+}
+
+// Returns true if the notification of key is still deferred, and cancels its timer
+func (c *clipWaits) takeDeferred(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer, ok := c.deferred[key]
+	if ok {
+		timer.Stop()
+		delete(c.deferred, key)
+	}
+	return ok
+}
+
+func (c *clipWaits) recordSent(key string) *notify.SentMessages {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sent := &notify.SentMessages{}
+	c.sent.Add(key, sent)
+	return sent
+}
+
+// nil if no messages of key were recorded, or they were already taken
+func (c *clipWaits) takeSent(key string) *notify.SentMessages {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.sent.Get(key)
+	if !ok {
+		return nil
+	}
+	c.sent.Remove(key)
+	return v.(*notify.SentMessages)
+}
+
+func clipWaitKey(event *sdmevents.DeviceEvent, notification *notify.Notification) string {
+	if event.EventThreadId != nil {
+		return *event.EventThreadId + "/" + string(notification.EventType)
+	}
+	return notification.EventSessionId + "/" + string(notification.EventType)
+}
+
+// Hold the notification of the event thread until its clip is saved, or notify it without the clip after
+// ClipWaitTimeout
+func (p *EventProcessor) deferNotification(ctx context.Context, event *sdmevents.DeviceEvent, eventType sdmevents.ResourceUpdateEventType, notification notify.Notification) {
+	log.Printf("Waiting up to %v for the clip of %v event thread %v", p.ClipWaitTimeout, sdmevents.EventName(eventType), *event.EventThreadId)
+	ctx = context.WithoutCancel(ctx)
+	p.clipWaits.deferNotification(clipWaitKey(event, &notification), p.ClipWaitTimeout, func() {
+		log.Printf("No clip of %v event thread %v in %v, notifying without it", sdmevents.EventName(eventType), *event.EventThreadId, p.ClipWaitTimeout)
+		if err := p.deliver(ctx, event, eventType, nil, &notification, true); err != nil {
+			log.Printf("Failed to process deferred %v event: %v", sdmevents.EventName(eventType), err)
+		}
+	})
+}
+
+// Edit the messages sent when the event thread started with notification, which has the clip
+func (p *EventProcessor) editNotification(ctx context.Context, event *sdmevents.DeviceEvent, eventType sdmevents.ResourceUpdateEventType, notification *notify.Notification) {
+	if (p.ClipWait != ClipWaitEdit && p.ClipWait != ClipWaitSnapshot) || len(notification.ClipPath) == 0 {
+		return
+	}
+	sent := p.clipWaits.takeSent(clipWaitKey(event, notification))
+	if sent == nil || sent.Len() == 0 {
+		return
+	}
+	log.Printf("Editing %v sent %v notifications to add the clip", sent.Len(), notification.EventName())
+	sent.EditAll(ctx, notification)
+}
+
+// Notify with the image of the event generated by SDM instead of the clip, recording the sent messages to edit when
+// the clip is saved. Returns false if the device has no event images or generating it failed, so that the event
+// should be notified as usual
+func (p *EventProcessor) notifyEventImage(ctx context.Context, event *sdmevents.DeviceEvent, notification *notify.Notification) bool {
+	if p.Devices == nil || p.DeviceAccessService == nil {
+		return false
+	}
+	device := p.Devices.Device(notification.Device)
+	if device == nil {
+		return false
+	}
+	if ok, _ := sdmevents.DecodeDeviceTrait(device, sdmevents.DeviceTraitCameraEventImage, &struct{}{}); !ok {
+		return false
+	}
+	var payload struct {
+		EventId string `json:"eventId"`
+	}
+	if err := json.Unmarshal(event.ResourceUpdate.Events[notification.EventType], &payload); err != nil || len(payload.EventId) == 0 {
+		return false
+	}
+	imageCtx, cancel := context.WithTimeout(ctx, eventImageTimeout)
+	defer cancel()
+	image, err := p.downloadEventImage(imageCtx, notification.Device, payload.EventId)
+	if err != nil {
+		log.Printf("Failed to generate the image of %v event, notifying without it: %v", notification.EventName(), err)
+		return false
+	}
+	defer os.Remove(image)
+	withImage := *notification
+	withImage.ClipFile = image
+	ctx = notify.RecordSentMessages(ctx, p.clipWaits.recordSent(clipWaitKey(event, notification)))
+	if notified, _ := p.notify(ctx, &withImage, nil); notified {
+		p.observeNotified(ctx, &withImage)
+	}
+	return true
+}
+
+// Download the image of CameraEventImage.GenerateImage into a temp file
+func (p *EventProcessor) downloadEventImage(ctx context.Context, deviceName string, eventId string) (string, error) {
+	var image sdmevents.GenerateImageResponse
+	if err := ExecuteDeviceCommand(ctx, p.DeviceAccessService, deviceName, "sdm.devices.commands.CameraEventImage.GenerateImage", sdmevents.GenerateImageRequestParam{EventId: eventId}, &image); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, image.Url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Basic "+image.Token)
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %v", resp.Status)
+	}
+	file, err := os.CreateTemp("", "nest-event-image-*.jpg")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
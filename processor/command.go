@@ -0,0 +1,129 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/smartdevicemanagement/v1"
+)
+
+// Retry of SDM API calls failing by 429, 5xx or the network. The caller's context bounds the whole retry. Commands
+// are retried only when SDM surely didn't act on them, see sdmCommandRetryable
+const (
+	sdmAttempts       = 5
+	sdmInitialBackoff = time.Second
+	sdmMaxBackoff     = 30 * time.Second
+	sdmAttemptTimeout = time.Minute // covers waiting for the client side quota
+)
+
+// Execute SDM command of the device. result is decoded from the command results unless nil.
+func ExecuteDeviceCommand(ctx context.Context, svc *smartdevicemanagement.Service, deviceName string, command string, params interface{}, result interface{}) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	var resp *smartdevicemanagement.GoogleHomeEnterpriseSdmV1ExecuteDeviceCommandResponse
+	// commands like GenerateWebRtcStream and GenerateImage aren't idempotent, a retry after SDM acted starts another
+	// stream or image
+	err = retrySDM(ctx, command, sdmCommandRetryable, func(ctx context.Context) error {
+		resp, err = svc.Enterprises.Devices.ExecuteCommand(deviceName, &smartdevicemanagement.GoogleHomeEnterpriseSdmV1ExecuteDeviceCommandRequest{
+			Command: command,
+			Params:  b,
+		}).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Results, result)
+}
+
+// Call f with exponential backoff and jitter while it fails by 429, 5xx or transient network errors, each attempt
+// within its own deadline. Retry-After of 429 is respected. name is used in logs. Only for idempotent calls like
+// list and get
+func RetrySDM(ctx context.Context, name string, f func(ctx context.Context) error) error {
+	return retrySDM(ctx, name, sdmRetryable, f)
+}
+
+func retrySDM(ctx context.Context, name string, retryable func(err error) bool, f func(ctx context.Context) error) error {
+	backoff := sdmInitialBackoff
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, sdmAttemptTimeout)
+		err := f(attemptCtx)
+		cancel()
+		if err == nil || attempt == sdmAttempts || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		wait := sdmRetryWait(backoff, err)
+		log.Printf("SDM %v failed (attempt %v/%v), retrying in %v: %v", name, attempt, sdmAttempts, wait.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, sdmMaxBackoff)
+	}
+}
+
+// Between half and the whole backoff so that callers failed together don't retry together, or Retry-After of 429 if
+// longer
+func sdmRetryWait(backoff time.Duration, err error) time.Duration {
+	wait := backoff/2 + rand.N(backoff/2)
+	if retryAfter := sdmRetryAfter(err); retryAfter > wait {
+		wait = retryAfter
+	}
+	return wait
+}
+
+func sdmRetryable(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500
+	}
+	var quotaErr *CommandQuotaError
+	if errors.As(err, &quotaErr) {
+		// waiting longer than the queue timeout is up to the caller
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// Errors of commands after which SDM surely didn't act: 429, and the request never sent since the connection
+// couldn't be made. 5xx, timeouts and broken connections may come after SDM started a stream or generated an image
+func sdmCommandRetryable(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func sdmRetryAfter(err error) time.Duration {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusTooManyRequests || apiErr.Header == nil {
+		return 0
+	}
+	seconds, err := strconv.Atoi(apiErr.Header.Get("Retry-After"))
+	if err != nil {
+		return 0
+	}
+	return min(time.Duration(seconds)*time.Second, sdmMaxBackoff)
+}
@@ -0,0 +1,122 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestSDMRetryable(t *testing.T) {
+	refused := &url.Error{Op: "Post", URL: "https://smartdevicemanagement.googleapis.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errors.New("connection refused"))}}
+	noHost := &url.Error{Op: "Post", URL: "https://smartdevicemanagement.googleapis.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "smartdevicemanagement.googleapis.com"}}}
+	reset := &url.Error{Op: "Post", URL: "https://smartdevicemanagement.googleapis.com", Err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}}
+	timeout := &url.Error{Op: "Post", URL: "https://smartdevicemanagement.googleapis.com", Err: timeoutError{}}
+	for _, c := range []struct {
+		name    string
+		err     error
+		list    bool // RetrySDM
+		command bool // ExecuteDeviceCommand
+	}{
+		{"429", &googleapi.Error{Code: http.StatusTooManyRequests}, true, true},
+		{"500", &googleapi.Error{Code: http.StatusInternalServerError}, true, false},
+		{"503", fmt.Errorf("wrapped: %w", &googleapi.Error{Code: http.StatusServiceUnavailable}), true, false},
+		{"400", &googleapi.Error{Code: http.StatusBadRequest}, false, false},
+		{"404", &googleapi.Error{Code: http.StatusNotFound}, false, false},
+		{"connection refused", refused, true, true},
+		{"no such host", noHost, true, true},
+		{"connection reset", reset, true, false},
+		{"timeout", timeout, true, false},
+		{"unexpected EOF", fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), true, false},
+		{"EOF", io.EOF, true, false},
+		// the deadline of an attempt
+		{"attempt deadline", context.DeadlineExceeded, true, false},
+		{"quota", &CommandQuotaError{Command: "GenerateImage", Wait: time.Minute}, false, false},
+		{"other", errors.New("other"), false, false},
+	} {
+		if got := sdmRetryable(c.err); got != c.list {
+			t.Errorf("sdmRetryable(%v) = %v, want %v", c.name, got, c.list)
+		}
+		if got := sdmCommandRetryable(c.err); got != c.command {
+			t.Errorf("sdmCommandRetryable(%v) = %v, want %v", c.name, got, c.command)
+		}
+	}
+}
+
+func TestSDMRetryAfter(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want time.Duration
+	}{
+		{&googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"7"}}}, 7 * time.Second},
+		{fmt.Errorf("wrapped: %w", &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"7"}}}), 7 * time.Second},
+		// capped by the max backoff
+		{&googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"3600"}}}, sdmMaxBackoff},
+		// HTTP dates aren't supported
+		{&googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"Wed, 21 Oct 2015 07:28:00 GMT"}}}, 0},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, 0},
+		{&googleapi.Error{Code: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": {"7"}}}, 0},
+		{errors.New("other"), 0},
+	} {
+		if got := sdmRetryAfter(c.err); got != c.want {
+			t.Errorf("sdmRetryAfter(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestSDMRetryWait(t *testing.T) {
+	backoff := sdmInitialBackoff
+	for attempt := 1; attempt < 10; attempt++ {
+		for i := 0; i < 100; i++ {
+			if wait := sdmRetryWait(backoff, errors.New("other")); wait < backoff/2 || wait >= backoff {
+				t.Fatalf("wait of backoff %v = %v, want in [%v, %v)", backoff, wait, backoff/2, backoff)
+			}
+		}
+		backoff = min(backoff*2, sdmMaxBackoff)
+	}
+	if backoff != sdmMaxBackoff {
+		t.Errorf("backoff = %v, want capped at %v", backoff, sdmMaxBackoff)
+	}
+	throttled := &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"20"}}}
+	if wait := sdmRetryWait(sdmInitialBackoff, throttled); wait != 20*time.Second {
+		t.Errorf("wait of Retry-After 20 = %v, want 20s", wait)
+	}
+}
+
+func TestRetrySDMStopsOnPermanentError(t *testing.T) {
+	calls := 0
+	err := retrySDM(context.Background(), "test", sdmCommandRetryable, func(ctx context.Context) error {
+		calls++
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("attempt without deadline")
+		}
+		return &googleapi.Error{Code: http.StatusInternalServerError}
+	})
+	if calls != 1 || err == nil {
+		t.Errorf("5xx of a command = %v after %v calls, want the error after 1 call", err, calls)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	err = retrySDM(ctx, "test", sdmRetryable, func(ctx context.Context) error {
+		calls++
+		cancel()
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	})
+	if calls != 1 || err == nil {
+		t.Errorf("canceled retry = %v after %v calls, want the error after 1 call", err, calls)
+	}
+}
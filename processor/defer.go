@@ -0,0 +1,209 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+// Decides which clip downloads are deferred to download windows.
+// Event types not listed in deferredEventTypes are always downloaded immediately.
+type DeferredDownloadPolicy struct {
+	deferredEventTypes map[sdmevents.ResourceUpdateEventType]bool
+	windows            []notify.DailyWindow
+}
+
+// Returns true if the download of eventType should be deferred at t
+func (p *DeferredDownloadPolicy) ShouldDefer(eventType sdmevents.ResourceUpdateEventType, t time.Time) bool {
+	if p == nil || !p.deferredEventTypes[eventType] {
+		return false
+	}
+	return !p.InWindow(t)
+}
+
+func (p *DeferredDownloadPolicy) InWindow(t time.Time) bool {
+	for _, w := range p.windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Create policy from flag values. Returns nil if no event types are deferred.
+func NewDeferredDownloadPolicy(eventNames []string, windows []string) (*DeferredDownloadPolicy, error) {
+	if len(eventNames) == 0 {
+		return nil, nil
+	}
+	policy := &DeferredDownloadPolicy{deferredEventTypes: map[sdmevents.ResourceUpdateEventType]bool{}}
+	for _, name := range eventNames {
+		eventType, ok := sdmevents.EventTypeByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown event type: %v", name)
+		}
+		policy.deferredEventTypes[eventType] = true
+	}
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("download window is required to defer downloads")
+	}
+	for _, s := range windows {
+		w, err := notify.ParseDailyWindow(s)
+		if err != nil {
+			return nil, err
+		}
+		policy.windows = append(policy.windows, w)
+	}
+	return policy, nil
+}
+
+// Clip download persisted in a DownloadQueue
+type QueuedDownload struct {
+	Event       *sdmevents.DeviceEvent                          `json:"event"`
+	EventType   sdmevents.ResourceUpdateEventType               `json:"eventType"`
+	ClipPreview *sdmevents.ResourceUpdateEventCameraClipPreview `json:"clipPreview"`
+	QueuedAt    string                                          `json:"queuedAt"`
+	Attempts    int                                             `json:"attempts,omitempty"` // failed tries of a deferred download
+}
+
+// Downloads persisted to a file so that they survive restarts
+type DownloadQueue struct {
+	path  string
+	mu    sync.Mutex
+	items []*QueuedDownload
+}
+
+const (
+	deferredDownloadQueueFileName = ".deferred_downloads.json"
+	pendingDownloadQueueFileName  = ".pending_downloads.json"
+)
+
+// Tries of a deferred download before it's dropped, a minute apart
+const deferredDownloadAttempts = 3
+
+func openDownloadQueue(path string) (*DownloadQueue, error) {
+	q := &DownloadQueue{path: path}
+	b, err := os.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &q.items); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Open the download queue file name in StateDir, moving the one which older versions kept in OutputDir
+func (p *EventProcessor) openJournal(name string) (*DownloadQueue, error) {
+	path := filepath.Join(p.StateDir, name)
+	legacyPath := filepath.Join(p.OutputDir, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if b, err := os.ReadFile(legacyPath); err == nil {
+			if err := storage.WriteFileAtomic(path, b, 0666); err != nil {
+				return nil, err
+			}
+			if err := os.Remove(legacyPath); err != nil {
+				return nil, err
+			}
+			log.Printf("Moved %v to %v", legacyPath, path)
+		}
+	}
+	return openDownloadQueue(path)
+}
+
+func (q *DownloadQueue) save() error {
+	b, err := json.Marshal(q.items)
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(q.path, b, 0666)
+}
+
+func (q *DownloadQueue) Push(item *QueuedDownload) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, i := range q.items {
+		if i.ClipPreview.PreviewUrl == item.ClipPreview.PreviewUrl {
+			return nil
+		}
+	}
+	q.items = append(q.items, item)
+	return q.save()
+}
+
+// Remove the item downloading url
+func (q *DownloadQueue) Remove(url string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, item := range q.items {
+		if item.ClipPreview.PreviewUrl == url {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return q.save()
+		}
+	}
+	return nil
+}
+
+// Remove and return all queued items
+func (q *DownloadQueue) PopAll() ([]*QueuedDownload, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := q.items
+	q.items = nil
+	if err := q.save(); err != nil {
+		q.items = items
+		return nil, err
+	}
+	return items, nil
+}
+
+// Download deferred clips whenever current time is in a download window. Never returns.
+func (p *EventProcessor) runDeferredDownloads() {
+	for {
+		if p.DeferredDownloadPolicy.InWindow(time.Now()) {
+			p.downloadDeferred(context.Background())
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// Download the deferred clips once. Failed ones are queued again for the next pass up to deferredDownloadAttempts,
+// except for expired preview URLs, which SDM may issue for a shorter time than the wait for the window
+func (p *EventProcessor) downloadDeferred(ctx context.Context) {
+	items, err := p.deferredDownloads.PopAll()
+	if err != nil {
+		log.Printf("Failed to read deferred downloads: %v", err)
+		return
+	}
+	for _, item := range items {
+		_, _, err := p.downloadAndSaveCameraClipPreview(ctx, item.Event, item.EventType, item.ClipPreview)
+		if err == nil {
+			continue
+		}
+		item.Attempts++
+		var statusErr *downloadStatusError
+		if errors.As(err, &statusErr) && statusErr.expired() {
+			log.Printf("Dropped deferred clipPreview for eventSession %v queued at %v, its preview URL expired: %v", item.ClipPreview.EventSessionId, item.QueuedAt, err)
+			continue
+		}
+		if item.Attempts >= deferredDownloadAttempts {
+			log.Printf("Dropped deferred clipPreview for eventSession %v after %v failed attempts: %v", item.ClipPreview.EventSessionId, item.Attempts, err)
+			continue
+		}
+		log.Printf("Failed to download deferred clipPreview for eventSession %v (attempt %v/%v), trying again later: %v", item.ClipPreview.EventSessionId, item.Attempts, deferredDownloadAttempts, err)
+		if err := p.deferredDownloads.Push(item); err != nil {
+			log.Printf("Failed to queue deferred download again: %v", err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+func TestDeferredDownloadPolicy(t *testing.T) {
+	policy, err := NewDeferredDownloadPolicy([]string{"motion"}, []string{"22:00-02:00", "04:00-05:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 4, hour, minute, 0, 0, time.UTC)
+	}
+	for _, c := range []struct {
+		eventType sdmevents.ResourceUpdateEventType
+		t         time.Time
+		want      bool
+	}{
+		{sdmevents.ResourceUpdateEventTypeCameraMotion, at(12, 0), true},
+		{sdmevents.ResourceUpdateEventTypeCameraMotion, at(21, 59), true},
+		{sdmevents.ResourceUpdateEventTypeCameraMotion, at(22, 0), false},
+		{sdmevents.ResourceUpdateEventTypeCameraMotion, at(1, 59), false},
+		{sdmevents.ResourceUpdateEventTypeCameraMotion, at(2, 0), true},
+		{sdmevents.ResourceUpdateEventTypeCameraMotion, at(4, 30), false},
+		{sdmevents.ResourceUpdateEventTypeCameraMotion, at(5, 0), true},
+		// not deferred event types are downloaded at once
+		{sdmevents.ResourceUpdateEventTypeDoorbellChime, at(12, 0), false},
+	} {
+		if got := policy.ShouldDefer(c.eventType, c.t); got != c.want {
+			t.Errorf("ShouldDefer(%v, %v) = %v, want %v", sdmevents.EventName(c.eventType), c.t.Format("15:04"), got, c.want)
+		}
+	}
+	var none *DeferredDownloadPolicy
+	if none.ShouldDefer(sdmevents.ResourceUpdateEventTypeCameraMotion, at(12, 0)) {
+		t.Error("nil policy defers downloads")
+	}
+}
+
+func TestNewDeferredDownloadPolicyErrors(t *testing.T) {
+	if policy, err := NewDeferredDownloadPolicy(nil, []string{"01:00-06:00"}); policy != nil || err != nil {
+		t.Errorf("policy without deferred events = %v, %v, want nil", policy, err)
+	}
+	for _, c := range []struct {
+		events, windows []string
+	}{
+		{[]string{"motion"}, nil},
+		{[]string{"doorknock"}, []string{"01:00-06:00"}},
+		{[]string{"motion"}, []string{"01:00"}},
+	} {
+		if _, err := NewDeferredDownloadPolicy(c.events, c.windows); err == nil {
+			t.Errorf("NewDeferredDownloadPolicy(%v, %v) succeeded, want error", c.events, c.windows)
+		}
+	}
+}
+
+// Failed deferred downloads are queued again up to deferredDownloadAttempts, and expired preview URLs are dropped
+func TestDownloadDeferred(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/expired":
+			http.Error(w, "gone", http.StatusGone)
+		case "/down":
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Write([]byte("clip"))
+		}
+	}))
+	defer server.Close()
+	p := &EventProcessor{
+		Client:                 server.Client(),
+		OutputDir:              t.TempDir(),
+		StateDir:               t.TempDir(),
+		OutputFileNameFormat:   "{eventSessionId}",
+		FilePathTimeSource:     FilePathTimeSourceReceived,
+		DeferredDownloadPolicy: &DeferredDownloadPolicy{},
+	}
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, session := range []string{"ok", "expired", "down"} {
+		event := &sdmevents.DeviceEvent{EventId: session, Timestamp: "2026-10-15T01:00:00Z", ResourceUpdate: &sdmevents.ResourceUpdate{Name: "enterprises/p/devices/d"}}
+		clipPreview := &sdmevents.ResourceUpdateEventCameraClipPreview{EventSessionId: session, PreviewUrl: server.URL + "/" + session}
+		if err := p.deferredDownloads.Push(&QueuedDownload{Event: event, EventType: sdmevents.ResourceUpdateEventTypeCameraMotion, ClipPreview: clipPreview}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queued := func() []string {
+		reopened, err := openDownloadQueue(p.deferredDownloads.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions := []string{}
+		for _, item := range reopened.items {
+			sessions = append(sessions, fmt.Sprintf("%v:%v", item.ClipPreview.EventSessionId, item.Attempts))
+		}
+		return sessions
+	}
+	for i, want := range [][]string{{"down:1"}, {"down:2"}, {}} {
+		p.downloadDeferred(context.Background())
+		if got := queued(); !slices.Equal(got, want) {
+			t.Errorf("queued after pass %v = %v, want %v", i+1, got, want)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := map[string]int{"/ok": 1, "/expired": 1, "/down": deferredDownloadAttempts}; !maps.Equal(requests, want) {
+		t.Errorf("requests %v, want %v", requests, want)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(p.OutputDir, "ok_0.*")); len(matches) != 2 {
+		t.Errorf("saved %v, want the clip and its metadata", matches)
+	}
+}
+
+// Journals are kept in StateDir, out of the archive served by the datasource, and old ones in OutputDir are moved there
+func TestOpenJournal(t *testing.T) {
+	p := &EventProcessor{OutputDir: t.TempDir(), StateDir: t.TempDir()}
+	legacy := `[{"clipPreview":{"eventSessionId":"s","previewUrl":"https://example.com/clip"},"queuedAt":"2026-10-15T01:00:00Z"}]`
+	if err := os.WriteFile(filepath.Join(p.OutputDir, deferredDownloadQueueFileName), []byte(legacy), 0666); err != nil {
+		t.Fatal(err)
+	}
+	q, err := p.openJournal(deferredDownloadQueueFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.items) != 1 || q.items[0].ClipPreview.EventSessionId != "s" || q.path != filepath.Join(p.StateDir, deferredDownloadQueueFileName) {
+		t.Errorf("journal %v of %v items, want the one moved from OutputDir", q.path, len(q.items))
+	}
+	if _, err := os.Stat(filepath.Join(p.OutputDir, deferredDownloadQueueFileName)); !os.IsNotExist(err) {
+		t.Errorf("journal left in OutputDir: %v", err)
+	}
+	if err := q.Push(&QueuedDownload{ClipPreview: &sdmevents.ResourceUpdateEventCameraClipPreview{PreviewUrl: "https://example.com/clip2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(p.OutputDir); len(entries) != 0 {
+		t.Errorf("OutputDir has %v, want nothing", entries)
+	}
+	if q, err = p.openJournal(deferredDownloadQueueFileName); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.items) != 2 {
+		t.Errorf("reopened journal of %v items, want 2", len(q.items))
+	}
+}
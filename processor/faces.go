@@ -0,0 +1,98 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+// Matches faces in a JPEG frame against a gallery of known people
+type FaceRecognizer interface {
+	RecognizeFaces(ctx context.Context, frame []byte) ([]storage.Face, error)
+}
+
+// FaceRecognizer of the face API of a self-hosted DeepStack or CodeProject.AI server, which keeps the gallery and the
+// embeddings of registered faces
+type HttpFaceRecognizer struct {
+	baseUrl       string // e.g. http://localhost:5000
+	minConfidence float64
+	client        *http.Client
+}
+
+// Faces of visitors must not leave the home, so baseUrl has to be on a loopback or private address
+func NewHttpFaceRecognizer(baseUrl string, minConfidence float64, client *http.Client) (*HttpFaceRecognizer, error) {
+	u, err := url.Parse(baseUrl)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{net.ParseIP(u.Hostname())}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(u.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() {
+			return nil, fmt.Errorf("%v is not a local address. Run the face recognition server in the home", ip)
+		}
+	}
+	return &HttpFaceRecognizer{baseUrl: strings.TrimSuffix(baseUrl, "/"), minConfidence: minConfidence, client: client}, nil
+}
+
+// Faces in the frame, most confident first
+func (r *HttpFaceRecognizer) RecognizeFaces(ctx context.Context, frame []byte) ([]storage.Face, error) {
+	var result struct {
+		Predictions []struct {
+			UserId     string  `json:"userid"` // "unknown" if no registered face matched
+			Confidence float64 `json:"confidence"`
+			XMin       int     `json:"x_min"`
+			YMin       int     `json:"y_min"`
+			XMax       int     `json:"x_max"`
+			YMax       int     `json:"y_max"`
+		} `json:"predictions"`
+	}
+	fields := map[string]string{"min_confidence": strconv.FormatFloat(r.minConfidence, 'f', -1, 64)}
+	if err := postDeepStack(ctx, r.client, r.baseUrl+"/v1/vision/face/recognize", fields, [][]byte{frame}, &result); err != nil {
+		return nil, err
+	}
+	faces := []storage.Face{}
+	for _, p := range result.Predictions {
+		face := storage.Face{Name: p.UserId, Confidence: p.Confidence, XMin: p.XMin, YMin: p.YMin, XMax: p.XMax, YMax: p.YMax}
+		if face.Name == "unknown" || p.Confidence < r.minConfidence {
+			face.Name = ""
+		}
+		faces = append(faces, face)
+	}
+	sort.SliceStable(faces, func(i, j int) bool { return faces[i].Confidence > faces[j].Confidence })
+	return faces, nil
+}
+
+// Add images of the face of name to the gallery
+func (r *HttpFaceRecognizer) Register(ctx context.Context, name string, images [][]byte) error {
+	var result struct{}
+	return postDeepStack(ctx, r.client, r.baseUrl+"/v1/vision/face/register", map[string]string{"userid": name}, images, &result)
+}
+
+// Names in the gallery
+func (r *HttpFaceRecognizer) List(ctx context.Context) ([]string, error) {
+	var result struct {
+		Faces []string `json:"faces"`
+	}
+	if err := postDeepStack(ctx, r.client, r.baseUrl+"/v1/vision/face/list", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Faces, nil
+}
+
+// Remove every face of name from the gallery
+func (r *HttpFaceRecognizer) Delete(ctx context.Context, name string) error {
+	var result struct{}
+	return postDeepStack(ctx, r.client, r.baseUrl+"/v1/vision/face/delete", map[string]string{"userid": name}, nil, &result)
+}
@@ -0,0 +1,92 @@
+package processor
+
+import (
+	"fmt"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Device filter given in the config file ("devices"). A device is given by its id, full name, custom name, room name
+// or type (e.g. sdm.devices.types.DOORBELL).
+type EventFilterConfig struct {
+	Include      []string            `json:"include"`      // process only events of these devices. empty means every device
+	Exclude      []string            `json:"exclude"`      // never process events of these devices
+	IgnoreEvents map[string][]string `json:"ignoreEvents"` // device => event names not processed e.g. {"Backyard": ["motion"]}
+}
+
+// Drop events before their clips are downloaded or notified
+type EventFilter struct {
+	include      []string
+	exclude      []string
+	ignoreEvents map[string]map[sdmevents.ResourceUpdateEventType]bool
+}
+
+func NewEventFilter(config *EventFilterConfig) (*EventFilter, error) {
+	f := &EventFilter{
+		include:      config.Include,
+		exclude:      config.Exclude,
+		ignoreEvents: map[string]map[sdmevents.ResourceUpdateEventType]bool{},
+	}
+	for device, names := range config.IgnoreEvents {
+		f.ignoreEvents[device] = map[sdmevents.ResourceUpdateEventType]bool{}
+		for _, name := range names {
+			eventType, ok := sdmevents.EventTypeByName(name)
+			if !ok {
+				return nil, fmt.Errorf("ignoreEvents[%v]: unknown event type: %v", device, name)
+			}
+			f.ignoreEvents[device][eventType] = true
+		}
+	}
+	return f, nil
+}
+
+// Returns true if selector given in the config designates the device. devices may be nil, then only ids and full
+// names are matched.
+func matchesDevice(devices *DeviceRegistry, deviceName string, selector string) bool {
+	if selector == deviceName || selector == sdmevents.DeviceId(deviceName) {
+		return true
+	}
+	if devices == nil {
+		return false
+	}
+	device := devices.Device(deviceName)
+	if device == nil {
+		return false
+	}
+	if selector == device.Type || selector == sdmevents.DeviceDisplayName(device) {
+		return true
+	}
+	for _, relation := range device.ParentRelations {
+		if selector == relation.DisplayName {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns empty string if eventType event of the device is processed, otherwise the reason to ignore it
+func (f *EventFilter) Check(devices *DeviceRegistry, deviceName string, eventType sdmevents.ResourceUpdateEventType) string {
+	if f == nil {
+		return ""
+	}
+	matchesAny := func(selectors []string) bool {
+		for _, selector := range selectors {
+			if matchesDevice(devices, deviceName, selector) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(f.include) > 0 && !matchesAny(f.include) {
+		return "device not included"
+	}
+	if matchesAny(f.exclude) {
+		return "excluded device"
+	}
+	for selector, events := range f.ignoreEvents {
+		if events[eventType] && matchesDevice(devices, deviceName, selector) {
+			return "ignored event of the device"
+		}
+	}
+	return ""
+}
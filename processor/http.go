@@ -0,0 +1,66 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Transport with timeouts so that a stalled connection can't hang the caller. 0 disables each timeout.
+func NewHTTPTransport(connectTimeout time.Duration, responseHeaderTimeout time.Duration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	transport.ResponseHeaderTimeout = responseHeaderTimeout
+	return transport
+}
+
+// Body reader failing when no data arrives within timeout, or more than limit bytes are read.
+type downloadReader struct {
+	body    io.Reader
+	cancel  context.CancelFunc // cancels the request
+	timer   *time.Timer        // nil if no timeout
+	timeout time.Duration
+	limit   int64 // 0 means no limit
+	read    int64
+}
+
+// Wrap body of the request made with ctx. The returned context must be given to the request.
+func newDownloadReader(ctx context.Context, timeout time.Duration, limit int64) (*downloadReader, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &downloadReader{cancel: cancel, timeout: timeout, limit: limit}
+	if timeout > 0 {
+		r.timer = time.AfterFunc(timeout, cancel)
+	}
+	return r, ctx
+}
+
+func (r *downloadReader) Read(b []byte) (int, error) {
+	n, err := r.body.Read(b)
+	r.read += int64(n)
+	if r.limit > 0 && r.read > r.limit {
+		r.Close()
+		return n, fmt.Errorf("download exceeds the max size %v bytes", r.limit)
+	}
+	if r.timer != nil && !r.timer.Stop() {
+		// fired while waiting for the data
+		return n, fmt.Errorf("no data received for %v: %v", r.timeout, err)
+	}
+	if r.timer != nil {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func (r *downloadReader) Close() {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.cancel()
+}
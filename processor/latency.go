@@ -0,0 +1,195 @@
+package processor
+
+import (
+	"context"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Point of the pipeline whose delay from DeviceEvent.Timestamp is tracked
+type LatencyMilestone string
+
+const (
+	LatencyMilestoneReceived = LatencyMilestone("received") // the message arrived from Pub/Sub
+	LatencyMilestoneSaved    = LatencyMilestone("saved")    // the clip was downloaded, analyzed and stored
+	LatencyMilestoneNotified = LatencyMilestone("notified") // notifiers returned
+)
+
+// Quantiles are of the latest events of each milestone and event type
+const latencyWindowSize = 1000
+
+// Don't alert again for this long, e.g. while Pub/Sub redelivers a backlog after an outage
+const latencyAlertInterval = 15 * time.Minute
+
+// Delays from events to milestones of the pipeline, and whether ring-to-notification is within the budget
+type LatencyTracker struct {
+	Budget time.Duration // alert "latency" when an event is notified later than this. 0 disables alerts
+
+	mu        sync.Mutex
+	windows   map[latencyKey]*latencyWindow
+	lastAlert time.Time
+}
+
+type latencyKey struct {
+	milestone LatencyMilestone
+	event     string
+}
+
+type latencyWindow struct {
+	samples []float64 // seconds, ring buffer of the latest ones
+	next    int
+	sum     float64
+	count   int64
+}
+
+// Quantiles of the latest delays of a milestone, and sum and count of all of them
+type LatencyStats struct {
+	Milestone  LatencyMilestone
+	Event      string // e.g. chime
+	P50        float64
+	P95        float64
+	P99        float64
+	SumSeconds float64
+	Count      int64
+}
+
+func NewLatencyTracker(budget time.Duration) *LatencyTracker {
+	return &LatencyTracker{Budget: budget, windows: map[latencyKey]*latencyWindow{}}
+}
+
+// Record the delay of the milestone reached at at. false if timestamp can't be parsed. No-op for nil trackers
+func (t *LatencyTracker) Observe(milestone LatencyMilestone, eventType sdmevents.ResourceUpdateEventType, timestamp string, at time.Time) (time.Duration, bool) {
+	if t == nil {
+		return 0, false
+	}
+	eventTime, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return 0, false
+	}
+	latency := max(at.Sub(eventTime), 0)
+	key := latencyKey{milestone: milestone, event: sdmevents.EventName(eventType)}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	window, ok := t.windows[key]
+	if !ok {
+		window = &latencyWindow{}
+		t.windows[key] = window
+	}
+	if len(window.samples) < latencyWindowSize {
+		window.samples = append(window.samples, latency.Seconds())
+	} else {
+		window.samples[window.next] = latency.Seconds()
+		window.next = (window.next + 1) % latencyWindowSize
+	}
+	window.sum += latency.Seconds()
+	window.count++
+	return latency, true
+}
+
+// Stats of every milestone and event type observed
+func (t *LatencyTracker) Stats() []LatencyStats {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := []LatencyStats{}
+	for key, window := range t.windows {
+		sorted := append([]float64{}, window.samples...)
+		sort.Float64s(sorted)
+		stats = append(stats, LatencyStats{
+			Milestone:  key.milestone,
+			Event:      key.event,
+			P50:        quantile(sorted, 0.5),
+			P95:        quantile(sorted, 0.95),
+			P99:        quantile(sorted, 0.99),
+			SumSeconds: window.sum,
+			Count:      window.count,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Milestone != stats[j].Milestone {
+			return stats[i].Milestone < stats[j].Milestone
+		}
+		return stats[i].Event < stats[j].Event
+	})
+	return stats
+}
+
+// Nearest-rank quantile of sorted samples
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
+
+// p95 of notified events of the type
+func (t *LatencyTracker) notifiedP95(event string) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	window, ok := t.windows[latencyKey{milestone: LatencyMilestoneNotified, event: event}]
+	if !ok {
+		return 0
+	}
+	sorted := append([]float64{}, window.samples...)
+	sort.Float64s(sorted)
+	return quantile(sorted, 0.95)
+}
+
+// Returns true if latency is over the budget and no alert was sent recently
+func (t *LatencyTracker) shouldAlert(latency time.Duration, now time.Time) bool {
+	if t == nil || t.Budget <= 0 || latency <= t.Budget {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.lastAlert) < latencyAlertInterval {
+		return false
+	}
+	t.lastAlert = now
+	return true
+}
+
+// Record ring-to-notification latency of the notified event, and notify "latency" when it's over the budget
+func (p *EventProcessor) observeNotified(ctx context.Context, notification *notify.Notification) {
+	now := time.Now()
+	latency, ok := p.Latency.Observe(LatencyMilestoneNotified, notification.EventType, notification.Timestamp, now)
+	if !ok || !p.Latency.shouldAlert(latency, now) {
+		return
+	}
+	device := p.deviceDisplayName(notification.Device)
+	if len(device) == 0 {
+		device = sdmevents.DeviceId(notification.Device)
+	}
+	alert := notify.Notification{
+		EventType: sdmevents.ResourceUpdateEventTypeLatencyAlert,
+		Event: &sdmevents.DeviceEvent{
+			Timestamp:      notification.Timestamp,
+			ResourceUpdate: &sdmevents.ResourceUpdate{Name: notification.Device},
+		},
+		Device:    notification.Device,
+		Timestamp: notification.Timestamp,
+		LatencyAlert: &notify.LatencyAlert{
+			Event:          notification.EventName(),
+			Device:         device,
+			LatencySeconds: latency.Seconds(),
+			BudgetSeconds:  p.Latency.Budget.Seconds(),
+			P95Seconds:     p.Latency.notifiedP95(notification.EventName()),
+		},
+	}
+	log.Printf("Notified %v %v after the event, over the latency budget %v", notification.EventName(), latency.Round(time.Second), p.Latency.Budget)
+	notifiers, rules := p.NotificationSettings()
+	if reason := rules.Check(&alert, now); len(reason) > 0 {
+		log.Printf("Suppressed %v notification: %v", alert.EventName(), reason)
+		return
+	}
+	notify.NotifyAll(ctx, notifiers, &alert)
+}
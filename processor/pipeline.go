@@ -0,0 +1,311 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"github.com/cormoran/NestDoorbellConsumer/tracing"
+	"github.com/golang/groupcache/lru"
+)
+
+type PipelineStageType string
+
+const (
+	PipelineStageDedupe   = PipelineStageType("dedupe")   // skip later stages of events already processed e.g. redelivered by Pub/Sub
+	PipelineStageDownload = PipelineStageType("download") // download, analyze and save the clip preview, or defer it
+	PipelineStageNotify   = PipelineStageType("notify")   // notify by the notification rules
+	PipelineStageWasm     = PipelineStageType("wasm")     // change, annotate or drop the notification by a WebAssembly module
+)
+
+type PipelineErrorPolicy string
+
+const (
+	PipelineFailOpen   = PipelineErrorPolicy("open")   // stages after a failed one still run (default)
+	PipelineFailClosed = PipelineErrorPolicy("closed") // stages after a failed one are skipped for the event
+)
+
+// Entry of "pipeline" in the config file
+type PipelineStageConfig struct {
+	Name        string              `json:"name"`        // referred by after. defaults to type
+	Type        PipelineStageType   `json:"type"`        // dedupe, download, notify or wasm
+	After       []string            `json:"after"`       // stages to finish before this one. empty runs it first
+	Notifiers   []string            `json:"notifiers"`   // notify: ids of the notifiers (name or type in the config, webhook, mqtt, grpc). empty means all
+	Module      string              `json:"module"`      // wasm: path of the .wasm file, see notify.WasmPlugin
+	Timeout     notify.Duration     `json:"timeout"`     // wasm: of each event. default 1s
+	Concurrency int                 `json:"concurrency"` // events in the stage at once. 0 means unlimited
+	OnError     PipelineErrorPolicy `json:"onError"`     // open or closed
+}
+
+// DAG of stages each event goes through, which replaces the default download then notify. Stages whose dependencies
+// are done run in parallel, e.g. notify MQTT right away while the clip downloads for a notify stage after download.
+type Pipeline struct {
+	stages []*pipelineStage // dependencies first
+	seen   *lru.Cache       // event ids processed by dedupe stages
+	seenMu sync.Mutex
+}
+
+type pipelineStage struct {
+	PipelineStageConfig
+	after     []int              // indexes of dependencies in Pipeline.stages
+	ancestors []int              // indexes of dependencies, direct or not, in order
+	slots     chan struct{}      // nil if unlimited
+	plugin    *notify.WasmPlugin // of wasm stages
+}
+
+type pipelineStageResult int
+
+const (
+	pipelineStageDone    = pipelineStageResult(iota)
+	pipelineStageFailed  // by an error, subject to OnError
+	pipelineStageSkipped // later stages are skipped as well
+)
+
+func NewPipeline(configs []PipelineStageConfig) (*Pipeline, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no stages")
+	}
+	byName := map[string]int{}
+	downloads := 0
+	for i, config := range configs {
+		if len(config.Name) == 0 {
+			configs[i].Name = string(config.Type)
+		}
+		switch config.Type {
+		case PipelineStageDedupe, PipelineStageNotify, PipelineStageWasm:
+		case PipelineStageDownload:
+			downloads++
+		default:
+			return nil, fmt.Errorf("stage %v: unknown type %q", configs[i].Name, config.Type)
+		}
+		if len(config.Notifiers) > 0 && config.Type != PipelineStageNotify {
+			return nil, fmt.Errorf("stage %v: notifiers are only for notify stages", configs[i].Name)
+		}
+		if (len(config.Module) > 0 || config.Timeout != 0) && config.Type != PipelineStageWasm {
+			return nil, fmt.Errorf("stage %v: module and timeout are only for wasm stages", configs[i].Name)
+		}
+		if config.OnError != "" && config.OnError != PipelineFailOpen && config.OnError != PipelineFailClosed {
+			return nil, fmt.Errorf("stage %v: onError should be open or closed", configs[i].Name)
+		}
+		if config.Concurrency < 0 {
+			return nil, fmt.Errorf("stage %v: negative concurrency", configs[i].Name)
+		}
+		if config.Timeout < 0 {
+			return nil, fmt.Errorf("stage %v: negative timeout", configs[i].Name)
+		}
+		if _, ok := byName[configs[i].Name]; ok {
+			return nil, fmt.Errorf("duplicated stage %v", configs[i].Name)
+		}
+		byName[configs[i].Name] = i
+	}
+	if downloads > 1 {
+		return nil, fmt.Errorf("clips can be downloaded by one stage only")
+	}
+	// topological sort by Kahn's algorithm
+	dependents := make([][]int, len(configs))
+	waiting := make([]int, len(configs))
+	for i, config := range configs {
+		for _, name := range config.After {
+			j, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("stage %v: unknown stage %v in after", config.Name, name)
+			}
+			dependents[j] = append(dependents[j], i)
+			waiting[i]++
+		}
+	}
+	order := []int{}
+	for i := range configs {
+		if waiting[i] == 0 {
+			order = append(order, i)
+		}
+	}
+	for k := 0; k < len(order); k++ {
+		for _, i := range dependents[order[k]] {
+			if waiting[i]--; waiting[i] == 0 {
+				order = append(order, i)
+			}
+		}
+	}
+	if len(order) < len(configs) {
+		cyclic := []string{}
+		for i, config := range configs {
+			if waiting[i] > 0 {
+				cyclic = append(cyclic, config.Name)
+			}
+		}
+		return nil, fmt.Errorf("cycle in after of stages %v", strings.Join(cyclic, ", "))
+	}
+	p := &Pipeline{seen: lru.New(1000)}
+	position := make([]int, len(configs))
+	for k, i := range order {
+		position[i] = k
+		stage := &pipelineStage{PipelineStageConfig: configs[i]}
+		ancestors := map[int]bool{}
+		for _, name := range configs[i].After {
+			j := position[byName[name]]
+			stage.after = append(stage.after, j)
+			ancestors[j] = true
+			for _, a := range p.stages[j].ancestors {
+				ancestors[a] = true
+			}
+		}
+		stage.ancestors = slices.Sorted(maps.Keys(ancestors))
+		if stage.Type == PipelineStageWasm {
+			var err error
+			if stage.plugin, err = notify.NewWasmPlugin(notify.WasmPluginConfig{Name: stage.Name, Module: stage.Module, Timeout: time.Duration(stage.Timeout)}); err != nil {
+				return nil, fmt.Errorf("stage %v: %v", stage.Name, err)
+			}
+		}
+		if stage.Concurrency > 0 {
+			stage.slots = make(chan struct{}, stage.Concurrency)
+		}
+		p.stages = append(p.stages, stage)
+	}
+	return p, nil
+}
+
+// Error if a notify stage refers to a notifier not in notifiers
+func (p *Pipeline) CheckNotifiers(notifiers []notify.Notifier) error {
+	ids := map[string]bool{}
+	for _, notifier := range notifiers {
+		ids[notify.NotifierId(notifier)] = true
+	}
+	for _, stage := range p.stages {
+		for _, id := range stage.Notifiers {
+			if !ids[id] {
+				return fmt.Errorf("stage %v: unknown notifier %v", stage.Name, id)
+			}
+		}
+	}
+	return nil
+}
+
+// Run the stages for the event. Returns the error of the download stage, like without pipeline
+func (p *Pipeline) run(ctx context.Context, eventProcessor *EventProcessor, event *sdmevents.DeviceEvent, eventType sdmevents.ResourceUpdateEventType, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview, notification *notify.Notification, shouldNotify bool) error {
+	results := make([]pipelineStageResult, len(p.stages))
+	done := make([]chan struct{}, len(p.stages))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	// changes to the notification by download and wasm stages, which stages after them see
+	changes := make([]func(*notify.Notification), len(p.stages))
+	input := func(stage *pipelineStage) notify.Notification {
+		n := *notification
+		for _, j := range stage.ancestors {
+			if changes[j] != nil {
+				changes[j](&n)
+			}
+		}
+		return n
+	}
+	var downloadErr error
+	var notified sync.Once
+	var wg sync.WaitGroup
+	for i, stage := range p.stages {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[i])
+			for _, j := range stage.after {
+				<-done[j]
+				if results[j] == pipelineStageSkipped || (results[j] == pipelineStageFailed && p.stages[j].OnError == PipelineFailClosed) {
+					results[i] = pipelineStageSkipped
+					return
+				}
+			}
+			if stage.slots != nil {
+				select {
+				case stage.slots <- struct{}{}:
+					defer func() { <-stage.slots }()
+				case <-ctx.Done():
+					results[i] = pipelineStageFailed
+					return
+				}
+			}
+			ctx, span := tracing.Start(ctx, "stage", tracing.String("pipeline.stage", stage.Name))
+			defer span.End()
+			var err error
+			switch stage.Type {
+			case PipelineStageDedupe:
+				if p.markSeen(event.EventId) {
+					log.Printf("Skip %v event %v already processed", sdmevents.EventName(eventType), event.EventId)
+					results[i] = pipelineStageSkipped
+					return
+				}
+			case PipelineStageDownload:
+				var duplicate bool
+				withClip := input(stage)
+				duplicate, err = eventProcessor.saveClip(ctx, event, eventType, clipPreview, &withClip)
+				downloadErr = err
+				if duplicate {
+					// the clip preview was already processed, so were the stages after it
+					results[i] = pipelineStageSkipped
+					return
+				}
+				changes[i] = func(n *notify.Notification) {
+					n.ClipFile, n.ClipPath, n.ClipUrl = withClip.ClipFile, withClip.ClipPath, withClip.ClipUrl
+					n.Detections, n.Faces, n.Frame, n.Sounds = withClip.Detections, withClip.Faces, withClip.Frame, withClip.Sounds
+				}
+			case PipelineStageWasm:
+				n := input(stage)
+				var response *notify.PluginResponse
+				if response, err = stage.plugin.Run(ctx, &n); err != nil {
+					break
+				}
+				var reason string
+				if reason, err = response.Apply(&n); err != nil {
+					break
+				}
+				if len(reason) > 0 {
+					log.Printf("Suppressed %v notification by stage %v: %v", sdmevents.EventName(eventType), stage.Name, reason)
+					results[i] = pipelineStageSkipped
+					return
+				}
+				changes[i] = func(n *notify.Notification) {
+					// validated by the Apply above
+					response.Apply(n)
+				}
+			case PipelineStageNotify:
+				n := input(stage)
+				if !shouldNotify {
+					// already notified when the thread started
+					eventProcessor.editNotification(ctx, event, eventType, &n)
+					return
+				}
+				var ok bool
+				if ok, err = eventProcessor.notify(ctx, &n, stage.Notifiers); ok {
+					notified.Do(func() { eventProcessor.observeNotified(ctx, &n) })
+				}
+			}
+			if err != nil {
+				span.RecordError(err)
+				log.Printf("Stage %v failed for %v event: %v", stage.Name, sdmevents.EventName(eventType), err)
+				results[i] = pipelineStageFailed
+			}
+		}()
+	}
+	wg.Wait()
+	return downloadErr
+}
+
+// Returns true if the event id was seen before, and marks it seen
+func (p *Pipeline) markSeen(eventId string) bool {
+	if len(eventId) == 0 {
+		return false
+	}
+	p.seenMu.Lock()
+	defer p.seenMu.Unlock()
+	if _, ok := p.seen.Get(eventId); ok {
+		return true
+	}
+	p.seen.Add(eventId, true)
+	return false
+}
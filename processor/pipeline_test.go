@@ -0,0 +1,293 @@
+package processor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Notifier recording the "tag" annotation of each notification
+type recordingNotifier struct {
+	name string
+	mu   sync.Mutex
+	tags []string
+}
+
+func (n *recordingNotifier) Name() string {
+	return n.name
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, notification *notify.Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.tags = append(n.tags, notification.Annotations["tag"])
+	return nil
+}
+
+// WebAssembly module whose transform answers answer (shorter than 64 bytes) by the nest host API. Returns its path
+func writeWasmAnswerModule(t *testing.T, answer string) string {
+	t.Helper()
+	n := byte(len(answer))
+	b := []byte("\x00asm\x01\x00\x00\x00")
+	b = append(b,
+		1, 9, 2, 0x60, 0, 0, 0x60, 2, 0x7f, 0x7f, 0, // types () and (i32, i32)
+		2, 15, 1, 4, 'n', 'e', 's', 't', 6, 'o', 'u', 't', 'p', 'u', 't', 0, 1, // import nest.output
+		3, 2, 1, 0, // function 1 of type ()
+		5, 3, 1, 0, 1, // memory of a page
+		7, 13, 1, 9, 't', 'r', 'a', 'n', 's', 'f', 'o', 'r', 'm', 0, 1, // export transform
+		10, 10, 1, 8, 0, 0x41, 0, 0x41, n, 0x10, 0, 0x0b, // transform calls output(0, len(answer))
+		11, 6+n, 1, 0, 0x41, 0, 0x0b, n, // answer at 0
+	)
+	b = append(b, answer...)
+	path := filepath.Join(t.TempDir(), "answer.wasm")
+	if err := os.WriteFile(path, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func stageNames(p *Pipeline, indexes []int) []string {
+	names := []string{}
+	for _, i := range indexes {
+		names = append(names, p.stages[i].Name)
+	}
+	return names
+}
+
+func TestNewPipelineOrder(t *testing.T) {
+	p, err := NewPipeline([]PipelineStageConfig{
+		{Name: "late", Type: PipelineStageNotify, After: []string{"download", "mqtt"}},
+		{Type: PipelineStageDownload, After: []string{"dedupe"}},
+		{Name: "mqtt", Type: PipelineStageNotify, After: []string{"dedupe"}},
+		{Type: PipelineStageDedupe},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	position := map[string]int{}
+	for i, stage := range p.stages {
+		position[stage.Name] = i
+		for _, j := range stage.after {
+			if j >= i {
+				t.Errorf("stage %v runs before its dependency %v", stage.Name, p.stages[j].Name)
+			}
+		}
+	}
+	if len(position) != 4 || position["dedupe"] != 0 || position["late"] != 3 {
+		t.Errorf("order = %v, want dedupe first and late last", position)
+	}
+	for _, c := range []struct {
+		stage     string
+		ancestors []string
+	}{
+		{"dedupe", []string{}},
+		{"download", []string{"dedupe"}},
+		{"mqtt", []string{"dedupe"}},
+		{"late", []string{"dedupe", "download", "mqtt"}},
+	} {
+		got := stageNames(p, p.stages[position[c.stage]].ancestors)
+		slices.Sort(got)
+		if !reflect.DeepEqual(got, c.ancestors) {
+			t.Errorf("ancestors of %v = %v, want %v", c.stage, got, c.ancestors)
+		}
+	}
+}
+
+func TestNewPipelineErrors(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		configs []PipelineStageConfig
+		want    string
+	}{
+		{"no stages", nil, "no stages"},
+		{"unknown type", []PipelineStageConfig{{Type: "upload"}}, "unknown type"},
+		{"notifiers of download", []PipelineStageConfig{{Type: PipelineStageDownload, Notifiers: []string{"mqtt"}}}, "notifiers are only for notify"},
+		{"module of notify", []PipelineStageConfig{{Type: PipelineStageNotify, Module: "a.wasm"}}, "only for wasm"},
+		{"timeout of dedupe", []PipelineStageConfig{{Type: PipelineStageDedupe, Timeout: 1}}, "only for wasm"},
+		{"unknown onError", []PipelineStageConfig{{Type: PipelineStageNotify, OnError: "retry"}}, "onError"},
+		{"negative concurrency", []PipelineStageConfig{{Type: PipelineStageNotify, Concurrency: -1}}, "negative concurrency"},
+		{"negative timeout", []PipelineStageConfig{{Type: PipelineStageWasm, Timeout: -1}}, "negative timeout"},
+		{"duplicated name", []PipelineStageConfig{{Type: PipelineStageNotify}, {Type: PipelineStageNotify}}, "duplicated stage notify"},
+		{"two downloads", []PipelineStageConfig{{Type: PipelineStageDownload}, {Name: "again", Type: PipelineStageDownload}}, "one stage"},
+		{"unknown after", []PipelineStageConfig{{Type: PipelineStageNotify, After: []string{"download"}}}, "unknown stage download"},
+		{"cycle", []PipelineStageConfig{
+			{Type: PipelineStageDedupe},
+			{Name: "a", Type: PipelineStageNotify, After: []string{"dedupe", "b"}},
+			{Name: "b", Type: PipelineStageNotify, After: []string{"a"}},
+		}, "cycle in after of stages a, b"},
+		{"wasm without module", []PipelineStageConfig{{Type: PipelineStageWasm}}, "module is required"},
+		{"wasm of missing module", []PipelineStageConfig{{Type: PipelineStageWasm, Module: filepath.Join(t.TempDir(), "missing.wasm")}}, "missing.wasm"},
+	} {
+		if _, err := NewPipeline(c.configs); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v: error = %v, want containing %q", c.name, err, c.want)
+		}
+	}
+}
+
+func TestPipelineCheckNotifiers(t *testing.T) {
+	p, err := NewPipeline([]PipelineStageConfig{{Type: PipelineStageNotify, Notifiers: []string{"a", "b"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CheckNotifiers([]notify.Notifier{&recordingNotifier{name: "a"}, &recordingNotifier{name: "b"}}); err != nil {
+		t.Error(err)
+	}
+	if err := p.CheckNotifiers([]notify.Notifier{&recordingNotifier{name: "a"}}); err == nil || !strings.Contains(err.Error(), "unknown notifier b") {
+		t.Errorf("error = %v, want unknown notifier b", err)
+	}
+}
+
+// Run the event through p with notifiers a and b. Returns the tags notified by each
+func runPipeline(t *testing.T, p *Pipeline, eventId string, shouldNotify bool) map[string][]string {
+	t.Helper()
+	a, b := &recordingNotifier{name: "a"}, &recordingNotifier{name: "b"}
+	processor := &EventProcessor{Notifiers: []notify.Notifier{a, b}}
+	event := &sdmevents.DeviceEvent{EventId: eventId, Timestamp: "2026-10-15T10:00:00Z"}
+	notification := &notify.Notification{
+		EventType: sdmevents.ResourceUpdateEventTypeDoorbellChime,
+		Event:     event,
+		Timestamp: event.Timestamp,
+	}
+	if err := p.run(context.Background(), processor, event, notification.EventType, nil, notification, shouldNotify); err != nil {
+		t.Fatal(err)
+	}
+	if notification.Annotations != nil {
+		t.Errorf("stages changed the notification of the caller: %v", notification.Annotations)
+	}
+	return map[string][]string{"a": a.tags, "b": b.tags}
+}
+
+func TestPipelineRun(t *testing.T) {
+	suppress := writeWasmAnswerModule(t, `{"action":"suppress","reason":"cat"}`)
+	tag := writeWasmAnswerModule(t, `{"annotations":{"tag":"cat"}}`)
+	invalid := writeWasmAnswerModule(t, `{`)
+	for _, c := range []struct {
+		name    string
+		configs []PipelineStageConfig
+		want    map[string][]string
+	}{
+		{
+			name:    "notify all",
+			configs: []PipelineStageConfig{{Type: PipelineStageDownload}, {Type: PipelineStageNotify, After: []string{"download"}}},
+			want:    map[string][]string{"a": {""}, "b": {""}},
+		},
+		{
+			name: "notifiers of each stage",
+			configs: []PipelineStageConfig{
+				{Name: "first", Type: PipelineStageNotify, Notifiers: []string{"a"}},
+				{Name: "second", Type: PipelineStageNotify, Notifiers: []string{"a", "b"}},
+			},
+			want: map[string][]string{"a": {"", ""}, "b": {""}},
+		},
+		{
+			name: "changes reach only later stages",
+			configs: []PipelineStageConfig{
+				{Name: "tag", Type: PipelineStageWasm, Module: tag},
+				{Name: "late", Type: PipelineStageNotify, After: []string{"tag"}, Notifiers: []string{"a"}},
+				{Name: "early", Type: PipelineStageNotify, Notifiers: []string{"b"}},
+			},
+			want: map[string][]string{"a": {"cat"}, "b": {""}},
+		},
+		{
+			name: "changes reach stages after later stages",
+			configs: []PipelineStageConfig{
+				{Name: "tag", Type: PipelineStageWasm, Module: tag},
+				{Type: PipelineStageDownload, After: []string{"tag"}},
+				{Type: PipelineStageNotify, After: []string{"download"}},
+			},
+			want: map[string][]string{"a": {"cat"}, "b": {"cat"}},
+		},
+		{
+			name: "suppress skips later stages",
+			configs: []PipelineStageConfig{
+				{Name: "filter", Type: PipelineStageWasm, Module: suppress},
+				{Type: PipelineStageDownload, After: []string{"filter"}},
+				{Name: "late", Type: PipelineStageNotify, After: []string{"download"}, Notifiers: []string{"a"}},
+				{Name: "early", Type: PipelineStageNotify, Notifiers: []string{"b"}},
+			},
+			want: map[string][]string{"b": {""}},
+		},
+		{
+			name: "suppress skips stages after any skipped dependency",
+			configs: []PipelineStageConfig{
+				{Name: "filter", Type: PipelineStageWasm, Module: suppress},
+				{Name: "tag", Type: PipelineStageWasm, Module: tag},
+				{Type: PipelineStageNotify, After: []string{"tag", "filter"}},
+			},
+			want: map[string][]string{},
+		},
+		{
+			name: "failed open stage runs later stages",
+			configs: []PipelineStageConfig{
+				{Name: "broken", Type: PipelineStageWasm, Module: invalid},
+				{Type: PipelineStageNotify, After: []string{"broken"}},
+			},
+			want: map[string][]string{"a": {""}, "b": {""}},
+		},
+		{
+			name: "failed closed stage skips later stages",
+			configs: []PipelineStageConfig{
+				{Name: "broken", Type: PipelineStageWasm, Module: invalid, OnError: PipelineFailClosed},
+				{Name: "late", Type: PipelineStageNotify, After: []string{"broken"}, Notifiers: []string{"a"}},
+				{Name: "early", Type: PipelineStageNotify, Notifiers: []string{"b"}},
+			},
+			want: map[string][]string{"b": {""}},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := NewPipeline(c.configs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := runPipeline(t, p, "event", true)
+			for name, tags := range got {
+				if len(tags) == 0 {
+					delete(got, name)
+				}
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("notified %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPipelineDedupe(t *testing.T) {
+	p, err := NewPipeline([]PipelineStageConfig{{Type: PipelineStageDedupe}, {Type: PipelineStageNotify, After: []string{"dedupe"}, Notifiers: []string{"a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		eventId string
+		want    int
+	}{
+		{"1", 1},
+		{"1", 0}, // redelivered
+		{"2", 1},
+		{"", 1}, // events without id are never deduplicated
+		{"", 1},
+	} {
+		if got := len(runPipeline(t, p, c.eventId, true)["a"]); got != c.want {
+			t.Errorf("event %q notified %v times, want %v", c.eventId, got, c.want)
+		}
+	}
+}
+
+// Events of threads already notified go through the stages without notifying again
+func TestPipelineRunWithoutNotify(t *testing.T) {
+	p, err := NewPipeline([]PipelineStageConfig{{Type: PipelineStageDownload}, {Type: PipelineStageNotify, After: []string{"download"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runPipeline(t, p, "event", false); len(got["a"])+len(got["b"]) > 0 {
+		t.Errorf("notified %v, want nothing", got)
+	}
+}
@@ -0,0 +1,95 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Periodically reload devices from SDM so that trait state stays fresh even when no events arrive,
+// and notify when a device stays offline longer than offlineAlertThreshold.
+type DevicePoller struct {
+	Devices               *DeviceRegistry
+	States                *DeviceStateTracker
+	Interval              time.Duration
+	OfflineAlertThreshold time.Duration                                         // 0 disables alerts
+	Notifications         func() ([]notify.Notifier, *notify.NotificationRules) // current notifiers and rules e.g. EventProcessor.NotificationSettings
+	alerted               map[string]bool                                       // device name => alerted in the current offline period
+}
+
+// Poll until ctx is done
+func (p *DevicePoller) Run(ctx context.Context) {
+	p.alerted = map[string]bool{}
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.poll(ctx)
+		}
+	}
+}
+
+func (p *DevicePoller) poll(ctx context.Context) {
+	now := time.Now()
+	for _, device := range p.Devices.Devices() {
+		if err := p.Devices.RefreshDevice(ctx, device.Name); err != nil {
+			log.Printf("Failed to poll device %v: %v", device.Name, err)
+			continue
+		}
+		refreshed := p.Devices.Device(device.Name)
+		if refreshed == nil {
+			continue
+		}
+		var traits map[string]json.RawMessage
+		if err := json.Unmarshal(refreshed.Traits, &traits); err == nil {
+			p.States.Update(refreshed.Name, traits, now)
+		}
+	}
+	if p.OfflineAlertThreshold > 0 {
+		p.alertOfflineDevices(now)
+	}
+}
+
+func (p *DevicePoller) alertOfflineDevices(now time.Time) {
+	for _, state := range p.States.States() {
+		device := p.Devices.Device(state.Device)
+		if device == nil {
+			// device of other project
+			continue
+		}
+		if len(state.Connectivity) == 0 || state.Online() {
+			delete(p.alerted, state.Device)
+			continue
+		}
+		if p.alerted[state.Device] || now.Sub(state.ConnectivitySince) < p.OfflineAlertThreshold {
+			continue
+		}
+		p.alerted[state.Device] = true
+		timestamp := state.ConnectivitySince.Format(time.RFC3339)
+		notification := notify.Notification{
+			EventType: sdmevents.ResourceUpdateEventTypeDeviceOffline,
+			Event: &sdmevents.DeviceEvent{
+				Timestamp:      timestamp,
+				ResourceUpdate: &sdmevents.ResourceUpdate{Name: state.Device},
+			},
+			Device:     state.Device,
+			DeviceName: sdmevents.DeviceDisplayName(device),
+			Timestamp:  timestamp,
+		}
+		notification.Room, notification.Structure = p.Devices.Placement(state.Device)
+		log.Printf("Device %v has been offline since %v", state.Device, timestamp)
+		notifiers, rules := p.Notifications()
+		if reason := rules.Check(&notification, now); len(reason) > 0 {
+			log.Printf("Suppressed %v notification: %v", notification.EventName(), reason)
+			continue
+		}
+		notify.NotifyAll(context.Background(), notifiers, &notification)
+	}
+}
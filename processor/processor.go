@@ -0,0 +1,738 @@
+// Package processor handles SDM events: it saves clip previews and notifies the events.
+package processor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+	"github.com/cormoran/NestDoorbellConsumer/tracing"
+	"github.com/golang/groupcache/lru"
+	"google.golang.org/api/smartdevicemanagement/v1"
+)
+
+type resourceUpdateEventHandler struct {
+	eventType sdmevents.ResourceUpdateEventType
+	// raw is the event payload of eventType. clipPreview is nil if the update doesn't contain ClipPreview event.
+	handle func(ctx context.Context, p *EventProcessor, event *sdmevents.DeviceEvent, raw json.RawMessage, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error
+}
+
+// Handlers in priority order. Only the first event type found in a ResourceUpdate is processed.
+var resourceUpdateEventHandlers []*resourceUpdateEventHandler
+
+// Register handler of a ResourceUpdate event type. Handlers registered earlier take priority when an update contains multiple events.
+func registerResourceUpdateEventHandler(eventType sdmevents.ResourceUpdateEventType, handle func(ctx context.Context, p *EventProcessor, event *sdmevents.DeviceEvent, raw json.RawMessage, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error) {
+	resourceUpdateEventHandlers = append(resourceUpdateEventHandlers, &resourceUpdateEventHandler{
+		eventType: eventType,
+		handle:    handle,
+	})
+}
+
+func init() {
+	registerResourceUpdateEventHandler(sdmevents.ResourceUpdateEventTypeDoorbellChime, func(ctx context.Context, p *EventProcessor, event *sdmevents.DeviceEvent, raw json.RawMessage, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error {
+		var chimeEvent sdmevents.ResourceUpdateEventDoorbellChime
+		if err := json.Unmarshal(raw, &chimeEvent); err != nil {
+			return err
+		}
+		return p.processChimeEvent(ctx, event, &chimeEvent, clipPreview)
+	})
+	registerResourceUpdateEventHandler(sdmevents.ResourceUpdateEventTypeCameraPackageLeft, func(ctx context.Context, p *EventProcessor, event *sdmevents.DeviceEvent, raw json.RawMessage, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error {
+		var packageEvent sdmevents.ResourceUpdateEventCameraPackage
+		if err := json.Unmarshal(raw, &packageEvent); err != nil {
+			return err
+		}
+		return p.processPackageEvent(ctx, event, sdmevents.ResourceUpdateEventTypeCameraPackageLeft, &packageEvent, clipPreview)
+	})
+	registerResourceUpdateEventHandler(sdmevents.ResourceUpdateEventTypeCameraPackageRetrieved, func(ctx context.Context, p *EventProcessor, event *sdmevents.DeviceEvent, raw json.RawMessage, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error {
+		var packageEvent sdmevents.ResourceUpdateEventCameraPackage
+		if err := json.Unmarshal(raw, &packageEvent); err != nil {
+			return err
+		}
+		return p.processPackageEvent(ctx, event, sdmevents.ResourceUpdateEventTypeCameraPackageRetrieved, &packageEvent, clipPreview)
+	})
+	registerResourceUpdateEventHandler(sdmevents.ResourceUpdateEventTypeCameraMotion, func(ctx context.Context, p *EventProcessor, event *sdmevents.DeviceEvent, raw json.RawMessage, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error {
+		var motionEvent sdmevents.ResourceUpdateEventCameraMotion
+		if err := json.Unmarshal(raw, &motionEvent); err != nil {
+			return err
+		}
+		return p.processMotionEvent(ctx, event, &motionEvent, clipPreview)
+	})
+	registerResourceUpdateEventHandler(sdmevents.ResourceUpdateEventTypeCameraPerson, func(ctx context.Context, p *EventProcessor, event *sdmevents.DeviceEvent, raw json.RawMessage, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error {
+		var personEvent sdmevents.ResourceUpdateEventCameraPerson
+		if err := json.Unmarshal(raw, &personEvent); err != nil {
+			return err
+		}
+		// familiar faces reach file names, metadata and notifications by sdmevents.EventFamiliarFace
+		return p.processPersonEvent(ctx, event, &personEvent, clipPreview)
+	})
+	registerResourceUpdateEventHandler(sdmevents.ResourceUpdateEventTypeCameraSound, func(ctx context.Context, p *EventProcessor, event *sdmevents.DeviceEvent, raw json.RawMessage, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error {
+		var soundEvent sdmevents.ResourceUpdateEventCameraSound
+		if err := json.Unmarshal(raw, &soundEvent); err != nil {
+			return err
+		}
+		return p.processSoundEvent(ctx, event, &soundEvent, clipPreview)
+	})
+}
+
+// Which time is used to format output file path
+type FilePathTimeSource string
+
+const (
+	FilePathTimeSourceEvent    = FilePathTimeSource("event")    // DeviceEvent.Timestamp
+	FilePathTimeSourceReceived = FilePathTimeSource("received") // time when the event was received
+)
+
+type EventProcessor struct {
+	Devices                   *DeviceRegistry     // nil if device list is not tracked
+	DeviceStates              *DeviceStateTracker // nil if traits are not tracked
+	Client                    *http.Client
+	DeviceAccessService       *smartdevicemanagement.Service
+	OutputDir                 string
+	StateDir                  string // journals of pending and deferred downloads. outside OutputDir, which the datasource serves
+	OutputFileNameFormat      string
+	DownloadAttempts          int
+	FilePathTimeSource        FilePathTimeSource
+	LateArrivalThreshold      time.Duration
+	ClipBaseUrl               string
+	Notifiers                 []notify.Notifier
+	NotificationRules         *notify.NotificationRules    // nil if not configured
+	DeferredDownloadPolicy    *DeferredDownloadPolicy      // nil if no downloads are deferred
+	DeviceFilter              func(deviceName string) bool // nil processes every device
+	EventFilter               *EventFilter                 // nil processes every event
+	SkipSavedClips            bool                         // don't download clips of event sessions already saved e.g. when replaying events
+	DryRun                    bool                         // log downloads instead of writing anything to OutputDir
+	Location                  *time.Location               // time zone of output paths and metadata timestamps. nil means the local time zone
+	ReadTimeout               time.Duration                // abort a download receiving no data for this long. 0 disables it
+	MaxDownloadBytes          int64                        // abort a download larger than this. 0 means no limit
+	ClipSaved                 func(path string)            // called with the path of each clip saved with its metadata. nil ignores it
+	Analyzer                  Analyzer                     // labels objects of saved clips into their metadata and notifications. nil skips it
+	FaceRecognizer            FaceRecognizer               // recognizes faces of saved person clips into their metadata and notifications. nil skips it
+	AudioTagger               AudioTagger                  // tags sounds of saved video clips into their metadata and notifications. nil skips it
+	Latency                   *LatencyTracker              // delays of events to milestones of the pipeline. nil doesn't track them
+	Pipeline                  *Pipeline                    // stages of events with a clip preview or notification. nil downloads the clip then notifies
+	Plugins                   []*notify.Plugin             // annotate or suppress each notification of events in order, after the notification rules
+	ClipWait                  ClipWait                     // how notifications of event threads wait for their clip
+	ClipWaitTimeout           time.Duration                // notifications deferred by ClipWaitDefer are sent without the clip after this. 0 means DefaultClipWaitTimeout
+	deferredDownloads         *DownloadQueue
+	pendingDownloads          *DownloadQueue // downloads in progress, re-run on startup when the process crashed during them
+	wasClipPreviewProcessed   *lru.Cache
+	wasClipPreviewProcessedMu sync.Mutex
+	eventThreads              *lru.Cache // eventThreadId => map[sdmevents.ResourceUpdateEventType]bool of notified event types
+	eventThreadsMu            sync.Mutex
+	clipWaits                 *clipWaits
+	settingsMu                sync.RWMutex // guards Notifiers, NotificationRules and EventFilter after Init
+}
+
+func (p *EventProcessor) clipSaved(path string) {
+	if p.ClipSaved != nil {
+		p.ClipSaved(path)
+	}
+}
+
+// Replace notifiers, notification rules and the event filter while events are processed e.g. when the config is reloaded
+func (p *EventProcessor) Reconfigure(notifiers []notify.Notifier, rules *notify.NotificationRules, filter *EventFilter) {
+	p.settingsMu.Lock()
+	defer p.settingsMu.Unlock()
+	p.Notifiers = notifiers
+	p.NotificationRules = rules
+	p.EventFilter = filter
+}
+
+// Current notifiers and notification rules
+func (p *EventProcessor) NotificationSettings() ([]notify.Notifier, *notify.NotificationRules) {
+	p.settingsMu.RLock()
+	defer p.settingsMu.RUnlock()
+	return p.Notifiers, p.NotificationRules
+}
+
+func (p *EventProcessor) eventFilter() *EventFilter {
+	p.settingsMu.RLock()
+	defer p.settingsMu.RUnlock()
+	return p.EventFilter
+}
+
+func (p *EventProcessor) Init() error {
+	p.wasClipPreviewProcessed = lru.New(100)
+	p.eventThreads = lru.New(100)
+	p.clipWaits = newClipWaits()
+	switch p.ClipWait {
+	case ClipWaitNone, ClipWaitDefer, ClipWaitEdit, ClipWaitSnapshot:
+	default:
+		return fmt.Errorf("unknown clip wait strategy: %v", p.ClipWait)
+	}
+	if p.ClipWaitTimeout <= 0 {
+		p.ClipWaitTimeout = DefaultClipWaitTimeout
+	}
+	if p.FilePathTimeSource != FilePathTimeSourceEvent && p.FilePathTimeSource != FilePathTimeSourceReceived {
+		return fmt.Errorf("unknown file path time source: %v", p.FilePathTimeSource)
+	}
+	if p.DownloadAttempts < 1 {
+		p.DownloadAttempts = 1
+	}
+	if p.DryRun {
+		return nil
+	}
+	if _, err := os.Stat(p.OutputDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(p.OutputDir, 0777); err != nil {
+			return err
+		}
+	}
+	if err := storage.RemoveTempFiles(p.OutputDir); err != nil {
+		return err
+	}
+	if len(p.StateDir) == 0 {
+		return fmt.Errorf("state directory is required")
+	}
+	if err := os.MkdirAll(p.StateDir, 0777); err != nil {
+		return err
+	}
+	pendingDownloads, err := p.openJournal(pendingDownloadQueueFileName)
+	if err != nil {
+		return err
+	}
+	p.pendingDownloads = pendingDownloads
+	go p.resumePendingDownloads()
+	if p.DeferredDownloadPolicy != nil {
+		queue, err := p.openJournal(deferredDownloadQueueFileName)
+		if err != nil {
+			return err
+		}
+		p.deferredDownloads = queue
+		go p.runDeferredDownloads()
+	}
+	return nil
+}
+
+func (p *EventProcessor) Process(event *sdmevents.DeviceEvent) error {
+	return p.ProcessContext(context.Background(), event)
+}
+
+// Process with outbound requests (downloads, notifications) canceled when ctx is done
+func (p *EventProcessor) ProcessContext(ctx context.Context, event *sdmevents.DeviceEvent) error {
+	ctx, span := tracing.Start(ctx, "process", tracing.String("sdm.event_id", event.EventId))
+	defer span.End()
+	var err error
+	if event.ResourceUpdate != nil {
+		err = p.processResourceUpdateEvent(ctx, event)
+	} else if event.RelationUpdate != nil {
+		err = p.processRelationUpdateEvent(ctx, event)
+	} else {
+		err = errors.New("Unsupported event: " + event.Format())
+	}
+	span.RecordError(err)
+	return err
+}
+
+func (p *EventProcessor) processResourceUpdateEvent(ctx context.Context, event *sdmevents.DeviceEvent) error {
+	resourceUpdate := event.ResourceUpdate
+	at := time.Now()
+	if t, err := time.Parse(time.RFC3339Nano, event.Timestamp); err == nil {
+		at = t
+	}
+	if len(resourceUpdate.Traits) > 0 && p.DeviceStates != nil {
+		p.DeviceStates.Update(resourceUpdate.Name, resourceUpdate.Traits, at)
+		if len(resourceUpdate.Events) == 0 {
+			return nil
+		}
+	}
+	if p.DeviceFilter != nil && !p.DeviceFilter(resourceUpdate.Name) {
+		log.Printf("Ignored event of filtered device %v", resourceUpdate.Name)
+		return nil
+	}
+	var clipPreviewEvent *sdmevents.ResourceUpdateEventCameraClipPreview
+	if raw, ok := resourceUpdate.Events[sdmevents.ResourceUpdateEventTypeCameraClipPreview]; ok {
+		clipPreviewEvent = &sdmevents.ResourceUpdateEventCameraClipPreview{}
+		if err := json.Unmarshal(raw, clipPreviewEvent); err != nil {
+			clipPreviewEvent = nil
+		}
+	}
+	filtered := false
+	eventFilter := p.eventFilter()
+	for _, handler := range resourceUpdateEventHandlers {
+		if raw, ok := resourceUpdate.Events[handler.eventType]; ok {
+			if reason := eventFilter.Check(p.Devices, resourceUpdate.Name, handler.eventType); len(reason) > 0 {
+				// a lower priority event in the same update may still be processed
+				log.Printf("Ignored %v event of %v: %v", sdmevents.EventName(handler.eventType), resourceUpdate.Name, reason)
+				filtered = true
+				continue
+			}
+			if p.DeviceStates != nil {
+				p.DeviceStates.EventReceived(resourceUpdate.Name, handler.eventType, at)
+			}
+			return handler.handle(ctx, p, event, raw, clipPreviewEvent)
+		}
+	}
+	if filtered {
+		return nil
+	}
+	var events = []string{}
+	for key := range resourceUpdate.Events {
+		events = append(events, string(key))
+	}
+	var traits = []string{}
+	for key := range resourceUpdate.Traits {
+		traits = append(traits, string(key))
+	}
+	// new event types may be added to SDM any time, so don't treat them as error
+	log.Printf("Ignored unsupported resource update event:\n\t* user id(%v)\n\t* events(%v)\n\t* traits(%v)", event.UserId, strings.Join(events, ","), strings.Join(traits, ","))
+	return nil
+}
+
+func (p *EventProcessor) processChimeEvent(ctx context.Context, event *sdmevents.DeviceEvent, chime *sdmevents.ResourceUpdateEventDoorbellChime, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error {
+	log.Printf("processChimeEvent: %v, %v", chime.Format(), clipPreview.Format())
+	return p.saveAndNotify(ctx, event, sdmevents.ResourceUpdateEventTypeDoorbellChime, chime.EventSessionId, clipPreview)
+}
+
+func (p *EventProcessor) processMotionEvent(ctx context.Context, event *sdmevents.DeviceEvent, motion *sdmevents.ResourceUpdateEventCameraMotion, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error {
+	log.Printf("processMotionEvent: %v, %v", motion.Format(), clipPreview.Format())
+	return p.saveAndNotify(ctx, event, sdmevents.ResourceUpdateEventTypeCameraMotion, motion.EventSessionId, clipPreview)
+}
+
+func (p *EventProcessor) processPersonEvent(ctx context.Context, event *sdmevents.DeviceEvent, person *sdmevents.ResourceUpdateEventCameraPerson, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error {
+	log.Printf("processPersonEvent: %v, %v", person.Format(), clipPreview.Format())
+	return p.saveAndNotify(ctx, event, sdmevents.ResourceUpdateEventTypeCameraPerson, person.EventSessionId, clipPreview)
+}
+
+func (p *EventProcessor) processPackageEvent(ctx context.Context, event *sdmevents.DeviceEvent, eventType sdmevents.ResourceUpdateEventType, packageEvent *sdmevents.ResourceUpdateEventCameraPackage, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error {
+	log.Printf("processPackageEvent: %v, %v, %v", eventType, packageEvent.Format(), clipPreview.Format())
+	return p.saveAndNotify(ctx, event, eventType, packageEvent.EventSessionId, clipPreview)
+}
+
+func (p *EventProcessor) processSoundEvent(ctx context.Context, event *sdmevents.DeviceEvent, sound *sdmevents.ResourceUpdateEventCameraSound, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error {
+	log.Printf("processSoundEvent: %v, %v", sound.Format(), clipPreview.Format())
+	return p.saveAndNotify(ctx, event, sdmevents.ResourceUpdateEventTypeCameraSound, sound.EventSessionId, clipPreview)
+}
+
+// Save clip preview if any, then notify the event to notifiers.
+func (p *EventProcessor) saveAndNotify(ctx context.Context, event *sdmevents.DeviceEvent, eventType sdmevents.ResourceUpdateEventType, eventSessionId string, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) error {
+	notification := notify.Notification{
+		EventType:      eventType,
+		Event:          event,
+		Device:         event.ResourceUpdate.Name,
+		DeviceName:     p.deviceDisplayName(event.ResourceUpdate.Name),
+		EventSessionId: eventSessionId,
+		Timestamp:      event.Timestamp,
+		FamiliarFace:   sdmevents.EventFamiliarFace(event),
+	}
+	notification.Room, notification.Structure = p.devicePlacement(event.ResourceUpdate.Name)
+	tracing.FromContext(ctx).SetAttributes(
+		tracing.String("sdm.event_type", sdmevents.EventName(eventType)),
+		tracing.String("sdm.device", sdmevents.DeviceId(notification.Device)),
+		tracing.String("sdm.event_session_id", eventSessionId))
+	p.Latency.Observe(LatencyMilestoneReceived, eventType, event.Timestamp, time.Now())
+	// Battery doorbells send the same session multiple times with eventThreadState STARTED, UPDATED and ENDED.
+	// Notify on the first message of the thread, and download the clip only when ENDED since the preview is final then.
+	shouldNotify := true
+	if event.EventThreadId != nil {
+		shouldNotify = p.markEventThreadNotified(*event.EventThreadId, eventType)
+		ended := event.EventThreadState != nil && *event.EventThreadState == sdmevents.EventThreadStateEnded
+		if !ended {
+			clipPreview = nil
+		}
+		switch {
+		case p.ClipWait == ClipWaitDefer && shouldNotify && !ended:
+			p.deferNotification(ctx, event, eventType, notification)
+			return nil
+		case p.ClipWait == ClipWaitDefer && ended:
+			// with the clip unless the timeout already notified without it
+			shouldNotify = shouldNotify || p.clipWaits.takeDeferred(clipWaitKey(event, &notification))
+		case p.ClipWait == ClipWaitEdit && shouldNotify && !ended:
+			ctx = notify.RecordSentMessages(ctx, p.clipWaits.recordSent(clipWaitKey(event, &notification)))
+		}
+	}
+	if p.ClipWait == ClipWaitSnapshot && shouldNotify && p.notifyEventImage(ctx, event, &notification) {
+		// the clip is added by editing the messages once saved
+		shouldNotify = false
+	}
+	return p.deliver(ctx, event, eventType, clipPreview, &notification, shouldNotify)
+}
+
+// Save the clip and notify, or run the pipeline. shouldNotify is false when the event thread was already notified
+func (p *EventProcessor) deliver(ctx context.Context, event *sdmevents.DeviceEvent, eventType sdmevents.ResourceUpdateEventType, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview, notification *notify.Notification, shouldNotify bool) error {
+	if p.Pipeline != nil {
+		return p.Pipeline.run(ctx, p, event, eventType, clipPreview, notification, shouldNotify)
+	}
+	duplicate, downloadErr := p.saveClip(ctx, event, eventType, clipPreview, notification)
+	if duplicate {
+		// the clip preview was already processed, so was the notification
+		return nil
+	}
+	if shouldNotify {
+		if notified, _ := p.notify(ctx, notification, nil); notified {
+			p.observeNotified(ctx, notification)
+		}
+	} else {
+		// already notified when the thread started
+		p.editNotification(ctx, event, eventType, notification)
+	}
+	return downloadErr
+}
+
+// Save the clip preview (if any) of the event into notification, or defer its download. Returns true if the clip
+// preview was already processed.
+func (p *EventProcessor) saveClip(ctx context.Context, event *sdmevents.DeviceEvent, eventType sdmevents.ResourceUpdateEventType, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview, notification *notify.Notification) (bool, error) {
+	var downloadErr error
+	if clipPreview != nil && p.DryRun {
+		placementTime, _ := p.clipPlacementTime(event, time.Now())
+		path := filepath.Join(p.OutputDir, strings.ReplaceAll(p.clipFileNameFormat(event, eventType, placementTime), "{eventSessionId}", clipPreview.EventSessionId+"_0"))
+		if p.DeferredDownloadPolicy.ShouldDefer(eventType, time.Now()) {
+			log.Printf("[dry-run] Would defer download of clipPreview %v to %v.*", clipPreview.PreviewUrl, path)
+		} else {
+			log.Printf("[dry-run] Would download clipPreview %v to %v.*", clipPreview.PreviewUrl, path)
+		}
+	} else if clipPreview != nil && p.DeferredDownloadPolicy.ShouldDefer(eventType, time.Now()) {
+		log.Printf("Deferred download of clipPreview for eventSession %v", clipPreview.EventSessionId)
+		downloadErr = p.deferredDownloads.Push(&QueuedDownload{
+			Event:       event,
+			EventType:   eventType,
+			ClipPreview: clipPreview,
+			QueuedAt:    time.Now().In(p.location()).Format(time.RFC3339),
+		})
+	} else if clipPreview != nil {
+		fileName, metadata, err := p.downloadAndSaveCameraClipPreview(ctx, event, eventType, clipPreview)
+		if err != nil {
+			// still notify without the clip
+			downloadErr = err
+		} else if len(fileName) == 0 {
+			return true, nil
+		} else if rel, err := filepath.Rel(p.OutputDir, fileName); err == nil {
+			p.Latency.Observe(LatencyMilestoneSaved, eventType, event.Timestamp, time.Now())
+			notification.ClipFile = fileName
+			notification.ClipPath = filepath.ToSlash(rel)
+			notification.Detections = metadata.Detections
+			notification.Faces = metadata.Faces
+			notification.Frame = metadata.Frame
+			notification.Sounds = metadata.Sounds
+			if len(p.ClipBaseUrl) > 0 {
+				notification.ClipUrl = p.ClipBaseUrl + notification.ClipPath
+			}
+		}
+	}
+	return false, downloadErr
+}
+
+// Send notification to the notifiers of ids (every notifier if empty, see notify.NotifierId) unless the notification
+// rules suppress it. Returns false if suppressed
+func (p *EventProcessor) notify(ctx context.Context, notification *notify.Notification, ids []string) (bool, error) {
+	notifiers, rules := p.NotificationSettings()
+	if len(ids) > 0 {
+		notifiers = slices.DeleteFunc(slices.Clone(notifiers), func(n notify.Notifier) bool {
+			return !slices.Contains(ids, notify.NotifierId(n))
+		})
+	}
+	if reason := rules.Check(notification, time.Now()); len(reason) > 0 {
+		log.Printf("Suppressed %v notification: %v", notification.EventName(), reason)
+		return false, nil
+	}
+	for _, plugin := range p.Plugins {
+		if reason, err := plugin.Process(ctx, notification); err != nil {
+			log.Printf("Plugin %v failed, forwarding %v notification: %v", plugin.Name(), notification.EventName(), err)
+		} else if len(reason) > 0 {
+			log.Printf("Suppressed %v notification by plugin %v: %v", notification.EventName(), plugin.Name(), reason)
+			return false, nil
+		}
+	}
+	return true, notify.NotifyAll(ctx, notifiers, notification)
+}
+
+// Returns true if eventType was not notified yet in the event thread, and marks it notified.
+func (p *EventProcessor) markEventThreadNotified(eventThreadId string, eventType sdmevents.ResourceUpdateEventType) bool {
+	p.eventThreadsMu.Lock()
+	defer p.eventThreadsMu.Unlock()
+	var notified map[sdmevents.ResourceUpdateEventType]bool
+	if v, ok := p.eventThreads.Get(eventThreadId); ok {
+		notified = v.(map[sdmevents.ResourceUpdateEventType]bool)
+	} else {
+		notified = map[sdmevents.ResourceUpdateEventType]bool{}
+		p.eventThreads.Add(eventThreadId, notified)
+	}
+	if notified[eventType] {
+		return false
+	}
+	notified[eventType] = true
+	return true
+}
+
+func (p *EventProcessor) processRelationUpdateEvent(ctx context.Context, event *sdmevents.DeviceEvent) error {
+	relation := event.RelationUpdate
+	if p.Devices == nil {
+		log.Printf("processRelationUpdateEvent: %v %v (subject: %v)", relation.Type, relation.Object, relation.Subject)
+		return nil
+	}
+	log.Printf("processRelationUpdateEvent: %v %v (subject: %v %v)", relation.Type, relation.Object, relation.Subject, p.Devices.PlaceName(relation.Subject))
+	switch relation.Type {
+	case sdmevents.RelationUpdateTypeCreated, sdmevents.RelationUpdateTypeDeleted:
+		// reload everything so that rooms and structures are also up to date
+		return p.Devices.Refresh(ctx)
+	case sdmevents.RelationUpdateTypeUpdated:
+		return p.Devices.RefreshDevice(ctx, relation.Object)
+	}
+	return fmt.Errorf("unknown relation update type: %v", relation.Type)
+}
+
+// Returns path to the saved file and its metadata. Returns empty path if the clip preview was already processed.
+func (p *EventProcessor) downloadAndSaveCameraClipPreview(ctx context.Context, event *sdmevents.DeviceEvent, eventType sdmevents.ResourceUpdateEventType, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview) (string, *storage.ClipMetadata, error) {
+	f := func() bool {
+		p.wasClipPreviewProcessedMu.Lock()
+		defer p.wasClipPreviewProcessedMu.Unlock()
+		if _, ok := p.wasClipPreviewProcessed.Get(clipPreview.PreviewUrl); ok {
+			// skip
+			return true
+		}
+		p.wasClipPreviewProcessed.Add(clipPreview.PreviewUrl, true)
+		return false
+	}
+	if f() {
+		return "", nil, nil
+	}
+	receivedAt := time.Now()
+	placementTime, lateArrival := p.clipPlacementTime(event, receivedAt)
+	if p.SkipSavedClips {
+		pattern := filepath.Join(p.OutputDir, strings.ReplaceAll(p.clipFileNameFormat(event, eventType, placementTime), "{eventSessionId}", clipPreview.EventSessionId+"_0")) + ".*"
+		if matches, err := filepath.Glob(pattern); err == nil && len(matches) > 0 {
+			log.Printf("Skip clipPreview for eventSession %v already saved as %v", clipPreview.EventSessionId, matches[0])
+			return "", nil, nil
+		}
+	}
+	if err := p.pendingDownloads.Push(&QueuedDownload{
+		Event:       event,
+		EventType:   eventType,
+		ClipPreview: clipPreview,
+		QueuedAt:    receivedAt.In(p.location()).Format(time.RFC3339),
+	}); err != nil {
+		log.Printf("Failed to record pending download: %v", err)
+	}
+	defer func() {
+		if err := p.pendingDownloads.Remove(clipPreview.PreviewUrl); err != nil {
+			log.Printf("Failed to remove pending download: %v", err)
+		}
+	}()
+	var lastErr error
+	for attempt := 1; attempt <= p.DownloadAttempts; attempt++ {
+		downloadCtx, span := tracing.Start(ctx, "download", tracing.Int("download.attempt", int64(attempt)))
+		fileName, download, err := p.downloadCameraClipPreview(downloadCtx, event, eventType, clipPreview, placementTime)
+		span.RecordError(err)
+		if download != nil {
+			span.SetAttributes(tracing.Int("download.bytes", download.Bytes), tracing.String("download.content_type", download.ContentType))
+		}
+		span.End()
+		if err != nil {
+			log.Printf("Failed to download clipPreview for eventSession %v (attempt %v/%v): %v", clipPreview.EventSessionId, attempt, p.DownloadAttempts, err)
+			lastErr = err
+			continue
+		}
+		download.Attempts = attempt
+		metadata := storage.ClipMetadata{
+			Event:          event,
+			EventType:      eventType,
+			Device:         event.ResourceUpdate.Name,
+			DeviceName:     p.deviceDisplayName(event.ResourceUpdate.Name),
+			EventTimestamp: event.Timestamp,
+			ReceivedAt:     receivedAt.In(p.location()).Format(time.RFC3339),
+			SavedAt:        time.Now().In(p.location()).Format(time.RFC3339),
+			LateArrival:    lateArrival,
+			FamiliarFace:   sdmevents.EventFamiliarFace(event),
+			Download:       *download,
+		}
+		p.analyzeClip(ctx, fileName, &metadata)
+		_, span = tracing.Start(ctx, "store")
+		err = storage.WriteClipMetadata(fileName, &metadata)
+		span.RecordError(err)
+		span.End()
+		if err != nil {
+			return fileName, &metadata, err
+		}
+		p.clipSaved(fileName)
+		return fileName, &metadata, nil
+	}
+	// allow redelivered events to try again
+	p.wasClipPreviewProcessedMu.Lock()
+	p.wasClipPreviewProcessed.Remove(clipPreview.PreviewUrl)
+	p.wasClipPreviewProcessedMu.Unlock()
+	return "", nil, lastErr
+}
+
+// Re-run downloads which were in progress when the process stopped last time.
+func (p *EventProcessor) resumePendingDownloads() {
+	items, err := p.pendingDownloads.PopAll()
+	if err != nil {
+		log.Printf("Failed to read pending downloads: %v", err)
+		return
+	}
+	for _, item := range items {
+		log.Printf("Resume interrupted download of clipPreview for eventSession %v", item.ClipPreview.EventSessionId)
+		if _, _, err := p.downloadAndSaveCameraClipPreview(context.Background(), item.Event, item.EventType, item.ClipPreview); err != nil {
+			log.Printf("Failed to resume download of clipPreview for eventSession %v: %v", item.ClipPreview.EventSessionId, err)
+		}
+	}
+}
+
+// Custom name of the device, empty if unknown
+func (p *EventProcessor) deviceDisplayName(deviceName string) string {
+	if p.Devices == nil {
+		return ""
+	}
+	if device := p.Devices.Device(deviceName); device != nil {
+		return sdmevents.DeviceDisplayName(device)
+	}
+	return ""
+}
+
+// Custom names of the room and structure of the device, empty if unknown
+func (p *EventProcessor) devicePlacement(deviceName string) (string, string) {
+	if p.Devices == nil {
+		return "", ""
+	}
+	return p.Devices.Placement(deviceName)
+}
+
+func (p *EventProcessor) location() *time.Location {
+	if p.Location == nil {
+		return time.Local
+	}
+	return p.Location
+}
+
+// Time to format OutputFileNameFormat of the event's clip, and whether the event arrived late
+func (p *EventProcessor) clipPlacementTime(event *sdmevents.DeviceEvent, receivedAt time.Time) (time.Time, bool) {
+	eventTime, err := time.Parse(time.RFC3339Nano, event.Timestamp)
+	if err != nil {
+		log.Printf("Failed to parse event timestamp(%v), using current time for the file path: %v", event.Timestamp, err)
+		return receivedAt, false
+	}
+	lateArrival := p.LateArrivalThreshold > 0 && receivedAt.Sub(eventTime) > p.LateArrivalThreshold
+	if p.FilePathTimeSource == FilePathTimeSourceEvent {
+		return eventTime, lateArrival
+	}
+	return receivedAt, lateArrival
+}
+
+// OutputFileNameFormat with everything but {eventSessionId} replaced
+func (p *EventProcessor) clipFileNameFormat(event *sdmevents.DeviceEvent, eventType sdmevents.ResourceUpdateEventType, placementTime time.Time) string {
+	var room, structure string
+	if event.ResourceUpdate != nil {
+		room, structure = p.devicePlacement(event.ResourceUpdate.Name)
+	}
+	return notify.ReplacePlaceholders(placementTime.In(p.location()).Format(p.OutputFileNameFormat), map[string]string{
+		"{eventType}":    sdmevents.EventName(eventType),
+		"{familiarFace}": storage.SanitizeFileName(sdmevents.EventFamiliarFace(event)),
+		"{room}":         storage.SanitizeFileName(room),
+		"{structure}":    storage.SanitizeFileName(structure),
+	})
+}
+
+// Clip preview answered by other than 200 OK
+type downloadStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *downloadStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %v", e.Status)
+}
+
+// The preview URL is no longer valid, which downloading again doesn't fix
+func (e *downloadStatusError) expired() bool {
+	return e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone
+}
+
+// Download clip preview into a new file. The file is removed when the download is incomplete.
+func (p *EventProcessor) downloadCameraClipPreview(ctx context.Context, event *sdmevents.DeviceEvent, eventType sdmevents.ResourceUpdateEventType, clipPreview *sdmevents.ResourceUpdateEventCameraClipPreview, placementTime time.Time) (string, *storage.ClipDownloadMetadata, error) {
+	body, ctx := newDownloadReader(ctx, p.ReadTimeout, p.MaxDownloadBytes)
+	defer body.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, clipPreview.PreviewUrl, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, &downloadStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if p.MaxDownloadBytes > 0 && resp.ContentLength > p.MaxDownloadBytes {
+		return "", nil, fmt.Errorf("Content-Length %v exceeds the max size %v bytes", resp.ContentLength, p.MaxDownloadBytes)
+	}
+	body.body = resp.Body
+	extensions, err := mime.ExtensionsByType(resp.Header.Get("Content-Type"))
+	if err != nil || len(extensions) == 0 {
+		log.Printf("Failed to get extension type from content type(%v): err(%v)", resp.Header.Get("Content-Type"), err)
+		extensions = []string{".video.unknown"}
+	}
+	fileName, err := p.newClipFileName(p.clipFileNameFormat(event, eventType, placementTime), clipPreview.EventSessionId, extensions[0])
+	if err != nil {
+		return "", nil, err
+	}
+	// write into temp file first so that partially downloaded clip never appears in the output directory
+	tempFileName := fileName + storage.TempFileExtension
+	file, err := os.OpenFile(tempFileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	numWritten, err := io.Copy(io.MultiWriter(file, hash), body)
+	if err == nil && resp.ContentLength >= 0 && numWritten != resp.ContentLength {
+		err = fmt.Errorf("truncated download: got %v bytes, Content-Length is %v", numWritten, resp.ContentLength)
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err == nil {
+		err = os.Rename(tempFileName, fileName)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tempFileName)
+		return "", nil, err
+	}
+	log.Printf("Wrote clipPreview for eventSession %v as %v (bytes: %v)", clipPreview.EventSessionId, extensions[0], numWritten)
+	return fileName, &storage.ClipDownloadMetadata{
+		Url:           clipPreview.PreviewUrl,
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: resp.ContentLength,
+		Bytes:         numWritten,
+		Sha256:        hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// Unused output path "<fileNameFormat with {eventSessionId} = eventSessionId_N><extension>". Its directory is created.
+func (p *EventProcessor) newClipFileName(fileNameFormat string, eventSessionId string, extension string) (string, error) {
+	i := 0
+	fileName := ""
+	for {
+		fileName = filepath.Join(p.OutputDir, strings.ReplaceAll(fileNameFormat, "{eventSessionId}", eventSessionId+"_"+strconv.Itoa(i))+extension)
+		if _, err := os.Stat(fileName); os.IsNotExist(err) {
+			if _, err := os.Stat(fileName + storage.TempFileExtension); os.IsNotExist(err) {
+				break
+			}
+		}
+		i = i + 1
+	}
+	outputDir := filepath.Dir(fileName)
+	if _, err := os.Stat(outputDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(outputDir, 0777); err != nil {
+			return "", err
+		}
+	}
+	return fileName, nil
+}
@@ -0,0 +1,340 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client side limit of an SDM command. 0 means no limit
+type CommandQuota struct {
+	PerMinute float64
+	PerDay    float64
+}
+
+// Parse quotas like "GenerateImage=10/m,GenerateImage=1000/d,*=10/m". Names are full commands, their last part, or *
+// for commands without their own quota, which share it
+func ParseCommandQuotas(spec string) (map[string]CommandQuota, error) {
+	quotas := map[string]CommandQuota{}
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' }) {
+		name, limit, ok := strings.Cut(entry, "=")
+		count, window, ok2 := strings.Cut(limit, "/")
+		n, err := strconv.ParseFloat(count, 64)
+		if !ok || !ok2 || len(name) == 0 || err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid quota %v. give <command>=<count>/m or <count>/d", entry)
+		}
+		quota := quotas[name]
+		switch window {
+		case "m":
+			quota.PerMinute = n
+		case "d":
+			quota.PerDay = n
+		default:
+			return nil, fmt.Errorf("invalid window of quota %v. give m or d", entry)
+		}
+		quotas[name] = quota
+	}
+	return quotas, nil
+}
+
+// Returned when a command can't get its quota within the queue timeout
+type CommandQuotaError struct {
+	Command string
+	Wait    time.Duration // until the next token
+}
+
+func (e *CommandQuotaError) Error() string {
+	return fmt.Sprintf("client side quota of %v exceeded. next request allowed in %v", e.Command, e.Wait.Round(time.Second))
+}
+
+// Usage of a command since the start, for metrics
+type CommandUsage struct {
+	Command         string
+	Quota           CommandQuota
+	Requests        int64 // sent to SDM
+	Rejected        int64 // not sent since no token was available within the queue timeout
+	Throttled       int64 // answered 429 by SDM anyway
+	QueuedSeconds   float64
+	MinuteRemaining float64 // tokens left of Quota.PerMinute
+	DayRemaining    float64 // tokens left of Quota.PerDay
+}
+
+// Daily quotas of SDM reset at midnight Pacific Time like other Google Cloud quotas
+var sdmQuotaLocation = func() *time.Location {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		return time.FixedZone("PST", -8*60*60)
+	}
+	return location
+}()
+
+// RoundTripper in front of the SDM client limiting executeCommand requests per quota entry, so that the per-minute and
+// per-day quotas of e.g. GenerateImage and GenerateWebRtcStream never throttle the project. Commands matching the same
+// entry, e.g. every one of *, share its limits. Requests over the limit wait in order up to the queue timeout, or fail
+// without reaching SDM.
+type CommandLimiter struct {
+	next         http.RoundTripper
+	quotas       map[string]CommandQuota
+	queueTimeout time.Duration
+	now          func() time.Time // replaced by tests
+	mu           sync.Mutex
+	usages       map[string]*commandUsage // full command name => usage
+	limits       map[string]*quotaLimits  // name of the quota entry => its limits
+}
+
+type commandUsage struct {
+	CommandUsage
+	limits *quotaLimits
+}
+
+// Limits of a quota entry, shared by the commands it applies to
+type quotaLimits struct {
+	minute *tokenBucket // nil without limit
+	day    *dailyQuota
+}
+
+func NewCommandLimiter(next http.RoundTripper, quotas map[string]CommandQuota, queueTimeout time.Duration) *CommandLimiter {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &CommandLimiter{next: next, quotas: quotas, queueTimeout: queueTimeout, now: time.Now, usages: map[string]*commandUsage{}, limits: map[string]*quotaLimits{}}
+}
+
+func (l *CommandLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || !strings.HasSuffix(req.URL.Path, ":executeCommand") || req.Body == nil {
+		return l.next.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var command struct {
+		Command string `json:"command"`
+	}
+	json.Unmarshal(body, &command)
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	if isStreamKeepAlive(command.Command) {
+		return l.next.RoundTrip(req)
+	}
+
+	wait, err := l.reserve(command.Command)
+	if err != nil {
+		return nil, err
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			l.release(command.Command)
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+	resp, err := l.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		l.mu.Lock()
+		l.usages[command.Command].Throttled++
+		l.mu.Unlock()
+	}
+	return resp, err
+}
+
+// Extend and Stop of live streams are never limited. A running stream expires when its extension waits for a token,
+// and stopping it frees the camera
+func isStreamKeepAlive(command string) bool {
+	name := command[strings.LastIndex(command, ".")+1:]
+	return strings.HasSuffix(name, "Stream") && (strings.HasPrefix(name, "Extend") || strings.HasPrefix(name, "Stop"))
+}
+
+// Quota entry applying to command and its name, the full command, its last part or *
+func (l *CommandLimiter) quota(command string) (string, CommandQuota) {
+	if quota, ok := l.quotas[command]; ok {
+		return command, quota
+	}
+	name := command[strings.LastIndex(command, ".")+1:]
+	if quota, ok := l.quotas[name]; ok {
+		return name, quota
+	}
+	return "*", l.quotas["*"]
+}
+
+// Take a token of each limit of command. Returns how long to wait until they are available
+func (l *CommandLimiter) reserve(command string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	usage, ok := l.usages[command]
+	if !ok {
+		name, quota := l.quota(command)
+		limits, ok := l.limits[name]
+		if !ok {
+			limits = &quotaLimits{}
+			if quota.PerMinute > 0 {
+				limits.minute = newTokenBucket(quota.PerMinute, time.Minute, now)
+			}
+			if quota.PerDay > 0 {
+				limits.day = newDailyQuota(quota.PerDay, sdmQuotaLocation, now)
+			}
+			l.limits[name] = limits
+		}
+		usage = &commandUsage{CommandUsage: CommandUsage{Command: command, Quota: quota}, limits: limits}
+		l.usages[command] = usage
+	}
+	wait := max(usage.limits.minute.wait(now), usage.limits.day.wait(now))
+	if wait > l.queueTimeout {
+		usage.Rejected++
+		return 0, &CommandQuotaError{Command: command, Wait: wait}
+	}
+	usage.limits.minute.take()
+	usage.limits.day.take()
+	usage.Requests++
+	usage.QueuedSeconds += wait.Seconds()
+	return wait, nil
+}
+
+// Give back the tokens of a request which wasn't sent
+func (l *CommandLimiter) release(command string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	usage := l.usages[command]
+	usage.limits.minute.put()
+	usage.limits.day.put()
+	usage.Requests--
+}
+
+// Usage of every command requested so far, sorted by command. Remaining tokens are of the quota entry, shared with the
+// other commands it applies to
+func (l *CommandLimiter) Usage() []CommandUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	usages := make([]CommandUsage, 0, len(l.usages))
+	for _, usage := range l.usages {
+		u := usage.CommandUsage
+		u.MinuteRemaining = usage.limits.minute.remaining(now)
+		u.DayRemaining = usage.limits.day.remaining(now)
+		usages = append(usages, u)
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].Command < usages[j].Command })
+	return usages
+}
+
+// Bucket of capacity tokens refilled over period. Tokens go negative while requests wait for them. Methods of nil
+// buckets are no-ops, for commands without the limit
+type tokenBucket struct {
+	capacity float64
+	rate     float64 // tokens per second
+	tokens   float64
+	updated  time.Time
+}
+
+func newTokenBucket(capacity float64, period time.Duration, now time.Time) *tokenBucket {
+	return &tokenBucket{capacity: capacity, rate: capacity / period.Seconds(), tokens: capacity, updated: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.capacity, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated = now
+}
+
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take() {
+	if b != nil {
+		b.tokens--
+	}
+}
+
+func (b *tokenBucket) put() {
+	if b != nil {
+		b.tokens++
+	}
+}
+
+func (b *tokenBucket) remaining(now time.Time) float64 {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	return max(0, b.tokens)
+}
+
+// Requests per calendar day of location, reset at its midnight. Requests waiting for the next day are counted beyond
+// capacity. Methods of nil quotas are no-ops like those of tokenBucket
+type dailyQuota struct {
+	capacity float64
+	location *time.Location
+	used     float64
+	resetAt  time.Time // next midnight
+}
+
+func newDailyQuota(capacity float64, location *time.Location, now time.Time) *dailyQuota {
+	return &dailyQuota{capacity: capacity, location: location, resetAt: nextMidnight(now, location)}
+}
+
+func nextMidnight(t time.Time, location *time.Location) time.Time {
+	year, month, day := t.In(location).Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, location)
+}
+
+func (q *dailyQuota) reset(now time.Time) {
+	for !now.Before(q.resetAt) && q.used > 0 {
+		q.used = max(0, q.used-q.capacity)
+		q.resetAt = nextMidnight(q.resetAt, q.location)
+	}
+	if !now.Before(q.resetAt) {
+		q.resetAt = nextMidnight(now, q.location)
+	}
+}
+
+func (q *dailyQuota) wait(now time.Time) time.Duration {
+	if q == nil {
+		return 0
+	}
+	q.reset(now)
+	days := int(q.used / q.capacity)
+	if days == 0 {
+		return 0
+	}
+	return q.resetAt.AddDate(0, 0, days-1).Sub(now)
+}
+
+func (q *dailyQuota) take() {
+	if q != nil {
+		q.used++
+	}
+}
+
+func (q *dailyQuota) put() {
+	if q != nil {
+		q.used--
+	}
+}
+
+func (q *dailyQuota) remaining(now time.Time) float64 {
+	if q == nil {
+		return 0
+	}
+	q.reset(now)
+	return max(0, q.capacity-q.used)
+}
@@ -0,0 +1,257 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCommandQuotas(t *testing.T) {
+	quotas, err := ParseCommandQuotas("GenerateImage=10/m,GenerateImage=500/d, *=2/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := quotas["GenerateImage"]; got.PerMinute != 10 || got.PerDay != 500 {
+		t.Errorf("GenerateImage = %+v, want 10/m and 500/d", got)
+	}
+	if got := quotas["*"]; got.PerMinute != 2 || got.PerDay != 0 {
+		t.Errorf("* = %+v, want 2/m", got)
+	}
+	if quotas, err := ParseCommandQuotas(""); err != nil || len(quotas) != 0 {
+		t.Errorf("empty spec = %v, %v, want no quota", quotas, err)
+	}
+	for _, spec := range []string{"GenerateImage", "GenerateImage=10", "GenerateImage=10/h", "=10/m", "GenerateImage=0/m", "GenerateImage=x/m"} {
+		if _, err := ParseCommandQuotas(spec); err == nil {
+			t.Errorf("ParseCommandQuotas(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(2, time.Minute, start)
+	for i := 0; i < 2; i++ {
+		if wait := b.wait(start); wait != 0 {
+			t.Fatalf("wait of token %v = %v, want 0", i, wait)
+		}
+		b.take()
+	}
+	// one token per 30s
+	if wait := b.wait(start); wait != 30*time.Second {
+		t.Errorf("wait of empty bucket = %v, want 30s", wait)
+	}
+	if got := b.remaining(start.Add(15 * time.Second)); got != 0.5 {
+		t.Errorf("remaining after 15s = %v, want 0.5", got)
+	}
+	// refilled up to the capacity only
+	if got := b.remaining(start.Add(time.Hour)); got != 2 {
+		t.Errorf("remaining after an hour = %v, want 2", got)
+	}
+	var none *tokenBucket
+	none.take()
+	none.put()
+	if wait, remaining := none.wait(start), none.remaining(start); wait != 0 || remaining != 0 {
+		t.Errorf("nil bucket wait = %v, remaining = %v, want 0", wait, remaining)
+	}
+}
+
+// Requests over the quota queue behind each other by taking tokens below zero
+func TestCommandLimiterQueuesInOrder(t *testing.T) {
+	l := NewCommandLimiter(nil, map[string]CommandQuota{"GenerateImage": {PerMinute: 1}}, 3*time.Minute)
+	command := "sdm.devices.commands.CameraEventImage.GenerateImage"
+	for i, want := range []time.Duration{0, time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		wait, err := l.reserve(command)
+		if err != nil {
+			t.Fatalf("request %v: %v", i, err)
+		}
+		if diff := want - wait; diff < 0 || diff > time.Second {
+			t.Errorf("request %v waits %v, want %v", i, wait, want)
+		}
+	}
+	var quotaErr *CommandQuotaError
+	if _, err := l.reserve(command); !errors.As(err, &quotaErr) || quotaErr.Command != command {
+		t.Fatalf("request over the queue timeout = %v, want CommandQuotaError", err)
+	}
+	usage := l.Usage()
+	if len(usage) != 1 || usage[0].Requests != 4 || usage[0].Rejected != 1 || usage[0].MinuteRemaining != 0 {
+		t.Errorf("usage = %+v, want 4 requests and 1 rejected", usage)
+	}
+}
+
+func TestCommandLimiterQuotaMatching(t *testing.T) {
+	l := NewCommandLimiter(nil, map[string]CommandQuota{
+		"sdm.devices.commands.CameraEventImage.GenerateImage": {PerMinute: 1},
+		"GenerateRtspStream": {PerMinute: 2},
+		"*":                  {PerDay: 3},
+	}, 0)
+	for _, c := range []struct {
+		command string
+		name    string
+		want    CommandQuota
+	}{
+		{"sdm.devices.commands.CameraEventImage.GenerateImage", "sdm.devices.commands.CameraEventImage.GenerateImage", CommandQuota{PerMinute: 1}},
+		{"sdm.devices.commands.CameraLiveStream.GenerateRtspStream", "GenerateRtspStream", CommandQuota{PerMinute: 2}},
+		{"sdm.devices.commands.CameraLiveStream.GenerateWebRtcStream", "*", CommandQuota{PerDay: 3}},
+	} {
+		if name, got := l.quota(c.command); name != c.name || got != c.want {
+			t.Errorf("quota(%v) = %v %+v, want %v %+v", c.command, name, got, c.name, c.want)
+		}
+	}
+}
+
+// Commands without their own quota share the one of *, while commands of their own quota don't take from it
+func TestCommandLimiterSharesQuotaEntries(t *testing.T) {
+	l := NewCommandLimiter(nil, map[string]CommandQuota{"GenerateImage": {PerMinute: 1}, "*": {PerMinute: 2}}, 0)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	for i, c := range []struct {
+		command string
+		allowed bool
+	}{
+		{"sdm.devices.commands.CameraEventImage.GenerateImage", true},
+		{"sdm.devices.commands.CameraLiveStream.GenerateWebRtcStream", true},
+		{"sdm.devices.commands.ThermostatMode.SetMode", true},
+		// * is used up by the two commands before
+		{"sdm.devices.commands.CameraLiveStream.GenerateRtspStream", false},
+		{"sdm.devices.commands.ThermostatMode.SetMode", false},
+		{"sdm.devices.commands.CameraEventImage.GenerateImage", false},
+	} {
+		if _, err := l.reserve(c.command); (err == nil) != c.allowed {
+			t.Errorf("request %v of %v = %v, want allowed %v", i, c.command, err, c.allowed)
+		}
+	}
+	for _, u := range l.Usage() {
+		if u.MinuteRemaining != 0 {
+			t.Errorf("%v has %v tokens left, want 0", u.Command, u.MinuteRemaining)
+		}
+	}
+}
+
+func TestDailyQuota(t *testing.T) {
+	location := time.FixedZone("PST", -8*60*60)
+	start := time.Date(2024, 3, 4, 22, 0, 0, 0, location)
+	q := newDailyQuota(2, location, start)
+	for i := 0; i < 2; i++ {
+		if wait := q.wait(start); wait != 0 {
+			t.Fatalf("wait of request %v = %v, want 0", i, wait)
+		}
+		q.take()
+	}
+	// no refill during the day, the next request waits for midnight
+	if wait := q.wait(start.Add(time.Hour)); wait != time.Hour {
+		t.Errorf("wait at 23:00 = %v, want 1h", wait)
+	}
+	if got := q.remaining(start.Add(time.Hour)); got != 0 {
+		t.Errorf("remaining at 23:00 = %v, want 0", got)
+	}
+	// a request waiting for the next day counts against it
+	q.take()
+	if got := q.remaining(start.Add(2 * time.Hour)); got != 1 {
+		t.Errorf("remaining after midnight = %v, want 1", got)
+	}
+	q.take()
+	if wait := q.wait(start.Add(2 * time.Hour)); wait != 24*time.Hour {
+		t.Errorf("wait when the next day is used up = %v, want 24h", wait)
+	}
+	// days later everything is back
+	if got := q.remaining(start.AddDate(0, 0, 10)); got != 2 {
+		t.Errorf("remaining 10 days later = %v, want 2", got)
+	}
+	if q.resetAt != time.Date(2024, 3, 15, 0, 0, 0, 0, location) {
+		t.Errorf("reset at %v after 10 days, want the next midnight", q.resetAt)
+	}
+	var none *dailyQuota
+	none.take()
+	none.put()
+	if wait, remaining := none.wait(start), none.remaining(start); wait != 0 || remaining != 0 {
+		t.Errorf("nil quota wait = %v, remaining = %v, want 0", wait, remaining)
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func commandRequest(ctx context.Context, command string) *http.Request {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "https://smartdevicemanagement.googleapis.com/v1/enterprises/p/devices/d:executeCommand", strings.NewReader(`{"command":"`+command+`"}`))
+	return req
+}
+
+func TestCommandLimiterRoundTrip(t *testing.T) {
+	sent := []string{}
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		sent = append(sent, string(body))
+		return &http.Response{StatusCode: http.StatusTooManyRequests, Body: http.NoBody}, nil
+	})
+	l := NewCommandLimiter(next, map[string]CommandQuota{"*": {PerMinute: 1}}, 0)
+	generate := "sdm.devices.commands.CameraLiveStream.GenerateWebRtcStream"
+	if _, err := l.RoundTrip(commandRequest(context.Background(), generate)); err != nil {
+		t.Fatal(err)
+	}
+	var quotaErr *CommandQuotaError
+	if _, err := l.RoundTrip(commandRequest(context.Background(), generate)); !errors.As(err, &quotaErr) {
+		t.Fatalf("second request = %v, want CommandQuotaError", err)
+	}
+	// keep-alive of the stream is never limited
+	for _, command := range []string{"sdm.devices.commands.CameraLiveStream.ExtendWebRtcStream", "sdm.devices.commands.CameraLiveStream.StopWebRtcStream", "sdm.devices.commands.CameraLiveStream.ExtendWebRtcStream"} {
+		if _, err := l.RoundTrip(commandRequest(context.Background(), command)); err != nil {
+			t.Errorf("%v: %v", command, err)
+		}
+	}
+	if len(sent) != 4 || sent[0] != `{"command":"`+generate+`"}` {
+		t.Errorf("sent %v, want the body of 4 requests", sent)
+	}
+	usage := l.Usage()
+	if len(usage) != 1 || usage[0].Command != generate || usage[0].Throttled != 1 {
+		t.Errorf("usage = %+v, want only %v throttled once", usage, generate)
+	}
+}
+
+// A request canceled while waiting for its token gives it back to the next one
+func TestCommandLimiterReleasesOnCancel(t *testing.T) {
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	l := NewCommandLimiter(next, map[string]CommandQuota{"*": {PerMinute: 1}}, time.Hour)
+	command := "sdm.devices.commands.CameraEventImage.GenerateImage"
+	if _, err := l.RoundTrip(commandRequest(context.Background(), command)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.RoundTrip(commandRequest(ctx, command)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("canceled request = %v, want context.DeadlineExceeded", err)
+	}
+	usage := l.Usage()
+	if len(usage) != 1 || usage[0].Requests != 1 {
+		t.Errorf("usage = %+v, want 1 request", usage)
+	}
+	// the next one waits for a single token again, not behind the canceled one
+	wait, err := l.reserve(command)
+	if err != nil || wait > time.Minute {
+		t.Errorf("reserve after cancel = %v, %v, want at most 1m", wait, err)
+	}
+}
+
+func TestIsStreamKeepAlive(t *testing.T) {
+	for command, want := range map[string]bool{
+		"sdm.devices.commands.CameraLiveStream.ExtendWebRtcStream":   true,
+		"sdm.devices.commands.CameraLiveStream.ExtendRtspStream":     true,
+		"sdm.devices.commands.CameraLiveStream.StopWebRtcStream":     true,
+		"sdm.devices.commands.CameraLiveStream.StopRtspStream":       true,
+		"sdm.devices.commands.CameraLiveStream.GenerateWebRtcStream": false,
+		"sdm.devices.commands.CameraEventImage.GenerateImage":        false,
+		"sdm.devices.commands.ThermostatMode.SetMode":                false,
+	} {
+		if got := isStreamKeepAlive(command); got != want {
+			t.Errorf("isStreamKeepAlive(%v) = %v, want %v", command, got, want)
+		}
+	}
+}
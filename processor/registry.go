@@ -0,0 +1,196 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/smartdevicemanagement/v1"
+)
+
+// Live view of devices, structures and rooms of the project.
+// Kept up to date by RelationUpdate events.
+type DeviceRegistry struct {
+	service    *smartdevicemanagement.Service
+	projectId  string
+	mu         sync.RWMutex
+	devices    map[string]*smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device // device name => device
+	structures map[string]string                                                 // structure name => custom name
+	rooms      map[string]string                                                 // room name => custom name
+}
+
+func NewDeviceRegistry(service *smartdevicemanagement.Service, projectId string) *DeviceRegistry {
+	return &DeviceRegistry{
+		service:    service,
+		projectId:  projectId,
+		devices:    map[string]*smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device{},
+		structures: map[string]string{},
+		rooms:      map[string]string{},
+	}
+}
+
+func decodeStructureCustomName(traits googleapi.RawMessage, trait string) string {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(traits, &values); err != nil {
+		return ""
+	}
+	var info sdmevents.StructureTraitInfoValue
+	if raw, ok := values[trait]; ok {
+		json.Unmarshal(raw, &info)
+	}
+	return info.CustomName
+}
+
+// Reload everything from SDM and log added/removed devices
+func (r *DeviceRegistry) Refresh(ctx context.Context) error {
+	devices := map[string]*smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device{}
+	err := RetrySDM(ctx, "devices.list", func(ctx context.Context) error {
+		return r.service.Enterprises.Devices.List(r.projectId).Pages(ctx, func(res *smartdevicemanagement.GoogleHomeEnterpriseSdmV1ListDevicesResponse) error {
+			for _, device := range res.Devices {
+				devices[device.Name] = device
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	structures := map[string]string{}
+	rooms := map[string]string{}
+	err = RetrySDM(ctx, "structures.list", func(ctx context.Context) error {
+		return r.service.Enterprises.Structures.List(r.projectId).Pages(ctx, func(res *smartdevicemanagement.GoogleHomeEnterpriseSdmV1ListStructuresResponse) error {
+			for _, structure := range res.Structures {
+				structures[structure.Name] = decodeStructureCustomName(structure.Traits, sdmevents.StructureTraitInfo)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for structure := range structures {
+		err = RetrySDM(ctx, "rooms.list", func(ctx context.Context) error {
+			return r.service.Enterprises.Structures.Rooms.List(structure).Pages(ctx, func(res *smartdevicemanagement.GoogleHomeEnterpriseSdmV1ListRoomsResponse) error {
+				for _, room := range res.Rooms {
+					rooms[room.Name] = decodeStructureCustomName(room.Traits, sdmevents.StructureTraitRoomInfo)
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, device := range devices {
+		if _, ok := r.devices[name]; !ok {
+			log.Printf("Device added: %v (%v, %v)", name, device.Type, sdmevents.DeviceDisplayName(device))
+		}
+	}
+	for name, device := range r.devices {
+		if _, ok := devices[name]; !ok {
+			log.Printf("Device removed: %v (%v, %v)", name, device.Type, sdmevents.DeviceDisplayName(device))
+		}
+	}
+	r.devices = devices
+	r.structures = structures
+	r.rooms = rooms
+	return nil
+}
+
+// Reload single device e.g. when it's renamed or moved to another room
+func (r *DeviceRegistry) RefreshDevice(ctx context.Context, name string) error {
+	var device *smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device
+	err := RetrySDM(ctx, "devices.get", func(ctx context.Context) (err error) {
+		device, err = r.service.Enterprises.Devices.Get(name).Context(ctx).Do()
+		return err
+	})
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		r.Remove(name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.devices[name]; !ok {
+		log.Printf("Device added: %v (%v, %v)", name, device.Type, sdmevents.DeviceDisplayName(device))
+	} else if sdmevents.DeviceDisplayName(old) != sdmevents.DeviceDisplayName(device) {
+		log.Printf("Device renamed: %v (%v => %v)", name, sdmevents.DeviceDisplayName(old), sdmevents.DeviceDisplayName(device))
+	}
+	r.devices[name] = device
+	return nil
+}
+
+func (r *DeviceRegistry) Remove(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if device, ok := r.devices[name]; ok {
+		log.Printf("Device removed: %v (%v, %v)", name, device.Type, sdmevents.DeviceDisplayName(device))
+		delete(r.devices, name)
+	}
+}
+
+// nil if the device is not known
+func (r *DeviceRegistry) Device(name string) *smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.devices[name]
+}
+
+// All devices sorted by name
+func (r *DeviceRegistry) Devices() []*smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	devices := make([]*smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device, 0, len(r.devices))
+	for _, device := range r.devices {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices
+}
+
+// Custom name of the structure or room, empty if unknown
+func (r *DeviceRegistry) PlaceName(name string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n, ok := r.rooms[name]; ok {
+		return n
+	}
+	return r.structures[name]
+}
+
+// Custom names of the room and structure of the device, empty if unknown
+func (r *DeviceRegistry) Placement(deviceName string) (room string, structure string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	device, ok := r.devices[deviceName]
+	if !ok {
+		return "", ""
+	}
+	for _, relation := range device.ParentRelations {
+		// parent is enterprises/<project>/structures/<structure>/rooms/<room>
+		if n, ok := r.rooms[relation.Parent]; ok && len(n) > 0 {
+			room = n
+		} else {
+			room = relation.DisplayName
+		}
+		if s, _, ok := strings.Cut(relation.Parent, "/rooms/"); ok {
+			structure = r.structures[s]
+		} else {
+			structure = r.structures[relation.Parent]
+		}
+		if len(room) > 0 || len(structure) > 0 {
+			break
+		}
+	}
+	return room, structure
+}
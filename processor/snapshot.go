@@ -0,0 +1,236 @@
+package processor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"google.golang.org/api/smartdevicemanagement/v1"
+)
+
+// Live streams generated by SDM expire in 5 minutes without extension
+const MaxSnapshotDuration = 5 * time.Minute
+
+// Record duration of the live stream of the device, independent of any event, and save it with a metadata sidecar
+// like clip previews. The event type of the saved file is "snapshot". Returns the saved file.
+//
+// WebRTC devices (e.g. battery doorbells) are recorded as raw H.264 video without audio. RTSP devices need ffmpeg in
+// PATH and are recorded as mp4.
+func (p *EventProcessor) Snapshot(ctx context.Context, deviceName string, duration time.Duration) (string, error) {
+	if duration <= 0 || duration > MaxSnapshotDuration {
+		return "", fmt.Errorf("snapshot duration must be in (0, %v]: %v", MaxSnapshotDuration, duration)
+	}
+	var device *smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device
+	if p.Devices != nil {
+		device = p.Devices.Device(deviceName)
+	}
+	if device == nil {
+		return "", fmt.Errorf("unknown device: %v", deviceName)
+	}
+	var liveStream sdmevents.DeviceTraitCameraLiveStreamValue
+	ok, err := sdmevents.DecodeDeviceTrait(device, sdmevents.DeviceTraitCameraLiveStream, &liveStream)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("device doesn't have %v trait", sdmevents.DeviceTraitCameraLiveStream)
+	}
+	protocol := ""
+	for _, supported := range liveStream.SupportedProtocols {
+		if supported == "WEB_RTC" || supported == "RTSP" {
+			protocol = supported
+			break
+		}
+	}
+	if len(protocol) == 0 {
+		return "", fmt.Errorf("no supported live stream protocol in %v", liveStream.SupportedProtocols)
+	}
+	extension, contentType := ".h264", "video/h264"
+	if protocol == "RTSP" {
+		extension, contentType = ".mp4", "video/mp4"
+	}
+
+	now := time.Now()
+	eventSessionId := "snapshot-" + strconv.FormatInt(now.Unix(), 10)
+	event := &sdmevents.DeviceEvent{
+		EventId:        eventSessionId,
+		Timestamp:      now.UTC().Format(time.RFC3339Nano),
+		ResourceUpdate: &sdmevents.ResourceUpdate{Name: deviceName},
+	}
+	eventType := sdmevents.ResourceUpdateEventTypeSnapshot
+	fileNameFormat := p.clipFileNameFormat(event, eventType, now)
+	if p.DryRun {
+		log.Printf("[dry-run] Would record %v of %v live stream of %v to %v", duration, protocol, deviceName, fileNameFormat)
+		return "", nil
+	}
+	fileName, err := p.newClipFileName(fileNameFormat, eventSessionId, extension)
+	if err != nil {
+		return "", err
+	}
+	// write into temp file first like downloads
+	tempFileName := fileName + storage.TempFileExtension
+	if protocol == "WEB_RTC" {
+		err = recordWebRtc(ctx, p.DeviceAccessService, deviceName, duration, tempFileName)
+	} else {
+		err = recordRtsp(ctx, p.DeviceAccessService, deviceName, duration, tempFileName)
+	}
+	var download *storage.ClipDownloadMetadata
+	if err == nil {
+		download, err = hashFile(tempFileName)
+	}
+	if err == nil && download.Bytes == 0 {
+		err = fmt.Errorf("no video received from %v", deviceName)
+	}
+	if err == nil {
+		err = os.Rename(tempFileName, fileName)
+	}
+	if err != nil {
+		os.Remove(tempFileName)
+		return "", err
+	}
+	log.Printf("Wrote snapshot of %v as %v (bytes: %v)", deviceName, fileName, download.Bytes)
+	download.ContentType = contentType
+	download.ContentLength = -1
+	download.Attempts = 1
+	metadata := storage.ClipMetadata{
+		Event:          event,
+		EventType:      eventType,
+		Device:         deviceName,
+		DeviceName:     sdmevents.DeviceDisplayName(device),
+		EventTimestamp: event.Timestamp,
+		ReceivedAt:     now.In(p.location()).Format(time.RFC3339),
+		SavedAt:        time.Now().In(p.location()).Format(time.RFC3339),
+		Download:       *download,
+	}
+	if err := storage.WriteClipMetadata(fileName, &metadata); err != nil {
+		return fileName, err
+	}
+	p.clipSaved(fileName)
+	return fileName, nil
+}
+
+func hashFile(path string) (*storage.ClipDownloadMetadata, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.ClipDownloadMetadata{Bytes: n, Sha256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// Record the video track of a WebRTC live stream into path as H.264 Annex B, starting from the first key frame
+func recordWebRtc(ctx context.Context, svc *smartdevicemanagement.Service, deviceName string, duration time.Duration, path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	// SDM requires audio, video and application m-lines in this order
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return err
+		}
+	}
+	if _, err := pc.CreateDataChannel("dataSendChannel", nil); err != nil {
+		return err
+	}
+	recorded := make(chan error, 1)
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if track.Kind() != webrtc.RTPCodecTypeVideo {
+			return
+		}
+		writer := h264writer.NewWith(file)
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				// the connection is closed
+				recorded <- nil
+				return
+			}
+			if err := writer.WriteRTP(packet); err != nil {
+				recorded <- err
+				return
+			}
+		}
+	})
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-gatherComplete
+	var stream sdmevents.GenerateWebRtcStreamResponse
+	if err := ExecuteDeviceCommand(ctx, svc, deviceName, "sdm.devices.commands.CameraLiveStream.GenerateWebRtcStream", sdmevents.GenerateWebRtcStreamRequestParam{OfferSdp: pc.LocalDescription().SDP}, &stream); err != nil {
+		return err
+	}
+	defer func() {
+		if err := ExecuteDeviceCommand(context.Background(), svc, deviceName, "sdm.devices.commands.CameraLiveStream.StopWebRtcStream", sdmevents.StopWebRtcStreamRequestParam{MediaSessionId: stream.MediaSessionId}, nil); err != nil {
+			log.Printf("Failed to stop WebRTC stream of %v: %v", deviceName, err)
+		}
+	}()
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: stream.AnswerSdp}); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(duration):
+	}
+	pc.Close()
+	select {
+	case err := <-recorded:
+		if err != nil {
+			return err
+		}
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("no video track received from %v", deviceName)
+	}
+	return file.Close()
+}
+
+// Record RTSP live stream into path as mp4 by ffmpeg
+func recordRtsp(ctx context.Context, svc *smartdevicemanagement.Service, deviceName string, duration time.Duration, path string) error {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return fmt.Errorf("recording RTSP streams needs ffmpeg: %v", err)
+	}
+	var stream sdmevents.GenerateRtspStreamResponse
+	if err := ExecuteDeviceCommand(ctx, svc, deviceName, "sdm.devices.commands.CameraLiveStream.GenerateRtspStream", struct{}{}, &stream); err != nil {
+		return err
+	}
+	defer func() {
+		if err := ExecuteDeviceCommand(context.Background(), svc, deviceName, "sdm.devices.commands.CameraLiveStream.StopRtspStream", sdmevents.StopRtspStreamRequestParam{StreamExtensionToken: stream.StreamExtensionToken}, nil); err != nil {
+			log.Printf("Failed to stop RTSP stream of %v: %v", deviceName, err)
+		}
+	}()
+	cmd := exec.CommandContext(ctx, ffmpeg, "-loglevel", "error", "-rtsp_transport", "tcp", "-i", stream.StreamUrls.RtspUrl,
+		"-t", strconv.FormatFloat(duration.Seconds(), 'f', -1, 64), "-c", "copy", "-f", "mp4", "-y", path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/notify"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+	"github.com/cormoran/NestDoorbellConsumer/storage"
+)
+
+type SummaryPeriod string
+
+const (
+	SummaryPeriodDaily  = SummaryPeriod("daily")  // every day, of the previous day
+	SummaryPeriodWeekly = SummaryPeriod("weekly") // every Monday, of the previous 7 days
+)
+
+// Notable events listed in a summary at most, the latest ones
+const maxNotableEvents = 10
+
+// Periodically notify "summary" of the clips saved in OutputDir, e.g. as household digest by email
+type SummaryReporter struct {
+	OutputDir     string
+	ClipBaseUrl   string
+	Location      *time.Location
+	Period        SummaryPeriod
+	At            time.Duration                                         // time of the day to send e.g. 8h
+	Notifications func() ([]notify.Notifier, *notify.NotificationRules) // current notifiers and rules e.g. EventProcessor.NotificationSettings
+}
+
+// Send summaries until ctx is done
+func (r *SummaryReporter) Run(ctx context.Context) {
+	for {
+		now := time.Now().In(r.Location)
+		next := r.nextReport(now)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+		}
+		r.Report(ctx, next)
+	}
+}
+
+// First time to send a summary after now
+func (r *SummaryReporter) nextReport(now time.Time) time.Time {
+	for day := 0; ; day++ {
+		t := time.Date(now.Year(), now.Month(), now.Day()+day, int(r.At/time.Hour), int(r.At%time.Hour/time.Minute), 0, 0, r.Location)
+		if t.After(now) && (r.Period != SummaryPeriodWeekly || t.Weekday() == time.Monday) {
+			return t
+		}
+	}
+}
+
+// Notify the summary of the period before the day of at
+func (r *SummaryReporter) Report(ctx context.Context, at time.Time) {
+	to := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, r.Location)
+	from := to.AddDate(0, 0, -1)
+	if r.Period == SummaryPeriodWeekly {
+		from = to.AddDate(0, 0, -7)
+	}
+	summary, err := BuildSummary(r.OutputDir, r.ClipBaseUrl, r.Period, from, to)
+	if err != nil {
+		log.Printf("Failed to build the %v summary of %v: %v", r.Period, r.OutputDir, err)
+		return
+	}
+	timestamp := to.Format(time.RFC3339)
+	notification := notify.Notification{
+		EventType: sdmevents.ResourceUpdateEventTypeSummary,
+		Event:     &sdmevents.DeviceEvent{Timestamp: timestamp, ResourceUpdate: &sdmevents.ResourceUpdate{}},
+		Timestamp: timestamp,
+		Summary:   summary,
+	}
+	// attach the latest notable clip for notifiers sending images
+	if len(summary.Notable) > 0 {
+		notable := summary.Notable[len(summary.Notable)-1]
+		notification.ClipFile = filepath.Join(r.OutputDir, filepath.FromSlash(notable.ClipPath))
+		notification.ClipPath = notable.ClipPath
+		notification.ClipUrl = notable.ClipUrl
+	}
+	log.Printf("Sending the %v summary of %v - %v", r.Period, from.Format(time.DateOnly), to.Format(time.DateOnly))
+	notifiers, rules := r.Notifications()
+	if reason := rules.Check(&notification, time.Now()); len(reason) > 0 {
+		log.Printf("Suppressed %v notification: %v", notification.EventName(), reason)
+		return
+	}
+	notify.NotifyAll(ctx, notifiers, &notification)
+}
+
+// Summary of the clips in outputDir whose events are in [from, to), read from their metadata sidecars
+func BuildSummary(outputDir string, clipBaseUrl string, period SummaryPeriod, from time.Time, to time.Time) (*notify.Summary, error) {
+	summary := &notify.Summary{Period: string(period), From: from, To: to, Events: map[string]int{}, BusiestHours: []notify.SummaryHour{}, Notable: []notify.NotableEvent{}}
+	hours := make([]int, 24)
+	err := filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || filepath.Ext(path) == ".tmp" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		summary.StorageBytes += info.Size()
+		// sidecars are written after their events, so older ones are of earlier events
+		if filepath.Ext(path) != ".json" || info.ModTime().Before(from) {
+			return nil
+		}
+		clipFile := strings.TrimSuffix(path, ".json")
+		clipInfo, err := os.Stat(clipFile)
+		if err != nil {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		var metadata storage.ClipMetadata
+		if err := json.Unmarshal(b, &metadata); err != nil || len(metadata.EventType) == 0 {
+			return nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, metadata.EventTimestamp)
+		if err != nil || t.Before(from) || !t.Before(to) {
+			return nil
+		}
+		t = t.In(from.Location())
+		event := sdmevents.EventName(metadata.EventType)
+		summary.Events[event]++
+		summary.ClipBytes += clipInfo.Size()
+		hours[t.Hour()]++
+		if description, ok := notableDescription(&metadata); ok {
+			rel, _ := filepath.Rel(outputDir, clipFile)
+			notable := notify.NotableEvent{Event: event, Device: metadata.DeviceName, Time: t, Description: description, ClipPath: filepath.ToSlash(rel)}
+			if len(notable.Device) == 0 {
+				notable.Device = sdmevents.DeviceId(metadata.Device)
+			}
+			if len(clipBaseUrl) > 0 {
+				notable.ClipUrl = clipBaseUrl + notable.ClipPath
+			}
+			summary.Notable = append(summary.Notable, notable)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for hour, count := range hours {
+		if count > 0 {
+			summary.BusiestHours = append(summary.BusiestHours, notify.SummaryHour{Hour: hour, Events: count})
+		}
+	}
+	sort.SliceStable(summary.BusiestHours, func(i, j int) bool { return summary.BusiestHours[i].Events > summary.BusiestHours[j].Events })
+	summary.BusiestHours = summary.BusiestHours[:min(len(summary.BusiestHours), 3)]
+	sort.Slice(summary.Notable, func(i, j int) bool { return summary.Notable[i].Time.Before(summary.Notable[j].Time) })
+	summary.Notable = summary.Notable[max(0, len(summary.Notable)-maxNotableEvents):]
+	return summary, nil
+}
+
+// Chimes, packages and recognized people are notable, described by who or what was seen
+func notableDescription(metadata *storage.ClipMetadata) (string, bool) {
+	n := notify.Notification{FamiliarFace: metadata.FamiliarFace, Faces: metadata.Faces, Detections: metadata.Detections}
+	description := n.FamiliarFace
+	if len(description) == 0 {
+		description = n.FaceSummary()
+	}
+	if len(description) == 0 {
+		description = n.DetectedLabels()
+	}
+	switch metadata.EventType {
+	case sdmevents.ResourceUpdateEventTypeDoorbellChime, sdmevents.ResourceUpdateEventTypeCameraPackageLeft, sdmevents.ResourceUpdateEventTypeCameraPackageRetrieved:
+		return description, true
+	case sdmevents.ResourceUpdateEventTypeCameraPerson:
+		return description, len(n.FamiliarFace) > 0 || strings.HasPrefix(n.FaceSummary(), "known")
+	}
+	return "", false
+}
@@ -0,0 +1,126 @@
+package processor
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Token bucket limiting bytes per second shared by every stream going through it. Bursts up to one second of data.
+type BandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   int64 // bytes per second. 0 means no limit
+	tokens float64
+	last   time.Time
+}
+
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	return &BandwidthLimiter{rate: bytesPerSecond}
+}
+
+func (l *BandwidthLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Change the limit of bytes per second at runtime. 0 removes the limit.
+func (l *BandwidthLimiter) SetRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = bytesPerSecond
+	l.last = time.Time{}
+}
+
+// Wait until up to n bytes may be transferred and return the granted count
+func (l *BandwidthLimiter) take(ctx context.Context, n int) (int, error) {
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return n, nil
+		}
+		now := time.Now()
+		if l.last.IsZero() {
+			l.tokens = float64(l.rate)
+		} else {
+			l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		}
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+		l.last = now
+		if int64(n) > l.rate {
+			n = int(l.rate)
+		}
+		if l.tokens >= float64(n) {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return n, nil
+		}
+		wait := time.Duration((float64(n) - l.tokens) / float64(l.rate) * float64(time.Second))
+		l.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Return tokens taken but not transferred
+func (l *BandwidthLimiter) refund(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens += float64(n)
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	body    io.ReadCloser
+	limiter *BandwidthLimiter
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	if len(b) > 32<<10 {
+		b = b[:32<<10]
+	}
+	granted, err := r.limiter.take(r.ctx, len(b))
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.body.Read(b[:granted])
+	if n < granted {
+		r.limiter.refund(granted - n)
+	}
+	return n, err
+}
+
+func (r *throttledReader) Close() error {
+	return r.body.Close()
+}
+
+// Transport limiting bandwidth of request bodies (uploads) and response bodies (downloads) by limiter
+type throttledTransport struct {
+	base    http.RoundTripper
+	limiter *BandwidthLimiter
+}
+
+func NewThrottledTransport(base http.RoundTripper, limiter *BandwidthLimiter) http.RoundTripper {
+	return &throttledTransport{base: base, limiter: limiter}
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(req.Context())
+		req.Body = &throttledReader{ctx: req.Context(), body: req.Body, limiter: t.limiter}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &throttledReader{ctx: req.Context(), body: resp.Body, limiter: t.limiter}
+	return resp, nil
+}
@@ -0,0 +1,126 @@
+package processor
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Last known trait state of a device
+type DeviceState struct {
+	Device              string    `json:"device"`
+	Connectivity        string    `json:"connectivity,omitempty"`
+	ConnectivitySince   time.Time `json:"connectivitySince,omitempty"` // when Connectivity changed to the current value
+	BatteryStatus       string    `json:"batteryStatus,omitempty"`
+	BatteryLevel        *float64  `json:"batteryLevel,omitempty"`
+	ChargingStatus      string    `json:"chargingStatus,omitempty"`
+	WifiRssi            *float64  `json:"wifiRssi,omitempty"` // dBm
+	ConnectivityChanges int       `json:"connectivityChanges"`
+	UpdatedAt           time.Time `json:"updatedAt"`           // when traits last changed
+	LastEvent           string    `json:"lastEvent,omitempty"` // name of the last processed event e.g. chime
+	LastEventAt         time.Time `json:"lastEventAt,omitempty"`
+}
+
+func (s *DeviceState) Online() bool {
+	return s.Connectivity == sdmevents.ConnectivityStatusOnline
+}
+
+func (s *DeviceState) Charging() bool {
+	return s.ChargingStatus == sdmevents.ChargingStatusCharging
+}
+
+type DeviceStateTracker struct {
+	mu     sync.Mutex
+	states map[string]*DeviceState // device name => state
+}
+
+func NewDeviceStateTracker() *DeviceStateTracker {
+	return &DeviceStateTracker{states: map[string]*DeviceState{}}
+}
+
+// Apply known traits of a device, logging transitions. Unknown traits are ignored.
+func (t *DeviceStateTracker) Update(device string, traits map[string]json.RawMessage, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.state(device)
+	updated := false
+	if raw, ok := traits[sdmevents.DeviceTraitConnectivity]; ok {
+		var connectivity sdmevents.DeviceTraitConnectivityValue
+		if err := json.Unmarshal(raw, &connectivity); err != nil {
+			log.Printf("Failed to decode %v of %v: %v", sdmevents.DeviceTraitConnectivity, device, err)
+		} else if connectivity.Status != state.Connectivity {
+			if len(state.Connectivity) > 0 {
+				log.Printf("Device %v went %v after %v %v", device, connectivity.Status, at.Sub(state.ConnectivitySince).Round(time.Second), state.Connectivity)
+				state.ConnectivityChanges++
+			}
+			state.Connectivity = connectivity.Status
+			state.ConnectivitySince = at
+			updated = true
+		}
+	}
+	if raw, ok := traits[sdmevents.DeviceTraitBattery]; ok {
+		var battery sdmevents.DeviceTraitBatteryValue
+		if err := json.Unmarshal(raw, &battery); err != nil {
+			log.Printf("Failed to decode %v of %v: %v", sdmevents.DeviceTraitBattery, device, err)
+		} else {
+			if battery.BatteryStatus != state.BatteryStatus {
+				log.Printf("Device %v battery status: %v => %v", device, state.BatteryStatus, battery.BatteryStatus)
+			}
+			if len(battery.ChargingStatus) > 0 && battery.ChargingStatus != state.ChargingStatus {
+				log.Printf("Device %v charging status: %v => %v", device, state.ChargingStatus, battery.ChargingStatus)
+			}
+			state.BatteryStatus = battery.BatteryStatus
+			state.BatteryLevel = battery.BatteryLevel
+			state.ChargingStatus = battery.ChargingStatus
+			updated = true
+		}
+	}
+	if raw, ok := traits[sdmevents.DeviceTraitWifi]; ok {
+		var wifi sdmevents.DeviceTraitWifiValue
+		if err := json.Unmarshal(raw, &wifi); err != nil {
+			log.Printf("Failed to decode %v of %v: %v", sdmevents.DeviceTraitWifi, device, err)
+		} else {
+			state.WifiRssi = wifi.Rssi
+			updated = true
+		}
+	}
+	if updated {
+		state.UpdatedAt = at
+	}
+}
+
+// Record the last processed event of a device
+func (t *DeviceStateTracker) EventReceived(device string, eventType sdmevents.ResourceUpdateEventType, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.state(device)
+	if at.After(state.LastEventAt) {
+		state.LastEvent = sdmevents.EventName(eventType)
+		state.LastEventAt = at
+	}
+}
+
+func (t *DeviceStateTracker) state(device string) *DeviceState {
+	state, ok := t.states[device]
+	if !ok {
+		state = &DeviceState{Device: device}
+		t.states[device] = state
+	}
+	return state
+}
+
+// Copy of all states sorted by device name
+func (t *DeviceStateTracker) States() []DeviceState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	states := make([]DeviceState, 0, len(t.states))
+	for _, state := range t.states {
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Device < states[j].Device })
+	return states
+}
@@ -0,0 +1,131 @@
+package nestconsumer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	pubsubapi "cloud.google.com/go/pubsub/apiv1"
+	"google.golang.org/api/option"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Client of PullSource. Connects to the Pub/Sub emulator when PUBSUB_EMULATOR_HOST is set, like pubsub.NewClient.
+func NewPullClient(ctx context.Context, opts ...option.ClientOption) (*pubsubapi.SubscriberClient, error) {
+	if addr := os.Getenv("PUBSUB_EMULATOR_HOST"); len(addr) > 0 {
+		opts = []option.ClientOption{
+			option.WithEndpoint(addr),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		}
+	}
+	return pubsubapi.NewSubscriberClient(ctx, opts...)
+}
+
+// Receive messages by polling unary Pull RPCs instead of StreamingPull, which can hang silently on flaky connections.
+// Every RPC has an explicit deadline, and failing pulls are retried every Interval.
+type PullSource struct {
+	Client       *pubsubapi.SubscriberClient
+	Subscription string        // "projects/<project>/subscriptions/<subscription>"
+	MaxMessages  int32         // max messages per pull. 0 means 10
+	Interval     time.Duration // wait between pulls which returned no message or failed. 0 means 5s
+	Timeout      time.Duration // deadline of each Pull and Acknowledge RPC. 0 means 30s
+	lastPulled   atomic.Int64  // unix nanos of the last pull which didn't fail
+}
+
+// Messages of a pull are handled sequentially, then acked at once
+func (s *PullSource) Receive(ctx context.Context, handle func(ctx context.Context, data []byte)) error {
+	maxMessages := s.MaxMessages
+	if maxMessages <= 0 {
+		maxMessages = 10
+	}
+	interval := s.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	failures := 0
+	for {
+		received, err := s.pull(ctx, maxMessages, timeout, handle)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			failures++
+			log.Printf("Failed to pull %v (%v consecutive failures), retrying in %v: %v", s.Subscription, failures, interval, err)
+		} else {
+			s.lastPulled.Store(time.Now().UnixNano())
+			if failures > 0 {
+				log.Printf("Pulled %v again after %v failures", s.Subscription, failures)
+				failures = 0
+			}
+		}
+		if err == nil && received > 0 {
+			// more messages may be waiting
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Healthy while pulls succeed, i.e. the last one is within 2 rounds of the timeout and the interval
+func (s *PullSource) CheckHealth(ctx context.Context) error {
+	timeout, interval := s.Timeout, s.Interval
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	last := s.lastPulled.Load()
+	if last == 0 {
+		return fmt.Errorf("no successful pull of %v yet", s.Subscription)
+	}
+	if since := time.Since(time.Unix(0, last)); since > 2*(timeout+interval) {
+		return fmt.Errorf("no successful pull of %v for %v", s.Subscription, since.Round(time.Second))
+	}
+	return nil
+}
+
+// Returns the number of received messages
+func (s *PullSource) pull(ctx context.Context, maxMessages int32, timeout time.Duration, handle func(ctx context.Context, data []byte)) (int, error) {
+	pullCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := s.Client.Pull(pullCtx, &pubsubpb.PullRequest{
+		Subscription: s.Subscription,
+		MaxMessages:  maxMessages,
+	})
+	if err != nil && pullCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		// no message arrived within the deadline
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if len(resp.ReceivedMessages) == 0 {
+		return 0, nil
+	}
+	ackIds := []string{}
+	for _, m := range resp.ReceivedMessages {
+		handle(ctx, m.Message.Data)
+		ackIds = append(ackIds, m.AckId)
+	}
+	ackCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// unacked messages are redelivered after the ack deadline
+	return len(ackIds), s.Client.Acknowledge(ackCtx, &pubsubpb.AcknowledgeRequest{
+		Subscription: s.Subscription,
+		AckIds:       ackIds,
+	})
+}
@@ -0,0 +1,54 @@
+package sdmevents
+
+// https://developers.google.com/nest/device-access/traits/device/camera-event-image#generateimage-request-fields
+type GenerateImageRequestParam struct {
+	EventId string `json:"eventId"`
+}
+
+// https://developers.google.com/nest/device-access/traits/device/camera-event-image#generateimage-response-fields
+type GenerateImageResponse struct {
+	Url   string `json:"url"`
+	Token string `json:"token"`
+}
+
+// https://developers.google.com/nest/device-access/traits/device/camera-live-stream#generatewebrtcstream
+type GenerateWebRtcStreamRequestParam struct {
+	OfferSdp string `json:"offerSdp"`
+}
+
+// https://developers.google.com/nest/device-access/traits/device/camera-live-stream#extendwebrtcstream
+type ExtendWebRtcStreamRequestParam struct {
+	MediaSessionId string `json:"mediaSessionId"`
+}
+
+// https://developers.google.com/nest/device-access/traits/device/camera-live-stream#stopwebrtcstream
+type StopWebRtcStreamRequestParam struct {
+	MediaSessionId string `json:"mediaSessionId"`
+}
+
+// https://developers.google.com/nest/device-access/traits/device/camera-live-stream#generatertspstream
+type GenerateRtspStreamResponse struct {
+	StreamUrls struct {
+		RtspUrl string `json:"rtspUrl"`
+	} `json:"streamUrls"`
+	StreamExtensionToken string `json:"streamExtensionToken"`
+	ExpiresAt            string `json:"expiresAt"`
+}
+
+// https://developers.google.com/nest/device-access/traits/device/camera-live-stream#stoprtspstream
+type StopRtspStreamRequestParam struct {
+	StreamExtensionToken string `json:"streamExtensionToken"`
+}
+
+// https://developers.google.com/nest/device-access/traits/device/camera-live-stream#generatewebrtcstream
+type GenerateWebRtcStreamResponse struct {
+	AnswerSdp      string `json:"answerSdp"`
+	MediaSessionId string `json:"mediaSessionId"`
+	ExpiresAt      string `json:"expiresAt"`
+}
+
+// https://developers.google.com/nest/device-access/traits/device/camera-live-stream#extendwebrtcstream
+type ExtendWebRtcStreamResponse struct {
+	MediaSessionId string `json:"mediaSessionId"`
+	ExpiresAt      string `json:"expiresAt"`
+}
@@ -0,0 +1,109 @@
+package sdmevents
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"google.golang.org/api/smartdevicemanagement/v1"
+)
+
+const (
+	DeviceTraitInfo             = "sdm.devices.traits.Info"
+	DeviceTraitCameraLiveStream = "sdm.devices.traits.CameraLiveStream"
+	DeviceTraitCameraEventImage = "sdm.devices.traits.CameraEventImage" // GenerateImage of events
+)
+
+// https://developers.google.com/nest/device-access/traits/device/info
+type DeviceTraitInfoValue struct {
+	CustomName string `json:"customName"`
+}
+
+// https://developers.google.com/nest/device-access/traits/device/camera-live-stream
+type DeviceTraitCameraLiveStreamValue struct {
+	SupportedProtocols []string `json:"supportedProtocols"` // RTSP, WEB_RTC
+}
+
+const (
+	// https://developers.google.com/nest/device-access/traits/device/connectivity
+	DeviceTraitConnectivity = "sdm.devices.traits.Connectivity"
+	// not documented in the SDM trait list, but reported by battery doorbells
+	DeviceTraitBattery = "sdm.devices.traits.Battery"
+	// not in the SDM trait list either, decoded when a device reports it
+	DeviceTraitWifi = "sdm.devices.traits.Wifi"
+)
+
+const (
+	ConnectivityStatusOnline  = "ONLINE"
+	ConnectivityStatusOffline = "OFFLINE"
+)
+
+type DeviceTraitConnectivityValue struct {
+	Status string `json:"status"` // ONLINE, OFFLINE
+}
+
+type DeviceTraitBatteryValue struct {
+	BatteryStatus  string   `json:"batteryStatus"`  // e.g. NORMAL, LOW, CRITICAL
+	BatteryLevel   *float64 `json:"batteryLevel"`   // 0-100, nil if not reported
+	ChargingStatus string   `json:"chargingStatus"` // e.g. CHARGING, NOT_CHARGING, empty if not reported
+}
+
+const ChargingStatusCharging = "CHARGING"
+
+type DeviceTraitWifiValue struct {
+	Rssi *float64 `json:"rssi"` // signal strength in dBm, nil if not reported
+}
+
+const (
+	DeviceTypeDoorbell = "sdm.devices.types.DOORBELL"
+
+	StructureTraitInfo     = "sdm.structures.traits.Info"
+	StructureTraitRoomInfo = "sdm.structures.traits.RoomInfo"
+)
+
+// customName trait value of structures and rooms
+type StructureTraitInfoValue struct {
+	CustomName string `json:"customName"`
+}
+
+// "enterprises/project-id/devices/device-id" => "device-id"
+func DeviceId(deviceName string) string {
+	return path.Base(deviceName)
+}
+
+// Decode trait of device into v. Returns false if the device doesn't have the trait.
+func DecodeDeviceTrait(device *smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device, trait string, v interface{}) (bool, error) {
+	var traits map[string]json.RawMessage
+	if err := json.Unmarshal(device.Traits, &traits); err != nil {
+		return false, err
+	}
+	raw, ok := traits[trait]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Custom name of the device, or room name if custom name is not set
+func DeviceDisplayName(device *smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device) string {
+	var info DeviceTraitInfoValue
+	if ok, err := DecodeDeviceTrait(device, DeviceTraitInfo, &info); err == nil && ok && len(info.CustomName) > 0 {
+		return info.CustomName
+	}
+	for _, relation := range device.ParentRelations {
+		if len(relation.DisplayName) > 0 {
+			return relation.DisplayName
+		}
+	}
+	return DeviceId(device.Name)
+}
+
+// Find device by full name, device id or display name
+func FindDevice(devices []*smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device, query string) (*smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device, error) {
+	for _, device := range devices {
+		if device.Name == query || DeviceId(device.Name) == query || DeviceDisplayName(device) == query {
+			return device, nil
+		}
+	}
+	return nil, fmt.Errorf("device %v not found", query)
+}
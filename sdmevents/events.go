@@ -0,0 +1,206 @@
+// Package sdmevents defines Smart Device Management API messages: Pub/Sub events, device traits and commands.
+package sdmevents
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// https://developers.google.com/nest/device-access/api/events#threads
+const (
+	EventThreadStateStarted = "STARTED"
+	EventThreadStateUpdated = "UPDATED"
+	EventThreadStateEnded   = "ENDED"
+)
+
+type DeviceEvent struct {
+	EventId          string          `json:"eventId"`
+	Timestamp        string          `json:"timestamp"`
+	RelationUpdate   *RelationUpdate `json:"relationUpdate"`
+	ResourceUpdate   *ResourceUpdate `json:"resourceUpdate"`
+	ResourceGroup    []string        `json:"resourceGroup"`
+	EventThreadId    *string         `json:"eventThreadId"`
+	EventThreadState *string         `json:"eventThreadState"`
+	UserId           string          `json:"userId"`
+}
+
+func (e *DeviceEvent) Format() string {
+	return fmt.Sprintf(strings.Join([]string{
+		"DeviceEvent",
+		"* UserId: %v",
+		"* EventId: %v",
+		"* Timestamp: %v",
+	}, "\n\t"), e.UserId, e.EventId, e.Timestamp)
+}
+
+// Notify a device (object) is registered to/deleted from/updated in the room(subject)
+// If Subject is empty, it means structure/room is created/deleted
+type RelationUpdate struct {
+	Type    string `json:"type"`    // CREATED, DELETED, UPDATED
+	Subject string `json:"subject"` // empty or "enterprises/project-id/structures/structure-id", (room or structure)
+	Object  string `json:"object"`  // "enterprises/project-id/devices/device-id"
+}
+
+const (
+	RelationUpdateTypeCreated = "CREATED"
+	RelationUpdateTypeDeleted = "DELETED"
+	RelationUpdateTypeUpdated = "UPDATED"
+)
+
+type ResourceUpdateEventType string
+
+const (
+	ResourceUpdateEventTypeDoorbellChime = ResourceUpdateEventType("sdm.devices.events.DoorbellChime.Chime")
+	ResourceUpdateEventTypeCameraMotion  = ResourceUpdateEventType("sdm.devices.events.CameraMotion.Motion")
+	ResourceUpdateEventTypeCameraPerson  = ResourceUpdateEventType("sdm.devices.events.CameraPerson.Person")
+	ResourceUpdateEventTypeCameraSound   = ResourceUpdateEventType("sdm.devices.events.CameraSound.Sound")
+	// sent by newer doorbells with package detection
+	ResourceUpdateEventTypeCameraPackageLeft      = ResourceUpdateEventType("sdm.devices.events.CameraPackage.PackageLeft")
+	ResourceUpdateEventTypeCameraPackageRetrieved = ResourceUpdateEventType("sdm.devices.events.CameraPackage.PackageRetrieved")
+	ResourceUpdateEventTypeCameraClipPreview      = ResourceUpdateEventType("sdm.devices.events.CameraClipPreview.ClipPreview")
+)
+
+// Events raised by the consumer itself, not sent by SDM
+const (
+	ResourceUpdateEventTypeDeviceOffline = ResourceUpdateEventType("nestconsumer.DeviceOffline")
+	ResourceUpdateEventTypeSnapshot      = ResourceUpdateEventType("nestconsumer.Snapshot")     // recorded on demand from the live stream
+	ResourceUpdateEventTypeSummary       = ResourceUpdateEventType("nestconsumer.Summary")      // daily or weekly digest of saved clips
+	ResourceUpdateEventTypeLatencyAlert  = ResourceUpdateEventType("nestconsumer.LatencyAlert") // an event notified later than the latency budget
+)
+
+// Short names of event types used in flags, config, topics and templates
+var eventNames = map[ResourceUpdateEventType]string{
+	ResourceUpdateEventTypeDoorbellChime:          "chime",
+	ResourceUpdateEventTypeCameraMotion:           "motion",
+	ResourceUpdateEventTypeCameraPerson:           "person",
+	ResourceUpdateEventTypeCameraSound:            "sound",
+	ResourceUpdateEventTypeCameraPackageLeft:      "package_left",
+	ResourceUpdateEventTypeCameraPackageRetrieved: "package_retrieved",
+	ResourceUpdateEventTypeDeviceOffline:          "offline",
+	ResourceUpdateEventTypeSnapshot:               "snapshot",
+	ResourceUpdateEventTypeSummary:                "summary",
+	ResourceUpdateEventTypeLatencyAlert:           "latency",
+}
+
+// Short name of event type e.g. "chime". Unknown event types are returned as is.
+func EventName(eventType ResourceUpdateEventType) string {
+	if name, ok := eventNames[eventType]; ok {
+		return name
+	}
+	return string(eventType)
+}
+
+// Inverse of EventName
+func EventTypeByName(name string) (ResourceUpdateEventType, bool) {
+	for eventType, n := range eventNames {
+		if n == name {
+			return eventType, true
+		}
+	}
+	return "", false
+}
+
+type ResourceUpdateEventDoorbellChime struct {
+	EventSessionId string `json:"eventSessionId"`
+	EventId        string `json:"eventId"`
+}
+
+func (p *ResourceUpdateEventDoorbellChime) Format() string {
+	if p == nil {
+		return "DoorbellChimeEvent(nil)"
+	}
+	return fmt.Sprintf("DoorbellChimeEvent(EventSessionId: %v, EventId: %v)", p.EventSessionId, p.EventId)
+}
+
+type ResourceUpdateEventCameraMotion struct {
+	EventSessionId string `json:"eventSessionId"`
+	EventId        string `json:"eventId"`
+}
+
+func (p *ResourceUpdateEventCameraMotion) Format() string {
+	if p == nil {
+		return "CameraMotionEvent(nil)"
+	}
+	return fmt.Sprintf("CameraMotionEvent(EventSessionId: %v, EventId: %v)", p.EventSessionId, p.EventId)
+}
+
+type ResourceUpdateEventCameraPerson struct {
+	EventSessionId string        `json:"eventSessionId"`
+	EventId        string        `json:"eventId"`
+	FamiliarFace   *FamiliarFace `json:"familiarFace,omitempty"` // only in newer payloads when the person was recognized
+}
+
+// Familiar face metadata attached to person events by newer SDM payloads
+type FamiliarFace struct {
+	Name string `json:"name"`
+}
+
+func (p *ResourceUpdateEventCameraPerson) Format() string {
+	if p == nil {
+		return "CameraPersonEvent(nil)"
+	}
+	if p.FamiliarFace != nil {
+		return fmt.Sprintf("CameraPersonEvent(EventSessionId: %v, EventId: %v, FamiliarFace: %v)", p.EventSessionId, p.EventId, p.FamiliarFace.Name)
+	}
+	return fmt.Sprintf("CameraPersonEvent(EventSessionId: %v, EventId: %v)", p.EventSessionId, p.EventId)
+}
+
+// Payload of package left/retrieved events sent by newer doorbells
+type ResourceUpdateEventCameraPackage struct {
+	EventSessionId string `json:"eventSessionId"`
+	EventId        string `json:"eventId"`
+}
+
+func (p *ResourceUpdateEventCameraPackage) Format() string {
+	if p == nil {
+		return "CameraPackageEvent(nil)"
+	}
+	return fmt.Sprintf("CameraPackageEvent(EventSessionId: %v, EventId: %v)", p.EventSessionId, p.EventId)
+}
+
+// Name of the familiar face in the person event of the update. Empty if the person wasn't recognized.
+func EventFamiliarFace(event *DeviceEvent) string {
+	if event.ResourceUpdate == nil {
+		return ""
+	}
+	raw, ok := event.ResourceUpdate.Events[ResourceUpdateEventTypeCameraPerson]
+	if !ok {
+		return ""
+	}
+	var person ResourceUpdateEventCameraPerson
+	if err := json.Unmarshal(raw, &person); err != nil || person.FamiliarFace == nil {
+		return ""
+	}
+	return person.FamiliarFace.Name
+}
+
+type ResourceUpdateEventCameraSound struct {
+	EventSessionId string `json:"eventSessionId"`
+	EventId        string `json:"eventId"`
+}
+
+func (p *ResourceUpdateEventCameraSound) Format() string {
+	if p == nil {
+		return "CameraSoundEvent(nil)"
+	}
+	return fmt.Sprintf("CameraSoundEvent(EventSessionId: %v, EventId: %v)", p.EventSessionId, p.EventId)
+}
+
+type ResourceUpdateEventCameraClipPreview struct {
+	EventSessionId string `json:"eventSessionId"`
+	PreviewUrl     string `json:"previewUrl"`
+}
+
+func (p *ResourceUpdateEventCameraClipPreview) Format() string {
+	if p == nil {
+		return "CameraClipPreview(nil)"
+	}
+	return fmt.Sprintf("CameraClipPreview(EventSessionId: %v, PreviewUrl: %v)", p.EventSessionId, p.PreviewUrl)
+}
+
+type ResourceUpdate struct {
+	Name   string                                      `json:"name"` // "enterprises/project-id/devices/device-id",
+	Traits map[string]json.RawMessage                  `json:"traits"`
+	Events map[ResourceUpdateEventType]json.RawMessage `json:"events"`
+}
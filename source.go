@@ -0,0 +1,241 @@
+package nestconsumer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Source of raw SDM event messages. The Pub/Sub subscription in production, recorded event JSON in tests and
+// dry runs.
+type MessageSource interface {
+	// Call handle for each message until ctx is done, the source is exhausted or receiving fails.
+	// handle may be called concurrently.
+	Receive(ctx context.Context, handle func(ctx context.Context, data []byte)) error
+}
+
+// MessageSource which can tell whether it's still receiving, e.g. for watchdogs
+type HealthChecker interface {
+	// nil if messages can be received
+	CheckHealth(ctx context.Context) error
+}
+
+// Receive messages by StreamingPull of the subscription. With StaleTimeout, a supervisor tears down the stream once it
+// has been silent for too long, which it sometimes stays after long network outages, and receives again on a new client.
+type PubsubSource struct {
+	Subscription *pubsub.Subscription
+	// New client of the project of Subscription e.g. pubsub.NewClient, used after a stale stream is torn down so that
+	// wedged connections are dropped. nil receives again on the same client
+	NewClient    func(ctx context.Context) (*pubsub.Client, error)
+	StaleTimeout time.Duration // reconnect when neither a message nor a keepalive probe succeeded for this long. 0 disables the supervisor
+	MaxIdle      time.Duration // reconnect also when no message arrived for this long although probes succeed. 0 disables it
+
+	mu            sync.Mutex     // guards Subscription and client
+	client        *pubsub.Client // created by NewClient
+	receiving     atomic.Bool
+	lastMessage   atomic.Int64 // unix nanos
+	lastKeepalive atomic.Int64 // unix nanos of the last successful probe
+	reconnects    atomic.Int64
+}
+
+func (s *PubsubSource) subscription() *pubsub.Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Subscription
+}
+
+// Messages are acked after handle returns. handle gets ctx rather than the context of the stream, so that reconnects
+// don't cancel messages being processed
+func (s *PubsubSource) Receive(ctx context.Context, handle func(ctx context.Context, data []byte)) error {
+	s.receiving.Store(true)
+	defer s.receiving.Store(false)
+	for {
+		now := time.Now().UnixNano()
+		s.lastMessage.Store(now)
+		s.lastKeepalive.Store(now)
+		subscription := s.subscription()
+		streamCtx, cancel := context.WithCancel(ctx)
+		stale := make(chan string, 1)
+		if s.StaleTimeout > 0 {
+			go s.supervise(streamCtx, subscription, stale, cancel)
+		}
+		err := subscription.Receive(streamCtx, func(_ context.Context, m *pubsub.Message) {
+			s.lastMessage.Store(time.Now().UnixNano())
+			defer m.Ack()
+			handle(ctx, m.Data)
+		})
+		cancel()
+		if ctx.Err() != nil {
+			return err
+		}
+		var reason string
+		select {
+		case reason = <-stale:
+		default:
+			return err
+		}
+		s.reconnects.Add(1)
+		log.Printf("Reconnecting %v (%v reconnects): %v", subscription, s.reconnects.Load(), reason)
+		if s.NewClient != nil {
+			s.reconnect(ctx, subscription)
+		}
+	}
+}
+
+// Replace the client of subscription by a new one. The old subscription is kept when it fails
+func (s *PubsubSource) reconnect(ctx context.Context, subscription *pubsub.Subscription) {
+	client, err := s.NewClient(ctx)
+	if err != nil {
+		log.Printf("Failed to create a new Pub/Sub client, receiving on the old one: %v", err)
+		return
+	}
+	renewed := client.Subscription(subscription.ID())
+	renewed.ReceiveSettings = subscription.ReceiveSettings
+	s.mu.Lock()
+	old := s.client
+	s.Subscription, s.client = renewed, client
+	s.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// Probe Pub/Sub every quarter of StaleTimeout until ctx is done, and cancel the stream when it's stale
+func (s *PubsubSource) supervise(ctx context.Context, subscription *pubsub.Subscription, stale chan<- string, cancel func()) {
+	interval := s.StaleTimeout / 4
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		probeCtx, probeCancel := context.WithTimeout(ctx, min(interval, 10*time.Second))
+		if _, err := subscription.Exists(probeCtx); err == nil {
+			s.lastKeepalive.Store(time.Now().UnixNano())
+		}
+		probeCancel()
+		lastMessage := time.Unix(0, s.lastMessage.Load())
+		lastAlive := time.Unix(0, max(s.lastMessage.Load(), s.lastKeepalive.Load()))
+		reason := ""
+		if since := time.Since(lastAlive); since > s.StaleTimeout {
+			reason = fmt.Sprintf("no message or keepalive for %v", since.Round(time.Second))
+		} else if since := time.Since(lastMessage); s.MaxIdle > 0 && since > s.MaxIdle {
+			reason = fmt.Sprintf("no message for %v", since.Round(time.Second))
+		}
+		if len(reason) > 0 && ctx.Err() == nil {
+			stale <- reason
+			cancel()
+			return
+		}
+	}
+}
+
+// Number of stale streams torn down
+func (s *PubsubSource) Reconnects() int64 {
+	return s.reconnects.Load()
+}
+
+// Time of the last received message, or when receiving (re)started
+func (s *PubsubSource) LastMessage() time.Time {
+	return time.Unix(0, s.lastMessage.Load())
+}
+
+// The streaming pull itself can't be observed, so Pub/Sub is probed by a unary RPC over the same connections of the
+// client, which fails when they are wedged
+func (s *PubsubSource) CheckHealth(ctx context.Context) error {
+	if !s.receiving.Load() {
+		return fmt.Errorf("not receiving %v", s.subscription())
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	subscription := s.subscription()
+	exists, err := subscription.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to reach %v: %v", subscription, err)
+	}
+	if !exists {
+		return fmt.Errorf("%v doesn't exist", subscription)
+	}
+	return nil
+}
+
+// Recorded event JSON read from a reader, one message after another. Messages can be either one per line (JSONL)
+// or pretty printed, as long as each of them is a JSON object.
+type FileSource struct {
+	Reader io.Reader
+	file   *os.File // nil unless opened by OpenFileSource
+}
+
+// Open recorded events of path. "-" reads stdin.
+func OpenFileSource(path string) (*FileSource, error) {
+	if path == "-" {
+		return &FileSource{Reader: os.Stdin}, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSource{Reader: bufio.NewReader(file), file: file}, nil
+}
+
+func (s *FileSource) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// Messages are handled sequentially in the recorded order. Returns nil at the end of the reader.
+func (s *FileSource) Receive(ctx context.Context, handle func(ctx context.Context, data []byte)) error {
+	decoder := json.NewDecoder(s.Reader)
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var message json.RawMessage
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read message %d: %v", i, err)
+		}
+		handle(ctx, message)
+	}
+}
+
+// Messages of Source whose event timestamp is in [Since, Until). Zero Since or Until means unbounded.
+type TimeRangeSource struct {
+	Source MessageSource
+	Since  time.Time
+	Until  time.Time
+}
+
+func (s *TimeRangeSource) Receive(ctx context.Context, handle func(ctx context.Context, data []byte)) error {
+	return s.Source.Receive(ctx, func(ctx context.Context, data []byte) {
+		var event sdmevents.DeviceEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			log.Printf("Failed to unmarshal message: %v\n\t%v", err, data)
+			return
+		}
+		timestamp, err := time.Parse(time.RFC3339Nano, event.Timestamp)
+		if err != nil {
+			log.Printf("Skip message with invalid timestamp(%v): %v", event.Timestamp, err)
+			return
+		}
+		if (!s.Since.IsZero() && timestamp.Before(s.Since)) || (!s.Until.IsZero() && !timestamp.Before(s.Until)) {
+			return
+		}
+		handle(ctx, data)
+	})
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Extension of files being written. They are renamed to the final name once completely written.
+const TempFileExtension = ".tmp"
+
+// Write data into path+".tmp" then rename it to path, so that readers never see partially written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tempPath := path + TempFileExtension
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// Replace characters unsafe in file names with "_"
+func SanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Remove temp files left in dir by a crash during writing.
+func RemoveTempFiles(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && filepath.Ext(path) == TempFileExtension {
+			log.Printf("Remove partially written file %v", path)
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
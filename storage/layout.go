@@ -0,0 +1,80 @@
+// Package storage defines the on-disk layout of saved clips shared by the consumer and the datasource.
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Output layout written by the consumer and served by the datasource. Reported by the datasource's /meta so that
+// the consumer can verify both sides agree. Bump LayoutVersion whenever the directory structure or file naming
+// contract changes.
+const (
+	LayoutVersion = 1
+	// directory layout assumed by the datasource's listing, in go's time layout
+	PathTemplate = "2006/01/02/15"
+)
+
+// Datasource feature listing clips of any directory layout by their time
+const FeatureAnyLayout = "any-layout"
+
+// Features the datasource must support to serve what this consumer writes
+var RequiredDatasourceFeatures = []string{
+	"list",
+	"file",
+	"skip-sidecar-json",
+	"skip-tmp",
+}
+
+// Response of the datasource's /meta
+type DatasourceMeta struct {
+	LayoutVersion int      `json:"layoutVersion"`
+	PathTemplate  string   `json:"pathTemplate"`
+	Features      []string `json:"features"`
+	Timezone      string   `json:"timezone,omitempty"` // time zone directories are listed in
+}
+
+func FetchDatasourceMeta(datasourceUrl string) (*DatasourceMeta, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(datasourceUrl, "/") + "/meta")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %v from datasource /meta (datasource may be too old)", resp.Status)
+	}
+	var meta DatasourceMeta
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// Verify the datasource can list files written with outputFileNameFormat in location.
+func CheckDatasourceCompatibility(meta *DatasourceMeta, outputFileNameFormat string, location *time.Location) error {
+	if meta.LayoutVersion != LayoutVersion {
+		return fmt.Errorf("layout version mismatch: consumer writes %v, datasource serves %v", LayoutVersion, meta.LayoutVersion)
+	}
+	supported := map[string]bool{}
+	for _, feature := range meta.Features {
+		supported[feature] = true
+	}
+	if dir := path.Dir(outputFileNameFormat); dir != meta.PathTemplate && !supported[FeatureAnyLayout] {
+		return fmt.Errorf("directory layout mismatch: -output-file-path-format puts files under %v, datasource lists %v", dir, meta.PathTemplate)
+	}
+	// "Local" may be a different zone on each host, so it can't be compared
+	if len(meta.Timezone) > 0 && meta.Timezone != "Local" && location.String() != "Local" && meta.Timezone != location.String() {
+		return fmt.Errorf("time zone mismatch: consumer writes paths in %v, datasource lists %v", location, meta.Timezone)
+	}
+	for _, feature := range RequiredDatasourceFeatures {
+		if !supported[feature] {
+			return fmt.Errorf("datasource doesn't support feature %v", feature)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"encoding/json"
+
+	"github.com/cormoran/NestDoorbellConsumer/sdmevents"
+)
+
+// Sidecar file written next to each saved clip as "<clip file name>.json"
+type ClipMetadata struct {
+	Event          *sdmevents.DeviceEvent            `json:"event"`
+	EventType      sdmevents.ResourceUpdateEventType `json:"eventType"`
+	Device         string                            `json:"device"`                 // "enterprises/project-id/devices/device-id"
+	DeviceName     string                            `json:"deviceName,omitempty"`   // custom name of the device when saved e.g. "Front door"
+	EventTimestamp string                            `json:"eventTimestamp"`         // timestamp of the DeviceEvent given by SDM
+	ReceivedAt     string                            `json:"receivedAt"`             // RFC3339 time when the event was received
+	SavedAt        string                            `json:"savedAt"`                // RFC3339 time when the clip was written
+	LateArrival    bool                              `json:"lateArrival"`            // event was received later than -late-arrival-threshold after its timestamp
+	FamiliarFace   string                            `json:"familiarFace,omitempty"` // name of recognized person
+	Detections     []Detection                       `json:"detections,omitempty"`   // objects in the clip found by the analyzer
+	Faces          []Face                            `json:"faces,omitempty"`        // faces in person clips matched against the gallery of the face recognizer
+	Frame          *FrameSize                        `json:"frame,omitempty"`        // size of the frame analyzed for detections and faces
+	Sounds         []string                          `json:"sounds,omitempty"`       // sounds heard in the clip by the audio tagger e.g. knock, bark
+	Download       ClipDownloadMetadata              `json:"download"`
+}
+
+// Object found in a frame of the clip e.g. by DeepStack
+type Detection struct {
+	Label      string  `json:"label"` // e.g. person, car, dog
+	Confidence float64 `json:"confidence"`
+	// bounding box in pixels of the analyzed frame
+	XMin int `json:"xMin"`
+	YMin int `json:"yMin"`
+	XMax int `json:"xMax"`
+	YMax int `json:"yMax"`
+}
+
+type FrameSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Face found in a frame of the clip
+type Face struct {
+	Name       string  `json:"name,omitempty"` // name registered in the gallery. empty if the face is unknown
+	Confidence float64 `json:"confidence"`
+	XMin       int     `json:"xMin"`
+	YMin       int     `json:"yMin"`
+	XMax       int     `json:"xMax"`
+	YMax       int     `json:"yMax"`
+}
+
+type ClipDownloadMetadata struct {
+	Url           string `json:"url"`
+	ContentType   string `json:"contentType"`
+	ContentLength int64  `json:"contentLength"` // -1 if the server didn't send Content-Length
+	Bytes         int64  `json:"bytes"`
+	Sha256        string `json:"sha256"` // hex encoded SHA-256 of the saved file
+	Attempts      int    `json:"attempts"`
+}
+
+const ClipMetadataExtension = ".json"
+
+func ClipMetadataPath(clipPath string) string {
+	return clipPath + ClipMetadataExtension
+}
+
+func WriteClipMetadata(clipPath string, metadata *ClipMetadata) error {
+	b, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(ClipMetadataPath(clipPath), b, 0666)
+}
@@ -0,0 +1,71 @@
+package nestconsumer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Topic SDM publishes events of the Device Access project to, as shown in the Device Access console
+func SdmTopic(nestProjectId string) string {
+	return "projects/sdm-prod/topics/enterprise-" + strings.TrimPrefix(nestProjectId, "enterprises/")
+}
+
+// Settings of the subscription created by EnsureSubscription
+type SubscriptionSettings struct {
+	Topic               string        // "projects/<project>/topics/<topic>" e.g. SdmTopic(nestProjectId)
+	AckDeadline         time.Duration // 0 uses the Pub/Sub default (10s)
+	RetentionDuration   time.Duration // retention of unacked messages. 0 uses the Pub/Sub default (7 days)
+	DeadLetterTopic     string        // "projects/<project>/topics/<topic>". empty disables dead lettering
+	MaxDeliveryAttempts int           // delivery attempts before dead lettering. 0 uses the Pub/Sub default (5)
+}
+
+// Return subscription id of client, creating it bound to settings.Topic if it doesn't exist.
+// Settings are not applied to an existing subscription.
+func EnsureSubscription(ctx context.Context, client *pubsub.Client, id string, settings SubscriptionSettings) (*pubsub.Subscription, error) {
+	subscription := client.Subscription(id)
+	exists, err := subscription.Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return subscription, nil
+	}
+	topic, err := topicByName(client, settings.Topic)
+	if err != nil {
+		return nil, err
+	}
+	config := pubsub.SubscriptionConfig{
+		Topic:             topic,
+		AckDeadline:       settings.AckDeadline,
+		RetentionDuration: settings.RetentionDuration,
+	}
+	if len(settings.DeadLetterTopic) > 0 {
+		if _, err := topicByName(client, settings.DeadLetterTopic); err != nil {
+			return nil, fmt.Errorf("dead letter %v", err)
+		}
+		config.DeadLetterPolicy = &pubsub.DeadLetterPolicy{
+			DeadLetterTopic:     settings.DeadLetterTopic,
+			MaxDeliveryAttempts: settings.MaxDeliveryAttempts,
+		}
+	}
+	subscription, err = client.CreateSubscription(ctx, id, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create subscription %v of %v: %v", id, settings.Topic, err)
+	}
+	log.Printf("Created subscription %v of %v", subscription.String(), settings.Topic)
+	return subscription, nil
+}
+
+// Topic of full name "projects/<project>/topics/<topic>", which may be in another project than client
+func topicByName(client *pubsub.Client, name string) (*pubsub.Topic, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "topics" || len(parts[1]) == 0 || len(parts[3]) == 0 {
+		return nil, fmt.Errorf("topic %v is not in the form projects/<project>/topics/<topic>", name)
+	}
+	return client.TopicInProject(parts[3], parts[1]), nil
+}
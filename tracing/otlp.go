@@ -0,0 +1,260 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	exportInterval  = 5 * time.Second
+	exportBatchSize = 512
+	// spans beyond this are dropped while the collector is unreachable
+	maxQueuedSpans = 4096
+)
+
+// Export spans to an OTLP/HTTP collector e.g. the OpenTelemetry Collector, Jaeger or Grafana Tempo, in batches of JSON
+// encoded ExportTraceServiceRequest
+type Exporter struct {
+	Endpoint    string            // e.g. http://localhost:4318, spans are POSTed to {Endpoint}/v1/traces
+	Headers     map[string]string // e.g. authorization of hosted collectors
+	ServiceName string            // service.name of the resource
+	Client      *http.Client
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped int
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Start exporting in background. Call Shutdown to flush queued spans before exit
+func NewExporter(endpoint string, serviceName string, headers map[string]string) *Exporter {
+	e := &Exporter{
+		Endpoint:    strings.TrimSuffix(endpoint, "/"),
+		Headers:     headers,
+		ServiceName: serviceName,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Headers of OTEL_EXPORTER_OTLP_HEADERS format "key1=value1,key2=value2"
+func ParseHeaders(s string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q, should be key=value", pair)
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+func (e *Exporter) add(span *Span) {
+	e.mu.Lock()
+	if len(e.queue) >= maxQueuedSpans {
+		e.dropped++
+	} else {
+		e.queue = append(e.queue, span)
+	}
+	full := len(e.queue) >= exportBatchSize
+	e.mu.Unlock()
+	if full {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			e.flush(context.Background())
+			return
+		case <-ticker.C:
+		case <-e.wake:
+		}
+		e.flush(context.Background())
+	}
+}
+
+// Export queued spans. Failed batches are dropped, as traces are best effort
+func (e *Exporter) flush(ctx context.Context) {
+	for {
+		e.mu.Lock()
+		batch := e.queue[:min(len(e.queue), exportBatchSize)]
+		e.queue = e.queue[len(batch):]
+		dropped := e.dropped
+		e.dropped = 0
+		e.mu.Unlock()
+		if dropped > 0 {
+			log.Printf("Dropped %d spans as the trace exporter is behind", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(ctx, batch); err != nil {
+			log.Printf("Failed to export %d spans: %v", len(batch), err)
+		}
+	}
+}
+
+// Flush queued spans and stop exporting
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	close(e.stop)
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *Exporter) export(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Endpoint+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.Headers {
+		req.Header.Set(key, value)
+	}
+	res, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("collector responded %v: %s", res.Status, b)
+	}
+	return nil
+}
+
+// OTLP JSON mapping of ExportTraceServiceRequest. Ids are hex and 64 bit integers are strings
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is STATUS_CODE_ERROR
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func newOtlpKeyValue(attribute Attribute) otlpKeyValue {
+	kv := otlpKeyValue{Key: attribute.Key}
+	switch v := attribute.Value.(type) {
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case float64:
+		kv.Value.DoubleValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	case string:
+		kv.Value.StringValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+func (e *Exporter) request(spans []*Span) otlpRequest {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "github.com/cormoran/NestDoorbellConsumer"}}
+	for _, span := range spans {
+		span.mu.Lock()
+		s := otlpSpan{
+			TraceId:           fmt.Sprintf("%x", span.traceId),
+			SpanId:            fmt.Sprintf("%x", span.spanId),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		}
+		if span.parentId != (SpanId{}) {
+			s.ParentSpanId = fmt.Sprintf("%x", span.parentId)
+		}
+		for _, attribute := range span.attributes {
+			s.Attributes = append(s.Attributes, newOtlpKeyValue(attribute))
+		}
+		if span.err != nil {
+			s.Status = &otlpStatus{Code: 2, Message: span.err.Error()}
+		}
+		span.mu.Unlock()
+		scope.Spans = append(scope.Spans, s)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpKeyValue{newOtlpKeyValue(String("service.name", e.ServiceName))}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}}
+}
@@ -0,0 +1,199 @@
+// Package tracing records spans of the event pipeline (receipt, parse, download, store, notify) and exports them via
+// OTLP, so that slow notifications can be traced back to where the time went.
+//
+// It implements only what the consumer needs instead of depending on the OpenTelemetry SDK: spans in context.Context,
+// W3C traceparent propagation and an OTLP/HTTP JSON exporter. Without an exporter every call is a no-op.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type TraceId [16]byte
+type SpanId [8]byte
+
+// Values of OTLP Span.SpanKind
+type SpanKind int
+
+const (
+	SpanKindInternal = SpanKind(1)
+	SpanKindServer   = SpanKind(2)
+	SpanKindClient   = SpanKind(3)
+	SpanKindProducer = SpanKind(4)
+	SpanKindConsumer = SpanKind(5)
+)
+
+// Value is a string, int64, float64 or bool
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Int(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Float(key string, value float64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Operation in a trace. Methods of nil spans, which Start returns without exporter, do nothing.
+type Span struct {
+	traceId  TraceId
+	spanId   SpanId
+	parentId SpanId // zero for root spans
+	name     string
+	start    time.Time
+	exporter *Exporter
+
+	mu         sync.Mutex
+	kind       SpanKind
+	end        time.Time
+	attributes []Attribute
+	err        error
+	ended      bool
+}
+
+var exporter atomic.Pointer[Exporter]
+
+// Export spans started afterwards to e. nil stops tracing
+func SetExporter(e *Exporter) {
+	exporter.Store(e)
+}
+
+type spanKey struct{}
+
+// Parent received from another process, e.g. by a traceparent header
+type remoteParent struct {
+	traceId TraceId
+	spanId  SpanId
+}
+
+type remoteParentKey struct{}
+
+// Span of ctx, nil if none
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// Start a span now as child of the span of ctx
+func Start(ctx context.Context, name string, attributes ...Attribute) (context.Context, *Span) {
+	return StartAt(ctx, name, time.Now(), attributes...)
+}
+
+// Start a span at start, e.g. when the event happened rather than when it arrived
+func StartAt(ctx context.Context, name string, start time.Time, attributes ...Attribute) (context.Context, *Span) {
+	e := exporter.Load()
+	if e == nil {
+		return ctx, nil
+	}
+	span := &Span{name: name, start: start, exporter: e, kind: SpanKindInternal, attributes: attributes}
+	rand.Read(span.spanId[:])
+	if parent := FromContext(ctx); parent != nil {
+		span.traceId, span.parentId = parent.traceId, parent.spanId
+	} else if remote, ok := ctx.Value(remoteParentKey{}).(remoteParent); ok {
+		span.traceId, span.parentId = remote.traceId, remote.spanId
+	} else {
+		rand.Read(span.traceId[:])
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *Span) SetKind(kind SpanKind) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kind = kind
+}
+
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, attributes...)
+}
+
+// Mark the span failed by err. nil is ignored
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// End the span at end and queue it to the exporter. Spans end only once
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = end
+	s.mu.Unlock()
+	s.exporter.add(s)
+}
+
+// W3C traceparent header of the span, empty for nil spans
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%x-%x-01", s.traceId, s.spanId)
+}
+
+// ctx whose spans continue the trace of a W3C traceparent header. Invalid headers are ignored
+func ContextWithTraceParent(ctx context.Context, traceParent string) context.Context {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return ctx
+	}
+	var remote remoteParent
+	if b, err := hex.DecodeString(parts[1]); err != nil || len(b) != len(remote.traceId) {
+		return ctx
+	} else {
+		copy(remote.traceId[:], b)
+	}
+	if b, err := hex.DecodeString(parts[2]); err != nil || len(b) != len(remote.spanId) {
+		return ctx
+	} else {
+		copy(remote.spanId[:], b)
+	}
+	return context.WithValue(ctx, remoteParentKey{}, remote)
+}
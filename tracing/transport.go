@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Transport recording a client span of each request made within a span, and passing the trace on by the traceparent
+// header. Requests outside of traces, e.g. of the exporter itself, go through as is
+type transport struct {
+	base http.RoundTripper
+}
+
+func NewTransport(base http.RoundTripper) http.RoundTripper {
+	return &transport{base: base}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if FromContext(req.Context()) == nil {
+		return t.base.RoundTrip(req)
+	}
+	// no path or query, which carry tokens of clip URLs
+	ctx, span := Start(req.Context(), "HTTP "+req.Method,
+		String("http.request.method", req.Method), String("server.address", req.URL.Hostname()))
+	defer span.End()
+	span.SetKind(SpanKindClient)
+	req = req.Clone(ctx)
+	req.Header.Set("traceparent", span.TraceParent())
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(Int("http.response.status_code", int64(res.StatusCode)))
+	if res.StatusCode >= 400 {
+		span.RecordError(httpStatusError(res.StatusCode))
+	}
+	return res, nil
+}
+
+type httpStatusError int
+
+func (e httpStatusError) Error() string {
+	return "HTTP " + strconv.Itoa(int(e))
+}